@@ -0,0 +1,93 @@
+// abbrev.go
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// autoAliasMinPrefix is the shortest prefix worth replacing with an automatic alias.
+const autoAliasMinPrefix = 16
+
+// topicAbbreviator shortens long topic prefixes for text output. Prefixes from
+// the alias table are replaced by their alias (longest match wins). With auto
+// enabled, other topics get a numbered alias ("~1") for all but their last two
+// levels, announced once on the legend writer.
+type topicAbbreviator struct {
+	prefixes []string // table prefixes, longest first
+	aliases  map[string]string
+	auto     bool
+	legend   io.Writer
+
+	mu   sync.Mutex
+	seen map[string]string // auto prefix -> alias
+}
+
+// newTopicAbbreviator returns nil when there is nothing to abbreviate.
+func newTopicAbbreviator(aliases map[string]string, auto bool, legend io.Writer) *topicAbbreviator {
+	if len(aliases) == 0 && !auto {
+		return nil
+	}
+	a := &topicAbbreviator{aliases: aliases, auto: auto, legend: legend, seen: map[string]string{}}
+	for p := range aliases {
+		a.prefixes = append(a.prefixes, p)
+	}
+	sort.Slice(a.prefixes, func(i, j int) bool { return len(a.prefixes[i]) > len(a.prefixes[j]) })
+	return a
+}
+
+// Abbreviate returns topic with its longest known prefix replaced by an alias.
+func (a *topicAbbreviator) Abbreviate(topic string) string {
+	if a == nil {
+		return topic
+	}
+	for _, p := range a.prefixes {
+		if strings.HasPrefix(topic, p) {
+			return a.aliases[p] + topic[len(p):]
+		}
+	}
+	if !a.auto {
+		return topic
+	}
+
+	levels := strings.Split(topic, "/")
+	if len(levels) < 3 {
+		return topic
+	}
+	prefix := strings.Join(levels[:len(levels)-2], "/")
+	if len(prefix) < autoAliasMinPrefix {
+		return topic
+	}
+
+	a.mu.Lock()
+	alias, ok := a.seen[prefix]
+	if !ok {
+		alias = fmt.Sprintf("~%d", len(a.seen)+1)
+		a.seen[prefix] = alias
+		fmt.Fprintf(a.legend, "[ALIAS] %s = %s\n", alias, prefix)
+	}
+	a.mu.Unlock()
+	return alias + topic[len(prefix):]
+}
+
+// aliasFlag collects repeated --topic-alias PREFIX=ALIAS flags.
+type aliasFlag map[string]string
+
+func (m *aliasFlag) String() string {
+	return fmt.Sprint(map[string]string(*m))
+}
+
+func (m *aliasFlag) Set(s string) error {
+	prefix, alias, ok := strings.Cut(s, "=")
+	if !ok || prefix == "" {
+		return fmt.Errorf("invalid alias '%s', expected 'PREFIX=ALIAS'", s)
+	}
+	if *m == nil {
+		*m = aliasFlag{}
+	}
+	(*m)[prefix] = alias
+	return nil
+}
@@ -0,0 +1,70 @@
+// ack.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// v5AckInterval is how often paho sends the acknowledgements of messages
+// handled with at_least_once.
+const v5AckInterval = 10 * time.Millisecond
+
+// ackWithholder is a connection that acknowledges received messages by hand;
+// only MQTT v5 connections with at_least_once do.
+type ackWithholder interface {
+	withholdAcks(reason error) bool
+}
+
+// withholdAcks keeps client from acknowledging the message being handled and
+// every later one, so the broker delivers them again, and reports whether
+// client acknowledges by hand at all. Without at_least_once it does nothing:
+// the client acknowledged the message when it arrived.
+//
+// A handler that didn't get a message to a sink calls it with the error; a
+// handler that drops a message it should have handled, like the one past
+// --count, calls it with nil, which leaves the connection open.
+func withholdAcks(client mqtt.Client, reason error) bool {
+	w, ok := client.(ackWithholder)
+	return ok && w.withholdAcks(reason)
+}
+
+// deliveryFailed withholds the acknowledgement of msg after err, and reports
+// whether it did; see withholdAcks.
+func deliveryFailed(client mqtt.Client, msg mqtt.Message, err error) bool {
+	if !withholdAcks(client, err) {
+		return false
+	}
+	logError("delivery_failed", true, "Not acknowledging the message on '%s' or any after it, "+
+		"so the broker sends them again after reconnecting: %v", msg.Topic(), err)
+	return true
+}
+
+// checkAtLeastOnce reports why cfg can't keep the at_least_once guarantee:
+// every message reaches a sink that confirms the write before the broker is
+// told it was received.
+func checkAtLeastOnce(cfg *Config) error {
+	switch {
+	case cfg.Protocol != 5:
+		return errors.New("at_least_once needs protocol_version 5; MQTT 3 connections start a clean session, so nothing unacknowledged is sent again")
+	case cfg.SessionExpiry <= 0:
+		return errors.New("at_least_once needs session_expiry, so the broker keeps unacknowledged messages while reconnecting")
+	case cfg.Exec == "" && cfg.OutDir == "":
+		return errors.New("at_least_once needs a sink that confirms each write: exec or out_dir")
+	case len(cfg.ExecSinks) > 0 || cfg.OutFIFO != "" || cfg.DBusSignal != "":
+		return errors.New("at_least_once works with exec and out_dir only; exec_sinks, out_fifo, and dbus_signal can't confirm a write")
+	case cfg.ExecConcurrency > 1 || cfg.ExecPartition != "":
+		return errors.New("at_least_once runs one exec command at a time, in order; drop exec_concurrency and exec_partition")
+	case cfg.SkipBacklog != "":
+		return errors.New("at_least_once can't skip the backlog: it would skip the messages sent again after a failed write")
+	}
+	for filter, qos := range cfg.subscriptions() {
+		if qos == 0 {
+			return fmt.Errorf("at_least_once needs QoS 1 or 2 for every subscription, not QoS 0 for '%s'", filter)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+// ack_test.go
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestCheckAtLeastOnce(t *testing.T) {
+	zero := byte(0)
+	valid := func() *Config {
+		return &Config{Protocol: 5, SessionExpiry: Duration(time.Hour), Exec: "cat", Topic: "t", QoS: 1}
+	}
+	for _, tc := range []struct {
+		name   string
+		change func(*Config)
+		want   string // error, if any
+	}{
+		{"exec", func(*Config) {}, ""},
+		{"out_dir", func(c *Config) { c.Exec, c.OutDir = "", "/tmp/out" }, ""},
+		{"MQTT 3", func(c *Config) { c.Protocol = 4 }, "needs protocol_version 5"},
+		{"no session", func(c *Config) { c.SessionExpiry = 0 }, "needs session_expiry"},
+		{"no sink", func(c *Config) { c.Exec = "" }, "needs a sink"},
+		{"exec_sinks", func(c *Config) { c.ExecSinks = []string{"cat"} }, "exec and out_dir only"},
+		{"out_fifo", func(c *Config) { c.OutFIFO = "/tmp/fifo" }, "exec and out_dir only"},
+		{"concurrent exec", func(c *Config) { c.ExecConcurrency = 2 }, "one exec command at a time"},
+		{"partitioned exec", func(c *Config) { c.ExecPartition = "topic" }, "one exec command at a time"},
+		{"skip_backlog", func(c *Config) { c.SkipBacklog = "100" }, "can't skip the backlog"},
+		{"QoS 0", func(c *Config) { c.QoS = 0 }, "not QoS 0 for 't'"},
+		{"QoS 0 in topics", func(c *Config) { c.Topics = []TopicSubscription{{Topic: "u", QoS: &zero}} }, "not QoS 0 for 'u'"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := valid()
+			tc.change(cfg)
+			err := checkAtLeastOnce(cfg)
+			if tc.want == "" {
+				if err != nil {
+					t.Errorf("got %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestV5WithholdAcks(t *testing.T) {
+	failed := errors.New("disk full")
+	for _, tc := range []struct {
+		name    string
+		manual  bool
+		reasons []error
+		want    bool
+		lost    error // passed to onLost, if any
+	}{
+		{"acknowledged on arrival", false, []error{failed}, false, nil},
+		{"past the count", true, []error{nil}, true, nil},
+		{"failed write", true, []error{failed}, true, failed},
+		{"failed again", true, []error{failed, errors.New("later")}, true, failed},
+		{"past the count, then failed", true, []error{nil, failed}, true, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lost := make(chan error, len(tc.reasons))
+			v := &v5Client{manualAcks: tc.manual, onLost: func(err error) { lost <- err }}
+			for _, reason := range tc.reasons {
+				if got := v.withholdAcks(reason); got != tc.want {
+					t.Errorf("withholdAcks(%v) = %t, want %t", reason, got, tc.want)
+				}
+			}
+			if v.withheld.Load() != tc.manual {
+				t.Errorf("got withheld %t, want %t", v.withheld.Load(), tc.manual)
+			}
+			if tc.lost != nil {
+				select {
+				case err := <-lost:
+					if err != tc.lost {
+						t.Errorf("got connection lost with %v, want %v", err, tc.lost)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("the connection wasn't closed")
+				}
+			}
+			select {
+			case err := <-lost:
+				t.Errorf("got connection lost again, with %v", err)
+			case <-time.After(20 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestV5RouteAfterWithholding(t *testing.T) {
+	v := &v5Client{manualAcks: true}
+	v.withheld.Store(true)
+	handled, err := v.route(paho.PublishReceived{Packet: &paho.Publish{Topic: "t", QoS: 1, PacketID: 1}})
+	if handled || err != nil {
+		t.Errorf("got %t, %v; want a message after a withheld acknowledgement left unhandled", handled, err)
+	}
+}
+
+// withholdingClient records the reasons passed to withholdAcks.
+type withholdingClient struct {
+	mqtt.Client
+	manual  bool
+	reasons []error
+}
+
+func (c *withholdingClient) withholdAcks(reason error) bool {
+	c.reasons = append(c.reasons, reason)
+	return c.manual
+}
+
+// failingSink fails every write with err.
+type failingSink struct{ err error }
+
+func (s failingSink) Write(messageRecord) error { return s.err }
+func (s failingSink) Close() error              { return nil }
+
+func TestSinkFailureWithholdsAcks(t *testing.T) {
+	failed := errors.New("disk full")
+	for _, tc := range []struct {
+		name    string
+		manual  bool
+		err     error
+		handled bool
+	}{
+		{"written", true, nil, true},
+		{"failed, at_least_once", true, failed, false},
+		{"failed, acknowledged on arrival", false, failed, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &withholdingClient{manual: tc.manual}
+			handled := false
+			handler := sinkSet{failingSink{tc.err}}.wrap(func(mqtt.Client, mqtt.Message) { handled = true }, nil)
+			handler(client, &recordedMessage{rec: messageRecord{Topic: "t"}, payload: []byte("x")})
+			if handled != tc.handled {
+				t.Errorf("got handled %t, want %t", handled, tc.handled)
+			}
+			if tc.err != nil && (len(client.reasons) != 1 || client.reasons[0] != tc.err) {
+				t.Errorf("got acknowledgements withheld for %v, want %v", client.reasons, tc.err)
+			}
+			if tc.err == nil && len(client.reasons) != 0 {
+				t.Errorf("got acknowledgements withheld for %v, want them sent", client.reasons)
+			}
+		})
+	}
+}
+
+func TestCountWithholdsAcksPastTheLimit(t *testing.T) {
+	client := &withholdingClient{manual: true}
+	handled := 0
+	handler := newMessageCounter(2).wrap(func(mqtt.Client, mqtt.Message) { handled++ })
+	for i := 0; i < 4; i++ {
+		handler(client, &recordedMessage{rec: messageRecord{Topic: "t"}})
+	}
+	if handled != 2 {
+		t.Errorf("handled %d messages, want 2", handled)
+	}
+	if len(client.reasons) != 2 || client.reasons[0] != nil || client.reasons[1] != nil {
+		t.Errorf("got acknowledgements withheld for %v, want twice without a reason", client.reasons)
+	}
+}
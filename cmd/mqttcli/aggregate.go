@@ -0,0 +1,180 @@
+// aggregate.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// aggregateGroup is the merged document for one concrete group topic.
+type aggregateGroup struct {
+	doc   map[string]interface{}
+	timer *time.Timer
+}
+
+// aggregator merges per-field sibling topics below each topic matching a group
+// filter back into one JSON document, emitted once updates settle.
+type aggregator struct {
+	group    []string // group filter levels, e.g. devices/+/state
+	debounce time.Duration
+	publish  string // suffix appended to the group topic; "" prints instead
+	qos      byte
+	retain   bool
+	out      io.Writer
+
+	mu     sync.Mutex
+	groups map[string]*aggregateGroup
+	client mqtt.Client
+}
+
+func newAggregator(group string, debounce time.Duration, out io.Writer) *aggregator {
+	return &aggregator{
+		group:    strings.Split(group, "/"),
+		debounce: debounce,
+		out:      out,
+		groups:   make(map[string]*aggregateGroup),
+	}
+}
+
+// split returns the concrete group topic and the field path below it, or
+// ok=false if topic is not strictly below a topic matching the group filter.
+func (a *aggregator) split(topic string) (root string, path []string, ok bool) {
+	levels := strings.Split(topic, "/")
+	if len(levels) <= len(a.group) {
+		return "", nil, false
+	}
+	if !topicMatches(strings.Join(a.group, "/"), strings.Join(levels[:len(a.group)], "/")) {
+		return "", nil, false
+	}
+	return strings.Join(levels[:len(a.group)], "/"), levels[len(a.group):], true
+}
+
+// fieldValue decodes payloads that are valid JSON and keeps the rest as strings.
+func fieldValue(payload []byte) interface{} {
+	var v interface{}
+	if err := json.Unmarshal(payload, &v); err == nil {
+		return v
+	}
+	return string(payload)
+}
+
+// setPath stores v in doc at path, creating nested objects as needed.
+func setPath(doc map[string]interface{}, path []string, v interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := doc[key].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			doc[key] = next
+		}
+		doc = next
+	}
+	doc[path[len(path)-1]] = v
+}
+
+func (a *aggregator) handler(client mqtt.Client, msg mqtt.Message) {
+	root, path, ok := a.split(msg.Topic())
+	if !ok {
+		return
+	}
+	if a.publish != "" && strings.Join(path, "/") == strings.TrimPrefix(a.publish, "/") {
+		// Skip our own output when the subscription covers it
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.client = client
+	g, ok := a.groups[root]
+	if !ok {
+		g = &aggregateGroup{doc: make(map[string]interface{})}
+		a.groups[root] = g
+	}
+	// Retained deletes (empty payloads) remove the field
+	if len(msg.Payload()) == 0 {
+		deletePath(g.doc, path)
+	} else {
+		setPath(g.doc, path, fieldValue(msg.Payload()))
+	}
+
+	if g.timer == nil {
+		g.timer = time.AfterFunc(a.debounce, func() { a.emit(root) })
+	} else {
+		g.timer.Reset(a.debounce)
+	}
+}
+
+// deletePath removes the value at path from doc, if present.
+func deletePath(doc map[string]interface{}, path []string) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := doc[key].(map[string]interface{})
+		if !ok {
+			return
+		}
+		doc = next
+	}
+	delete(doc, path[len(path)-1])
+}
+
+// emit prints or publishes the current document for one group topic.
+func (a *aggregator) emit(root string) {
+	a.mu.Lock()
+	data, err := json.Marshal(a.groups[root].doc)
+	client := a.client
+	a.mu.Unlock()
+	if err != nil {
+		logWarn("aggregate_failed", "Could not encode document for '%s': %v", root, err)
+		return
+	}
+
+	if a.publish == "" {
+		fmt.Fprintf(a.out, "%s %s\n", sanitizeForTerminal(root), sanitizeForTerminal(string(data)))
+		return
+	}
+	topic := root + "/" + strings.TrimPrefix(a.publish, "/")
+	token := client.Publish(topic, a.qos, a.retain, data)
+	if token.Wait() && token.Error() != nil {
+		logWarn("publish_failed", "Failed to publish to '%s': %v", topic, token.Error())
+	}
+}
+
+func runAggregate(args []string) {
+	fs := flag.NewFlagSet("aggregate", flag.ExitOnError)
+	flags := initCLIFlags(fs)
+	group := fs.String("group", "", "Topic filter of the documents to rebuild, e.g. 'devices/+/state' (required).")
+	debounce := fs.Duration("debounce", 500*time.Millisecond, "Wait this long after the last field update before emitting.")
+	publish := fs.String("publish", "", "Publish merged documents to GROUP/SUFFIX instead of printing them.")
+	retain := fs.Bool("retain", false, "Publish merged documents as retained messages.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s aggregate --group FILTER [options]\n\n"+
+			"Merges per-field topics below each group topic into one JSON document, e.g.\n"+
+			"devices/x/state/battery 87 -> devices/x/state {\"battery\":87}. --topic defaults to FILTER/#.\n\nOptions:\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *group == "" || strings.Contains(*group, "#") {
+		fatal("config_invalid", false, "--group is required and must not contain '#'")
+	}
+	if len(flags.Topics) == 0 && flags.ConfigPath == "" {
+		flags.Topics = topicFlag{{Topic: *group + "/#"}}
+	}
+
+	cfg := buildConfig(flags)
+	if *publish != "" {
+		refuseReadOnly(&cfg, "aggregate --publish")
+	}
+	a := newAggregator(*group, *debounce, os.Stdout)
+	a.publish = *publish
+	a.qos = cfg.QoS
+	a.retain = *retain
+	runSubscription(context.Background(), &cfg, a.handler)
+}
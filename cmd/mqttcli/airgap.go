@@ -0,0 +1,177 @@
+// airgap.go
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// errEgressBlocked is returned for a connection air_gapped doesn't allow.
+var errEgressBlocked = errors.New("blocked by air_gapped")
+
+// proxyEnvVars are the variables that could route connections elsewhere;
+// air_gapped ignores them.
+var proxyEnvVars = []string{"HTTP_PROXY", "HTTPS_PROXY", "ALL_PROXY", "http_proxy", "https_proxy", "all_proxy"}
+
+// egressGuard only lets connections through to the broker's address, checked
+// on the resolved IP and port as each socket connects, so neither a proxy
+// setting nor a redirect can reach another host.
+type egressGuard struct {
+	host, port string
+
+	mu      sync.Mutex
+	allowed map[string]bool // the broker's IPs, as last resolved
+}
+
+// airGap is the guard of an air-gapped run, or nil; every broker connection
+// dials through egressDialer, which consults it.
+var airGap *egressGuard
+
+// brokerAddress returns the host and port a broker URL connects to,
+// filling in the scheme's default port.
+func brokerAddress(broker string) (string, string, error) {
+	u, err := url.Parse(broker)
+	if err != nil || u.Hostname() == "" {
+		return "", "", fmt.Errorf("invalid broker URL '%s'", broker)
+	}
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"tcp": "1883", "mqtt": "1883", "ssl": "8883", "tls": "8883", "mqtts": "8883", "tcps": "8883",
+			"ws": "80", "http": "80", "wss": "443", "https": "443"}[u.Scheme]
+	}
+	if port == "" {
+		return "", "", fmt.Errorf("unsupported broker scheme '%s'", u.Scheme)
+	}
+	return u.Hostname(), port, nil
+}
+
+func newEgressGuard(broker string) (*egressGuard, error) {
+	host, port, err := brokerAddress(broker)
+	if err != nil {
+		return nil, fmt.Errorf("air_gapped: %v", err)
+	}
+	g := &egressGuard{host: host, port: port, allowed: map[string]bool{}}
+	if err := g.resolve(); err != nil {
+		return nil, fmt.Errorf("air_gapped: could not resolve broker host '%s': %v", host, err)
+	}
+	return g, nil
+}
+
+// resolve looks up the broker's IPs again, as DNS may have moved it.
+func (g *egressGuard) resolve() error {
+	ips, err := net.LookupIP(g.host)
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, ip := range ips {
+		g.allowed[ip.String()] = true
+	}
+	return nil
+}
+
+func (g *egressGuard) allows(ip string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.allowed[ip]
+}
+
+// control is a net.Dialer Control function, run with the resolved address
+// before each socket connects.
+func (g *egressGuard) control(network, address string, _ syscall.RawConn) error {
+	host, port, err := net.SplitHostPort(address)
+	if err == nil && port == g.port && net.ParseIP(host) != nil {
+		ip := net.ParseIP(host).String()
+		if g.allows(ip) || (g.resolve() == nil && g.allows(ip)) {
+			return nil
+		}
+	}
+	logWarn("egress_blocked", "Refused a %s connection to %s: only broker %s is allowed", network, address, net.JoinHostPort(g.host, g.port))
+	return fmt.Errorf("connection to %s %w", address, errEgressBlocked)
+}
+
+// egressDialer returns the dialer for broker connections, which enforces
+// air_gapped when set.
+func egressDialer(timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	if airGap != nil {
+		d.Control = airGap.control
+	}
+	return d
+}
+
+// openEgress is a paho OpenConnectionFunc for tcp:// and ssl:// brokers that
+// dials through egressDialer, without paho's $all_proxy support.
+func openEgress(uri *url.URL, opts mqtt.ClientOptions) (net.Conn, error) {
+	host, port, err := brokerAddress(uri.String())
+	if err != nil {
+		return nil, err
+	}
+	d := egressDialer(opts.ConnectTimeout)
+	switch uri.Scheme {
+	case "ssl", "tls", "mqtts", "tcps":
+		return tls.DialWithDialer(d, "tcp", net.JoinHostPort(host, port), opts.TLSConfig)
+	}
+	return d.Dial("tcp", net.JoinHostPort(host, port))
+}
+
+// startAirGap turns on air_gapped for cfg, refusing what would need the
+// network beyond the broker, and logs an audit of what may still happen.
+func startAirGap(cfg *Config) error {
+	if cfg.OCSP == ocspCheck {
+		return errors.New("air_gapped rules out ocsp check, which asks the CA's OCSP responder; use ocsp stapled or must-staple")
+	}
+	g, err := newEgressGuard(cfg.BrokerURL)
+	if err != nil {
+		return err
+	}
+	airGap = g
+	g.mu.Lock()
+	ips := make([]string, 0, len(g.allowed))
+	for ip := range g.allowed {
+		ips = append(ips, ip)
+	}
+	g.mu.Unlock()
+	sort.Strings(ips)
+	logInfo("egress_audit", "Air-gapped: connections go only to broker %s (%s); anything else is refused",
+		net.JoinHostPort(g.host, g.port), strings.Join(ips, ", "))
+
+	var ignored []string
+	for _, v := range proxyEnvVars {
+		if os.Getenv(v) != "" {
+			ignored = append(ignored, v)
+		}
+	}
+	if len(ignored) > 0 {
+		logInfo("egress_audit", "Air-gapped: ignoring proxy settings in $%s", strings.Join(ignored, ", $"))
+	}
+	if cfg.HistoryListen != "" {
+		logInfo("egress_audit", "Air-gapped: accepting history requests on %s (inbound only)", cfg.HistoryListen)
+	}
+	var commands []string
+	for _, c := range []struct{ name, value string }{
+		{"exec", cfg.Exec},
+		{"sink_exec", strings.Join(cfg.ExecSinks, "")},
+		{"ws_header_command", cfg.WSHeaderCommand},
+	} {
+		if c.value != "" {
+			commands = append(commands, c.name)
+		}
+	}
+	if len(commands) > 0 {
+		logWarn("egress_audit", "Air-gapped: commands run by %s are separate processes that this mode can't restrict", strings.Join(commands, ", "))
+	}
+	return nil
+}
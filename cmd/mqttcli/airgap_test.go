@@ -0,0 +1,86 @@
+// airgap_test.go
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// withAirGap turns on air_gapped for broker until the test ends.
+func withAirGap(t *testing.T, broker string) {
+	t.Helper()
+	g, err := newEgressGuard(broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	airGap = g
+	t.Cleanup(func() { airGap = nil })
+}
+
+func TestEgressDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	withAirGap(t, "tcp://"+ln.Addr().String())
+
+	conn, err := egressDialer(0).Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("refused the broker: %v", err)
+	}
+	conn.Close()
+	for _, addr := range []string{"127.0.0.1:9", "127.0.0.2" + ln.Addr().String()[len("127.0.0.1"):]} {
+		if _, err := egressDialer(0).Dial("tcp", addr); !errors.Is(err, errEgressBlocked) {
+			t.Errorf("%s: got %v, want errEgressBlocked", addr, err)
+		}
+	}
+}
+
+// listen returns a listener accepting connections until the test ends, for
+// a broker that can be reached but isn't the one allowed.
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return ln
+}
+
+func TestProxyUpstreamAirGapped(t *testing.T) {
+	other := listen(t).Addr().String()
+	withAirGap(t, "tcp://127.0.0.1:1")
+	for _, upstream := range []string{"tcp://" + other, "ssl://" + other} {
+		u, _ := url.Parse(upstream)
+		p := &mqttProxy{cfg: &Config{}, upstream: u, tls: &tls.Config{InsecureSkipVerify: true}}
+		if _, err := p.dialUpstream(); !errors.Is(err, errEgressBlocked) {
+			t.Errorf("%s: got %v, want errEgressBlocked", upstream, err)
+		}
+	}
+}
+
+func TestRelayAirGapped(t *testing.T) {
+	r := &tunnelRelay{broker: listen(t).Addr().String(), sessions: make(map[string]*tunnelSession)}
+	withAirGap(t, "tcp://127.0.0.1:1")
+	w := httptest.NewRecorder()
+	r.open(w)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("got status %d, want %d for a broker that isn't allowed", w.Code, http.StatusBadGateway)
+	}
+}
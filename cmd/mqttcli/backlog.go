@@ -0,0 +1,135 @@
+// backlog.go
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// backlogSettle is how long after reconnecting (or after the last skipped
+// message) --skip-backlog waits for more queued messages before deciding the
+// backlog is over and live traffic has resumed.
+const backlogSettle = time.Second
+
+// backlogSkipper implements --skip-backlog: after a reconnect it drops the
+// messages the broker had queued for the session, so live monitoring resumes
+// at once. With a count it skips at most that many; with an age it skips
+// messages older than that (see ageFilter) and stops at the first fresh one.
+// Either way, skipping ends once no message arrives for backlogSettle.
+type backlogSkipper struct {
+	limit int        // skip at most this many; zero with an age
+	ages  *ageFilter // with an age
+
+	mu      sync.Mutex
+	armed   bool
+	skipped int
+	timer   *time.Timer
+}
+
+// parseSkipBacklog parses skip_backlog: a message count such as "500", or an
+// age such as "10m".
+func parseSkipBacklog(cfg *Config) (*backlogSkipper, error) {
+	if cfg.SkipBacklog == "" {
+		return nil, nil
+	}
+	if n, err := strconv.Atoi(cfg.SkipBacklog); err == nil {
+		if n <= 0 {
+			return nil, fmt.Errorf("skip_backlog must be a positive message count, got %d", n)
+		}
+		return &backlogSkipper{limit: n}, nil
+	}
+	d, err := time.ParseDuration(cfg.SkipBacklog)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("invalid skip_backlog '%s', expected a message count such as 500 or an age such as 10m", cfg.SkipBacklog)
+	}
+	ages := newAgeFilter(cfg)
+	ages.maxAge = d
+	return &backlogSkipper{ages: ages}, nil
+}
+
+// watch arms the skipper whenever client loses its connection.
+func (s *backlogSkipper) watch(client mqtt.Client) {
+	if s == nil {
+		return
+	}
+	if r, ok := client.(*reconnectingClient); ok {
+		r.onReconnect(s.arm, s.settle)
+	}
+}
+
+// arm starts skipping; called when the connection is lost, so nothing queued
+// on the broker can slip through before the reconnect.
+func (s *backlogSkipper) arm() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.armed, s.skipped = true, 0
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
+
+// settle starts the wait for the backlog to dry up; called once reconnected
+// and after every skipped message.
+func (s *backlogSkipper) settle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.armed {
+		return
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.timer = time.AfterFunc(backlogSettle, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.disarmLocked()
+	})
+}
+
+func (s *backlogSkipper) disarmLocked() {
+	if !s.armed {
+		return
+	}
+	s.armed = false
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	if s.skipped > 0 {
+		logInfo("backlog_skipped", "Skipped %d queued message(s) after reconnecting", s.skipped)
+	}
+}
+
+// skip reports whether msg is part of the backlog to drop.
+func (s *backlogSkipper) skip(msg mqtt.Message) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.armed {
+		return false
+	}
+	if s.ages != nil && !s.ages.stale(msg) {
+		s.disarmLocked()
+		return false
+	}
+	s.skipped++
+	if s.limit > 0 && s.skipped >= s.limit {
+		s.disarmLocked()
+	}
+	return true
+}
+
+func (s *backlogSkipper) wrap(next mqtt.MessageHandler) mqtt.MessageHandler {
+	if s == nil {
+		return next
+	}
+	return func(client mqtt.Client, msg mqtt.Message) {
+		if s.skip(msg) {
+			s.settle()
+			return
+		}
+		next(client, msg)
+	}
+}
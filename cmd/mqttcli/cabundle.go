@@ -0,0 +1,27 @@
+//go:build cabundle
+
+// cabundle.go
+package main
+
+import (
+	"crypto/x509"
+	_ "embed"
+)
+
+// caBundle is Mozilla's CA certificate bundle, fetched into cacert.pem by
+// "make cacert" before a release build.
+//
+//go:embed cacert.pem
+var caBundle []byte
+
+// The bundle only takes over where the system has no roots of its own, such
+// as a scratch or busybox image without /etc/ssl; a --cafile still replaces
+// both.
+func init() {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caBundle) {
+		return
+	}
+	x509.SetFallbackRoots(pool)
+	embeddedRoots = len(parsePEMCertificates(caBundle))
+}
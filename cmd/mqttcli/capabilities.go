@@ -0,0 +1,140 @@
+// capabilities.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// brokerCaps is what a broker is known to support, as MQTT v5 brokers
+// advertise it in the CONNACK. Unset fields mean no known restriction.
+type brokerCaps struct {
+	MaxQoS          *byte  `json:"max_qos,omitempty"`
+	RetainAvailable *bool  `json:"retain_available,omitempty"`
+	MaxPacketSize   uint32 `json:"max_packet_size,omitempty"`
+	SharedSubs      *bool  `json:"shared_subscriptions,omitempty"`
+	WildcardSubs    *bool  `json:"wildcard_subscriptions,omitempty"`
+	Updated         string `json:"updated,omitempty"`
+}
+
+// capsReporter is implemented by clients that learned the broker's
+// capabilities while connecting.
+type capsReporter interface {
+	brokerCaps() brokerCaps
+}
+
+// merge copies the fields set in o into c and reports whether anything changed.
+func (c *brokerCaps) merge(o brokerCaps) bool {
+	changed := false
+	if o.MaxQoS != nil && (c.MaxQoS == nil || *c.MaxQoS != *o.MaxQoS) {
+		c.MaxQoS, changed = o.MaxQoS, true
+	}
+	if o.RetainAvailable != nil && (c.RetainAvailable == nil || *c.RetainAvailable != *o.RetainAvailable) {
+		c.RetainAvailable, changed = o.RetainAvailable, true
+	}
+	if o.MaxPacketSize != c.MaxPacketSize && o.MaxPacketSize != 0 {
+		c.MaxPacketSize, changed = o.MaxPacketSize, true
+	}
+	if o.SharedSubs != nil && (c.SharedSubs == nil || *c.SharedSubs != *o.SharedSubs) {
+		c.SharedSubs, changed = o.SharedSubs, true
+	}
+	if o.WildcardSubs != nil && (c.WildcardSubs == nil || *c.WildcardSubs != *o.WildcardSubs) {
+		c.WildcardSubs, changed = o.WildcardSubs, true
+	}
+	return changed
+}
+
+// String describes the restrictions in c, e.g. "max QoS 1, no retain".
+func (c brokerCaps) String() string {
+	var parts []string
+	if c.MaxQoS != nil && *c.MaxQoS < 2 {
+		parts = append(parts, fmt.Sprintf("max QoS %d", *c.MaxQoS))
+	}
+	if c.RetainAvailable != nil && !*c.RetainAvailable {
+		parts = append(parts, "no retain")
+	}
+	if c.MaxPacketSize > 0 {
+		parts = append(parts, fmt.Sprintf("max packet size %d bytes", c.MaxPacketSize))
+	}
+	if c.SharedSubs != nil && !*c.SharedSubs {
+		parts = append(parts, "no shared subscriptions")
+	}
+	if c.WildcardSubs != nil && !*c.WildcardSubs {
+		parts = append(parts, "no wildcard subscriptions")
+	}
+	if len(parts) == 0 {
+		return "no restrictions"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// capsFile returns where broker capabilities are cached: caps_file, or
+// brokers.json in the user's cache directory. It is empty when caching is off.
+func capsFile(cfg *Config) string {
+	if cfg.NoAdapt {
+		return ""
+	}
+	if cfg.CapsFile != "" {
+		return cfg.CapsFile
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "mqttcli", "brokers.json")
+}
+
+// readCapsFile returns the cached capabilities of every broker, keyed by URL.
+func readCapsFile(path string) map[string]brokerCaps {
+	all := map[string]brokerCaps{}
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &all)
+	}
+	return all
+}
+
+// loadBrokerCaps returns the cached capabilities of cfg's broker.
+func loadBrokerCaps(cfg *Config) brokerCaps {
+	path := capsFile(cfg)
+	if path == "" {
+		return brokerCaps{}
+	}
+	return readCapsFile(path)[cfg.BrokerURL]
+}
+
+// saveBrokerCaps updates the cache entry of cfg's broker. Failing to write the
+// cache only costs relearning next time, so errors are logged, not returned.
+func saveBrokerCaps(cfg *Config, caps brokerCaps) {
+	path := capsFile(cfg)
+	if path == "" {
+		return
+	}
+	all := readCapsFile(path)
+	caps.Updated = time.Now().UTC().Format(time.RFC3339)
+	all[cfg.BrokerURL] = caps
+	data, _ := json.MarshalIndent(all, "", "    ")
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err == nil {
+		tmp := path + ".tmp"
+		if err = os.WriteFile(tmp, append(data, '\n'), 0o600); err == nil {
+			err = os.Rename(tmp, path)
+		}
+	}
+	if err != nil {
+		logWarn("caps_not_saved", "Could not cache broker capabilities in %s: %v", path, err)
+	}
+}
+
+// isSharedSubscription reports whether filter is a "$share/GROUP/..." filter.
+func isSharedSubscription(filter string) bool {
+	return strings.HasPrefix(filter, "$share/")
+}
+
+// hasWildcard reports whether filter contains + or # levels.
+func hasWildcard(filter string) bool {
+	return strings.ContainsAny(sharedSubscriptionFilter(filter), "+#")
+}
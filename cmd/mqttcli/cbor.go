@@ -0,0 +1,205 @@
+// cbor.go
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"unicode/utf8"
+)
+
+// cborMaxDepth bounds nesting, so a hostile payload can't exhaust the stack.
+const cborMaxDepth = 64
+
+var errCBORShort = errors.New("truncated CBOR data")
+
+// decodeCBOR renders a CBOR item (RFC 8949) as JSON. Byte strings become
+// base64, map keys that aren't text are formatted, and tags are dropped
+// except for bignums.
+func decodeCBOR(b []byte) ([]byte, error) {
+	v, rest, err := parseCBOR(b, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("%d bytes after the CBOR item", len(rest))
+	}
+	return json.Marshal(v)
+}
+
+// cborHead splits the initial byte and argument off an item.
+func cborHead(b []byte) (major byte, info byte, arg uint64, rest []byte, err error) {
+	if len(b) == 0 {
+		return 0, 0, 0, nil, errCBORShort
+	}
+	major, info, b = b[0]>>5, b[0]&0x1f, b[1:]
+	switch {
+	case info < 24:
+		return major, info, uint64(info), b, nil
+	case info <= 27:
+		n := 1 << (info - 24)
+		if len(b) < n {
+			return 0, 0, 0, nil, errCBORShort
+		}
+		for _, c := range b[:n] {
+			arg = arg<<8 | uint64(c)
+		}
+		return major, info, arg, b[n:], nil
+	case info == 31 && major >= 2 && major <= 5, info == 31 && major == 7:
+		return major, info, 0, b, nil // indefinite length, or a break
+	}
+	return 0, 0, 0, nil, fmt.Errorf("invalid CBOR initial byte 0x%02x", major<<5|info)
+}
+
+func parseCBOR(b []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, errors.New("CBOR nested too deeply")
+	}
+	major, info, arg, b, err := cborHead(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	indefinite := info == 31
+	switch major {
+	case 0:
+		return json.Number(fmt.Sprint(arg)), b, nil
+	case 1:
+		n := new(big.Int).SetUint64(arg)
+		return json.Number(n.Neg(n).Sub(n, big.NewInt(1)).String()), b, nil
+	case 2, 3:
+		var s []byte
+		if indefinite {
+			for {
+				if len(b) > 0 && b[0] == 0xff {
+					b = b[1:]
+					break
+				}
+				m, i, n, rest, err := cborHead(b)
+				if err != nil {
+					return nil, nil, err
+				}
+				if m != major || i == 31 || uint64(len(rest)) < n {
+					return nil, nil, errors.New("invalid CBOR string chunk")
+				}
+				s, b = append(s, rest[:n]...), rest[n:]
+			}
+		} else {
+			if uint64(len(b)) < arg {
+				return nil, nil, errCBORShort
+			}
+			s, b = b[:arg], b[arg:]
+		}
+		if major == 2 {
+			return base64.StdEncoding.EncodeToString(s), b, nil
+		}
+		if !utf8.Valid(s) {
+			return nil, nil, errors.New("CBOR text string is not UTF-8")
+		}
+		return string(s), b, nil
+	case 4:
+		list := []interface{}{}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			if indefinite && len(b) > 0 && b[0] == 0xff {
+				b = b[1:]
+				break
+			}
+			var v interface{}
+			if v, b, err = parseCBOR(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+			list = append(list, v)
+		}
+		return list, b, nil
+	case 5:
+		m := map[string]interface{}{}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			if indefinite && len(b) > 0 && b[0] == 0xff {
+				b = b[1:]
+				break
+			}
+			var k, v interface{}
+			if k, b, err = parseCBOR(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+			if v, b, err = parseCBOR(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				key = fmt.Sprint(k)
+			}
+			m[key] = v
+		}
+		return m, b, nil
+	case 6:
+		v, b, err := parseCBOR(b, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Tags 2 and 3 are positive and negative bignums
+		if s, ok := v.(string); ok && (arg == 2 || arg == 3) {
+			raw, _ := base64.StdEncoding.DecodeString(s)
+			n := new(big.Int).SetBytes(raw)
+			if arg == 3 {
+				n.Neg(n).Sub(n, big.NewInt(1))
+			}
+			return json.Number(n.String()), b, nil
+		}
+		return v, b, nil
+	}
+
+	// Major type 7: simple values and floats
+	var f float64
+	switch info {
+	case 20:
+		return false, b, nil
+	case 21:
+		return true, b, nil
+	case 22, 23:
+		return nil, b, nil
+	case 25:
+		f = halfFloat(uint16(arg))
+	case 26:
+		f = float64(math.Float32frombits(uint32(arg)))
+	case 27:
+		f = math.Float64frombits(arg)
+	case 31:
+		return nil, nil, errors.New("unexpected CBOR break")
+	default:
+		return json.Number(fmt.Sprint(arg)), b, nil
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Sprint(f), b, nil // JSON has no NaN or infinities
+	}
+	return f, b, nil
+}
+
+// halfFloat expands an IEEE 754 half-precision number.
+func halfFloat(h uint16) float64 {
+	exp, mant := int(h>>10&0x1f), float64(h&0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		f = math.Inf(1)
+		if mant != 0 {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
+
+// isCBOR reports whether b holds exactly one well-formed CBOR item.
+func isCBOR(b []byte) bool {
+	_, rest, err := parseCBOR(b, 0)
+	return err == nil && len(rest) == 0
+}
@@ -0,0 +1,117 @@
+// cbor_test.go
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestDecodeCBOR(t *testing.T) {
+	// Mostly the examples of RFC 8949, appendix A
+	for _, tc := range []struct {
+		cbor string // hex
+		want string
+	}{
+		{"00", "0"},
+		{"17", "23"},
+		{"1818", "24"},
+		{"1903e8", "1000"},
+		{"1b000000e8d4a51000", "1000000000000"},
+		{"1bffffffffffffffff", "18446744073709551615"},
+		{"20", "-1"},
+		{"3903e7", "-1000"},
+		{"3bffffffffffffffff", "-18446744073709551616"},
+		{"c249010000000000000000", "18446744073709551616"},
+		{"c349010000000000000000", "-18446744073709551617"},
+		{"f93c00", "1"},
+		{"f93e00", "1.5"},
+		{"f97bff", "65504"},
+		{"fa47c35000", "100000"},
+		{"fb3ff199999999999a", "1.1"},
+		{"f97c00", `"+Inf"`},
+		{"f9fc00", `"-Inf"`},
+		{"f97e00", `"NaN"`},
+		{"f4", "false"},
+		{"f5", "true"},
+		{"f6", "null"},
+		{"f7", "null"},
+		{"f0", "16"},
+		{"40", `""`},
+		{"4401020304", `"AQIDBA=="`},
+		{"60", `""`},
+		{"62c3bc", `"ü"`},
+		{"80", "[]"},
+		{"8301820203820405", "[1,[2,3],[4,5]]"},
+		{"a0", "{}"},
+		{"a201020304", `{"1":2,"3":4}`},
+		{"a26161016162820203", `{"a":1,"b":[2,3]}`},
+		{"c074323031332d30332d32315432303a30343a30305a", `"2013-03-21T20:04:00Z"`},
+		{"5f42010243030405ff", `"AQIDBAU="`},
+		{"7f657374726561646d696e67ff", `"streaming"`},
+		{"9fff", "[]"},
+		{"9f018202039f0405ffff", "[1,[2,3],[4,5]]"},
+		{"bf61610161629f0203ffff", `{"a":1,"b":[2,3]}`},
+	} {
+		t.Run(tc.cbor, func(t *testing.T) {
+			b, err := hex.DecodeString(tc.cbor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeCBOR(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+			if !isCBOR(b) {
+				t.Errorf("isCBOR is false")
+			}
+		})
+	}
+}
+
+func TestDecodeCBORRejects(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cbor string // hex
+		want string
+	}{
+		{"empty", "", "truncated"},
+		{"missing argument", "18", "truncated"},
+		{"short text", "6261", "truncated"},
+		{"short array", "8201", "truncated"},
+		{"unterminated map", "bf6161", "truncated"},
+		{"trailing bytes", "0001", "1 bytes after"},
+		{"reserved argument", "1c", "invalid CBOR initial byte 0x1c"},
+		{"indefinite integer", "1f", "invalid CBOR initial byte 0x1f"},
+		{"lone break", "ff", "unexpected CBOR break"},
+		{"text chunk in bytes", "5f6161ff", "invalid CBOR string chunk"},
+		{"nested indefinite chunk", "5f5fffff", "invalid CBOR string chunk"},
+		{"invalid UTF-8", "61ff", "not UTF-8"},
+		{"nested too deeply", strings.Repeat("81", cborMaxDepth+1) + "00", "nested too deeply"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := hex.DecodeString(tc.cbor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := decodeCBOR(b); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got %v, want an error containing %q", err, tc.want)
+			}
+			if isCBOR(b) {
+				t.Errorf("isCBOR is true")
+			}
+		})
+	}
+}
+
+func TestIsCBORText(t *testing.T) {
+	// Text payloads mostly aren't one well-formed item
+	for _, s := range []string{`{"a":1}`, "hello", "12.5"} {
+		if isCBOR([]byte(s)) {
+			t.Errorf("isCBOR(%q) is true", s)
+		}
+	}
+}
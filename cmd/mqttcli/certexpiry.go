@@ -0,0 +1,113 @@
+// certexpiry.go
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultCertExpiryWarnDays is the warning window used when none is configured.
+const defaultCertExpiryWarnDays = 30
+
+// parsePEMCertificates returns every certificate found in PEM data, skipping
+// blocks that are not certificates or fail to parse.
+func parsePEMCertificates(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if c, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, c)
+		}
+	}
+}
+
+// daysUntilExpiry returns the whole days left before c expires, rounded down,
+// so it's negative as soon as c has expired.
+func daysUntilExpiry(c *x509.Certificate) int {
+	return int(math.Floor(time.Until(c.NotAfter).Hours() / 24))
+}
+
+// certExpiryDays holds the fewest days to expiry of the certificates last
+// loaded, by kind ("client", "ca", "intermediate"), for --metrics-file.
+var certExpiryDays = struct {
+	sync.Mutex
+	days map[string]int
+}{days: map[string]int{}}
+
+// recordCertExpiry replaces the days to expiry of kind with the fewest of certs.
+func recordCertExpiry(kind string, certs []*x509.Certificate) {
+	if len(certs) == 0 {
+		return
+	}
+	fewest := daysUntilExpiry(certs[0])
+	for _, c := range certs[1:] {
+		fewest = min(fewest, daysUntilExpiry(c))
+	}
+	certExpiryDays.Lock()
+	defer certExpiryDays.Unlock()
+	certExpiryDays.days[strings.ToLower(kind)] = fewest
+}
+
+// certExpirySnapshot returns the recorded days to expiry by kind, or nil if no
+// certificates were loaded.
+func certExpirySnapshot() map[string]int {
+	certExpiryDays.Lock()
+	defer certExpiryDays.Unlock()
+	if len(certExpiryDays.days) == 0 {
+		return nil
+	}
+	days := make(map[string]int, len(certExpiryDays.days))
+	for k, d := range certExpiryDays.days {
+		days[k] = d
+	}
+	return days
+}
+
+// checkCertExpiry logs the days-to-expiry of each certificate and warns about any
+// that fall inside the configured window. With StrictCertExpiry set, such a
+// certificate is returned as an error so the process refuses to start.
+func checkCertExpiry(kind string, certs []*x509.Certificate, cfg *Config) error {
+	recordCertExpiry(kind, certs)
+	warnDays := cfg.CertExpiryWarnDays
+	if warnDays <= 0 {
+		warnDays = defaultCertExpiryWarnDays
+	}
+
+	for _, c := range certs {
+		days := daysUntilExpiry(c)
+		name := c.Subject.CommonName
+		if days >= warnDays {
+			if kind == "client" {
+				logInfo("cert_expiry", "%s certificate '%s' expires in %d days (%s)",
+					kind, name, days, c.NotAfter.Format(time.RFC3339))
+			}
+			continue
+		}
+
+		var msg string
+		if days < 0 {
+			msg = fmt.Sprintf("%s certificate '%s' expired %d days ago (%s)",
+				kind, name, -days, c.NotAfter.Format(time.RFC3339))
+		} else {
+			msg = fmt.Sprintf("%s certificate '%s' expires in %d days (%s), below the %d day warning threshold",
+				kind, name, days, c.NotAfter.Format(time.RFC3339), warnDays)
+		}
+		if cfg.StrictCertExpiry {
+			return fmt.Errorf("%s (--strict-cert-expiry)", msg)
+		}
+		logWarn("cert_expiring", "%s", msg)
+	}
+	return nil
+}
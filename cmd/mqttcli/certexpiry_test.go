@@ -0,0 +1,51 @@
+// certexpiry_test.go
+package main
+
+import (
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+)
+
+func expiringIn(cn string, d time.Duration) *x509.Certificate {
+	c := &x509.Certificate{NotAfter: time.Now().Add(d)}
+	c.Subject.CommonName = cn
+	return c
+}
+
+func TestDaysUntilExpiry(t *testing.T) {
+	for _, tc := range []struct {
+		in   time.Duration
+		want int
+	}{
+		{48*time.Hour + time.Minute, 2},
+		{23 * time.Hour, 0},
+		{time.Minute, 0},
+		{-time.Minute, -1},
+		{-23*time.Hour - 59*time.Minute, -1},
+		{-24*time.Hour - time.Minute, -2},
+	} {
+		if got := daysUntilExpiry(expiringIn("c", tc.in)); got != tc.want {
+			t.Errorf("expiring in %v: got %d days, want %d", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestCheckCertExpiry(t *testing.T) {
+	cfg := &Config{StrictCertExpiry: true, CertExpiryWarnDays: 7}
+	if err := checkCertExpiry("client", []*x509.Certificate{expiringIn("fresh", 30*24*time.Hour)}, cfg); err != nil {
+		t.Errorf("refused a certificate with 30 days left: %v", err)
+	}
+	err := checkCertExpiry("client", []*x509.Certificate{expiringIn("stale", -time.Hour)}, cfg)
+	if err == nil || !strings.Contains(err.Error(), "expired 1 days ago") {
+		t.Errorf("an hour after expiry: got %v, want an expired error", err)
+	}
+	if days := certExpirySnapshot()["client"]; days != -1 {
+		t.Errorf("recorded %d days for the client certificate, want -1", days)
+	}
+	checkCertExpiry("CA", []*x509.Certificate{expiringIn("a", 10*24*time.Hour), expiringIn("b", 3*24*time.Hour+time.Hour)}, &Config{})
+	if days := certExpirySnapshot()["ca"]; days != 3 {
+		t.Errorf("recorded %d days for the CA certificates, want the fewest, 3", days)
+	}
+}
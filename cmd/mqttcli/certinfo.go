@@ -0,0 +1,274 @@
+// certinfo.go
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// certSummary is one certificate of the chain, as printed by certinfo.
+type certSummary struct {
+	Subject   string   `json:"subject"`
+	Issuer    string   `json:"issuer"`
+	SANs      []string `json:"sans,omitempty"`
+	NotBefore string   `json:"not_before"`
+	NotAfter  string   `json:"not_after"`
+	DaysLeft  int      `json:"days_left"`
+	Serial    string   `json:"serial"`
+	Key       string   `json:"key"`
+	SHA256    string   `json:"sha256"`
+	Pin       string   `json:"pin_sha256"`
+	CA        bool     `json:"ca"`
+}
+
+// certReport is what certinfo found out about a broker's TLS endpoint.
+type certReport struct {
+	Address     string        `json:"address"`
+	ServerName  string        `json:"server_name"`
+	Version     string        `json:"tls_version"`
+	CipherSuite string        `json:"cipher_suite"`
+	ALPN        string        `json:"alpn,omitempty"`
+	OCSPStapled bool          `json:"ocsp_stapled"`
+	Chain       []certSummary `json:"chain"`
+	Verified    bool          `json:"verified"`
+	Error       string        `json:"error,omitempty"`
+	Hint        string        `json:"hint,omitempty"`
+}
+
+// summarizeCert describes c for certinfo.
+func summarizeCert(c *x509.Certificate) certSummary {
+	s := certSummary{
+		Subject:   c.Subject.String(),
+		Issuer:    c.Issuer.String(),
+		NotBefore: c.NotBefore.UTC().Format(time.RFC3339),
+		NotAfter:  c.NotAfter.UTC().Format(time.RFC3339),
+		DaysLeft:  daysUntilExpiry(c),
+		Serial:    colonHex(c.SerialNumber.Bytes()),
+		Key:       describeKey(c.PublicKey),
+		Pin:       "sha256//" + spkiPin(c),
+		CA:        c.IsCA,
+	}
+	sum := sha256.Sum256(c.Raw)
+	s.SHA256 = colonHex(sum[:])
+	for _, n := range c.DNSNames {
+		s.SANs = append(s.SANs, "DNS:"+n)
+	}
+	for _, ip := range c.IPAddresses {
+		s.SANs = append(s.SANs, "IP:"+ip.String())
+	}
+	for _, u := range c.URIs {
+		s.SANs = append(s.SANs, "URI:"+u.String())
+	}
+	for _, e := range c.EmailAddresses {
+		s.SANs = append(s.SANs, "email:"+e)
+	}
+	return s
+}
+
+// colonHex formats b as upper-case hex bytes separated by colons.
+func colonHex(b []byte) string {
+	parts := make([]string, len(b))
+	for i, v := range b {
+		parts[i] = fmt.Sprintf("%02X", v)
+	}
+	return strings.Join(parts, ":")
+}
+
+// describeKey names the type and size of a certificate's public key.
+func describeKey(key interface{}) string {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d bits", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + k.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return fmt.Sprintf("%T", key)
+}
+
+// verifyHint suggests a fix for a failed verification of chain.
+func verifyHint(err error, chain []*x509.Certificate, serverName string) string {
+	var unknown x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	last := chain[len(chain)-1]
+	switch {
+	case errors.As(err, &unknown):
+		return fmt.Sprintf("No trusted CA issued this chain. Pass the certificate of '%s', which issued the last certificate the broker sent, with --cafile; "+
+			"if that is an intermediate, the broker should send it too", last.Issuer.String())
+	case errors.As(err, &hostname):
+		return fmt.Sprintf("The certificate isn't for '%s'. Connect with a name from its SANs, or set --tls-server-name to one", serverName)
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		return "A certificate in the chain has expired or isn't valid yet; check the dates above and this machine's clock"
+	}
+	return ""
+}
+
+// inspectBroker connects to cfg's broker, completes the TLS handshake, and
+// reports the presented chain and whether cfg's TLS settings accept it.
+func inspectBroker(ctx context.Context, cfg *Config) (*certReport, error) {
+	if !isTLSBrokerURL(cfg.BrokerURL) {
+		return nil, fmt.Errorf("certinfo needs a TLS broker URL (ssl://, mqtts://, wss://, or https://), not '%s'", cfg.BrokerURL)
+	}
+	host, port, err := brokerAddress(cfg.BrokerURL)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := NewTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	// Take the chain whatever it is, then check it below, so a broken one
+	// can still be shown
+	c := tlsConfig.Clone()
+	c.InsecureSkipVerify = true
+	c.VerifyConnection = nil
+	if c.ServerName == "" {
+		c.ServerName = host
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.ConnectTimeout))
+	defer cancel()
+	report := &certReport{Address: net.JoinHostPort(host, port), ServerName: c.ServerName}
+	conn, err := egressDialer(0).DialContext(ctx, "tcp", report.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	tc := tls.Client(conn, c)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake with %s failed: %v", report.Address, err)
+	}
+	cs := tc.ConnectionState()
+	report.Version = tls.VersionName(cs.Version)
+	report.CipherSuite = tls.CipherSuiteName(cs.CipherSuite)
+	report.ALPN = cs.NegotiatedProtocol
+	report.OCSPStapled = len(cs.OCSPResponse) > 0
+	for _, cert := range cs.PeerCertificates {
+		report.Chain = append(report.Chain, summarizeCert(cert))
+	}
+	if len(cs.PeerCertificates) == 0 {
+		report.Error = "the broker presented no certificate"
+		return report, nil
+	}
+
+	if !cfg.Insecure {
+		intermediates := x509.NewCertPool()
+		for _, cert := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		chains, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+			DNSName:       c.ServerName,
+			Roots:         tlsConfig.RootCAs,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			report.Error = err.Error()
+			report.Hint = verifyHint(err, cs.PeerCertificates, c.ServerName)
+			return report, nil
+		}
+		cs.VerifiedChains = chains
+	}
+	if tlsConfig.VerifyConnection != nil {
+		if err := tlsConfig.VerifyConnection(cs); err != nil {
+			report.Error = err.Error()
+			return report, nil
+		}
+	}
+	report.Verified = true
+	return report, nil
+}
+
+// printCertReport writes r as text.
+func printCertReport(w io.Writer, r *certReport, insecure bool) {
+	fmt.Fprintf(w, "Connected to %s (%s, %s", r.Address, r.Version, r.CipherSuite)
+	if r.ALPN != "" {
+		fmt.Fprintf(w, ", ALPN %s", r.ALPN)
+	}
+	fmt.Fprintf(w, ")\nServer name: %s\nOCSP stapled: %v\n\n", r.ServerName, map[bool]string{true: "yes", false: "no"}[r.OCSPStapled])
+	fmt.Fprintf(w, "Certificate chain presented by the broker (%d):\n", len(r.Chain))
+	for i, c := range r.Chain {
+		fmt.Fprintf(w, "\n[%d] %s\n", i, c.Subject)
+		fmt.Fprintf(w, "    Issuer:   %s\n", c.Issuer)
+		if len(c.SANs) > 0 {
+			fmt.Fprintf(w, "    SANs:     %s\n", strings.Join(c.SANs, ", "))
+		}
+		expiry := fmt.Sprintf("expires in %d days", c.DaysLeft)
+		if c.DaysLeft < 0 {
+			expiry = fmt.Sprintf("EXPIRED %d days ago", -c.DaysLeft)
+		}
+		fmt.Fprintf(w, "    Valid:    %s to %s (%s)\n", c.NotBefore, c.NotAfter, expiry)
+		fmt.Fprintf(w, "    Serial:   %s\n", c.Serial)
+		fmt.Fprintf(w, "    Key:      %s%s\n", c.Key, map[bool]string{true: " (CA)", false: ""}[c.CA])
+		fmt.Fprintf(w, "    SHA-256:  %s\n", c.SHA256)
+		fmt.Fprintf(w, "    Pin:      %s\n", c.Pin)
+	}
+	fmt.Fprintln(w)
+	switch {
+	case r.Verified && insecure:
+		fmt.Fprintln(w, "Verification: skipped (--insecure); pins and revocation checks passed")
+	case r.Verified:
+		fmt.Fprintln(w, "Verification: OK with these TLS settings")
+	default:
+		fmt.Fprintf(w, "Verification: FAILED: %s\n", r.Error)
+		if r.Hint != "" {
+			fmt.Fprintf(w, "Hint: %s.\n", r.Hint)
+		}
+	}
+}
+
+func runCertInfo(args []string) {
+	fs := flag.NewFlagSet("certinfo", flag.ExitOnError)
+	flags := initCLIFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s certinfo --broker ssl://HOST:PORT [options]\n\n"+
+			"Completes the TLS handshake with the broker, without MQTT, and prints the certificate chain it\n"+
+			"presents: subjects, SANs, validity, fingerprints, and pins. The chain is then verified with\n"+
+			"the given TLS options (--cafile, --tls-server-name, --pin-sha256, --crl-file, --ocsp), with a\n"+
+			"hint when that fails. Exits with status 1 if it fails. --output json prints one object.\n\nOptions:\n",
+			filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if flags.BrokerURL == "" && flags.ConfigPath == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	// Neither is used, but the shared config checks want them
+	if flags.ClientID == "" {
+		flags.ClientID = "mqttcli-certinfo"
+	}
+	if len(flags.Topics) == 0 {
+		flags.Topics = topicFlag{{Topic: "#"}}
+	}
+	cfg := buildConfig(flags)
+
+	report, err := inspectBroker(context.Background(), &cfg)
+	if err != nil {
+		fatal("tls_failed", isRetryable(err), "%v", err)
+	}
+	if cfg.Output == outputJSON {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Printf("%s\n", data)
+	} else {
+		printCertReport(os.Stdout, report, cfg.Insecure)
+	}
+	if !report.Verified {
+		os.Exit(1)
+	}
+}
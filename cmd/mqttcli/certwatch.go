@@ -0,0 +1,136 @@
+// certwatch.go
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// certFilePaths lists the TLS files of cfg that can be renewed on disk.
+func certFilePaths(cfg *Config) []string {
+	var paths []string
+	for _, p := range []string{cfg.CAFile, cfg.CertFile, cfg.KeyFile, cfg.ChainFile, cfg.PKCS12File, cfg.CRLFile} {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// readCertFiles returns the contents of paths, to compare between polls.
+func readCertFiles(paths []string) string {
+	var b strings.Builder
+	for _, p := range paths {
+		data, _ := ioutil.ReadFile(p)
+		b.Write(data)
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// loadClientIdentity checks that the TLS files of cfg load, returning the
+// client certificate if there is one.
+func loadClientIdentity(cfg *Config) (*x509.Certificate, error) {
+	for _, f := range []struct{ kind, inline, path string }{
+		{"CA", cfg.CAPEM, cfg.CAFile},
+		{"chain", "", cfg.ChainFile},
+	} {
+		data, err := readPEM(f.inline, f.path)
+		if err != nil {
+			return nil, err
+		}
+		if data != nil && len(parsePEMCertificates(data)) == 0 {
+			return nil, fmt.Errorf("no certificates found in %s file", f.kind)
+		}
+	}
+
+	var cert tls.Certificate
+	var err error
+	switch {
+	case cfg.PKCS12File != "":
+		cert, _, err = loadPKCS12(cfg)
+	case cfg.PKCS11Module != "":
+		cert, err = loadPKCS11(cfg)
+	default:
+		certPEM, err := readPEM(cfg.CertPEM, cfg.CertFile)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM, err := readPEM(cfg.KeyPEM, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if certPEM == nil || keyPEM == nil {
+			return nil, nil
+		}
+		if keyPEM, err = decryptKeyPEM(keyPEM, cfg); err != nil {
+			return nil, err
+		}
+		if cert, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("no client certificate")
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
+
+// watchCertFiles returns a context that is cancelled when the TLS files of
+// cfg change to an identity that loads, or when a signal arrives on reload,
+// so the caller reconnects with the renewed certificate. A half-finished
+// rotation, such as a new certificate whose key hasn't been written yet, is
+// reported and tried again at the next poll.
+func watchCertFiles(ctx context.Context, cfg *Config, reload <-chan os.Signal) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	paths := certFilePaths(cfg)
+	current := readCertFiles(paths)
+	go func() {
+		defer cancel()
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		var lastErr string
+		for {
+			var reason string
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-reload:
+				reason = fmt.Sprintf("Received %v", sig)
+			case <-ticker.C:
+				if readCertFiles(paths) == current {
+					continue
+				}
+				reason = "TLS files changed"
+			}
+			leaf, err := loadClientIdentity(cfg)
+			if err != nil {
+				if err.Error() != lastErr {
+					logWarn("cert_reload_failed", "%s, but keeping the current certificate: %v", reason, err)
+				}
+				lastErr = err.Error()
+				continue
+			}
+			if leaf != nil {
+				logInfo("cert_reloading", "%s, reconnecting as '%s' (valid until %s)", reason, leaf.Subject.CommonName, leaf.NotAfter.UTC().Format(time.RFC3339))
+			} else {
+				logInfo("cert_reloading", "%s, reconnecting", reason)
+			}
+			return
+		}
+	}()
+	return ctx
+}
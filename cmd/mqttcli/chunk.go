@@ -0,0 +1,256 @@
+// chunk.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Limits on reassembling chunked payloads, so a lost chunk or a flood of
+// bogus ones can't hold memory for good.
+const (
+	chunkMaxBuffered = 64 << 20 // bytes of incomplete payloads kept at once
+	chunkExpiry      = 5 * time.Minute
+)
+
+// chunkManifest describes the payload a chunk belongs to. Every chunk carries
+// it, so the payload can be put together again whichever chunk arrives first.
+type chunkManifest struct {
+	ID     string `json:"id"`
+	Index  int    `json:"index"`
+	Count  int    `json:"count"`
+	Size   int    `json:"size"`   // of the whole payload
+	SHA256 string `json:"sha256"` // of the whole payload, hex
+}
+
+// chunkEnvelope is the payload of one chunk published by "pub --chunk".
+type chunkEnvelope struct {
+	Chunk chunkManifest `json:"mqttcli_chunk"`
+	Data  []byte        `json:"data"` // base64 in JSON
+}
+
+// chunkPrefix starts every chunk envelope, so other payloads are told apart
+// without parsing them.
+var chunkPrefix = []byte(`{"mqttcli_chunk":`)
+
+// splitChunks splits payload into chunk envelopes of at most limit bytes each.
+func splitChunks(payload []byte, limit int) ([][]byte, error) {
+	id := make([]byte, 8)
+	rand.Read(id)
+	sum := sha256.Sum256(payload)
+	m := chunkManifest{ID: hex.EncodeToString(id), Size: len(payload), SHA256: hex.EncodeToString(sum[:])}
+
+	// The envelope grows with the digits of the count, so settle the count
+	// first: each pass can only raise it
+	per := 0
+	for m.Count = 1; ; {
+		m.Index = m.Count - 1
+		empty, err := json.Marshal(chunkEnvelope{Chunk: m})
+		if err != nil {
+			return nil, err
+		}
+		overhead := len(empty) - len("null") + len(`""`)
+		if per = (limit - overhead) / 4 * 3; per <= 0 {
+			return nil, fmt.Errorf("a limit of %d bytes leaves no room for data in a chunk", limit)
+		}
+		count := (len(payload) + per - 1) / per
+		if count <= m.Count {
+			break
+		}
+		m.Count = count
+	}
+
+	chunks := make([][]byte, 0, m.Count)
+	for m.Index = 0; m.Index < m.Count; m.Index++ {
+		data := payload[m.Index*per : min((m.Index+1)*per, len(payload))]
+		b, err := json.Marshal(chunkEnvelope{Chunk: m, Data: data})
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, b)
+	}
+	return chunks, nil
+}
+
+// publishOverhead estimates the bytes a publish to topic adds around its
+// payload: the fixed header, topic, packet ID, and MQTT v5 properties.
+func publishOverhead(cfg *Config, topic string) int {
+	n := len(topic) + 16
+	if cfg.Protocol == 5 {
+		n += 5 + len(cfg.ContentType) + 3 + len(cfg.CorrelationData) + 3 + len(cfg.ResponseTopic) + 3
+		for k, v := range cfg.UserProperties {
+			n += len(k) + len(v) + 5
+		}
+	}
+	return n
+}
+
+// chunker publishes payloads too large for the broker's maximum packet size
+// in chunks with pub --chunk, or refuses them without it.
+type chunker struct {
+	enabled   bool
+	maxPacket int64 // max_packet_size; zero leaves it to what the broker advertises
+}
+
+func newChunker(cfg *Config) (*chunker, error) {
+	c := &chunker{enabled: cfg.Chunk}
+	if cfg.MaxPacketSize != "" {
+		n, err := parseByteSize(cfg.MaxPacketSize)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid max_packet_size '%s', expected a size such as 128KB", cfg.MaxPacketSize)
+		}
+		c.maxPacket = n
+	}
+	return c, nil
+}
+
+// limit returns the largest payload a publish to topic fits into: the lower
+// of max_packet_size and the broker's advertised maximum, less the packet
+// overhead. Zero means no known limit.
+func (c *chunker) limit(client mqtt.Client, cfg *Config, topic string) int {
+	maxPacket := c.maxPacket
+	if cr, ok := client.(capsReporter); ok {
+		if advertised := int64(cr.brokerCaps().MaxPacketSize); advertised > 0 && (maxPacket == 0 || advertised < maxPacket) {
+			maxPacket = advertised
+		}
+	}
+	if maxPacket == 0 {
+		return 0
+	}
+	return int(maxPacket) - publishOverhead(cfg, topic)
+}
+
+// publish sends payload to topic, as chunks if it's over the limit.
+func (c *chunker) publish(ctx context.Context, client mqtt.Client, cfg *Config, topic string, retain bool, payload []byte) error {
+	parts := [][]byte{payload}
+	if limit := c.limit(client, cfg, topic); limit > 0 && len(payload) > limit {
+		if !c.enabled {
+			return fmt.Errorf("payload of %d bytes doesn't fit the maximum packet size; --chunk splits it", len(payload))
+		}
+		var err error
+		if parts, err = splitChunks(payload, limit); err != nil {
+			return err
+		}
+		logInfo("chunked", "Publishing %d bytes to '%s' in %d chunks", len(payload), topic, len(parts))
+	}
+	for _, p := range parts {
+		if err := waitToken(ctx, client.Publish(topic, cfg.QoS, retain, p), defaultPublishTimeout, "publish"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// partialPayload is a chunked payload still missing chunks.
+type partialPayload struct {
+	manifest chunkManifest
+	chunks   [][]byte
+	got      int
+	bytes    int
+	started  time.Time
+}
+
+// chunkAssembler implements sub --reassemble: it holds back the chunks "pub
+// --chunk" publishes and hands on the whole payload once every chunk arrived.
+// Other messages pass through.
+type chunkAssembler struct {
+	mu       sync.Mutex
+	partial  map[string]*partialPayload // by topic and ID
+	buffered int
+}
+
+func newChunkAssembler(cfg *Config) *chunkAssembler {
+	if !cfg.Reassemble {
+		return nil
+	}
+	return &chunkAssembler{partial: map[string]*partialPayload{}}
+}
+
+func (a *chunkAssembler) wrap(next mqtt.MessageHandler) mqtt.MessageHandler {
+	if a == nil {
+		return next
+	}
+	return func(client mqtt.Client, msg mqtt.Message) {
+		if !bytes.HasPrefix(msg.Payload(), chunkPrefix) {
+			next(client, msg)
+			return
+		}
+		payload, err := a.add(msg.Topic(), msg.Payload())
+		if err != nil {
+			logWarn("chunk_invalid", "Dropped a chunk on '%s': %v", msg.Topic(), err)
+			return
+		}
+		if payload != nil {
+			next(client, &decodedMessage{Message: msg, payload: payload})
+		}
+	}
+}
+
+// add stores one chunk envelope received on topic, and returns the whole
+// payload once it was the last one missing.
+func (a *chunkAssembler) add(topic string, envelope []byte) ([]byte, error) {
+	var e chunkEnvelope
+	if err := json.Unmarshal(envelope, &e); err != nil {
+		return nil, err
+	}
+	m := e.Chunk
+	if m.Count <= 0 || m.Count > m.Size || m.Index < 0 || m.Index >= m.Count || m.Size > chunkMaxBuffered {
+		return nil, fmt.Errorf("chunk %d of %d for %d bytes is out of range", m.Index, m.Count, m.Size)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.expire()
+	key := topic + "\x00" + m.ID
+	p := a.partial[key]
+	if p == nil {
+		p = &partialPayload{manifest: m, chunks: make([][]byte, m.Count), started: time.Now()}
+		a.partial[key] = p
+	}
+	if m.Count != p.manifest.Count || m.Size != p.manifest.Size || m.SHA256 != p.manifest.SHA256 {
+		return nil, fmt.Errorf("chunk %d doesn't match the others of payload %s", m.Index, m.ID)
+	}
+	if p.chunks[m.Index] != nil {
+		return nil, nil // sent again, e.g. at QoS 1
+	}
+	if p.bytes+len(e.Data) > m.Size || a.buffered+len(e.Data) > chunkMaxBuffered {
+		delete(a.partial, key)
+		a.buffered -= p.bytes
+		return nil, fmt.Errorf("payload %s is larger than announced or too much is buffered", m.ID)
+	}
+	p.chunks[m.Index] = e.Data
+	p.got++
+	p.bytes += len(e.Data)
+	a.buffered += len(e.Data)
+	if p.got < m.Count {
+		return nil, nil
+	}
+
+	delete(a.partial, key)
+	a.buffered -= p.bytes
+	payload := bytes.Join(p.chunks, nil)
+	if sum := sha256.Sum256(payload); len(payload) != m.Size || hex.EncodeToString(sum[:]) != m.SHA256 {
+		return nil, fmt.Errorf("payload %s doesn't match its checksum", m.ID)
+	}
+	return payload, nil
+}
+
+// expire drops payloads whose chunks stopped arriving; a.mu must be held.
+func (a *chunkAssembler) expire() {
+	for key, p := range a.partial {
+		if time.Since(p.started) > chunkExpiry {
+			logWarn("chunk_expired", "Dropped payload %s after %d of %d chunks arrived within %s", p.manifest.ID, p.got, p.manifest.Count, chunkExpiry)
+			delete(a.partial, key)
+			a.buffered -= p.bytes
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// chunk_test.go
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func randomPayload(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSplitChunks(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		size   int
+		limit  int
+		chunks int
+	}{
+		{"one chunk", 10, 400, 1},
+		{"a few", 3000, 400, 17},
+		{"a hundred or more", 20000, 400, 115}, // the count's digits grow the envelope
+		{"exact fit", 300, 560, 1},
+		{"one byte over", 301, 560, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			payload := randomPayload(t, tc.size)
+			chunks, err := splitChunks(payload, tc.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chunks) != tc.chunks {
+				t.Errorf("got %d chunks, want %d", len(chunks), tc.chunks)
+			}
+			for i, c := range chunks {
+				if len(c) > tc.limit {
+					t.Errorf("chunk %d is %d bytes, over the limit of %d", i, len(c), tc.limit)
+				}
+				if !bytes.HasPrefix(c, chunkPrefix) {
+					t.Errorf("chunk %d doesn't start with %s", i, chunkPrefix)
+				}
+			}
+
+			// Reassembled in reverse, with a duplicate
+			a := &chunkAssembler{partial: map[string]*partialPayload{}}
+			var got []byte
+			for i := len(chunks) - 1; i >= 0; i-- {
+				if _, err := a.add("t", chunks[len(chunks)-1]); err != nil {
+					t.Fatal(err)
+				}
+				out, err := a.add("t", chunks[i])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if out != nil && i != 0 {
+					t.Fatalf("payload complete after chunk %d", i)
+				}
+				got = out
+			}
+			if !bytes.Equal(got, payload) {
+				t.Errorf("reassembled %d bytes, want the %d published", len(got), len(payload))
+			}
+			if len(a.partial) != 0 || a.buffered != 0 {
+				t.Errorf("%d partial payload(s) and %d bytes left buffered", len(a.partial), a.buffered)
+			}
+		})
+	}
+}
+
+func TestSplitChunksLimitTooSmall(t *testing.T) {
+	if _, err := splitChunks(make([]byte, 100), 50); err == nil || !strings.Contains(err.Error(), "no room for data") {
+		t.Errorf("got %v, want a no room error", err)
+	}
+}
+
+// envelope returns a chunk envelope with m and data.
+func envelope(t *testing.T, m chunkManifest, data string) []byte {
+	t.Helper()
+	b, err := json.Marshal(chunkEnvelope{Chunk: m, Data: []byte(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestChunkAssemblerRejects(t *testing.T) {
+	chunks, err := splitChunks([]byte("hello, chunked world"), 180)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first chunkEnvelope
+	if err := json.Unmarshal(chunks[0], &first); err != nil {
+		t.Fatal(err)
+	}
+	m := first.Chunk
+
+	for _, tc := range []struct {
+		name     string
+		envelope func(t *testing.T) []byte
+		want     string
+	}{
+		{"not JSON", func(*testing.T) []byte { return []byte(`{"mqttcli_chunk":`) }, "unexpected end"},
+		{"index out of range", func(t *testing.T) []byte {
+			bad := m
+			bad.Index = m.Count
+			return envelope(t, bad, "x")
+		}, "out of range"},
+		{"count beyond the size", func(t *testing.T) []byte {
+			bad := m
+			bad.Count, bad.Size = 1<<30, 10
+			return envelope(t, bad, "x")
+		}, "out of range"},
+		{"too large to buffer", func(t *testing.T) []byte {
+			bad := m
+			bad.Size = chunkMaxBuffered + 1
+			return envelope(t, bad, "x")
+		}, "out of range"},
+		{"disagrees with the first chunk", func(t *testing.T) []byte {
+			bad := m
+			bad.Index, bad.SHA256 = 1, "00"
+			return envelope(t, bad, "x")
+		}, "doesn't match the others"},
+		{"more data than announced", func(t *testing.T) []byte {
+			bad := m
+			bad.Index = 1
+			return envelope(t, bad, strings.Repeat("x", m.Size))
+		}, "larger than announced"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &chunkAssembler{partial: map[string]*partialPayload{}}
+			if _, err := a.add("t", chunks[0]); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := a.add("t", tc.envelope(t)); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestChunkAssemblerChecksum(t *testing.T) {
+	chunks, err := splitChunks([]byte("hello, chunked world"), 180)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &chunkAssembler{partial: map[string]*partialPayload{}}
+	for i, c := range chunks {
+		var e chunkEnvelope
+		if err := json.Unmarshal(c, &e); err != nil {
+			t.Fatal(err)
+		}
+		e.Data = bytes.ToUpper(e.Data)
+		tampered, _ := json.Marshal(e)
+		_, err := a.add("t", tampered)
+		if i < len(chunks)-1 && err != nil {
+			t.Fatal(err)
+		}
+		if i == len(chunks)-1 && (err == nil || !strings.Contains(err.Error(), "checksum")) {
+			t.Errorf("got %v, want a checksum error", err)
+		}
+	}
+}
+
+func TestChunkAssemblerTopics(t *testing.T) {
+	chunks, err := splitChunks([]byte("hello, chunked world"), 180)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) < 2 {
+		t.Fatalf("got %d chunk(s), want several", len(chunks))
+	}
+	// The same chunks on another topic are another payload
+	a := &chunkAssembler{partial: map[string]*partialPayload{}}
+	for _, c := range chunks[:len(chunks)-1] {
+		a.add("a", c)
+	}
+	if out, _ := a.add("b", chunks[len(chunks)-1]); out != nil {
+		t.Errorf("completed a payload from chunks on two topics")
+	}
+}
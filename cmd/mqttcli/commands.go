@@ -0,0 +1,113 @@
+// commands.go
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// version is set at build time with -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+// command is one mqttcli subcommand. Each parses its own flag set, usually
+// starting from initCLIFlags so connection flags and --config work everywhere.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string)
+}
+
+// commands returns the subcommands in the order they are listed in help. It is a
+// function rather than a variable because the help command refers back to it.
+func commands() []command {
+	return []command{
+		{"sub", "Subscribe and print messages (the default command)", runSubscribe},
+		{"pub", "Publish a message (from --message, --file, or stdin)", runPublish},
+		{"rpc", "Send a request and wait for the matching response", runRPC},
+		{"plot", "Chart a numeric JSON field as a live terminal sparkline", runPlot},
+		{"watch", "Table of the latest value, age, and rate per matched topic", runWatch},
+		{"grep", "Print messages whose payload matches a regular expression", runGrep},
+		{"lint-topics", "Check observed topics against naming conventions", runLintTopics},
+		{"clock-skew", "Measure per-device clock skew from payload timestamps", runClockSkew},
+		{"explode", "Republish each JSON payload field to its own sub-topic", runExplode},
+		{"aggregate", "Merge per-field sibling topics back into one JSON document", runAggregate},
+		{"play", "Show a session saved with --record", runPlay},
+		{"history", "Show the last messages per topic kept by 'sub --history-listen'", runHistory},
+		{"metrics", "Compare two runs' --metrics-file snapshots", runMetrics},
+		{"survey", "Rank brokers by connect, TLS, subscribe, and ping latency", runSurvey},
+		{"certinfo", "Print and check the certificate chain a TLS broker presents", runCertInfo},
+		{"share-demo", "Show how a broker spreads messages across a shared subscription group", runShareDemo},
+		{"proxy", "Log every packet between MQTT clients and a broker", runProxy},
+		{"relay", "Experimental relay for MQTT tunnelled over HTTP(S)", runRelay},
+		{"config", "Import connection profiles from MQTTX or MQTT Explorer, or export them", runConfig},
+		{"selftest", "Check this build end to end against an embedded broker", runSelfTest},
+		{"version", "Print version information", runVersion},
+		{"help", "Show help for a command", runHelp},
+	}
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands() {
+		if c.name == name {
+			return &c
+		}
+	}
+	return nil
+}
+
+// printCommands writes the command overview shown by "help" and by --help
+// without a command.
+func printCommands(w io.Writer) {
+	prog := filepath.Base(os.Args[0])
+	fmt.Fprintf(w, "Usage: %s <command> [options]\n       %s [options]            (same as '%s sub')\n\nCommands:\n", prog, prog, prog)
+	for _, c := range commands() {
+		fmt.Fprintf(w, "  %-13s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(w, "\nConnection, TLS, and --config options are shared by all commands that connect.\n"+
+		"Run '%s help <command>' for the options of a command.\n", prog)
+}
+
+func runHelp(args []string) {
+	if len(args) == 0 {
+		printCommands(os.Stdout)
+		return
+	}
+	c := findCommand(args[0])
+	if c == nil || c.name == "help" || c.name == "version" {
+		printCommands(os.Stderr)
+		os.Exit(2)
+	}
+	c.run([]string{"-help"})
+}
+
+func runVersion(args []string) {
+	v := version
+	if info, ok := debug.ReadBuildInfo(); ok && v == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		v = info.Main.Version
+	}
+	fmt.Printf("%s %s (%s, %s/%s)\n", filepath.Base(os.Args[0]), v, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	if embeddedRoots > 0 {
+		fmt.Printf("Embedded CA bundle: %d certificates, used when the system has none\n", embeddedRoots)
+	}
+}
+
+// dispatch runs the command named by args[0]. Without a command name, args are
+// treated as options to "sub", so existing invocations keep working.
+func dispatch(args []string) {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		c := findCommand(args[0])
+		if c == nil {
+			fmt.Fprintf(os.Stderr, "Unknown command '%s'.\n\n", args[0])
+			printCommands(os.Stderr)
+			os.Exit(2)
+		}
+		c.run(args[1:])
+		return
+	}
+	runSubscribe(args)
+}
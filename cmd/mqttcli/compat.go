@@ -0,0 +1,64 @@
+// compat.go
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// mosquittoFlags are the mosquitto_sub/mosquitto_pub style short flags, so
+// existing scripts can switch to mqttcli without rewriting their arguments.
+type mosquittoFlags struct {
+	Host string
+	Port int
+}
+
+// initMosquittoFlags registers the mosquitto-compatible short flags on fs. Flags
+// with a native equivalent share its destination, so either spelling works.
+func initMosquittoFlags(fs *flag.FlagSet, f *cliFlags) {
+	fs.StringVar(&f.Mosquitto.Host, "h", "", "Broker host (mosquitto compatible; combined with -p into --broker).")
+	fs.IntVar(&f.Mosquitto.Port, "p", 0, "Broker port (mosquitto compatible; default 1883, or 8883 with TLS files).")
+	fs.StringVar(&f.Protocol, "V", "", "Same as --protocol: mqttv31, mqttv311, or mqttv5 (mosquitto compatible).")
+	fs.Var(&f.Topics, "t", "Same as --topic (mosquitto compatible).")
+	fs.IntVar(&f.QoS, "q", -1, "Same as --qos (mosquitto compatible).")
+	fs.StringVar(&f.ClientID, "i", "", "Same as --clientid (mosquitto compatible).")
+	fs.StringVar(&f.Username, "u", "", "Same as --username (mosquitto compatible).")
+	fs.StringVar(&f.Password, secretFlag("P"), "", "Same as --password (mosquitto compatible).")
+}
+
+// brokerURL builds a broker URL from -h and -p, or returns "" if neither was given.
+// TLS is implied when any CA or client certificate file is set, as with mosquitto.
+func (m mosquittoFlags) brokerURL(tls bool) string {
+	if m.Host == "" && m.Port == 0 {
+		return ""
+	}
+	host, port, scheme := m.Host, m.Port, "tcp"
+	if host == "" {
+		host = "localhost"
+	}
+	if tls {
+		scheme = "ssl"
+	}
+	if port == 0 {
+		port = 1883
+		if tls {
+			port = 8883
+		}
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, host, port)
+}
+
+// parseProtocolVersion maps a --protocol or mosquitto -V value to the protocol
+// version number (3 for MQTT 3.1, 4 for MQTT 3.1.1, 5 for MQTT v5).
+func parseProtocolVersion(s string) (uint, error) {
+	switch strings.TrimPrefix(strings.ToLower(s), "mqttv") {
+	case "31", "3", "3.1":
+		return 3, nil
+	case "311", "4", "3.1.1":
+		return 4, nil
+	case "5", "5.0":
+		return 5, nil
+	}
+	return 0, fmt.Errorf("unknown protocol version '%s', expected 3, 4, 5 (or mqttv31, mqttv311, mqttv5)", s)
+}
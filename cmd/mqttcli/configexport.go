@@ -0,0 +1,260 @@
+// configexport.go
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportedBroker is a broker URL split the way GUI clients store it.
+type exportedBroker struct {
+	scheme, host, path string
+	port               int
+	tls, ws            bool
+}
+
+func splitBrokerURL(cfg *Config) (exportedBroker, error) {
+	host, port, err := brokerAddress(cfg.BrokerURL)
+	if err != nil {
+		return exportedBroker{}, err
+	}
+	u, _ := url.Parse(cfg.BrokerURL)
+	b := exportedBroker{scheme: u.Scheme, host: host, path: u.Path}
+	b.port, _ = strconv.Atoi(port)
+	switch u.Scheme {
+	case "tcp", "mqtt":
+	case "ssl", "tls", "mqtts", "tcps":
+		b.tls = true
+	case "ws":
+		b.ws = true
+	case "wss":
+		b.tls, b.ws = true, true
+	default:
+		return exportedBroker{}, fmt.Errorf("broker scheme '%s' has no equivalent; use tcp://, ssl://, ws://, or wss://", u.Scheme)
+	}
+	if cfg.WSPath != "" {
+		b.path = cfg.WSPath
+	}
+	return b, nil
+}
+
+// exportWarnings lists the settings of cfg no GUI client can carry.
+func exportWarnings(cfg *Config) []string {
+	var warnings []string
+	for _, s := range []struct {
+		set  bool
+		name string
+	}{
+		{cfg.PKCS12File != "", "pkcs12_file"},
+		{cfg.PKCS11Module != "", "pkcs11_module"},
+		{cfg.KeyPassword != "", "key_password"},
+		{cfg.ChainFile != "", "chain_file"},
+		{len(cfg.WSHeaders) > 0, "ws_headers"},
+		{cfg.TopicsFile != "", "topics_file"},
+	} {
+		if s.set {
+			warnings = append(warnings, s.name+" not carried over")
+		}
+	}
+	return warnings
+}
+
+// sortedSubscriptions returns the subscriptions of cfg ordered by filter.
+func sortedSubscriptions(cfg *Config) []mqttxSubscription {
+	subs := cfg.subscriptions()
+	var out []mqttxSubscription
+	for _, topic := range sortedKeys(subs) {
+		out = append(out, mqttxSubscription{Topic: topic, QoS: subs[topic]})
+	}
+	return out
+}
+
+// toMQTTX converts cfg into an MQTTX connection named name, with certificate
+// files by absolute path and inline PEM as text.
+func toMQTTX(name string, cfg *Config) (mqttxConnection, []string, error) {
+	b, err := splitBrokerURL(cfg)
+	if err != nil {
+		return mqttxConnection{}, nil, err
+	}
+	warnings := exportWarnings(cfg)
+	protocol := map[[2]bool]string{{false, false}: "mqtt", {true, false}: "mqtts", {false, true}: "ws", {true, true}: "wss"}[[2]bool{b.tls, b.ws}]
+	keepAlive, clean, verify := mqttcliKeepAlive, cfg.SessionExpiry <= 0, !cfg.Insecure
+	c := mqttxConnection{
+		ID: newConnectionID(), Name: name, ClientID: cfg.ClientID,
+		Host: b.host, Port: b.port, Protocol: protocol, SSL: b.tls,
+		MQTTVersion: map[uint]string{3: "3.1", 5: "5.0"}[cfg.Protocol],
+		Username:    cfg.Username, Password: cfg.Password,
+		KeepAlive: &keepAlive, Clean: &clean, RejectUnauthorized: &verify,
+		ConnectTimeout: int(defaultConnectTimeout / time.Second), Reconnect: true,
+		Subscriptions: sortedSubscriptions(cfg),
+	}
+	if c.MQTTVersion == "" {
+		c.MQTTVersion = "3.1.1"
+	}
+	if b.ws {
+		c.Path = b.path
+	}
+	if !clean {
+		if cfg.Protocol == 5 {
+			c.Properties.SessionExpiryInterval = int(time.Duration(cfg.SessionExpiry) / time.Second)
+		} else {
+			warnings = append(warnings, "session_expiry not carried over; it needs protocol_version 5")
+			clean = true
+		}
+	}
+	for _, m := range []struct {
+		dst       *string
+		pem, file string
+	}{
+		{&c.CA, cfg.CAPEM, cfg.CAFile},
+		{&c.Cert, cfg.CertPEM, cfg.CertFile},
+		{&c.Key, cfg.KeyPEM, cfg.KeyFile},
+	} {
+		switch {
+		case m.pem != "":
+			*m.dst = m.pem
+		case m.file != "":
+			if *m.dst, err = filepath.Abs(m.file); err != nil {
+				return mqttxConnection{}, nil, err
+			}
+		}
+		if *m.dst != "" {
+			c.CertType = "self"
+		}
+	}
+	return c, warnings, nil
+}
+
+// toMQTTExplorer converts cfg into an MQTT Explorer connection named name,
+// copying the certificate and key files into it as MQTT Explorer does.
+func toMQTTExplorer(name string, cfg *Config) (mqttExplorerConnection, []string, error) {
+	b, err := splitBrokerURL(cfg)
+	if err != nil {
+		return mqttExplorerConnection{}, nil, err
+	}
+	warnings := exportWarnings(cfg)
+	if cfg.Protocol == 5 {
+		warnings = append(warnings, "protocol_version 5 not carried over; MQTT Explorer chooses the version itself")
+	}
+	if cfg.SessionExpiry > 0 {
+		warnings = append(warnings, "session_expiry not carried over; MQTT Explorer always starts a clean session")
+	}
+	verify := !cfg.Insecure
+	c := mqttExplorerConnection{
+		ID: newConnectionID(), Type: "mqtt", Name: name, ClientID: cfg.ClientID,
+		Host: b.host, Port: b.port, Protocol: "mqtt", Encryption: b.tls, CertValidation: &verify,
+		Username: cfg.Username, Password: cfg.Password,
+	}
+	if b.ws {
+		c.Protocol, c.BasePath = "ws", strings.TrimPrefix(b.path, "/")
+	}
+	for _, s := range sortedSubscriptions(cfg) {
+		c.Subscriptions = append(c.Subscriptions, mqttExplorerSubscription(s))
+	}
+	for _, m := range []struct {
+		dst             **mqttExplorerFile
+		pem, file, name string
+	}{
+		{&c.SelfSignedCertificate, cfg.CAPEM, cfg.CAFile, "ca.pem"},
+		{&c.ClientCertificate, cfg.CertPEM, cfg.CertFile, "client.pem"},
+		{&c.ClientKey, cfg.KeyPEM, cfg.KeyFile, "client.key"},
+	} {
+		data := []byte(m.pem)
+		if m.pem == "" && m.file != "" {
+			if data, err = ioutil.ReadFile(m.file); err != nil {
+				return mqttExplorerConnection{}, nil, err
+			}
+			m.name = filepath.Base(m.file)
+		}
+		if len(data) > 0 {
+			*m.dst = &mqttExplorerFile{Name: m.name, Data: base64.StdEncoding.EncodeToString(data)}
+		}
+	}
+	return c, warnings, nil
+}
+
+// newConnectionID returns a random UUID, as both GUI clients identify
+// connections by.
+func newConnectionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// runConfigExport converts mqttcli JSON config files into one connections
+// file for a GUI client, one connection per config, named after the file.
+func runConfigExport(args []string) {
+	fs := flag.NewFlagSet("config export", flag.ExitOnError)
+	to := fs.String("to", "mqttx", "Format to write: mqttx, or mqtt-explorer for the connections of its settings.json.")
+	outFile := fs.String("out", "", "File to write the connections to (default stdout).")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s config export --to mqttx|mqtt-explorer [options] CONFIG...\n\nOptions:\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *to != "mqttx" && *to != "mqtt-explorer" {
+		fatal("config_invalid", false, "Unsupported export format '%s'. Supported: mqttx, mqtt-explorer.", *to)
+	}
+
+	var mqttx []mqttxConnection
+	explorer := map[string]mqttExplorerConnection{}
+	for _, path := range fs.Args() {
+		cfg, err := loadConfig(path)
+		if err != nil {
+			fatal("export_failed", false, "could not load config file '%s': %v", path, err)
+		}
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		var warnings []string
+		if *to == "mqttx" {
+			var c mqttxConnection
+			c, warnings, err = toMQTTX(name, cfg)
+			mqttx = append(mqttx, c)
+		} else {
+			var c mqttExplorerConnection
+			c, warnings, err = toMQTTExplorer(name, cfg)
+			explorer[c.ID] = c
+		}
+		if err != nil {
+			fatal("export_failed", false, "%s: %v", path, err)
+		}
+		for _, w := range warnings {
+			logWarn("export_incomplete", "%s: %s", name, w)
+		}
+	}
+
+	var doc interface{} = mqttx
+	if *to == "mqtt-explorer" {
+		doc = map[string]interface{}{mqttExplorerSettingsKey: explorer}
+	}
+	out, err := json.MarshalIndent(doc, "", "    ")
+	if err != nil {
+		fatal("export_failed", false, "%v", err)
+	}
+	out = append(out, '\n')
+	if *outFile == "" {
+		os.Stdout.Write(out)
+		return
+	}
+	// the connections carry passwords and keys
+	if err := ioutil.WriteFile(*outFile, out, 0o600); err != nil {
+		fatal("export_failed", false, "could not write %s: %v", *outFile, err)
+	}
+	logInfo("exported", "Exported %d connection(s) to %s", fs.NArg(), *outFile)
+}
@@ -0,0 +1,394 @@
+// configimport.go
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// mqttxConnection is the subset of an MQTTX exported connection that maps onto
+// a Config; config export writes the same fields.
+type mqttxConnection struct {
+	ID                 string `json:"id,omitempty"`
+	Name               string `json:"name"`
+	ClientID           string `json:"clientId"`
+	Host               string `json:"host"`
+	Port               int    `json:"port"`
+	Protocol           string `json:"protocol"` // mqtt, mqtts, ws, wss
+	Path               string `json:"path"`
+	MQTTVersion        string `json:"mqttVersion"`
+	Username           string `json:"username"`
+	Password           string `json:"password"`
+	SSL                bool   `json:"ssl"`
+	CertType           string `json:"certType,omitempty"` // "self" with CA or client certificate files
+	RejectUnauthorized *bool  `json:"rejectUnauthorized"`
+	CA                 string `json:"ca"`
+	Cert               string `json:"cert"`
+	Key                string `json:"key"`
+	KeepAlive          *int   `json:"keepalive"` // seconds
+	Clean              *bool  `json:"clean"`
+	ConnectTimeout     int    `json:"connectTimeout,omitempty"` // seconds
+	Reconnect          bool   `json:"reconnect,omitempty"`
+	Properties         struct {
+		SessionExpiryInterval int `json:"sessionExpiryInterval,omitempty"` // seconds, MQTT 5.0
+	} `json:"properties"`
+	Will struct {
+		LastWillTopic string `json:"lastWillTopic"`
+	} `json:"will"`
+	Subscriptions []mqttxSubscription `json:"subscriptions"`
+}
+
+type mqttxSubscription struct {
+	Topic string `json:"topic"`
+	QoS   byte   `json:"qos"`
+}
+
+// mqttcliKeepAlive is the keepalive interval mqttcli always uses, in seconds.
+const mqttcliKeepAlive = 30
+
+// parseMQTTXExport accepts either a bare array of connections or an object
+// with a "connections" array, as written by different MQTTX versions.
+func parseMQTTXExport(data []byte) ([]mqttxConnection, error) {
+	var conns []mqttxConnection
+	if err := json.Unmarshal(data, &conns); err == nil {
+		return conns, nil
+	}
+	var wrapped struct {
+		Connections []mqttxConnection `json:"connections"`
+	}
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return nil, fmt.Errorf("not an MQTTX connections export: %v", err)
+	}
+	return wrapped.Connections, nil
+}
+
+// toConfig converts an MQTTX connection into mqttcli JSON config fields, keyed
+// by their JSON names so unset fields are left out of the written file. Any
+// settings that cannot be carried over are returned as warnings.
+func (c mqttxConnection) toConfig() (map[string]interface{}, []string) {
+	var warnings []string
+	out := map[string]interface{}{}
+
+	scheme := map[string]string{"mqtt": "tcp", "mqtts": "ssl", "ws": "ws", "wss": "wss"}[c.Protocol]
+	if scheme == "" {
+		scheme = "tcp"
+		if c.SSL {
+			scheme = "ssl"
+		}
+	}
+	url := fmt.Sprintf("%s://%s:%d", scheme, c.Host, c.Port)
+	if scheme == "ws" || scheme == "wss" {
+		url += c.Path
+	}
+	out["broker_url"] = url
+	setIf(out, "client_id", c.ClientID)
+	setIf(out, "username", c.Username)
+	setIf(out, "password", c.Password)
+
+	v5 := false
+	switch c.MQTTVersion {
+	case "3.1":
+		out["protocol_version"] = 3
+	case "5.0", "5":
+		out["protocol_version"] = 5
+		v5 = true
+	}
+
+	if c.KeepAlive != nil && *c.KeepAlive != mqttcliKeepAlive {
+		warnings = append(warnings, fmt.Sprintf("keepalive of %ds not carried over; mqttcli always uses %ds", *c.KeepAlive, mqttcliKeepAlive))
+	}
+	if c.Clean != nil && !*c.Clean {
+		switch {
+		case v5 && c.Properties.SessionExpiryInterval > 0:
+			out["session_expiry"] = fmt.Sprintf("%ds", c.Properties.SessionExpiryInterval)
+		case v5:
+			warnings = append(warnings, "persistent session not carried over: it has no session expiry interval; set session_expiry")
+		default:
+			warnings = append(warnings, "persistent session (clean session off) not carried over; mqttcli keeps sessions with MQTT 5.0 and session_expiry only")
+		}
+	}
+	if c.Will.LastWillTopic != "" {
+		warnings = append(warnings, fmt.Sprintf("last will on '%s' not carried over; mqttcli doesn't send a will message", c.Will.LastWillTopic))
+	}
+
+	tls := scheme == "ssl" || scheme == "wss"
+	if tls && c.RejectUnauthorized != nil && !*c.RejectUnauthorized {
+		out["insecure"] = true
+	}
+	// MQTTX stores either a file path or the PEM text itself
+	for _, m := range []struct{ value, file, pem string }{
+		{c.CA, "ca_file", "ca_pem"},
+		{c.Cert, "cert_file", "cert_pem"},
+		{c.Key, "key_file", "key_pem"},
+	} {
+		if strings.HasPrefix(strings.TrimSpace(m.value), "-----BEGIN") {
+			out[m.pem] = m.value
+		} else {
+			setIf(out, m.file, m.value)
+		}
+	}
+
+	if len(c.Subscriptions) > 0 {
+		out["topic"] = c.Subscriptions[0].Topic
+		out["qos"] = c.Subscriptions[0].QoS
+		var more []TopicSubscription
+		for _, sub := range c.Subscriptions[1:] {
+			qos := sub.QoS
+			more = append(more, TopicSubscription{Topic: sub.Topic, QoS: &qos})
+		}
+		if len(more) > 0 {
+			out["topics"] = more
+		}
+	}
+	return out, warnings
+}
+
+// mqttExplorerConnection is the subset of an MQTT Explorer connection, as kept
+// in its settings.json, that maps onto a Config.
+type mqttExplorerConnection struct {
+	ID                    string                     `json:"id"`
+	Type                  string                     `json:"type"` // always "mqtt"
+	Name                  string                     `json:"name"`
+	Host                  string                     `json:"host"`
+	Port                  int                        `json:"port"`
+	Protocol              string                     `json:"protocol"`           // mqtt or ws
+	BasePath              string                     `json:"basePath,omitempty"` // WebSocket path
+	Username              string                     `json:"username,omitempty"`
+	Password              string                     `json:"password,omitempty"`
+	Encryption            bool                       `json:"encryption"`
+	CertValidation        *bool                      `json:"certValidation"`
+	SelfSignedCertificate *mqttExplorerFile          `json:"selfSignedCertificate,omitempty"` // CA
+	ClientCertificate     *mqttExplorerFile          `json:"clientCertificate,omitempty"`
+	ClientKey             *mqttExplorerFile          `json:"clientKey,omitempty"`
+	ClientID              string                     `json:"clientId,omitempty"`
+	Subscriptions         []mqttExplorerSubscription `json:"subscriptions"`
+}
+
+// mqttExplorerFile is a certificate or key file MQTT Explorer keeps a copy of.
+type mqttExplorerFile struct {
+	Name string `json:"name"`
+	Data string `json:"data"` // base64 of the file
+}
+
+type mqttExplorerSubscription struct {
+	Topic string `json:"topic"`
+	QoS   byte   `json:"qos"`
+}
+
+// UnmarshalJSON also accepts the bare topic strings older MQTT Explorer
+// versions stored, subscribed with QoS 0.
+func (s *mqttExplorerSubscription) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &s.Topic); err == nil {
+		return nil
+	}
+	type plain mqttExplorerSubscription
+	return json.Unmarshal(data, (*plain)(s))
+}
+
+// mqttExplorerSettingsKey holds the connections in MQTT Explorer's settings.json.
+const mqttExplorerSettingsKey = "ConnectionManager_connections"
+
+// parseMQTTExplorerExport accepts MQTT Explorer's settings.json, the object of
+// connections by ID in it, or an array of connections.
+func parseMQTTExplorerExport(data []byte) ([]mqttExplorerConnection, error) {
+	var conns []mqttExplorerConnection
+	if err := json.Unmarshal(data, &conns); err == nil {
+		return conns, nil
+	}
+	var settings map[string]json.RawMessage
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("not an MQTT Explorer settings file: %v", err)
+	}
+	if raw, ok := settings[mqttExplorerSettingsKey]; ok {
+		data = raw
+	}
+	var byID map[string]mqttExplorerConnection
+	if err := json.Unmarshal(data, &byID); err != nil {
+		return nil, fmt.Errorf("not an MQTT Explorer settings file: %v", err)
+	}
+	ids := make([]string, 0, len(byID))
+	for id := range byID {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		conns = append(conns, byID[id])
+	}
+	return conns, nil
+}
+
+// toConfig converts an MQTT Explorer connection into mqttcli JSON config
+// fields, as mqttxConnection.toConfig does.
+func (c mqttExplorerConnection) toConfig() (map[string]interface{}, []string) {
+	var warnings []string
+	out := map[string]interface{}{}
+
+	scheme := "tcp"
+	switch {
+	case c.Protocol == "ws" && c.Encryption:
+		scheme = "wss"
+	case c.Protocol == "ws":
+		scheme = "ws"
+	case c.Encryption:
+		scheme = "ssl"
+	}
+	url := fmt.Sprintf("%s://%s:%d", scheme, c.Host, c.Port)
+	if c.Protocol == "ws" && c.BasePath != "" {
+		url += "/" + strings.TrimPrefix(c.BasePath, "/")
+	}
+	out["broker_url"] = url
+	setIf(out, "client_id", c.ClientID)
+	setIf(out, "username", c.Username)
+	setIf(out, "password", c.Password)
+
+	if c.Encryption && c.CertValidation != nil && !*c.CertValidation {
+		out["insecure"] = true
+	}
+	// MQTT Explorer keeps its own copy of each file, so they become inline PEM
+	for _, m := range []struct {
+		file *mqttExplorerFile
+		key  string
+	}{
+		{c.SelfSignedCertificate, "ca_pem"},
+		{c.ClientCertificate, "cert_pem"},
+		{c.ClientKey, "key_pem"},
+	} {
+		if m.file == nil || m.file.Data == "" {
+			continue
+		}
+		pem, err := base64.StdEncoding.DecodeString(m.file.Data)
+		if err != nil || !strings.Contains(string(pem), "-----BEGIN") {
+			warnings = append(warnings, fmt.Sprintf("%s '%s' not carried over: it isn't PEM", m.key, m.file.Name))
+			continue
+		}
+		out[m.key] = string(pem)
+	}
+
+	if len(c.Subscriptions) > 0 {
+		out["topic"] = c.Subscriptions[0].Topic
+		out["qos"] = c.Subscriptions[0].QoS
+		var more []TopicSubscription
+		for _, sub := range c.Subscriptions[1:] {
+			qos := sub.QoS
+			more = append(more, TopicSubscription{Topic: sub.Topic, QoS: &qos})
+		}
+		if len(more) > 0 {
+			out["topics"] = more
+		}
+	}
+	return out, warnings
+}
+
+func setIf(m map[string]interface{}, key, value string) {
+	if value != "" {
+		m[key] = value
+	}
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// runConfig implements "mqttcli config", whose actions are import and export.
+func runConfig(args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "import":
+			runConfigImport(args[1:])
+			return
+		case "export":
+			runConfigExport(args[1:])
+			return
+		}
+	}
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s config import --from mqttx|mqtt-explorer [options] FILE\n"+
+		"       %s config export --to mqttx|mqtt-explorer [options] CONFIG...\n", name, name)
+	os.Exit(2)
+}
+
+// importedConnection is one connection of an export file, converted.
+type importedConnection struct {
+	name     string
+	config   map[string]interface{}
+	warnings []string
+}
+
+// runConfigImport converts connections exported from a GUI client into
+// mqttcli JSON config files, one per connection.
+func runConfigImport(args []string) {
+	fs := flag.NewFlagSet("config import", flag.ExitOnError)
+	from := fs.String("from", "mqttx", "Format of the export file: mqttx, or mqtt-explorer for its settings.json.")
+	outDir := fs.String("out-dir", ".", "Directory to write one <name>.json config per connection.")
+	force := fs.Bool("force", false, "Overwrite existing config files.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s config import --from mqttx|mqtt-explorer [options] FILE\n\nOptions:\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *from != "mqttx" && *from != "mqtt-explorer" {
+		fatal("config_invalid", false, "Unsupported import format '%s'. Supported: mqttx, mqtt-explorer.", *from)
+	}
+	data, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		fatal("import_failed", false, "could not read export file: %v", err)
+	}
+	var conns []importedConnection
+	if *from == "mqttx" {
+		list, err := parseMQTTXExport(data)
+		if err != nil {
+			fatal("import_failed", false, "%v", err)
+		}
+		for _, c := range list {
+			cfg, warnings := c.toConfig()
+			conns = append(conns, importedConnection{c.Name, cfg, warnings})
+		}
+	} else {
+		list, err := parseMQTTExplorerExport(data)
+		if err != nil {
+			fatal("import_failed", false, "%v", err)
+		}
+		for _, c := range list {
+			cfg, warnings := c.toConfig()
+			conns = append(conns, importedConnection{c.Name, cfg, warnings})
+		}
+	}
+	if len(conns) == 0 {
+		fatal("import_failed", false, "no connections found in '%s'", fs.Arg(0))
+	}
+
+	for i, c := range conns {
+		name := unsafeFileChars.ReplaceAllString(c.name, "_")
+		if name == "" {
+			name = fmt.Sprintf("connection-%d", i+1)
+		}
+		path := filepath.Join(*outDir, name+".json")
+		if _, err := os.Stat(path); err == nil && !*force {
+			logWarn("import_skipped", "%s exists, skipping (use --force to overwrite)", path)
+			continue
+		}
+
+		for _, w := range c.warnings {
+			logWarn("import_incomplete", "%s: %s", c.name, w)
+		}
+		out, err := json.MarshalIndent(c.config, "", "    ")
+		if err != nil {
+			fatal("import_failed", false, "%v", err)
+		}
+		if err := ioutil.WriteFile(path, append(out, '\n'), 0o600); err != nil {
+			fatal("import_failed", false, "could not write %s: %v", path, err)
+		}
+		logInfo("imported", "Imported '%s' to %s", c.name, path)
+	}
+}
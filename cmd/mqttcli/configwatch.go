@@ -0,0 +1,46 @@
+// configwatch.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"time"
+)
+
+// configPollInterval is how often a watched config file is checked for changes.
+// Kubernetes updates mounted ConfigMaps by swapping a symlink, which polling the
+// resolved contents handles without inotify.
+const configPollInterval = 5 * time.Second
+
+// watchConfigFile returns a context that is cancelled when the contents of path
+// change to a config that loads successfully. Unreadable or invalid revisions
+// are reported and ignored, so a bad ConfigMap edit keeps the current config.
+func watchConfigFile(ctx context.Context, path string) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	current, _ := ioutil.ReadFile(path)
+	go func() {
+		defer cancel()
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil || bytes.Equal(data, current) {
+				continue
+			}
+			if _, err := loadConfig(path); err != nil {
+				logWarn("config_reload_failed", "Ignoring changed config file '%s': %v", path, err)
+				current = data
+				continue
+			}
+			logInfo("config_reloading", "Config file '%s' changed, reconnecting", path)
+			return
+		}
+	}()
+	return ctx
+}
@@ -0,0 +1,79 @@
+// count.go
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// messageCounter implements --count and --timeout: it counts handled messages
+// and reports when enough have arrived.
+type messageCounter struct {
+	limit int // zero counts without a limit
+	n     atomic.Int64
+	done  chan struct{}
+}
+
+func newMessageCounter(limit int) *messageCounter {
+	return &messageCounter{limit: limit, done: make(chan struct{})}
+}
+
+// wrap counts messages passed to next and drops any after the limit, which can
+// still arrive while the client disconnects.
+func (c *messageCounter) wrap(next mqtt.MessageHandler) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		n := c.n.Add(1)
+		if c.limit > 0 && n > int64(c.limit) {
+			// Past the limit; with at_least_once, leave it to the next run
+			withholdAcks(client, nil)
+			return
+		}
+		next(client, msg)
+		if n == int64(c.wanted()) {
+			close(c.done)
+		}
+	}
+}
+
+// wanted is how many messages satisfy --timeout: the --count limit, or one.
+func (c *messageCounter) wanted() int {
+	if c.limit > 0 {
+		return c.limit
+	}
+	return 1
+}
+
+func (c *messageCounter) received() int {
+	if n := int(c.n.Load()); c.limit == 0 || n < c.limit {
+		return n
+	}
+	return c.limit
+}
+
+// wait blocks until ctx is done, the limit is reached, or timeout (if set)
+// passes. It returns false only on a timeout before enough messages arrived.
+// Without a limit, reaching the timeout with at least one message is a
+// success; without either, wait returns when ctx is done.
+func (c *messageCounter) wait(ctx context.Context, timeout time.Duration) bool {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	limitReached := c.done
+	if c.limit == 0 {
+		limitReached = nil
+	}
+	select {
+	case <-ctx.Done():
+	case <-limitReached:
+		logInfo("count_reached", "Received %d message(s)", c.limit)
+	case <-expired:
+		return c.received() >= c.wanted()
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+//go:build linux
+
+// dbus_linux.go
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Every message is emitted as the Message signal from this object, e.g.
+// dbus-monitor "type='signal',interface='io.github.miketigerblue.mqttcli'"
+const (
+	dbusObjectPath = dbus.ObjectPath("/io/github/miketigerblue/mqttcli")
+	dbusInterface  = "io.github.miketigerblue.mqttcli"
+	dbusSignal     = dbusInterface + ".Message"
+)
+
+// dbusSink emits a D-Bus signal per message with the arguments topic (s),
+// payload (ay), qos (y), retained (b), timestamp (s), and topic pattern
+// fields (a{ss}).
+type dbusSink struct {
+	conn *dbus.Conn
+	bus  string
+
+	mu      sync.Mutex
+	failing bool // logged that emitting fails
+}
+
+// newDBusSink connects to the "session" or "system" bus.
+func newDBusSink(bus string) (Sink, error) {
+	var conn *dbus.Conn
+	var err error
+	switch bus {
+	case "session":
+		conn, err = dbus.ConnectSessionBus()
+	case "system":
+		conn, err = dbus.ConnectSystemBus()
+	default:
+		return nil, fmt.Errorf("unknown D-Bus bus '%s'; use 'session' or 'system'", bus)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to the D-Bus %s bus: %v", bus, err)
+	}
+	logInfo("dbus_ready", "Emitting %s signals on the D-Bus %s bus", dbusSignal, bus)
+	return &dbusSink{conn: conn, bus: bus}, nil
+}
+
+func (s *dbusSink) Write(rec messageRecord) error {
+	payload := []byte(rec.Payload)
+	if rec.PayloadEncoding == "base64" {
+		payload, _ = base64.StdEncoding.DecodeString(rec.Payload)
+	}
+	fields := rec.Fields
+	if fields == nil {
+		fields = map[string]string{}
+	}
+	err := s.conn.Emit(dbusObjectPath, dbusSignal, rec.Topic, payload, rec.QoS, rec.Retained, rec.Timestamp, fields)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case err != nil && !s.failing:
+		logWarn("dbus_failed", "Could not emit D-Bus signal on the %s bus: %v", s.bus, err)
+	case err == nil && s.failing:
+		logInfo("dbus_recovered", "Emitting D-Bus signals again")
+	}
+	s.failing = err != nil
+	return err
+}
+
+func (s *dbusSink) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+// dbus_other.go
+package main
+
+import "errors"
+
+func newDBusSink(bus string) (Sink, error) {
+	return nil, errors.New("--dbus-signal is only supported on Linux")
+}
@@ -0,0 +1,288 @@
+// decoders.go
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// DecoderRule applies a decoder chain to payloads on topics matching Topic.
+type DecoderRule struct {
+	Topic string `json:"topic"` // MQTT filter, e.g. "iot/gnss/+/data"
+	Chain string `json:"chain"` // comma-separated decoders, e.g. "gzip,protobuf:Telemetry"
+}
+
+// parseDecoderRule parses a rule written as "FILTER=CHAIN".
+func parseDecoderRule(s string) (DecoderRule, error) {
+	topic, chain, ok := strings.Cut(s, "=")
+	if !ok || topic == "" || chain == "" {
+		return DecoderRule{}, fmt.Errorf("invalid decoder rule '%s', expected 'FILTER=DECODER[,DECODER...]'", s)
+	}
+	return DecoderRule{Topic: topic, Chain: chain}, nil
+}
+
+// decodeFunc transforms a payload into its decoded form.
+type decodeFunc func([]byte) ([]byte, error)
+
+// decoderChain steps also get the topic, which the sniffer logs by.
+type decoderChain struct {
+	filter string
+	chain  string
+	steps  []func(topic string, b []byte) ([]byte, error)
+}
+
+// payloadDecoder picks the first rule whose filter matches a message's topic
+// and runs its chain over the payload.
+type payloadDecoder struct {
+	chains []decoderChain
+}
+
+// newPayloadDecoder builds decoder chains for rules, resolving protobuf message
+// types from the FileDescriptorSet at descriptorPath. It returns nil if there
+// are no rules.
+func newPayloadDecoder(rules []DecoderRule, descriptorPath string) (*payloadDecoder, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	var files *protoregistry.Files
+	if descriptorPath != "" {
+		var err error
+		if files, err = loadDescriptorSet(descriptorPath); err != nil {
+			return nil, err
+		}
+	}
+
+	d := &payloadDecoder{}
+	for _, r := range rules {
+		c := decoderChain{filter: r.Topic, chain: r.Chain}
+		for _, name := range strings.Split(r.Chain, ",") {
+			name = strings.TrimSpace(name)
+			if name == "sniff" || strings.HasPrefix(name, "sniff:") {
+				sn, err := newPayloadSniffer(name)
+				if err != nil {
+					return nil, fmt.Errorf("decoder chain for '%s': %v", r.Topic, err)
+				}
+				c.steps = append(c.steps, sn.decode)
+				continue
+			}
+			step, err := newDecodeStep(name, files)
+			if err != nil {
+				return nil, fmt.Errorf("decoder chain for '%s': %v", r.Topic, err)
+			}
+			c.steps = append(c.steps, func(_ string, b []byte) ([]byte, error) { return step(b) })
+		}
+		d.chains = append(d.chains, c)
+	}
+	return d, nil
+}
+
+// newDecodeStep returns the decoder for one "name[:arg]" chain element.
+func newDecodeStep(spec string, files *protoregistry.Files) (decodeFunc, error) {
+	name, arg, _ := strings.Cut(spec, ":")
+	switch name {
+	case "gzip":
+		return func(b []byte) ([]byte, error) { return decompress(gzip.NewReader(bytes.NewReader(b))) }, nil
+	case "zlib":
+		return func(b []byte) ([]byte, error) { return decompress(zlib.NewReader(bytes.NewReader(b))) }, nil
+	case "base64":
+		return func(b []byte) ([]byte, error) {
+			return base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+		}, nil
+	case "hex":
+		return func(b []byte) ([]byte, error) { return hex.DecodeString(strings.TrimSpace(string(b))) }, nil
+	case "cbor":
+		return decodeCBOR, nil
+	case "nmea":
+		return decodeNMEA, nil
+	case "protobuf":
+		if arg == "" {
+			return decodeRawProtobuf, nil
+		}
+		if files == nil {
+			return nil, fmt.Errorf("protobuf:%s needs a descriptor set (--proto-descriptors)", arg)
+		}
+		desc, err := files.FindDescriptorByName(protoreflect.FullName(arg))
+		if err != nil {
+			return nil, fmt.Errorf("protobuf message type '%s': %v", arg, err)
+		}
+		md, ok := desc.(protoreflect.MessageDescriptor)
+		if !ok {
+			return nil, fmt.Errorf("'%s' is not a protobuf message type", arg)
+		}
+		return func(b []byte) ([]byte, error) {
+			msg := dynamicpb.NewMessage(md)
+			if err := proto.Unmarshal(b, msg); err != nil {
+				return nil, err
+			}
+			return protojson.Marshal(msg)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown decoder '%s'", spec)
+}
+
+// decompressedMax caps what one gzip or zlib payload unpacks to, so a few
+// kilobytes of compression bomb can't exhaust memory.
+const decompressedMax = 16 << 20
+
+func decompress(r io.ReadCloser, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(r, decompressedMax+1))
+	if err == nil && len(b) > decompressedMax {
+		return nil, fmt.Errorf("decompresses to more than %d MiB", decompressedMax>>20)
+	}
+	return b, err
+}
+
+// loadDescriptorSet reads a FileDescriptorSet, as written by
+// "protoc --include_imports --descriptor_set_out=FILE".
+func loadDescriptorSet(path string) (*protoregistry.Files, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid descriptor set '%s': %v", path, err)
+	}
+	return protodesc.NewFiles(&set)
+}
+
+// decodeRawProtobuf renders protobuf wire data without a schema as JSON keyed
+// by field number. Length-delimited fields are shown as nested messages when
+// they parse as such, else as strings when valid UTF-8, else as base64.
+func decodeRawProtobuf(b []byte) ([]byte, error) {
+	fields, err := parseProtoFields(b)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+func parseProtoFields(b []byte) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var v interface{}
+		switch typ {
+		case protowire.VarintType:
+			x, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			v, b = x, b[n:]
+		case protowire.Fixed32Type:
+			x, n := protowire.ConsumeFixed32(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			v, b = x, b[n:]
+		case protowire.Fixed64Type:
+			x, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			v, b = x, b[n:]
+		case protowire.BytesType:
+			x, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+			if nested, err := parseProtoFields(x); err == nil && len(x) > 0 {
+				v = nested
+			} else if utf8.Valid(x) {
+				v = string(x)
+			} else {
+				v = base64.StdEncoding.EncodeToString(x)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported protobuf wire type %d", typ)
+		}
+
+		// Repeated fields collect into an array
+		key := fmt.Sprint(num)
+		switch prev := fields[key].(type) {
+		case nil:
+			fields[key] = v
+		case []interface{}:
+			fields[key] = append(prev, v)
+		default:
+			fields[key] = []interface{}{prev, v}
+		}
+	}
+	return fields, nil
+}
+
+// Decode runs the matching chain over payload. It returns the payload unchanged
+// if no rule matches.
+func (d *payloadDecoder) Decode(topic string, payload []byte) ([]byte, error) {
+	if d == nil {
+		return payload, nil
+	}
+	for _, c := range d.chains {
+		if !topicMatches(c.filter, topic) {
+			continue
+		}
+		out := payload
+		for _, step := range c.steps {
+			var err error
+			if out, err = step(topic, out); err != nil {
+				return payload, fmt.Errorf("%s: %v", c.chain, err)
+			}
+		}
+		return out, nil
+	}
+	return payload, nil
+}
+
+// decodedMessage is a received message with its payload replaced by the decoded form.
+type decodedMessage struct {
+	mqtt.Message
+	payload []byte
+}
+
+func (m *decodedMessage) Payload() []byte { return m.payload }
+
+// wrap returns a handler that decodes payloads before passing messages to h.
+// Payloads that fail to decode are passed through as received, with a warning.
+func (d *payloadDecoder) wrap(h mqtt.MessageHandler) mqtt.MessageHandler {
+	if d == nil {
+		return h
+	}
+	return func(client mqtt.Client, msg mqtt.Message) {
+		payload, err := d.Decode(msg.Topic(), msg.Payload())
+		if err != nil {
+			logWarn("decode_failed", "Could not decode payload on '%s': %v", msg.Topic(), err)
+			h(client, msg)
+			return
+		}
+		h(client, &decodedMessage{Message: msg, payload: payload})
+	}
+}
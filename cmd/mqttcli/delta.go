@@ -0,0 +1,560 @@
+// delta.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// deltaSuffix names the topic next to a retained document that "pub
+	// --delta" publishes its delta to, so the document itself stays whole for
+	// subscribers that don't reconstruct.
+	deltaSuffix = "/_delta"
+
+	deltaFormatJSON   = "json-patch" // RFC 6902, for JSON objects and arrays
+	deltaFormatBinary = "binary"     // copies from the base and inserted bytes
+
+	deltaBlock       = 16       // bytes matched at once when diffing binary documents
+	deltaMaxBuffered = 64 << 20 // bytes of bases and pending deltas sub --reconstruct keeps
+)
+
+// deltaManifest says what a delta patches and what it should produce.
+type deltaManifest struct {
+	Format     string `json:"format"`
+	BaseSHA256 string `json:"base_sha256"` // of the retained document, hex
+	SHA256     string `json:"sha256"`      // of the patched document, hex; compact with sorted keys for JSON
+}
+
+// deltaEnvelope is the payload "pub --delta" publishes to TOPIC/_delta.
+type deltaEnvelope struct {
+	Delta deltaManifest `json:"mqttcli_delta"`
+	Patch []jsonPatchOp `json:"patch,omitempty"` // json-patch
+	Ops   []binaryOp    `json:"ops,omitempty"`   // binary
+}
+
+// jsonPatchOp is one RFC 6902 operation; only add, remove, and replace are
+// generated or applied.
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// binaryOp either copies Copy[1] bytes from offset Copy[0] of the base, or
+// inserts Insert.
+type binaryOp struct {
+	Copy   []int  `json:"copy,omitempty"`
+	Insert []byte `json:"insert,omitempty"` // base64 in JSON
+}
+
+// deltaPrefix starts every delta envelope.
+var deltaPrefix = []byte(`{"mqttcli_delta":`)
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// parseJSONDocument decodes b if it's a single JSON object or array, keeping
+// numbers' exact digits.
+func parseJSONDocument(b []byte) (interface{}, bool) {
+	trimmed := bytes.TrimSpace(b)
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return nil, false
+	}
+	dec := json.NewDecoder(bytes.NewReader(trimmed))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, false
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, false
+	}
+	return v, true
+}
+
+// canonicalJSON encodes v compactly with sorted keys and without HTML
+// escaping, so both ends of a delta hash the same bytes.
+func canonicalJSON(v interface{}) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil // only decoded JSON is encoded, which always re-encodes
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+}
+
+// makeDelta returns the delta that turns base into doc: a JSON patch when
+// both are JSON documents, else a binary delta.
+func makeDelta(base, doc []byte) *deltaEnvelope {
+	e := &deltaEnvelope{Delta: deltaManifest{BaseSHA256: sha256Hex(base)}}
+	if from, ok := parseJSONDocument(base); ok {
+		if to, ok := parseJSONDocument(doc); ok {
+			e.Delta.Format = deltaFormatJSON
+			e.Delta.SHA256 = sha256Hex(canonicalJSON(to))
+			e.Patch = diffJSON("", from, to, nil)
+			return e
+		}
+	}
+	e.Delta.Format = deltaFormatBinary
+	e.Delta.SHA256 = sha256Hex(doc)
+	e.Ops = diffBytes(base, doc)
+	return e
+}
+
+// applyDelta returns the document e produces from base. JSON documents come
+// out compact with sorted keys.
+func applyDelta(base []byte, e *deltaEnvelope) ([]byte, error) {
+	if sha256Hex(base) != e.Delta.BaseSHA256 {
+		return nil, errors.New("the delta patches another document")
+	}
+	var doc []byte
+	switch e.Delta.Format {
+	case deltaFormatJSON:
+		v, ok := parseJSONDocument(base)
+		if !ok {
+			return nil, errors.New("the document a json-patch delta patches isn't JSON")
+		}
+		for _, op := range e.Patch {
+			var err error
+			if v, err = applyJSONPatchOp(v, op); err != nil {
+				return nil, err
+			}
+		}
+		doc = canonicalJSON(v)
+	case deltaFormatBinary:
+		var err error
+		if doc, err = applyBinary(base, e.Ops); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown delta format '%s'", e.Delta.Format)
+	}
+	if sha256Hex(doc) != e.Delta.SHA256 {
+		return nil, errors.New("the patched document doesn't match its checksum")
+	}
+	return doc, nil
+}
+
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+var jsonPointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+
+// diffJSON appends the operations that turn a into b at path to ops. Objects
+// are compared key by key and arrays element by element; anything else that
+// changed is replaced.
+func diffJSON(path string, a, b interface{}, ops []jsonPatchOp) []jsonPatchOp {
+	switch from := a.(type) {
+	case map[string]interface{}:
+		to, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		for _, k := range jsonKeys(from) {
+			if v, ok := to[k]; ok {
+				ops = diffJSON(path+"/"+jsonPointerEscaper.Replace(k), from[k], v, ops)
+			} else {
+				ops = append(ops, jsonPatchOp{Op: "remove", Path: path + "/" + jsonPointerEscaper.Replace(k)})
+			}
+		}
+		for _, k := range jsonKeys(to) {
+			if _, ok := from[k]; !ok {
+				ops = append(ops, jsonPatchOp{Op: "add", Path: path + "/" + jsonPointerEscaper.Replace(k), Value: canonicalJSON(to[k])})
+			}
+		}
+		return ops
+	case []interface{}:
+		to, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		common := min(len(from), len(to))
+		for i := 0; i < common; i++ {
+			ops = diffJSON(path+"/"+strconv.Itoa(i), from[i], to[i], ops)
+		}
+		for i := common; i < len(to); i++ {
+			ops = append(ops, jsonPatchOp{Op: "add", Path: path + "/" + strconv.Itoa(i), Value: canonicalJSON(to[i])})
+		}
+		// From the end, so the indexes still hold
+		for i := len(from) - 1; i >= common; i-- {
+			ops = append(ops, jsonPatchOp{Op: "remove", Path: path + "/" + strconv.Itoa(i)})
+		}
+		return ops
+	}
+	if !reflect.DeepEqual(a, b) {
+		ops = append(ops, jsonPatchOp{Op: "replace", Path: path, Value: canonicalJSON(b)})
+	}
+	return ops
+}
+
+// jsonKeys returns the keys of a JSON object, sorted.
+func jsonKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// applyJSONPatchOp applies op to doc and returns the result.
+func applyJSONPatchOp(doc interface{}, op jsonPatchOp) (interface{}, error) {
+	switch op.Op {
+	case "add", "remove", "replace":
+	default:
+		return nil, fmt.Errorf("unsupported patch operation '%s'", op.Op)
+	}
+	var value interface{}
+	if op.Op != "remove" {
+		dec := json.NewDecoder(bytes.NewReader(op.Value))
+		dec.UseNumber()
+		if err := dec.Decode(&value); err != nil {
+			return nil, fmt.Errorf("%s '%s' has no valid value: %v", op.Op, op.Path, err)
+		}
+	}
+	if op.Path == "" {
+		if op.Op == "remove" {
+			return nil, errors.New("can't remove the whole document")
+		}
+		return value, nil
+	}
+	if !strings.HasPrefix(op.Path, "/") {
+		return nil, fmt.Errorf("invalid path '%s'", op.Path)
+	}
+	tokens := strings.Split(op.Path[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = jsonPointerUnescaper.Replace(t)
+	}
+	return patchAt(doc, tokens, op, value)
+}
+
+// patchAt applies op at tokens below node and returns the updated node.
+func patchAt(node interface{}, tokens []string, op jsonPatchOp, value interface{}) (interface{}, error) {
+	tok, last := tokens[0], len(tokens) == 1
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[tok]
+		if !last {
+			if !ok {
+				return nil, fmt.Errorf("path '%s' doesn't exist", op.Path)
+			}
+			v, err := patchAt(child, tokens[1:], op, value)
+			n[tok] = v
+			return n, err
+		}
+		if !ok && op.Op != "add" {
+			return nil, fmt.Errorf("path '%s' doesn't exist", op.Path)
+		}
+		if op.Op == "remove" {
+			delete(n, tok)
+		} else {
+			n[tok] = value
+		}
+		return n, nil
+	case []interface{}:
+		if last && op.Op == "add" && tok == "-" {
+			return append(n, value), nil
+		}
+		i, err := strconv.Atoi(tok)
+		if err != nil || i < 0 || i > len(n) || (i == len(n) && !(last && op.Op == "add")) || strings.TrimLeft(tok, "0123456789") != "" {
+			return nil, fmt.Errorf("path '%s' doesn't exist", op.Path)
+		}
+		if !last {
+			v, err := patchAt(n[i], tokens[1:], op, value)
+			n[i] = v
+			return n, err
+		}
+		switch op.Op {
+		case "add":
+			n = append(n, nil)
+			copy(n[i+1:], n[i:])
+			n[i] = value
+		case "remove":
+			n = append(n[:i], n[i+1:]...)
+		default:
+			n[i] = value
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("path '%s' doesn't exist", op.Path)
+}
+
+// diffBytes returns the operations that build doc from base: runs of at
+// least deltaBlock bytes found in base are copied, the rest inserted.
+func diffBytes(base, doc []byte) []binaryOp {
+	index := make(map[string]int)
+	for off := 0; off+deltaBlock <= len(base); off += deltaBlock {
+		if _, ok := index[string(base[off:off+deltaBlock])]; !ok {
+			index[string(base[off:off+deltaBlock])] = off
+		}
+	}
+	var ops []binaryOp
+	literal := 0 // start of the bytes not yet copied or inserted
+	for i := 0; i+deltaBlock <= len(doc); {
+		off, ok := index[string(doc[i:i+deltaBlock])]
+		if !ok {
+			i++
+			continue
+		}
+		// Grow the match both ways; blocks are only indexed at multiples of
+		// deltaBlock, so it usually starts before the block found
+		start, from := i, off
+		for start > literal && from > 0 && doc[start-1] == base[from-1] {
+			start--
+			from--
+		}
+		end, to := i+deltaBlock, off+deltaBlock
+		for end < len(doc) && to < len(base) && doc[end] == base[to] {
+			end++
+			to++
+		}
+		if start > literal {
+			ops = append(ops, binaryOp{Insert: doc[literal:start]})
+		}
+		ops = append(ops, binaryOp{Copy: []int{from, end - start}})
+		literal, i = end, end
+	}
+	if literal < len(doc) {
+		ops = append(ops, binaryOp{Insert: doc[literal:]})
+	}
+	return ops
+}
+
+// applyBinary builds a document from base and ops.
+func applyBinary(base []byte, ops []binaryOp) ([]byte, error) {
+	var doc []byte
+	for i, op := range ops {
+		switch {
+		case op.Copy != nil:
+			if len(op.Copy) != 2 || op.Copy[0] < 0 || op.Copy[1] <= 0 || op.Copy[0] > len(base) || op.Copy[1] > len(base)-op.Copy[0] {
+				return nil, fmt.Errorf("operation %d copies outside the %d-byte document", i, len(base))
+			}
+			doc = append(doc, base[op.Copy[0]:op.Copy[0]+op.Copy[1]]...)
+		case len(op.Insert) > 0:
+			doc = append(doc, op.Insert...)
+		default:
+			return nil, fmt.Errorf("operation %d neither copies nor inserts", i)
+		}
+		if len(doc) > deltaMaxBuffered {
+			return nil, fmt.Errorf("the patched document is over %d bytes", deltaMaxBuffered)
+		}
+	}
+	return doc, nil
+}
+
+// retainedPublish is one retained message pub --delta sends.
+type retainedPublish struct {
+	topic   string
+	payload []byte
+}
+
+// deltaPublishes returns what pub --delta sends to make doc the document on
+// topic, given base, the one retained there now. That's a delta on
+// TOPIC/_delta against base. When there is no base, or the delta wouldn't save
+// at least half of doc, it's doc itself on topic, followed by clearing the
+// delta of the document it replaces.
+func deltaPublishes(topic string, base, doc []byte) ([]retainedPublish, *deltaEnvelope) {
+	full := []retainedPublish{{topic, doc}, {topic + deltaSuffix, nil}}
+	if len(base) == 0 || bytes.HasPrefix(base, deltaPrefix) {
+		return full, nil
+	}
+	if bytes.Equal(base, doc) {
+		return full[1:], nil
+	}
+	e := makeDelta(base, doc)
+	b, err := json.Marshal(e)
+	if err != nil || len(b) >= len(doc)/2 {
+		return full, nil
+	}
+	return []retainedPublish{{topic + deltaSuffix, b}}, e
+}
+
+// fetchRetained returns the payload retained on topic, or nil if the broker
+// sends none within retainedSettle of subscribing.
+func fetchRetained(ctx context.Context, client mqtt.Client, cfg *Config, topic string) ([]byte, error) {
+	got := make(chan []byte, 1)
+	token := client.Subscribe(topic, cfg.QoS, func(_ mqtt.Client, msg mqtt.Message) {
+		if msg.Retained() {
+			select {
+			case got <- msg.Payload():
+			default:
+			}
+		}
+	})
+	if err := waitToken(ctx, token, time.Duration(cfg.SubscribeTimeout), "subscribe"); err != nil {
+		return nil, err
+	}
+	var payload []byte
+	select {
+	case payload = <-got:
+	case <-time.After(retainedSettle):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return payload, waitToken(ctx, client.Unsubscribe(topic), time.Duration(cfg.SubscribeTimeout), "unsubscribe")
+}
+
+// reconstructedMessage is a document rebuilt from a delta, delivered on the
+// document's topic.
+type reconstructedMessage struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (m *reconstructedMessage) Topic() string   { return m.topic }
+func (m *reconstructedMessage) Payload() []byte { return m.payload }
+
+// pendingDelta is the latest delta received for a document.
+type pendingDelta struct {
+	envelope *deltaEnvelope
+	size     int
+}
+
+// deltaReconstructor implements sub --reconstruct: it keeps the documents
+// retained on the topics it sees and hands on each delta "pub --delta"
+// publishes as the document it patches, on that document's topic. A delta
+// whose document hasn't arrived yet is held until it does.
+type deltaReconstructor struct {
+	mu       sync.Mutex
+	bases    map[string][]byte
+	pending  map[string]pendingDelta // by the document's topic
+	buffered int
+	warned   bool
+}
+
+func newDeltaReconstructor(cfg *Config) *deltaReconstructor {
+	if !cfg.Reconstruct {
+		return nil
+	}
+	return &deltaReconstructor{bases: map[string][]byte{}, pending: map[string]pendingDelta{}}
+}
+
+func (r *deltaReconstructor) wrap(next mqtt.MessageHandler) mqtt.MessageHandler {
+	if r == nil {
+		return next
+	}
+	return func(client mqtt.Client, msg mqtt.Message) {
+		topic, payload := msg.Topic(), msg.Payload()
+		if base, ok := strings.CutSuffix(topic, deltaSuffix); ok && (len(payload) == 0 || bytes.HasPrefix(payload, deltaPrefix)) {
+			doc, err := r.delta(base, payload)
+			if err != nil {
+				logWarn("delta_invalid", "Dropped a delta for '%s': %v", base, err)
+				return
+			}
+			if doc != nil {
+				next(client, &reconstructedMessage{Message: msg, topic: base, payload: doc})
+			}
+			return
+		}
+		doc, err := r.base(topic, payload)
+		if err != nil {
+			logWarn("delta_invalid", "Dropped the delta for '%s': %v", topic, err)
+		}
+		if doc != nil {
+			next(client, &reconstructedMessage{Message: msg, topic: topic, payload: doc})
+			return
+		}
+		next(client, msg)
+	}
+}
+
+// delta stores the delta envelope received for the document on topic, and
+// returns the patched document if that document is known. An empty payload
+// clears the delta, as pub --delta does after republishing the document.
+func (r *deltaReconstructor) delta(topic string, payload []byte) ([]byte, error) {
+	var e *deltaEnvelope
+	if len(payload) > 0 {
+		e = new(deltaEnvelope)
+		if err := json.Unmarshal(payload, e); err != nil {
+			return nil, err
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buffered -= r.pending[topic].size
+	delete(r.pending, topic)
+	if e == nil {
+		return nil, nil
+	}
+	if base, ok := r.bases[topic]; ok && sha256Hex(base) == e.Delta.BaseSHA256 {
+		doc, err := applyDelta(base, e)
+		if err != nil {
+			return nil, err
+		}
+		r.hold(topic, e, len(payload))
+		return doc, nil
+	}
+	r.hold(topic, e, len(payload))
+	return nil, nil
+}
+
+// base stores the document received on topic, and returns it patched if the
+// delta held for it applies to it.
+func (r *deltaReconstructor) base(topic string, payload []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.buffered -= len(r.bases[topic])
+	delete(r.bases, topic)
+	if len(payload) == 0 {
+		return nil, nil // the document was deleted
+	}
+	if r.buffered+len(payload) > deltaMaxBuffered {
+		r.warnFull()
+		return nil, nil
+	}
+	r.bases[topic] = append([]byte(nil), payload...)
+	r.buffered += len(payload)
+	p, ok := r.pending[topic]
+	if !ok || sha256Hex(payload) != p.envelope.Delta.BaseSHA256 {
+		return nil, nil
+	}
+	return applyDelta(payload, p.envelope)
+}
+
+// hold keeps e as the delta for topic; r.mu must be held.
+func (r *deltaReconstructor) hold(topic string, e *deltaEnvelope, size int) {
+	if r.buffered+size > deltaMaxBuffered {
+		r.warnFull()
+		return
+	}
+	r.pending[topic] = pendingDelta{e, size}
+	r.buffered += size
+}
+
+// warnFull logs, once, that documents are dropped for lack of room; r.mu must
+// be held.
+func (r *deltaReconstructor) warnFull() {
+	if !r.warned {
+		r.warned = true
+		logWarn("delta_buffer_full", "Keeping over %d bytes of documents and deltas; deltas for further documents can't be applied", deltaMaxBuffered)
+	}
+}
+
+// deltaFilters returns, for each filter in subs, the one matching the delta
+// topics of the documents it matches, unless it matches them already.
+func deltaFilters(subs map[string]byte) map[string]byte {
+	filters := make(map[string]byte)
+	for _, filter := range sortedKeys(subs) {
+		if !strings.HasSuffix(filter, "#") && !strings.HasSuffix(filter, deltaSuffix) {
+			filters[filter+deltaSuffix] = subs[filter]
+		}
+	}
+	return filters
+}
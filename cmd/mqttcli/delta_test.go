@@ -0,0 +1,220 @@
+// delta_test.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestDeltaRoundTrip(t *testing.T) {
+	large := randomPayload(t, 4096)
+	edited := append(append(append([]byte(nil), large[:1000]...), "inserted"...), large[1100:]...)
+	for _, tc := range []struct {
+		name, base, doc string
+		format          string
+		want            string // the reconstructed document, if not doc
+	}{
+		{"changed field", `{"a": 1, "b": {"c": "x"}}`, `{"a": 1, "b": {"c": "y"}}`, deltaFormatJSON, `{"a":1,"b":{"c":"y"}}`},
+		{"added and removed keys", `{"a":1,"b":2}`, `{"b":2,"c":[1]}`, deltaFormatJSON, ""},
+		{"keys needing escapes", `{"a/b":1,"c~d":2}`, `{"a/b":3,"c~d":{"e":null}}`, deltaFormatJSON, ""},
+		{"array grows", `{"l":[1,2]}`, `{"l":[1,2,3,4]}`, deltaFormatJSON, ""},
+		{"array shrinks", `{"l":[1,2,3,4]}`, `{"l":[9]}`, deltaFormatJSON, ""},
+		{"object becomes array", `{"a":{}}`, `[1,{"a":"<b>"}]`, deltaFormatJSON, ""},
+		{"exact numbers", `{"n":1.50}`, `{"n":12345678901234567890}`, deltaFormatJSON, ""},
+		{"text", "hello, world", "hello, delta world", deltaFormatBinary, ""},
+		{"binary edit", string(large), string(edited), deltaFormatBinary, ""},
+		{"JSON to text", `{"a":1}`, "plain", deltaFormatBinary, ""},
+		{"to empty", "something", "", deltaFormatBinary, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := makeDelta([]byte(tc.base), []byte(tc.doc))
+			if e.Delta.Format != tc.format {
+				t.Errorf("got format %s, want %s", e.Delta.Format, tc.format)
+			}
+			// Through JSON, as sent
+			b, err := json.Marshal(e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var received deltaEnvelope
+			if err := json.Unmarshal(b, &received); err != nil {
+				t.Fatal(err)
+			}
+			got, err := applyDelta([]byte(tc.base), &received)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []byte(tc.doc)
+			if tc.want != "" {
+				want = []byte(tc.want)
+			} else if v, ok := parseJSONDocument(want); ok {
+				want = canonicalJSON(v)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestDiffBytesCopies(t *testing.T) {
+	base := randomPayload(t, 64<<10)
+	doc := append(append([]byte("header"), base[:30000]...), base[30010:]...)
+	b, err := json.Marshal(makeDelta(base, doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) > 300 {
+		t.Errorf("a delta of a 6-byte insert and a 10-byte cut is %d bytes", len(b))
+	}
+}
+
+func TestApplyDeltaRejects(t *testing.T) {
+	base := []byte(`{"a":[1,2],"b":{"c":1}}`)
+	sum := sha256Hex(base)
+	json := func(ops ...jsonPatchOp) *deltaEnvelope {
+		return &deltaEnvelope{Delta: deltaManifest{Format: deltaFormatJSON, BaseSHA256: sum}, Patch: ops}
+	}
+	binary := func(ops ...binaryOp) *deltaEnvelope {
+		return &deltaEnvelope{Delta: deltaManifest{Format: deltaFormatBinary, BaseSHA256: sum}, Ops: ops}
+	}
+	for _, tc := range []struct {
+		name     string
+		envelope *deltaEnvelope
+		want     string
+	}{
+		{"another base", &deltaEnvelope{Delta: deltaManifest{Format: deltaFormatJSON, BaseSHA256: "00"}}, "another document"},
+		{"unknown format", &deltaEnvelope{Delta: deltaManifest{Format: "bsdiff", BaseSHA256: sum}}, "unknown delta format"},
+		{"checksum", json(jsonPatchOp{Op: "replace", Path: "/a/0", Value: []byte("3")}), "checksum"},
+		{"unsupported operation", json(jsonPatchOp{Op: "move", Path: "/a"}), "unsupported patch operation"},
+		{"missing key", json(jsonPatchOp{Op: "remove", Path: "/x"}), "doesn't exist"},
+		{"missing parent", json(jsonPatchOp{Op: "add", Path: "/x/y", Value: []byte("1")}), "doesn't exist"},
+		{"index out of range", json(jsonPatchOp{Op: "replace", Path: "/a/2", Value: []byte("1")}), "doesn't exist"},
+		{"index with sign", json(jsonPatchOp{Op: "replace", Path: "/a/+1", Value: []byte("1")}), "doesn't exist"},
+		{"into a number", json(jsonPatchOp{Op: "add", Path: "/b/c/d", Value: []byte("1")}), "doesn't exist"},
+		{"relative path", json(jsonPatchOp{Op: "add", Path: "a", Value: []byte("1")}), "invalid path"},
+		{"no value", json(jsonPatchOp{Op: "add", Path: "/x"}), "no valid value"},
+		{"remove everything", json(jsonPatchOp{Op: "remove", Path: ""}), "whole document"},
+		{"copy past the end", binary(binaryOp{Copy: []int{10, len(base)}}), "outside"},
+		{"negative copy", binary(binaryOp{Copy: []int{-1, 2}}), "outside"},
+		{"bad copy", binary(binaryOp{Copy: []int{1}}), "outside"},
+		{"empty operation", binary(binaryOp{}), "neither copies nor inserts"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := applyDelta(base, tc.envelope); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestDeltaPublishes(t *testing.T) {
+	doc := []byte(`{"version":2,"settings":"` + strings.Repeat("x", 2000) + `"}`)
+	for _, tc := range []struct {
+		name   string
+		base   []byte
+		topics []string
+		delta  bool
+	}{
+		{"nothing retained", nil, []string{"cfg", "cfg/_delta"}, false},
+		{"a delta retained", []byte(`{"mqttcli_delta":{}}`), []string{"cfg", "cfg/_delta"}, false},
+		{"unchanged", doc, []string{"cfg/_delta"}, false},
+		{"small change", bytes.Replace(doc, []byte(`2`), []byte(`1`), 1), []string{"cfg/_delta"}, true},
+		{"rewritten", []byte(`{"other":true}`), []string{"cfg", "cfg/_delta"}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			publishes, delta := deltaPublishes("cfg", tc.base, doc)
+			var topics []string
+			for _, p := range publishes {
+				topics = append(topics, p.topic)
+			}
+			if !reflect.DeepEqual(topics, tc.topics) {
+				t.Errorf("got publishes to %v, want %v", topics, tc.topics)
+			}
+			if (delta != nil) != tc.delta {
+				t.Errorf("got delta %v, want one: %t", delta, tc.delta)
+			}
+			if tc.delta && !bytes.HasPrefix(publishes[0].payload, deltaPrefix) {
+				t.Errorf("got payload %s, want a delta envelope", publishes[0].payload)
+			}
+			if !tc.delta && len(publishes) == 2 && (!bytes.Equal(publishes[0].payload, doc) || publishes[1].payload != nil) {
+				t.Errorf("got %q, want the document and then the delta cleared", publishes)
+			}
+		})
+	}
+}
+
+func TestDeltaReconstructor(t *testing.T) {
+	v1 := []byte(`{"v":1,"pad":"` + strings.Repeat("x", 100) + `"}`)
+	v2 := []byte(`{"v":2,"pad":"` + strings.Repeat("x", 100) + `"}`)
+	v3 := []byte(`{"v":3,"pad":"` + strings.Repeat("x", 100) + `"}`)
+	delta := func(doc []byte) []byte {
+		b, err := json.Marshal(makeDelta(v1, doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	canonical := func(doc []byte) string {
+		v, _ := parseJSONDocument(doc)
+		return string(canonicalJSON(v))
+	}
+	type message struct{ topic, payload string }
+	for _, tc := range []struct {
+		name string
+		in   []message
+		want []message
+	}{
+		{
+			"document first",
+			[]message{{"cfg", string(v1)}, {"cfg/_delta", string(delta(v2))}, {"cfg/_delta", string(delta(v3))}},
+			[]message{{"cfg", string(v1)}, {"cfg", canonical(v2)}, {"cfg", canonical(v3)}},
+		},
+		{
+			"delta first",
+			[]message{{"cfg/_delta", string(delta(v2))}, {"cfg", string(v1)}},
+			[]message{{"cfg", canonical(v2)}},
+		},
+		{
+			"republished document",
+			[]message{{"cfg/_delta", string(delta(v2))}, {"cfg", string(v3)}, {"cfg/_delta", ""}},
+			[]message{{"cfg", string(v3)}},
+		},
+		{
+			"delta for another document",
+			[]message{{"other", string(v1)}, {"cfg/_delta", string(delta(v2))}},
+			[]message{{"other", string(v1)}},
+		},
+		{
+			"other payloads on a delta topic",
+			[]message{{"cfg/_delta", "not a delta"}},
+			[]message{{"cfg/_delta", "not a delta"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []message
+			handler := newDeltaReconstructor(&Config{Reconstruct: true}).wrap(func(_ mqtt.Client, msg mqtt.Message) {
+				got = append(got, message{msg.Topic(), string(msg.Payload())})
+			})
+			for _, m := range tc.in {
+				handler(nil, &recordedMessage{rec: messageRecord{Topic: m.topic}, payload: []byte(m.payload)})
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDeltaFilters(t *testing.T) {
+	cfg := &Config{Topic: "cfg/+", Topics: []TopicSubscription{{Topic: "all/#"}, {Topic: "one"}}, QoS: 1, Reconstruct: true}
+	want := map[string]byte{"cfg/+": 1, "cfg/+/_delta": 1, "all/#": 1, "one": 1, "one/_delta": 1}
+	if got := cfg.subscriptions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
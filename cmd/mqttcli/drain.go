@@ -0,0 +1,52 @@
+// drain.go
+package main
+
+import (
+	"sort"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// defaultDrainTimeout is how long shutdown waits for in-flight work by default.
+const defaultDrainTimeout = time.Second
+
+// drain tears the connection down on shutdown: with unsubscribe_on_exit it
+// first unsubscribes from every filter, so a persistent session stops queuing
+// messages, then it disconnects, letting in-flight QoS 1/2 publishes finish.
+// Both steps share the drain_timeout.
+func drain(client mqtt.Client, cfg *Config) {
+	deadline := time.Now().Add(time.Duration(cfg.DrainTimeout))
+	if cfg.UnsubscribeOnExit {
+		filters := subscribedFilters(client, cfg)
+		token := client.Unsubscribe(filters...)
+		if !token.WaitTimeout(time.Until(deadline)) {
+			logWarn("unsubscribe_timeout", "No UNSUBACK within %s; disconnecting anyway", time.Duration(cfg.DrainTimeout))
+		} else if err := token.Error(); err != nil {
+			logWarn("unsubscribe_failed", "Failed to unsubscribe from %d filter(s): %v", len(filters), err)
+		} else {
+			logInfo("unsubscribed", "Unsubscribed from %d filter(s)", len(filters))
+		}
+	}
+	quiesce := max(time.Until(deadline), 0)
+	client.Disconnect(uint(quiesce / time.Millisecond))
+}
+
+// subscribedFilters returns the filters client is subscribed to, as adapted
+// to the broker's limits, or else those in cfg.
+func subscribedFilters(client mqtt.Client, cfg *Config) []string {
+	var filters []string
+	if r, ok := client.(*reconnectingClient); ok {
+		r.mu.Lock()
+		for filter := range r.subs {
+			filters = append(filters, filter)
+		}
+		r.mu.Unlock()
+	} else {
+		for filter := range cfg.subscriptions() {
+			filters = append(filters, filter)
+		}
+	}
+	sort.Strings(filters)
+	return filters
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+// eventlog_other.go
+package main
+
+import "errors"
+
+func openEventLog(source string) (eventWriter, error) {
+	return nil, errors.New("--eventlog is only supported on Windows")
+}
@@ -0,0 +1,48 @@
+//go:build windows
+
+// eventlog_windows.go
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// Event IDs written to the Windows Event Log, one per event type.
+const (
+	eventIDLifecycle = 1
+	eventIDWarning   = 2
+	eventIDError     = 3
+)
+
+type windowsEventLog struct {
+	log *eventlog.Log
+}
+
+// openEventLog opens the Application log for source, registering the source
+// first if needed (which needs administrator rights once per machine).
+func openEventLog(source string) (eventWriter, error) {
+	l, err := eventlog.Open(source)
+	if err != nil {
+		return nil, fmt.Errorf("could not open the Windows Event Log for source '%s': %v", source, err)
+	}
+	// Open succeeds for unregistered sources, but their events show a
+	// "description cannot be found" note; registering is best effort.
+	if err := eventlog.InstallAsEventCreate(source, eventlog.Error|eventlog.Warning|eventlog.Info); err == nil {
+		logInfo("eventlog_registered", "Registered Windows Event Log source '%s'", source)
+	}
+	return &windowsEventLog{log: l}, nil
+}
+
+func (w *windowsEventLog) write(typ, code, msg string) {
+	text := fmt.Sprintf("%s: %s", code, msg)
+	switch typ {
+	case "error":
+		w.log.Error(eventIDError, text)
+	case "warning":
+		w.log.Warning(eventIDWarning, text)
+	default:
+		w.log.Info(eventIDLifecycle, text)
+	}
+}
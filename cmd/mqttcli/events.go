@@ -0,0 +1,133 @@
+// events.go
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Output formats selected with --output.
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// jsonEvents is set when --output json is active. Lifecycle events, warnings,
+// and errors are then written to stderr as one JSON record per line instead of
+// "[LEVEL] message" log lines, so supervisors can parse them.
+var (
+	jsonEvents bool
+	eventsMu   sync.Mutex
+)
+
+// eventRecord is the structured form of a lifecycle event or error.
+type eventRecord struct {
+	Time      string `json:"time"`
+	Type      string `json:"type"` // "lifecycle", "warning", or "error"
+	Code      string `json:"code"` // stable, machine-readable identifier, e.g. "connect_failed"
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"`
+}
+
+var eventLevels = map[string]string{"lifecycle": "INFO", "warning": "WARN", "error": "ERROR"}
+
+// eventWriter is an extra destination for events, such as the Windows Event Log.
+type eventWriter interface {
+	write(typ, code, msg string)
+}
+
+// eventLog is set by --eventlog.
+var eventLog eventWriter
+
+func emitEvent(typ, code string, retryable bool, msg string) {
+	switch typ {
+	case "warning":
+		warningEvents.Add(1)
+	case "error":
+		errorEvents.Add(1)
+	}
+	if eventLog != nil {
+		eventLog.write(typ, code, msg)
+	}
+	if !jsonEvents {
+		log.Printf("[%s] %s", eventLevels[typ], msg)
+		return
+	}
+	rec, _ := json.Marshal(eventRecord{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Type:      typ,
+		Code:      code,
+		Message:   msg,
+		Retryable: retryable,
+	})
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	fmt.Fprintf(os.Stderr, "%s\n", rec)
+}
+
+// logInfo reports a lifecycle event such as a connect or shutdown.
+func logInfo(code, format string, args ...interface{}) {
+	emitEvent("lifecycle", code, false, fmt.Sprintf(format, args...))
+}
+
+// logWarn reports a condition worth attention that does not stop the run.
+func logWarn(code, format string, args ...interface{}) {
+	emitEvent("warning", code, false, fmt.Sprintf(format, args...))
+}
+
+// logError reports a failure; retryable tells supervisors whether running again may succeed.
+func logError(code string, retryable bool, format string, args ...interface{}) {
+	emitEvent("error", code, retryable, fmt.Sprintf(format, args...))
+}
+
+// Process exit statuses.
+const (
+	exitFailure         = 1 // configuration errors, rejected connections, and other failures
+	exitBudgetExhausted = 3 // --connect-attempts or --total-timeout used up without connecting
+	exitNoMessages      = 4 // --timeout passed before --count messages (or any message) arrived
+)
+
+// fatal reports a failure and exits with status 1.
+func fatal(code string, retryable bool, format string, args ...interface{}) {
+	fatalStatus(exitFailure, code, retryable, format, args...)
+}
+
+// fatalStatus reports a failure and exits with the given status.
+func fatalStatus(status int, code string, retryable bool, format string, args ...interface{}) {
+	logError(code, retryable, format, args...)
+	activeMetrics.write()
+	closePKCS11()
+	os.Exit(status)
+}
+
+// isRetryable reports whether a connect or subscribe error is likely transient:
+// network failures and a broker that is temporarily unavailable, as opposed to
+// rejected credentials, untrusted certificates, or invalid configuration.
+func isRetryable(err error) bool {
+	var certErr *tls.CertificateVerificationError
+	if errors.As(err, &certErr) {
+		return false
+	}
+	if errors.Is(err, errTimeout) {
+		return true
+	}
+	var rcErr *reasonCodeError
+	if errors.As(err, &rcErr) {
+		return rcErr.retryable()
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, paho.ErrConnectionLost) {
+		return true
+	}
+	return errors.Is(err, packets.ErrorNetworkError) || errors.Is(err, packets.ErrorRefusedServerUnavailable)
+}
@@ -0,0 +1,190 @@
+// exec.go
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// execHook runs a command for every message, with the payload on stdin and the
+// message details in MQTT_* environment variables. At most limit commands run
+// at once; further messages wait for a free slot, which slows down message
+// handling rather than dropping messages.
+//
+// With a partition key, each of the limit workers runs its commands one after
+// another, and every message with the same key (its topic, or a topic-pattern
+// field) goes to the same worker. Commands for one key then run in arrival
+// order, while different keys still run in parallel.
+type execHook struct {
+	command   string
+	timeout   time.Duration
+	slots     chan struct{}
+	partition string         // "topic" or a topic-pattern field; empty runs commands in any order
+	queues    []chan execJob // one per worker, with a partition key
+	running   sync.WaitGroup
+	failed    atomic.Int64
+	wait      bool // run each command before returning from Write, for at_least_once
+}
+
+// execPartitionTopic partitions exec commands by topic.
+const execPartitionTopic = "topic"
+
+// validExecPartition checks that exec_partition is "topic" or a field of the
+// topic pattern.
+func validExecPartition(cfg *Config) error {
+	if cfg.ExecPartition == "" || cfg.ExecPartition == execPartitionTopic {
+		return nil
+	}
+	pattern, err := parseTopicPattern(cfg.TopicPattern)
+	if err != nil {
+		return err
+	}
+	for _, name := range pattern.Names() {
+		if name == cfg.ExecPartition {
+			return nil
+		}
+	}
+	return fmt.Errorf("exec_partition '%s' is neither 'topic' nor a field of topic_pattern '%s'", cfg.ExecPartition, cfg.TopicPattern)
+}
+
+// execPartitionQueue is how many messages may wait for each partitioned worker
+// before message handling slows down.
+const execPartitionQueue = 64
+
+type execJob struct {
+	rec     messageRecord
+	payload []byte
+}
+
+func newExecHook(command string, limit int, timeout time.Duration, partition string) *execHook {
+	h := &execHook{command: command, timeout: timeout, slots: make(chan struct{}, limit), partition: partition}
+	if partition == "" {
+		return h
+	}
+	for i := 0; i < limit; i++ {
+		q := make(chan execJob, execPartitionQueue)
+		h.queues = append(h.queues, q)
+		h.running.Add(1)
+		go func() {
+			defer h.running.Done()
+			for job := range q {
+				h.runLogged(job)
+			}
+		}()
+	}
+	return h
+}
+
+// worker returns the index of the worker for rec. Messages without the
+// partition field, such as topics outside the topic pattern, are partitioned by
+// topic. The FNV-1a hash keeps the assignment stable, as for --shard.
+func (h *execHook) worker(rec messageRecord) int {
+	key := rec.Topic
+	if v, ok := rec.Fields[h.partition]; ok && h.partition != execPartitionTopic {
+		key = v
+	}
+	f := fnv.New32a()
+	f.Write([]byte(key))
+	return int(f.Sum32() % uint32(len(h.queues)))
+}
+
+// execEnv returns the environment for the command run for rec.
+func execEnv(rec messageRecord) []string {
+	env := append(os.Environ(),
+		"MQTT_TOPIC="+rec.Topic,
+		"MQTT_QOS="+strconv.Itoa(int(rec.QoS)),
+		"MQTT_RETAINED="+strconv.FormatBool(rec.Retained),
+		"MQTT_TIMESTAMP="+rec.Timestamp,
+	)
+	names := make([]string, 0, len(rec.Fields))
+	for name := range rec.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, "MQTT_FIELD_"+strings.ToUpper(name)+"="+rec.Fields[name])
+	}
+	return env
+}
+
+func (h *execHook) Write(rec messageRecord) error {
+	payload := []byte(rec.Payload)
+	if rec.PayloadEncoding == "base64" {
+		payload, _ = base64.StdEncoding.DecodeString(rec.Payload)
+	}
+	job := execJob{rec: rec, payload: payload}
+	if h.wait {
+		return h.runLogged(job)
+	}
+	if h.queues != nil {
+		h.queues[h.worker(rec)] <- job
+		return nil
+	}
+	h.slots <- struct{}{}
+	h.running.Add(1)
+	go func() {
+		defer func() {
+			<-h.slots
+			h.running.Done()
+		}()
+		h.runLogged(job)
+	}()
+	return nil
+}
+
+func (h *execHook) runLogged(job execJob) error {
+	err := h.run(job.rec, job.payload)
+	if err != nil {
+		h.failed.Add(1)
+		logWarn("exec_failed", "'%s' failed for message on '%s': %v", h.command, job.rec.Topic, err)
+	}
+	return err
+}
+
+func (h *execHook) run(rec messageRecord, payload []byte) error {
+	cmd := shellCommand(h.command)
+	cmd.Env = execEnv(rec)
+	cmd.Stdin = bytes.NewReader(payload)
+	// Keep the command's output away from the messages on stdout
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.WaitDelay = time.Second
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if h.timeout > 0 {
+		var timedOut atomic.Bool
+		timer := time.AfterFunc(h.timeout, func() {
+			timedOut.Store(true)
+			cmd.Process.Kill()
+		})
+		defer timer.Stop()
+		err := cmd.Wait()
+		if timedOut.Load() {
+			return fmt.Errorf("killed after %s", h.timeout)
+		}
+		return err
+	}
+	return cmd.Wait()
+}
+
+// Close waits for running and queued commands to finish.
+func (h *execHook) Close() error {
+	for _, q := range h.queues {
+		close(q)
+	}
+	h.running.Wait()
+	if n := h.failed.Load(); n > 0 {
+		logWarn("exec_failures", "'%s' failed for %d message(s)", h.command, n)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+// explode.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// topicLevelReplacer makes JSON keys safe to use as a single topic level.
+var topicLevelReplacer = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// jsonLeaf is one scalar value of a JSON document and its path of topic levels.
+type jsonLeaf struct {
+	path  []string
+	value interface{}
+}
+
+// flattenJSON returns the scalar leaves of v in a stable order. Object keys and
+// array indexes each become one level of the path.
+func flattenJSON(v interface{}, path []string, leaves []jsonLeaf) []jsonLeaf {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(node))
+		for k := range node {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			level := topicLevelReplacer.Replace(k)
+			if level == "" {
+				level = "_"
+			}
+			leaves = flattenJSON(node[k], append(path[:len(path):len(path)], level), leaves)
+		}
+	case []interface{}:
+		for i, item := range node {
+			leaves = flattenJSON(item, append(path[:len(path):len(path)], strconv.Itoa(i)), leaves)
+		}
+	default:
+		leaves = append(leaves, jsonLeaf{path: path, value: v})
+	}
+	return leaves
+}
+
+// leafPayload formats a leaf for publishing: strings as-is, everything else as JSON.
+func leafPayload(v interface{}) []byte {
+	if s, ok := v.(string); ok {
+		return []byte(s)
+	}
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// exploder republishes each leaf of a JSON object or array payload to its own
+// sub-topic below the message's topic.
+type exploder struct {
+	qos    byte
+	retain bool
+	dryRun bool
+	out    io.Writer
+}
+
+func (e *exploder) handler(client mqtt.Client, msg mqtt.Message) {
+	var doc interface{}
+	if err := json.Unmarshal(msg.Payload(), &doc); err != nil {
+		return
+	}
+	// Scalars are skipped, which also ignores our own leaf messages when the
+	// subscription covers the sub-topics.
+	switch doc.(type) {
+	case map[string]interface{}, []interface{}:
+	default:
+		return
+	}
+
+	for _, leaf := range flattenJSON(doc, nil, nil) {
+		topic := msg.Topic() + "/" + strings.Join(leaf.path, "/")
+		payload := leafPayload(leaf.value)
+		if e.dryRun {
+			fmt.Fprintf(e.out, "%s %s\n", sanitizeForTerminal(topic), sanitizeForTerminal(string(payload)))
+			continue
+		}
+		token := client.Publish(topic, e.qos, e.retain, payload)
+		go func() {
+			if token.Wait() && token.Error() != nil {
+				logWarn("publish_failed", "Failed to publish to '%s': %v", topic, token.Error())
+			}
+		}()
+	}
+}
+
+func runExplode(args []string) {
+	fs := flag.NewFlagSet("explode", flag.ExitOnError)
+	flags := initCLIFlags(fs)
+	e := &exploder{out: os.Stdout}
+	fs.BoolVar(&e.retain, "retain", false, "Publish leaf values as retained messages.")
+	fs.BoolVar(&e.dryRun, "dry-run", false, "Print the leaf topics and values instead of publishing them.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s explode [options]\n\n"+
+			"Republishes each leaf of JSON object payloads to its own sub-topic, e.g.\n"+
+			"devices/x/state {\"battery\":87} -> devices/x/state/battery 87. Leaves use --qos.\n\nOptions:\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cfg := buildConfig(flags)
+	if !e.dryRun {
+		refuseReadOnly(&cfg, "explode without --dry-run")
+	}
+	e.qos = cfg.QoS
+	runSubscription(context.Background(), &cfg, e.handler)
+}
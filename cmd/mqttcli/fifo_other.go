@@ -0,0 +1,10 @@
+//go:build !unix
+
+// fifo_other.go
+package main
+
+import "errors"
+
+func newFIFOSink(path string, block bool) (Sink, error) {
+	return nil, errors.New("--out-fifo needs a Unix-like system with named pipes")
+}
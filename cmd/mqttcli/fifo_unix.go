@@ -0,0 +1,130 @@
+//go:build unix
+
+// fifo_unix.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Without --out-fifo-block, a write waits at most fifoWriteWait for room in the
+// pipe before the message is dropped, and opening is retried at most every
+// fifoReopenDelay while no reader is attached.
+const (
+	fifoWriteWait   = 100 * time.Millisecond
+	fifoReopenDelay = time.Second
+)
+
+// fifoSink writes messages as JSON lines to a named pipe. It never blocks on a
+// missing reader: messages are dropped (and counted) until one opens the pipe.
+type fifoSink struct {
+	path  string
+	block bool // wait for a slow reader instead of dropping messages
+
+	mu       sync.Mutex
+	f        *os.File
+	nextOpen time.Time
+	dropped  int
+	waiting  bool // logged that no reader is attached
+}
+
+// newFIFOSink creates the named pipe at path if it doesn't exist.
+func newFIFOSink(path string, block bool) (Sink, error) {
+	fi, err := os.Stat(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if err := syscall.Mkfifo(path, 0o600); err != nil {
+			return nil, fmt.Errorf("could not create FIFO %s: %v", path, err)
+		}
+	case err != nil:
+		return nil, err
+	case fi.Mode()&os.ModeNamedPipe == 0:
+		return nil, fmt.Errorf("%s exists and is not a named pipe", path)
+	}
+	logInfo("fifo_ready", "Writing messages to FIFO %s", path)
+	return &fifoSink{path: path, block: block}, nil
+}
+
+// open attaches to a reader if one has the pipe open; s.mu must be held.
+func (s *fifoSink) open() bool {
+	if s.f != nil {
+		return true
+	}
+	if time.Now().Before(s.nextOpen) {
+		return false
+	}
+	// O_NONBLOCK makes the open fail with ENXIO instead of waiting for a reader
+	f, err := os.OpenFile(s.path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		s.nextOpen = time.Now().Add(fifoReopenDelay)
+		if !s.waiting {
+			s.waiting = true
+			if errors.Is(err, syscall.ENXIO) {
+				logWarn("fifo_no_reader", "No reader on FIFO %s, dropping messages until one attaches", s.path)
+			} else {
+				logWarn("fifo_open_failed", "Could not open FIFO %s: %v", s.path, err)
+			}
+		}
+		return false
+	}
+	if s.waiting || s.dropped > 0 {
+		logInfo("fifo_reader", "Reader attached to FIFO %s (%d message(s) dropped)", s.path, s.dropped)
+	}
+	s.f, s.waiting, s.dropped = f, false, 0
+	return true
+}
+
+func (s *fifoSink) Write(rec messageRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.open() {
+		s.dropped++
+		return nil
+	}
+
+	if !s.block {
+		s.f.SetWriteDeadline(time.Now().Add(fifoWriteWait))
+	}
+	n, err := s.f.Write(line)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		if n == 0 {
+			s.dropped++
+			return nil
+		}
+		// Finish a partly written line so the reader never sees a torn record
+		s.f.SetWriteDeadline(time.Time{})
+		_, err = s.f.Write(line[n:])
+	}
+	if err != nil {
+		s.f.Close()
+		s.f = nil
+		s.dropped++
+		if !errors.Is(err, syscall.EPIPE) {
+			return err
+		}
+		// The reader went away; reopen for the next one
+		s.waiting = true
+		logWarn("fifo_no_reader", "Reader left FIFO %s, dropping messages until one attaches", s.path)
+	}
+	return nil
+}
+
+func (s *fifoSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f != nil {
+		return s.f.Close()
+	}
+	return nil
+}
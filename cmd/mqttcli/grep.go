@@ -0,0 +1,236 @@
+// grep.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"regexp/syntax"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// grepQueue is how many messages may wait for a worker or for earlier messages
+// to be printed before the subscription is slowed down.
+const grepQueue = 4096
+
+// payloadMatcher reports whether a payload matches a regular expression. Most
+// payloads on a busy broker don't match, so a cheap substring check on literals
+// every match must contain runs first and the regexp only on candidates.
+type payloadMatcher struct {
+	re       *regexp.Regexp
+	literals [][]byte // at least one occurs in every match; nil disables the prefilter
+}
+
+func newPayloadMatcher(pattern string, ignoreCase bool) (*payloadMatcher, error) {
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	m := &payloadMatcher{re: re}
+	if ast, err := syntax.Parse(pattern, syntax.Perl); err == nil {
+		for _, lit := range requiredLiterals(ast.Simplify()) {
+			m.literals = append(m.literals, []byte(lit))
+		}
+	}
+	return m, nil
+}
+
+func (m *payloadMatcher) match(payload []byte) bool {
+	if m.literals != nil {
+		found := false
+		for _, lit := range m.literals {
+			if bytes.Contains(payload, lit) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return m.re.Match(payload)
+}
+
+// requiredLiterals returns literals of which at least one appears in any text
+// re matches, or nil if there is no such set, e.g. for case-insensitive
+// literals or patterns that can match the empty string.
+func requiredLiterals(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 || len(re.Rune) == 0 {
+			return nil
+		}
+		return []string{string(re.Rune)}
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiterals(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min < 1 {
+			return nil
+		}
+		return requiredLiterals(re.Sub[0])
+	case syntax.OpConcat:
+		// every part must match, so the part with the longest shortest literal
+		// filters best
+		var best []string
+		bestLen := 0
+		for _, sub := range re.Sub {
+			lits := requiredLiterals(sub)
+			if lits == nil {
+				continue
+			}
+			if n := shortest(lits); n > bestLen {
+				best, bestLen = lits, n
+			}
+		}
+		return best
+	case syntax.OpAlternate:
+		var all []string
+		for _, sub := range re.Sub {
+			lits := requiredLiterals(sub)
+			if lits == nil {
+				return nil
+			}
+			all = append(all, lits...)
+		}
+		return all
+	}
+	return nil
+}
+
+func shortest(lits []string) int {
+	n := len(lits[0])
+	for _, l := range lits[1:] {
+		if len(l) < n {
+			n = len(l)
+		}
+	}
+	return n
+}
+
+// grepJob is one message waiting for, or done with, a worker.
+type grepJob struct {
+	msg     mqtt.Message
+	matched chan bool
+}
+
+// grepper matches payloads on several workers and prints matches in the order
+// the messages arrived.
+type grepper struct {
+	cfg     *Config
+	matcher *payloadMatcher
+	invert  bool
+	color   bool // --pretty colors
+	out     io.Writer
+
+	jobs    chan *grepJob // to the workers
+	order   chan *grepJob // to the printer, in arrival order
+	pending sync.WaitGroup
+	seen    atomic.Int64
+	matches atomic.Int64
+}
+
+func newGrepper(cfg *Config, matcher *payloadMatcher, invert bool, workers int, out io.Writer) *grepper {
+	g := &grepper{
+		cfg:     cfg,
+		matcher: matcher,
+		invert:  invert,
+		color:   cfg.Pretty && stdoutIsTerminal(),
+		out:     out,
+		jobs:    make(chan *grepJob, grepQueue),
+		order:   make(chan *grepJob, grepQueue),
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range g.jobs {
+				job.matched <- g.matcher.match(job.msg.Payload()) != g.invert
+			}
+		}()
+	}
+	go g.print()
+	return g
+}
+
+func (g *grepper) handler(_ mqtt.Client, msg mqtt.Message) {
+	g.seen.Add(1)
+	g.pending.Add(1)
+	job := &grepJob{msg: msg, matched: make(chan bool, 1)}
+	g.order <- job
+	g.jobs <- job
+}
+
+func (g *grepper) print() {
+	for job := range g.order {
+		if <-job.matched {
+			g.matches.Add(1)
+			g.write(job.msg)
+		}
+		g.pending.Done()
+	}
+}
+
+func (g *grepper) write(msg mqtt.Message) {
+	if g.cfg.Output == outputJSON {
+		rec := newMessageRecord(msg, nil)
+		encodeRecordPayload(&rec, msg.Payload(), g.cfg.PayloadFormat)
+		line, _ := json.Marshal(rec)
+		fmt.Fprintf(g.out, "%s\n", line)
+		return
+	}
+	topic := msg.Topic()
+	if !g.cfg.Raw {
+		topic = sanitizeForTerminal(topic)
+	}
+	if g.cfg.Pretty {
+		if payload, ok := prettyPayload(msg.Payload(), g.cfg.Raw, g.color); ok {
+			fmt.Fprintf(g.out, "%s: %s\n", topic, payload)
+			return
+		}
+	}
+	fmt.Fprintf(g.out, "%s: %s\n", topic, formatPayload(msg.Payload(), g.cfg.PayloadFormat, g.cfg.Raw))
+}
+
+func runGrep(args []string) {
+	fs := flag.NewFlagSet("grep", flag.ExitOnError)
+	flags := initCLIFlags(fs)
+	pattern := fs.String("pattern", "", "Regular expression (RE2 syntax) to search payloads for, e.g. 'ERROR|panic'. Required.")
+	ignoreCase := fs.Bool("ignore-case", false, "Match --pattern case-insensitively.")
+	invert := fs.Bool("invert", false, "Print messages whose payload does not match.")
+	workers := fs.Int("workers", runtime.NumCPU(), "Number of payloads matched in parallel.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s grep --pattern REGEXP [options]\n\n"+
+			"Prints 'topic: payload' for each message whose payload matches, in the order\n"+
+			"received. Subscribes to --topic, e.g. '#' for the whole broker.\n\nOptions:\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *pattern == "" {
+		fatal("config_invalid", false, "--pattern is required.")
+	}
+	if *workers < 1 {
+		fatal("config_invalid", false, "--workers must be at least 1.")
+	}
+	matcher, err := newPayloadMatcher(*pattern, *ignoreCase)
+	if err != nil {
+		fatal("config_invalid", false, "Invalid --pattern: %v", err)
+	}
+
+	cfg := buildConfig(flags)
+	g := newGrepper(&cfg, matcher, *invert, *workers, os.Stdout)
+	runSubscription(context.Background(), &cfg, g.handler)
+	g.pending.Wait()
+	logInfo("grep_summary", "%d of %d message(s) matched.", g.matches.Load(), g.seen.Load())
+}
@@ -0,0 +1,345 @@
+// history.go
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	historyDefaultSize     = 100
+	historyDefaultMaxBytes = 64 << 20
+	historyDefaultListen   = "127.0.0.1:8787"
+	// historyEntryOverhead is charged per message on top of its topic and
+	// JSON record, for the bookkeeping around it.
+	historyEntryOverhead = 128
+)
+
+// historyEntry is one buffered message, kept as its JSON record.
+type historyEntry struct {
+	seq   uint64
+	topic string
+	at    time.Time
+	line  []byte
+}
+
+func (e *historyEntry) size() int64 {
+	return int64(len(e.topic) + len(e.line) + historyEntryOverhead)
+}
+
+// messageHistory keeps the last messages of each topic for the history API.
+// Each topic holds at most perTopic messages, and all of them together at
+// most maxBytes; past that the oldest message of any topic goes first, so a
+// burst on one topic can't run the process out of memory.
+type messageHistory struct {
+	perTopic int
+	maxBytes int64
+
+	mu      sync.Mutex
+	seq     uint64
+	bytes   int64
+	evicted uint64
+	order   *list.List // every entry, oldest first
+	topics  map[string][]*list.Element
+}
+
+// newMessageHistory returns the buffer configured by history_listen, or nil.
+func newMessageHistory(cfg *Config) (*messageHistory, error) {
+	if cfg.HistoryListen == "" {
+		return nil, nil
+	}
+	h := &messageHistory{perTopic: cfg.HistorySize, maxBytes: historyDefaultMaxBytes, order: list.New(), topics: make(map[string][]*list.Element)}
+	if h.perTopic == 0 {
+		h.perTopic = historyDefaultSize
+	}
+	if cfg.HistoryMaxBytes != "" {
+		n, err := parseByteSize(cfg.HistoryMaxBytes)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid history_max_bytes '%s', expected a size such as 64MiB", cfg.HistoryMaxBytes)
+		}
+		h.maxBytes = n
+	}
+	return h, nil
+}
+
+func (h *messageHistory) add(rec messageRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	e := &historyEntry{seq: h.seq, topic: rec.Topic, at: time.Now(), line: line}
+	if e.size() > h.maxBytes {
+		h.evicted++
+		return
+	}
+	h.topics[e.topic] = append(h.topics[e.topic], h.order.PushBack(e))
+	h.bytes += e.size()
+	if len(h.topics[e.topic]) > h.perTopic {
+		h.removeOldest(e.topic)
+	}
+	for h.bytes > h.maxBytes {
+		h.removeOldest(h.order.Front().Value.(*historyEntry).topic)
+		h.evicted++
+	}
+}
+
+// removeOldest drops the oldest message of topic.
+func (h *messageHistory) removeOldest(topic string) {
+	q := h.topics[topic]
+	e := h.order.Remove(q[0]).(*historyEntry)
+	h.bytes -= e.size()
+	if len(q) == 1 {
+		delete(h.topics, topic)
+	} else {
+		h.topics[topic] = q[1:]
+	}
+}
+
+// messages returns the last n records on topics matching filter, oldest first.
+func (h *messageHistory) messages(filter string, n int) [][]byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var found []*historyEntry
+	for topic, q := range h.topics {
+		if !topicMatches(filter, topic) {
+			continue
+		}
+		if len(q) > n {
+			q = q[len(q)-n:]
+		}
+		for _, el := range q {
+			found = append(found, el.Value.(*historyEntry))
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].seq < found[j].seq })
+	if len(found) > n {
+		found = found[len(found)-n:]
+	}
+	lines := make([][]byte, len(found))
+	for i, e := range found {
+		lines[i] = e.line
+	}
+	return lines
+}
+
+// historySummary is what GET /topics returns.
+type historySummary struct {
+	Messages int            `json:"messages"`
+	Bytes    int64          `json:"bytes"`
+	MaxBytes int64          `json:"max_bytes"`
+	PerTopic int            `json:"per_topic"`
+	Evicted  uint64         `json:"evicted"` // dropped to stay under max_bytes
+	Topics   []historyTopic `json:"topics"`
+}
+
+type historyTopic struct {
+	Topic    string `json:"topic"`
+	Messages int    `json:"messages"`
+	Last     string `json:"last"` // when the newest message arrived
+}
+
+func (h *messageHistory) summary() historySummary {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := historySummary{Messages: h.order.Len(), Bytes: h.bytes, MaxBytes: h.maxBytes, PerTopic: h.perTopic, Evicted: h.evicted, Topics: []historyTopic{}}
+	for topic, q := range h.topics {
+		last := q[len(q)-1].Value.(*historyEntry).at
+		s.Topics = append(s.Topics, historyTopic{Topic: topic, Messages: len(q), Last: last.UTC().Format(time.RFC3339Nano)})
+	}
+	sort.Slice(s.Topics, func(i, j int) bool { return s.Topics[i].Topic < s.Topics[j].Topic })
+	return s
+}
+
+// wrap records each message before passing it to next.
+func (h *messageHistory) wrap(next mqtt.MessageHandler, tp *topicPattern) mqtt.MessageHandler {
+	if h == nil {
+		return next
+	}
+	return func(client mqtt.Client, msg mqtt.Message) {
+		h.add(newMessageRecord(msg, tp))
+		next(client, msg)
+	}
+}
+
+// ServeHTTP answers GET /topics with a summary of the buffer, and
+// GET /messages?topic=FILTER&n=N with the last N messages on topics matching
+// FILTER as JSON lines, oldest first.
+func (h *messageHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch r.URL.Path {
+	case "/topics":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.summary())
+	case "/messages":
+		filter := r.URL.Query().Get("topic")
+		if filter == "" {
+			filter = "#"
+		}
+		n := h.perTopic
+		if v := r.URL.Query().Get("n"); v != "" {
+			var err error
+			if n, err = strconv.Atoi(v); err != nil || n <= 0 {
+				http.Error(w, "n must be a positive number", http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		for _, line := range h.messages(filter, n) {
+			w.Write(line)
+			w.Write([]byte{'\n'})
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serve listens on history_listen and answers history requests there until
+// ctx is done. It returns once listening, or with the error that kept it from
+// listening.
+func (h *messageHistory) serve(ctx context.Context, addr string) error {
+	if h == nil {
+		return nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	logInfo("history_listening", "Serving the last %d messages per topic on http://%s", h.perTopic, ln.Addr())
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logWarn("history_failed", "Stopped serving the message history: %v", err)
+		}
+	}()
+	return nil
+}
+
+// runHistory implements "mqttcli history", which shows the messages buffered
+// by a running "mqttcli sub --history-listen".
+func runHistory(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	from := fs.String("from", historyDefaultListen, "Address of the --history-listen API of a running subscriber.")
+	topic := fs.String("topic", "", "Show the messages on topics matching this filter; without it, list the buffered topics.")
+	n := fs.Int("n", 20, "How many of the latest messages to show.")
+	var cfg Config
+	fs.BoolVar(&cfg.Raw, "raw", false, "Print payloads as received, without escaping control characters.")
+	fs.StringVar(&cfg.PayloadFormat, "payload-format", "", "How to print payloads: string (default), raw, hex, or base64.")
+	fs.BoolVar(&cfg.Pretty, "pretty", false, "Indent JSON object and array payloads.")
+	fs.StringVar(&cfg.Format, "format", "", "Text message lines: short (default), full, or payload-only.")
+	fs.StringVar(&cfg.Output, "output", "", "Output format: 'text' (default) or 'json'.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s history [options]\n\n"+
+			"Shows the last messages per topic kept by a subscriber running with\n"+
+			"--history-listen, e.g. 'history --topic devices/X -n 20'.\n\nOptions:\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	jsonEvents = cfg.Output == outputJSON
+
+	if *n <= 0 {
+		fatal("config_invalid", false, "-n must be positive.")
+	}
+	if err := validPayloadFormat(cfg.PayloadFormat); err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+	if err := validTextFormat(cfg.Format); err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+	base := "http://" + *from
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	if *topic == "" {
+		resp, err := client.Get(base + "/topics")
+		if err != nil {
+			fatal("history_failed", true, "%v", err)
+		}
+		defer resp.Body.Close()
+		body := historyBody(resp)
+		if cfg.Output == outputJSON {
+			io.Copy(os.Stdout, body)
+			return
+		}
+		var s historySummary
+		if err := json.NewDecoder(body).Decode(&s); err != nil {
+			fatal("history_failed", false, "Unexpected answer from %s: %v", *from, err)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "TOPIC\tMESSAGES\tLAST")
+		for _, t := range s.Topics {
+			last, _ := time.Parse(time.RFC3339Nano, t.Last)
+			fmt.Fprintf(tw, "%s\t%d\t%s ago\n", t.Topic, t.Messages, time.Since(last).Round(time.Second))
+		}
+		tw.Flush()
+		logInfo("history", "%d message(s) on %d topic(s), %d of %d bytes; %d dropped to stay under the cap",
+			s.Messages, len(s.Topics), s.Bytes, s.MaxBytes, s.Evicted)
+		return
+	}
+
+	q := url.Values{"topic": {*topic}, "n": {strconv.Itoa(*n)}}
+	resp, err := client.Get(base + "/messages?" + q.Encode())
+	if err != nil {
+		fatal("history_failed", true, "%v", err)
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(historyBody(resp))
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	handler := messageHandler(&cfg, nil, nil, nil)
+	for scanner.Scan() {
+		var rec messageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		payload := []byte(rec.Payload)
+		if rec.PayloadEncoding == "base64" {
+			payload, _ = base64.StdEncoding.DecodeString(rec.Payload)
+		}
+		if cfg.Output == outputJSON {
+			encodeRecordPayload(&rec, payload, cfg.PayloadFormat)
+			line, _ := json.Marshal(rec)
+			fmt.Printf("%s\n", line)
+			continue
+		}
+		if cfg.Format != formatPayloadOnly {
+			fmt.Print(rec.Timestamp, " ")
+		}
+		handler(nil, &recordedMessage{rec: rec, payload: payload})
+	}
+}
+
+// historyBody returns the body of a successful answer, failing otherwise.
+func historyBody(resp *http.Response) io.Reader {
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		fatal("history_failed", false, "%s: %s", resp.Status, msg)
+	}
+	return resp.Body
+}
@@ -0,0 +1,326 @@
+// inflight.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	packets5 "github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho/session"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	packets3 "github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// inflightListed is how many pending exchanges a periodic report names.
+const inflightListed = 5
+
+// inflightKey identifies an exchange; each direction has its own packet IDs.
+type inflightKey struct {
+	out bool
+	id  uint16
+}
+
+// inflightEntry is a QoS 1/2 exchange, or a SUBSCRIBE or UNSUBSCRIBE, that
+// hasn't completed.
+type inflightEntry struct {
+	inflightKey
+	packet   string // the packet held: PUBLISH, PUBREL, SUBSCRIBE, or UNSUBSCRIBE
+	awaiting string // what completes the step
+	topic    string
+	since    time.Time
+	resent   int // retransmissions with the DUP flag
+}
+
+func (e *inflightEntry) String() string {
+	dir := "outgoing"
+	if !e.out {
+		dir = "incoming"
+	}
+	s := fmt.Sprintf("%s %s #%d", dir, e.packet, e.id)
+	if e.topic != "" {
+		s += fmt.Sprintf(" on '%s'", e.topic)
+	}
+	return s
+}
+
+// inflightWindow tracks the packet IDs of the connection that are awaiting
+// an acknowledgement, so a stalled delivery shows what it is waiting for.
+type inflightWindow struct {
+	mu      sync.Mutex
+	entries map[inflightKey]*inflightEntry
+	resent  int64 // retransmissions since the start, across reconnects
+}
+
+// inflight is the window of the current connection.
+var inflight = &inflightWindow{entries: make(map[inflightKey]*inflightEntry)}
+
+// put records that a packet is held for an exchange, replacing the step it
+// was at, such as a PUBLISH answered with PUBREC and now awaiting PUBCOMP.
+func (w *inflightWindow) put(out bool, id uint16, packet, awaiting, topic string, dup bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	k := inflightKey{out, id}
+	e, ok := w.entries[k]
+	if !ok {
+		e = &inflightEntry{inflightKey: k, since: time.Now()}
+		w.entries[k] = e
+	}
+	e.packet, e.awaiting = packet, awaiting
+	if topic != "" {
+		e.topic = topic
+	}
+	if dup && packet == "PUBLISH" {
+		e.resent++
+		w.resent++
+	}
+}
+
+// done ends an exchange, timing the broker's acknowledgement of a publish
+// sent once to see whether it is throttling.
+func (w *inflightWindow) done(out bool, id uint16) {
+	w.mu.Lock()
+	k := inflightKey{out, id}
+	e := w.entries[k]
+	delete(w.entries, k)
+	w.mu.Unlock()
+	if e != nil && out && e.resent == 0 && (e.packet == "PUBLISH" || e.packet == "PUBREL") {
+		throttle.acked(time.Since(e.since))
+	}
+}
+
+// reset forgets every exchange, when a connection starts without them.
+func (w *inflightWindow) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.entries = make(map[inflightKey]*inflightEntry)
+}
+
+// snapshot returns copies of the pending exchanges, oldest first.
+func (w *inflightWindow) snapshot() ([]inflightEntry, int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	list := make([]inflightEntry, 0, len(w.entries))
+	for _, e := range w.entries {
+		list = append(list, *e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].since.Before(list[j].since) })
+	return list, w.resent
+}
+
+// summarizeInflight describes the window in one line, naming the oldest
+// exchanges.
+func summarizeInflight(list []inflightEntry, resent int64, now time.Time) string {
+	if len(list) == 0 {
+		return fmt.Sprintf("In flight: none (%d retransmissions so far)", resent)
+	}
+	var out, in int
+	awaiting := map[string]int{}
+	var order []string
+	for _, e := range list {
+		if e.out {
+			out++
+		} else {
+			in++
+		}
+		if awaiting[e.awaiting] == 0 {
+			order = append(order, e.awaiting)
+		}
+		awaiting[e.awaiting]++
+	}
+	sort.Strings(order)
+	by := make([]string, len(order))
+	for i, a := range order {
+		by[i] = fmt.Sprintf("%d %s", awaiting[a], a)
+	}
+	var oldest []string
+	for i := 0; i < len(list) && i < inflightListed; i++ {
+		e := &list[i]
+		oldest = append(oldest, fmt.Sprintf("#%d awaiting %s for %s", e.id, e.awaiting, now.Sub(e.since).Round(time.Millisecond)))
+	}
+	return fmt.Sprintf("In flight: %d outgoing, %d incoming, awaiting %s; oldest %s; %d retransmissions so far",
+		out, in, strings.Join(by, ", "), strings.Join(oldest, ", "), resent)
+}
+
+// dumpInflight logs every pending exchange.
+func dumpInflight() {
+	list, resent := inflight.snapshot()
+	now := time.Now()
+	logInfo("inflight", "%s", summarizeInflight(list, resent, now))
+	for i := range list {
+		e := &list[i]
+		logInfo("inflight_entry", "%s awaiting %s for %s, retransmitted %d times",
+			e.String(), e.awaiting, now.Sub(e.since).Round(time.Millisecond), e.resent)
+	}
+}
+
+var inflightReporting sync.Once
+
+// startInflightReporting logs the window every inflight_interval, and in
+// full on SIGUSR1 where there is one. A report warns instead when the oldest
+// exchange was already pending at the previous one, since delivery stalled.
+func startInflightReporting(cfg *Config) {
+	inflightReporting.Do(func() {
+		dump := make(chan os.Signal, 1)
+		notifyInflightDump(dump)
+		var tick <-chan time.Time
+		if cfg.InflightInterval > 0 {
+			tick = time.NewTicker(time.Duration(cfg.InflightInterval)).C
+		}
+		go func() {
+			var last time.Time
+			reported := false
+			for {
+				select {
+				case <-dump:
+					dumpInflight()
+				case now := <-tick:
+					list, resent := inflight.snapshot()
+					switch {
+					case len(list) == 0 && !reported:
+					case len(list) > 0 && !last.IsZero() && !list[0].since.After(last):
+						logWarn("inflight_stalled", "%s", summarizeInflight(list, resent, now))
+					default:
+						logInfo("inflight", "%s", summarizeInflight(list, resent, now))
+					}
+					reported, last = len(list) > 0, now
+				}
+			}
+		}()
+	})
+}
+
+// inflightStore tracks the window of an MQTT 3 client from what it persists:
+// it keeps each outgoing PUBLISH, PUBREL, SUBSCRIBE, and UNSUBSCRIBE until
+// acknowledged, and each incoming QoS 1/2 PUBLISH until it has answered it.
+type inflightStore struct {
+	mqtt.Store
+	w *inflightWindow
+}
+
+func newInflightStore(w *inflightWindow) *inflightStore {
+	return &inflightStore{Store: mqtt.NewMemoryStore(), w: w}
+}
+
+func (s *inflightStore) Open() {
+	s.w.reset()
+	s.Store.Open()
+}
+
+func (s *inflightStore) Put(key string, m packets3.ControlPacket) {
+	s.Store.Put(key, m)
+	out := strings.HasPrefix(key, "o.")
+	id := m.Details().MessageID
+	switch p := m.(type) {
+	case *packets3.PublishPacket:
+		awaiting := map[bool]string{true: "PUBACK", false: "PUBREC"}[p.Qos == 1]
+		if !out {
+			awaiting = map[bool]string{true: "our PUBACK", false: "PUBREL"}[p.Qos == 1]
+		}
+		s.w.put(out, id, "PUBLISH", awaiting, p.TopicName, p.Dup)
+	case *packets3.PubrelPacket:
+		s.w.put(out, id, "PUBREL", map[bool]string{true: "PUBCOMP", false: "our PUBCOMP"}[out], "", false)
+	case *packets3.SubscribePacket:
+		s.w.put(out, id, "SUBSCRIBE", "SUBACK", strings.Join(p.Topics, ","), false)
+	case *packets3.UnsubscribePacket:
+		s.w.put(out, id, "UNSUBSCRIBE", "UNSUBACK", strings.Join(p.Topics, ","), false)
+	}
+}
+
+func (s *inflightStore) Del(key string) {
+	s.Store.Del(key)
+	if id, err := strconv.ParseUint(key[2:], 10, 16); err == nil {
+		s.w.done(strings.HasPrefix(key, "o."), uint16(id))
+	}
+}
+
+func (s *inflightStore) Reset() {
+	s.Store.Reset()
+	s.w.reset()
+}
+
+// inflightSession tracks the window of an MQTT v5 client from its session
+// state, which sees every packet with a packet ID.
+type inflightSession struct {
+	session.SessionManager
+	w *inflightWindow
+}
+
+func (s *inflightSession) ConAckReceived(conn io.Writer, cp *packets5.Connect, ca *packets5.Connack) error {
+	if !ca.SessionPresent {
+		s.w.reset()
+	} else {
+		// The session state resends what was pending on the last connection
+		s.w.mu.Lock()
+		for k, e := range s.w.entries {
+			if k.out && e.packet == "PUBLISH" {
+				e.resent++
+				s.w.resent++
+			}
+		}
+		s.w.mu.Unlock()
+	}
+	return s.SessionManager.ConAckReceived(conn, cp, ca)
+}
+
+func (s *inflightSession) AddToSession(ctx context.Context, packet session.Packet, resp chan<- packets5.ControlPacket) error {
+	if err := s.SessionManager.AddToSession(ctx, packet, resp); err != nil {
+		return err
+	}
+	switch p := packet.(type) {
+	case *packets5.Publish:
+		s.w.put(true, p.PacketID, "PUBLISH", map[bool]string{true: "PUBACK", false: "PUBREC"}[p.QoS == 1], p.Topic, false)
+	case *packets5.Subscribe:
+		var filters []string
+		for _, sub := range p.Subscriptions {
+			filters = append(filters, sub.Topic)
+		}
+		s.w.put(true, p.PacketID, "SUBSCRIBE", "SUBACK", strings.Join(filters, ","), false)
+	case *packets5.Unsubscribe:
+		s.w.put(true, p.PacketID, "UNSUBSCRIBE", "UNSUBACK", strings.Join(p.Topics, ","), false)
+	}
+	return nil
+}
+
+func (s *inflightSession) PacketReceived(cp *packets5.ControlPacket, recv chan<- *packets5.Publish) error {
+	err := s.SessionManager.PacketReceived(cp, recv)
+	switch p := cp.Content.(type) {
+	case *packets5.Puback:
+		s.w.done(true, p.PacketID)
+	case *packets5.Pubrec:
+		if p.ReasonCode >= 0x80 {
+			s.w.done(true, p.PacketID)
+		} else {
+			s.w.put(true, p.PacketID, "PUBREL", "PUBCOMP", "", false)
+		}
+	case *packets5.Pubcomp:
+		s.w.done(true, p.PacketID)
+	case *packets5.Suback:
+		s.w.done(true, p.PacketID)
+	case *packets5.Unsuback:
+		s.w.done(true, p.PacketID)
+	case *packets5.Publish:
+		if p.QoS > 0 {
+			s.w.put(false, p.PacketID, "PUBLISH", map[bool]string{true: "our PUBACK", false: "our PUBREC"}[p.QoS == 1], p.Topic, p.Duplicate)
+		}
+	case *packets5.Pubrel:
+		s.w.done(false, p.PacketID) // answered with PUBCOMP at once
+	}
+	return err
+}
+
+func (s *inflightSession) Ack(pb *packets5.Publish) error {
+	err := s.SessionManager.Ack(pb)
+	if pb.QoS == 1 {
+		s.w.done(false, pb.PacketID)
+	} else if pb.QoS == 2 {
+		s.w.put(false, pb.PacketID, "PUBLISH", "PUBREL", "", false)
+	}
+	return err
+}
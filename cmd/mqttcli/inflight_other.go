@@ -0,0 +1,10 @@
+//go:build !unix
+
+// inflight_other.go
+package main
+
+import "os"
+
+// notifyInflightDump does nothing: there is no SIGUSR1 here, so only
+// --inflight-interval reports the window.
+func notifyInflightDump(c chan<- os.Signal) {}
@@ -0,0 +1,157 @@
+// inflight_test.go
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	packets3 "github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// pending lists w's exchanges as "ENTRY awaiting WHAT", sorted.
+func pending(w *inflightWindow) []string {
+	list, _ := w.snapshot()
+	var s []string
+	for i := range list {
+		s = append(s, list[i].String()+" awaiting "+list[i].awaiting)
+	}
+	sort.Strings(s)
+	return s
+}
+
+func TestInflightWindow(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		steps  func(w *inflightWindow)
+		want   []string
+		resent int64
+	}{
+		{"QoS 1 acknowledged", func(w *inflightWindow) {
+			w.put(true, 1, "PUBLISH", "PUBACK", "a", false)
+			w.done(true, 1)
+		}, nil, 0},
+		{"QoS 2 at PUBREL", func(w *inflightWindow) {
+			w.put(true, 2, "PUBLISH", "PUBREC", "a", false)
+			w.put(true, 2, "PUBREL", "PUBCOMP", "", false)
+		}, []string{"outgoing PUBREL #2 on 'a' awaiting PUBCOMP"}, 0},
+		{"retransmitted", func(w *inflightWindow) {
+			w.put(true, 3, "PUBLISH", "PUBACK", "a", false)
+			w.put(true, 3, "PUBLISH", "PUBACK", "a", true)
+			w.put(true, 3, "PUBLISH", "PUBACK", "a", true)
+		}, []string{"outgoing PUBLISH #3 on 'a' awaiting PUBACK"}, 2},
+		{"a resent PUBREL isn't counted", func(w *inflightWindow) {
+			w.put(true, 4, "PUBREL", "PUBCOMP", "", true)
+		}, []string{"outgoing PUBREL #4 awaiting PUBCOMP"}, 0},
+		{"each direction has its own IDs", func(w *inflightWindow) {
+			w.put(true, 5, "PUBLISH", "PUBACK", "out", false)
+			w.put(false, 5, "PUBLISH", "our PUBACK", "in", false)
+			w.done(false, 5)
+		}, []string{"outgoing PUBLISH #5 on 'out' awaiting PUBACK"}, 0},
+		{"reset", func(w *inflightWindow) {
+			w.put(true, 6, "SUBSCRIBE", "SUBACK", "a,b", false)
+			w.put(true, 7, "PUBLISH", "PUBACK", "a", true)
+			w.reset()
+		}, nil, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := &inflightWindow{entries: make(map[inflightKey]*inflightEntry)}
+			tc.steps(w)
+			if got := pending(w); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+			if _, resent := w.snapshot(); resent != tc.resent {
+				t.Errorf("got %d retransmissions, want %d", resent, tc.resent)
+			}
+		})
+	}
+}
+
+func TestSummarizeInflight(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	entry := func(out bool, id uint16, awaiting string, age time.Duration) inflightEntry {
+		return inflightEntry{inflightKey: inflightKey{out, id}, packet: "PUBLISH", awaiting: awaiting, since: now.Add(-age)}
+	}
+	var many []inflightEntry
+	for i := 7; i > 0; i-- {
+		many = append(many, entry(true, uint16(i), "PUBACK", time.Duration(i)*time.Second))
+	}
+	for _, tc := range []struct {
+		name   string
+		list   []inflightEntry
+		resent int64
+		want   string
+	}{
+		{"none", nil, 3, "In flight: none (3 retransmissions so far)"},
+		{
+			"a few",
+			[]inflightEntry{entry(true, 1, "PUBACK", 2*time.Second), entry(false, 2, "PUBREL", time.Second), entry(true, 3, "SUBACK", 500*time.Millisecond)},
+			0,
+			"In flight: 2 outgoing, 1 incoming, awaiting 1 PUBACK, 1 PUBREL, 1 SUBACK; " +
+				"oldest #1 awaiting PUBACK for 2s, #2 awaiting PUBREL for 1s, #3 awaiting SUBACK for 500ms; 0 retransmissions so far",
+		},
+		{
+			"more than are listed",
+			many,
+			4,
+			"In flight: 7 outgoing, 0 incoming, awaiting 7 PUBACK; " +
+				"oldest #7 awaiting PUBACK for 7s, #6 awaiting PUBACK for 6s, #5 awaiting PUBACK for 5s, #4 awaiting PUBACK for 4s, #3 awaiting PUBACK for 3s; 4 retransmissions so far",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := summarizeInflight(tc.list, tc.resent, now); got != tc.want {
+				t.Errorf("got  %s\nwant %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestInflightStore(t *testing.T) {
+	publish := func(id uint16, qos byte, dup bool) packets3.ControlPacket {
+		p := packets3.NewControlPacket(packets3.Publish).(*packets3.PublishPacket)
+		p.TopicName, p.MessageID, p.Qos, p.Dup = "t", id, qos, dup
+		return p
+	}
+	pubrel := packets3.NewControlPacket(packets3.Pubrel).(*packets3.PubrelPacket)
+	pubrel.MessageID = 3
+	subscribe := packets3.NewControlPacket(packets3.Subscribe).(*packets3.SubscribePacket)
+	subscribe.MessageID, subscribe.Topics, subscribe.Qoss = 4, []string{"a", "b"}, []byte{1, 1}
+
+	for _, tc := range []struct {
+		name  string
+		steps func(s *inflightStore)
+		want  []string
+	}{
+		{"outgoing QoS 1", func(s *inflightStore) { s.Put("o.1", publish(1, 1, false)) }, []string{"outgoing PUBLISH #1 on 't' awaiting PUBACK"}},
+		{"outgoing QoS 2", func(s *inflightStore) { s.Put("o.2", publish(2, 2, false)) }, []string{"outgoing PUBLISH #2 on 't' awaiting PUBREC"}},
+		{"incoming QoS 1", func(s *inflightStore) { s.Put("i.1", publish(1, 1, false)) }, []string{"incoming PUBLISH #1 on 't' awaiting our PUBACK"}},
+		{"incoming QoS 2", func(s *inflightStore) { s.Put("i.2", publish(2, 2, false)) }, []string{"incoming PUBLISH #2 on 't' awaiting PUBREL"}},
+		{"outgoing PUBREL", func(s *inflightStore) {
+			s.Put("o.3", publish(3, 2, false))
+			s.Put("o.3", pubrel)
+		}, []string{"outgoing PUBREL #3 on 't' awaiting PUBCOMP"}},
+		{"incoming PUBREL", func(s *inflightStore) { s.Put("i.3", pubrel) }, []string{"incoming PUBREL #3 awaiting our PUBCOMP"}},
+		{"subscribe", func(s *inflightStore) { s.Put("o.4", subscribe) }, []string{"outgoing SUBSCRIBE #4 on 'a,b' awaiting SUBACK"}},
+		{"acknowledged", func(s *inflightStore) {
+			s.Put("o.1", publish(1, 1, false))
+			s.Put("i.1", publish(1, 1, false))
+			s.Del("o.1")
+		}, []string{"incoming PUBLISH #1 on 't' awaiting our PUBACK"}},
+		{"reset", func(s *inflightStore) {
+			s.Put("o.1", publish(1, 1, false))
+			s.Reset()
+		}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := &inflightWindow{entries: make(map[inflightKey]*inflightEntry)}
+			s := newInflightStore(w)
+			s.Open()
+			defer s.Close()
+			tc.steps(s)
+			if got := pending(w); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
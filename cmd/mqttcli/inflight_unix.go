@@ -0,0 +1,16 @@
+//go:build unix
+
+// inflight_unix.go
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyInflightDump delivers SIGUSR1 to c, so "kill -USR1" lists the
+// in-flight window.
+func notifyInflightDump(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
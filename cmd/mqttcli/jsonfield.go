@@ -0,0 +1,63 @@
+// jsonfield.go
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// lookupJSONField decodes payload as JSON and returns the value at a dotted
+// path such as "sensors.0.temp". An empty path returns the whole document.
+func lookupJSONField(payload []byte, path string) (interface{}, bool) {
+	var doc interface{}
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return nil, false
+	}
+	return jsonPath(doc, path)
+}
+
+// jsonPath walks objects by key and arrays by index along a dotted path.
+func jsonPath(v interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return v, true
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			next, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			v = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// toFloat converts a JSON number, numeric string, or boolean to a finite
+// float64; strings like "NaN", "Inf", and "1e999" aren't numbers to chart.
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil && !math.IsNaN(f) && !math.IsInf(f, 0)
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,55 @@
+// jsonfield_test.go
+package main
+
+import "testing"
+
+func TestJSONPath(t *testing.T) {
+	payload := []byte(`{"env":{"temp":21.5},"sensors":[{"id":"a"},{"id":"b"}]}`)
+	for _, tc := range []struct {
+		path string
+		want interface{}
+		ok   bool
+	}{
+		{"env.temp", 21.5, true},
+		{"sensors.1.id", "b", true},
+		{"sensors.2.id", nil, false},
+		{"sensors.-1.id", nil, false},
+		{"sensors.x", nil, false},
+		{"env.temp.x", nil, false},
+		{"missing", nil, false},
+	} {
+		got, ok := lookupJSONField(payload, tc.path)
+		if ok != tc.ok || got != tc.want {
+			t.Errorf("%s: got %v, %v, want %v, %v", tc.path, got, ok, tc.want, tc.ok)
+		}
+	}
+	if _, ok := lookupJSONField([]byte("not json"), ""); ok {
+		t.Error("found a field in a payload that isn't JSON")
+	}
+}
+
+func TestToFloat(t *testing.T) {
+	for _, tc := range []struct {
+		v    interface{}
+		want float64
+		ok   bool
+	}{
+		{21.5, 21.5, true},
+		{" 42 ", 42, true},
+		{"1e3", 1000, true},
+		{true, 1, true},
+		{false, 0, true},
+		{"NaN", 0, false},
+		{"Inf", 0, false},
+		{"-Infinity", 0, false},
+		{"1e999", 0, false},
+		{"warm", 0, false},
+		{nil, 0, false},
+		{map[string]interface{}{}, 0, false},
+	} {
+		got, ok := toFloat(tc.v)
+		if ok != tc.ok || (ok && got != tc.want) {
+			t.Errorf("%#v: got %v, %v, want %v, %v", tc.v, got, ok, tc.want, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+// keylog.go
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// keyLogs holds the open tls_keylog files by path, so reconnects append to
+// the same file instead of opening it again.
+var keyLogs = struct {
+	sync.Mutex
+	files map[string]*os.File
+}{files: map[string]*os.File{}}
+
+// openKeyLog opens path to append TLS session secrets in the NSS key log
+// format that Wireshark reads, warning the first time.
+func openKeyLog(path string) (io.Writer, error) {
+	keyLogs.Lock()
+	defer keyLogs.Unlock()
+	if f, ok := keyLogs.files[path]; ok {
+		return f, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("tls_keylog: %v", err)
+	}
+	keyLogs.files[path] = f
+	logWarn("tls_keylog", "WRITING TLS SESSION SECRETS to '%s': anyone with this file can decrypt the captured traffic, "+
+		"including passwords and payloads. Use it only to debug, and delete the file afterwards.", path)
+	return f, nil
+}
@@ -0,0 +1,252 @@
+// keypassword.go
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+)
+
+// envKeyPassword holds the passphrase of an encrypted private key, so it
+// needn't appear on the command line.
+const envKeyPassword = "MQTTCLI_KEY_PASSWORD"
+
+// errKeyPassword reports a missing or wrong passphrase.
+var errKeyPassword = errors.New("incorrect key password")
+
+// OIDs of the PKCS#5 v2 (PBES2) schemes used by encrypted PKCS#8 keys.
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+type pkixAlgorithm struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkixAlgorithm
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkixAlgorithm
+	EncryptionScheme  pkixAlgorithm
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int           `asn1:"optional"`
+	PRF        pkixAlgorithm `asn1:"optional"`
+}
+
+// pbkdf2 derives a key of keyLen bytes from password (RFC 8018).
+func pbkdf2(h func() hash.Hash, password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(h, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// decryptPBES2 decrypts data protected with PKCS#5 v2 password-based
+// encryption: PBKDF2 with an HMAC-SHA PRF, and AES-CBC or 3DES-CBC.
+func decryptPBES2(params []byte, data, password []byte) ([]byte, error) {
+	var p pbes2Params
+	if _, err := asn1.Unmarshal(params, &p); err != nil {
+		return nil, fmt.Errorf("invalid PBES2 parameters: %v", err)
+	}
+	if !p.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation %s; only PBKDF2 is supported", p.KeyDerivationFunc.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(p.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, fmt.Errorf("invalid PBKDF2 parameters: %v", err)
+	}
+	var h func() hash.Hash
+	switch prf := kdf.PRF.Algorithm; {
+	case len(prf) == 0 || prf.Equal(oidHMACSHA1):
+		h = sha1.New
+	case prf.Equal(oidHMACSHA256):
+		h = sha256.New
+	case prf.Equal(oidHMACSHA384):
+		h = sha512.New384
+	case prf.Equal(oidHMACSHA512):
+		h = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported PBKDF2 hash %s", prf)
+	}
+
+	var keyLen int
+	var newCipher func([]byte) (cipher.Block, error)
+	switch enc := p.EncryptionScheme.Algorithm; {
+	case enc.Equal(oidAES128CBC):
+		keyLen, newCipher = 16, aes.NewCipher
+	case enc.Equal(oidAES192CBC):
+		keyLen, newCipher = 24, aes.NewCipher
+	case enc.Equal(oidAES256CBC):
+		keyLen, newCipher = 32, aes.NewCipher
+	case enc.Equal(oidDESEDE3CBC):
+		keyLen, newCipher = 24, des.NewTripleDESCipher
+	default:
+		return nil, fmt.Errorf("unsupported key encryption %s; use AES-CBC or 3DES", enc)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(p.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, fmt.Errorf("invalid cipher parameters: %v", err)
+	}
+	block, err := newCipher(pbkdf2(h, password, kdf.Salt, kdf.Iterations, keyLen))
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errors.New("malformed encrypted data")
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+	return unpad(plain, block.BlockSize())
+}
+
+// unpad strips PKCS#7 padding; bad padding almost always means a wrong
+// password.
+func unpad(b []byte, size int) ([]byte, error) {
+	n := int(b[len(b)-1])
+	if n == 0 || n > size || n > len(b) || !bytes.Equal(b[len(b)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+		return nil, errKeyPassword
+	}
+	return b[:len(b)-n], nil
+}
+
+// keyPassword returns the passphrase for an encrypted key: key_password,
+// else one typed at a terminal prompt, which is kept for reconnecting.
+func keyPassword(cfg *Config) ([]byte, error) {
+	if cfg.KeyPassword != "" {
+		return []byte(cfg.KeyPassword), nil
+	}
+	pw, err := promptPassword("Password for the private key: ")
+	if err != nil {
+		return nil, fmt.Errorf("the private key is encrypted; set --key-password or $%s (%v)", envKeyPassword, err)
+	}
+	cfg.KeyPassword = string(pw)
+	return pw, nil
+}
+
+// decryptKeyPEM returns keyPEM with any encrypted private key decrypted:
+// "ENCRYPTED PRIVATE KEY" (PKCS#8 with PBES2), or a traditional PKCS#1 or EC
+// key with Proc-Type and DEK-Info headers. Unencrypted keys pass unchanged.
+func decryptKeyPEM(keyPEM []byte, cfg *Config) ([]byte, error) {
+	var out []byte
+	rest := keyPEM
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		// Legacy PEM encryption is deprecated as weak, but many devices still ship with it
+		encrypted := x509.IsEncryptedPEMBlock(block)
+		if !encrypted && block.Type != "ENCRYPTED PRIVATE KEY" {
+			out = append(out, pem.EncodeToMemory(block)...)
+			continue
+		}
+		pw, err := keyPassword(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if encrypted {
+			der, err := x509.DecryptPEMBlock(block, pw)
+			if err != nil {
+				if errors.Is(err, x509.IncorrectPasswordError) {
+					err = errKeyPassword
+				}
+				return nil, err
+			}
+			out = append(out, pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})...)
+			continue
+		}
+		var info encryptedPrivateKeyInfo
+		if _, err := asn1.Unmarshal(block.Bytes, &info); err != nil {
+			return nil, fmt.Errorf("invalid encrypted private key: %v", err)
+		}
+		if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+			return nil, fmt.Errorf("unsupported key encryption %s; re-encrypt it with 'openssl pkcs8 -topk8 -v2 aes256'", info.Algorithm.Algorithm)
+		}
+		der, err := decryptPBES2(info.Algorithm.Parameters.FullBytes, info.EncryptedData, pw)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := x509.ParsePKCS8PrivateKey(der); err != nil {
+			return nil, errKeyPassword
+		}
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})...)
+	}
+	if out == nil {
+		return keyPEM, nil // not PEM; let tls.X509KeyPair report it
+	}
+	return out, nil
+}
+
+// stdinIsTerminal reports whether a password can be prompted for.
+func stdinIsTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// readPasswordLine reads one line, without its line ending, from r.
+func readPasswordLine(r *os.File) ([]byte, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+		}
+		if err != nil {
+			if len(line) > 0 {
+				break
+			}
+			return nil, err
+		}
+	}
+	return []byte(strings.TrimSuffix(string(line), "\r")), nil
+}
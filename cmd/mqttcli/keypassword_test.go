@@ -0,0 +1,100 @@
+// keypassword_test.go
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"testing"
+)
+
+// The encrypted keys in testdata use the passphrase "secret":
+//
+//	openssl genpkey -algorithm EC -pkeyopt ec_paramgen_curve:P-256 -aes256 -pass pass:secret -out key-aes256.pem
+//	openssl pkey -in key-aes256.pem -passin pass:secret -out key-aes256-plain.pem
+//	openssl ec -in client.key -des3 -passout pass:secret -out key-des3.pem
+var encryptedKeys = []struct {
+	file, plain string
+}{
+	{"key-aes256.pem", "key-aes256-plain.pem"}, // PKCS#8 with PBES2, PBKDF2-SHA256, and AES-256-CBC
+	{"key-des3.pem", "client.key"},             // legacy PEM with DEK-Info DES-EDE3-CBC
+}
+
+// parseKeyPEM returns the private key in the first PEM block of data.
+func parseKeyPEM(t *testing.T, data []byte) interface{ Equal(crypto.PrivateKey) bool } {
+	t.Helper()
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatal("no PEM block")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		t.Fatalf("%s: %v", block.Type, err)
+	}
+	return key.(interface{ Equal(crypto.PrivateKey) bool })
+}
+
+func TestDecryptKeyPEM(t *testing.T) {
+	for _, k := range encryptedKeys {
+		t.Run(k.file, func(t *testing.T) {
+			encrypted, err := os.ReadFile("testdata/" + k.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plain, err := os.ReadFile("testdata/" + k.plain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decryptKeyPEM(encrypted, &Config{KeyPassword: "secret"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !parseKeyPEM(t, got).Equal(parseKeyPEM(t, plain)) {
+				t.Errorf("decrypted a different key than testdata/%s", k.plain)
+			}
+		})
+	}
+}
+
+func TestDecryptKeyPEMWrongPassword(t *testing.T) {
+	for _, k := range encryptedKeys {
+		encrypted, err := os.ReadFile("testdata/" + k.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pw := range []string{"Secret", "secret "} {
+			if _, err := decryptKeyPEM(encrypted, &Config{KeyPassword: pw}); !errors.Is(err, errKeyPassword) {
+				t.Errorf("%s with password %q: got %v, want errKeyPassword", k.file, pw, err)
+			}
+		}
+	}
+}
+
+func TestDecryptKeyPEMUnencrypted(t *testing.T) {
+	plain, err := os.ReadFile("testdata/client.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No password is asked for, so none is needed
+	got, err := decryptKeyPEM(plain, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := os.ReadFile("testdata/client.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tls.X509KeyPair(cert, got); err != nil {
+		t.Errorf("key no longer matches its certificate: %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+// latency.go
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// latencyWarnEvery limits how often latency_budget_exceeded is logged.
+const latencyWarnEvery = 30 * time.Second
+
+// latencyBudget times each message's way through the handler pipeline, stage
+// by stage, and warns when one takes longer than budget. A stage's time
+// doesn't include the stages nested in it, so the slow one stands out.
+//
+// The client hands messages over one at a time on its delivery goroutine,
+// so the message in progress needs no locking; mu guards the totals.
+type latencyBudget struct {
+	budget time.Duration
+
+	// the message in progress
+	topic string
+	depth int
+	inner time.Duration // time of the stages nested in the current one
+	order []string      // stages in the order the message reached them
+	spent map[string]time.Duration
+
+	mu         sync.Mutex
+	rng        *rand.Rand
+	total      latencyRecorder
+	stages     map[string]*latencyRecorder
+	over       int64
+	warned     time.Time
+	suppressed int64
+}
+
+// pipeline times the message handling of this run.
+var pipeline = &latencyBudget{}
+
+// start begins timing a subscription with cfg's latency_budget, if set.
+func (b *latencyBudget) start(cfg *Config) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.budget = time.Duration(cfg.LatencyBudget)
+	b.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	b.total = latencyRecorder{}
+	b.stages = map[string]*latencyRecorder{}
+	b.spent = map[string]time.Duration{}
+	b.over, b.suppressed, b.warned = 0, 0, time.Time{}
+}
+
+// stage times h as the named stage of the pipeline.
+func (b *latencyBudget) stage(name string, h mqtt.MessageHandler) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		if b.depth == 0 {
+			b.topic = msg.Topic()
+		}
+		b.measure(name, func() { h(client, msg) })
+	}
+}
+
+// measure times f as the named stage, within the one in progress.
+func (b *latencyBudget) measure(name string, f func()) {
+	if b.budget <= 0 {
+		f()
+		return
+	}
+	if b.depth == 0 {
+		b.order = b.order[:0]
+		for k := range b.spent {
+			delete(b.spent, k)
+		}
+	}
+	if _, ok := b.spent[name]; !ok {
+		b.order = append(b.order, name)
+		b.spent[name] = 0
+	}
+	outer := b.inner
+	b.inner = 0
+	b.depth++
+	started := time.Now()
+	f()
+	took := time.Since(started)
+	b.depth--
+	b.spent[name] += took - b.inner
+	b.inner = outer + took
+	if b.depth == 0 {
+		b.finish(took)
+	}
+}
+
+// finish records the message just handled, warning if it went over budget.
+func (b *latencyBudget) finish(took time.Duration) {
+	b.mu.Lock()
+	b.total.add(took, b.rng)
+	for _, name := range b.order {
+		r := b.stages[name]
+		if r == nil {
+			r = &latencyRecorder{}
+			b.stages[name] = r
+		}
+		r.add(b.spent[name], b.rng)
+	}
+	if took <= b.budget {
+		b.mu.Unlock()
+		return
+	}
+	b.over++
+	now := time.Now()
+	if now.Sub(b.warned) < latencyWarnEvery {
+		b.suppressed++
+		b.mu.Unlock()
+		return
+	}
+	suppressed := b.suppressed
+	b.warned, b.suppressed = now, 0
+	b.mu.Unlock()
+
+	byTime := append([]string(nil), b.order...)
+	sort.SliceStable(byTime, func(i, j int) bool { return b.spent[byTime[i]] > b.spent[byTime[j]] })
+	parts := make([]string, 0, 3)
+	for _, name := range byTime[:min(3, len(byTime))] {
+		parts = append(parts, fmt.Sprintf("%s %s", name, roundLatency(b.spent[name])))
+	}
+	more := ""
+	if suppressed > 0 {
+		more = fmt.Sprintf(" (%d more since the last warning)", suppressed)
+	}
+	logWarn("latency_budget_exceeded", "Handling a message on '%s' took %s, over the %s budget%s; slowest stage %s",
+		b.topic, roundLatency(took), b.budget, more, strings.Join(parts, ", then "))
+}
+
+// snapshot summarizes the time of each stage, and of the whole pipeline as
+// "total", or returns nil if nothing was timed.
+func (b *latencyBudget) snapshot() map[string]*latencySummary {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.total.count == 0 {
+		return nil
+	}
+	s := map[string]*latencySummary{"total": b.total.summary()}
+	for name, r := range b.stages {
+		s[name] = r.summary()
+	}
+	return s
+}
+
+// report logs how the run's messages fared against the budget, naming the
+// stages that took at least 1% of the time.
+func (b *latencyBudget) report() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.total.count == 0 {
+		return
+	}
+	names := make([]string, 0, len(b.stages))
+	for name, r := range b.stages {
+		if r.sum*100 >= b.total.sum {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return b.stages[names[i]].sum > b.stages[names[j]].sum })
+	parts := make([]string, len(names))
+	for i, name := range names {
+		r := b.stages[name]
+		parts[i] = fmt.Sprintf("%s mean %s, max %s", name, roundLatency(r.sum/time.Duration(r.count)), roundLatency(r.max))
+	}
+	logInfo("latency_summary", "%d of %d message(s) took longer than the %s budget; by stage: %s",
+		b.over, b.total.count, b.budget, strings.Join(parts, "; "))
+}
+
+// roundLatency rounds d for log messages, keeping three significant digits.
+func roundLatency(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	}
+	return d.Round(100 * time.Nanosecond)
+}
+
+// timedSink times the writes of a sink as a stage of the pipeline.
+type timedSink struct {
+	Sink
+	stage string
+}
+
+func (s timedSink) Write(rec messageRecord) (err error) {
+	pipeline.measure(s.stage, func() { err = s.Sink.Write(rec) })
+	return err
+}
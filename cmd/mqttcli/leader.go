@@ -0,0 +1,307 @@
+// leader.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// In-cluster service account files, as mounted into every pod.
+const (
+	serviceAccountDir       = "/var/run/secrets/kubernetes.io/serviceaccount"
+	defaultLeaseDuration    = 15 * time.Second
+	leaseTimeFormat         = "2006-01-02T15:04:05.000000Z07:00"
+	leaseRequestTimeout     = 5 * time.Second
+	leaderRetryBackoffRatio = 3 // renew/retry every duration/3
+)
+
+// leaderFlags configure Kubernetes leader election, so only one replica of a
+// Deployment consumes a non-shared subscription at a time.
+type leaderFlags struct {
+	Lease     string
+	Namespace string
+	Identity  string
+	Duration  time.Duration
+}
+
+func initLeaderFlags(fs *flag.FlagSet) *leaderFlags {
+	var f leaderFlags
+	fs.StringVar(&f.Lease, "leader-elect", "", "Only subscribe while holding this Kubernetes Lease (coordination.k8s.io/v1).")
+	fs.StringVar(&f.Namespace, "leader-namespace", "", "Namespace of the Lease (default: the pod's namespace).")
+	fs.StringVar(&f.Identity, "leader-identity", "", "Holder identity written to the Lease (default: hostname, i.e. the pod name).")
+	fs.DurationVar(&f.Duration, "leader-lease-duration", defaultLeaseDuration, "How long a Lease stays valid without renewal.")
+	return &f
+}
+
+// kubeClient is a minimal in-cluster client for the Kubernetes API using the
+// pod's service account.
+type kubeClient struct {
+	baseURL string
+	http    *http.Client
+}
+
+func newInClusterClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes pod (KUBERNETES_SERVICE_HOST is unset)")
+	}
+	caPEM, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates in %s/ca.crt", serviceAccountDir)
+	}
+	return &kubeClient{
+		baseURL: "https://" + net.JoinHostPort(host, port),
+		http: &http.Client{
+			Timeout:   leaseRequestTimeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+// do sends a JSON request and decodes a JSON response into out. The token is
+// read per request, since projected service account tokens are rotated.
+func (k *kubeClient) do(ctx context.Context, method, path string, in, out interface{}) (int, error) {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return 0, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, k.baseURL+path, &body)
+	if err != nil {
+		return 0, err
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out != nil {
+		return resp.StatusCode, json.Unmarshal(data, out)
+	}
+	return resp.StatusCode, nil
+}
+
+// lease is the subset of a coordination.k8s.io/v1 Lease used for election.
+type lease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   leaseMetadata `json:"metadata"`
+	Spec       leaseSpec     `json:"spec"`
+}
+
+type leaseMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions"`
+}
+
+// expired reports whether the current holder has stopped renewing.
+func (s leaseSpec) expired(now time.Time) bool {
+	if s.HolderIdentity == "" {
+		return true
+	}
+	renewed, err := time.Parse(time.RFC3339Nano, s.RenewTime)
+	if err != nil {
+		return true
+	}
+	return now.After(renewed.Add(time.Duration(s.LeaseDurationSeconds) * time.Second))
+}
+
+// leaderElector acquires and renews a Lease for one identity.
+type leaderElector struct {
+	api      *kubeClient
+	path     string
+	name     string
+	identity string
+	duration time.Duration
+}
+
+func newLeaderElector(f *leaderFlags) (*leaderElector, error) {
+	api, err := newInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	ns := f.Namespace
+	if ns == "" {
+		data, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("could not determine namespace, set --leader-namespace: %v", err)
+		}
+		ns = strings.TrimSpace(string(data))
+	}
+	identity := f.Identity
+	if identity == "" {
+		if identity, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+	if f.Duration < time.Second {
+		return nil, fmt.Errorf("--leader-lease-duration must be at least 1s")
+	}
+	return &leaderElector{
+		api:      api,
+		path:     fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s", ns, f.Lease),
+		name:     f.Lease,
+		identity: identity,
+		duration: f.Duration,
+	}, nil
+}
+
+// tryAcquireOrRenew takes the Lease if it is free or expired, or renews it if
+// already held. It returns whether this identity holds the Lease afterwards.
+func (e *leaderElector) tryAcquireOrRenew(ctx context.Context) (bool, error) {
+	now := time.Now()
+	stamp := now.UTC().Format(leaseTimeFormat)
+
+	var l lease
+	status, err := e.api.do(ctx, http.MethodGet, e.path, nil, &l)
+	if status == http.StatusNotFound {
+		l = lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   leaseMetadata{Name: e.name},
+			Spec: leaseSpec{
+				HolderIdentity:       e.identity,
+				LeaseDurationSeconds: int(e.duration / time.Second),
+				AcquireTime:          stamp,
+				RenewTime:            stamp,
+			},
+		}
+		create := e.path[:strings.LastIndex(e.path, "/")]
+		if status, err := e.api.do(ctx, http.MethodPost, create, &l, nil); err != nil {
+			if status == http.StatusConflict {
+				return false, nil // another replica created it first
+			}
+			return false, err
+		}
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if l.Spec.HolderIdentity != e.identity {
+		if !l.Spec.expired(now) {
+			return false, nil
+		}
+		l.Spec.HolderIdentity = e.identity
+		l.Spec.AcquireTime = stamp
+		l.Spec.LeaseTransitions++
+	}
+	l.Spec.LeaseDurationSeconds = int(e.duration / time.Second)
+	l.Spec.RenewTime = stamp
+
+	// The resourceVersion makes this a compare-and-swap: a concurrent update
+	// by another replica fails with 409 Conflict.
+	if status, err := e.api.do(ctx, http.MethodPut, e.path, &l, nil); err != nil {
+		if status == http.StatusConflict {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// release gives up the Lease on shutdown so another replica can take over
+// without waiting for it to expire.
+func (e *leaderElector) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), leaseRequestTimeout)
+	defer cancel()
+	var l lease
+	if _, err := e.api.do(ctx, http.MethodGet, e.path, nil, &l); err != nil || l.Spec.HolderIdentity != e.identity {
+		return
+	}
+	l.Spec.HolderIdentity = ""
+	l.Spec.LeaseDurationSeconds = 1
+	if _, err := e.api.do(ctx, http.MethodPut, e.path, &l, nil); err != nil {
+		logWarn("leader_release_failed", "Could not release lease '%s': %v", e.name, err)
+	}
+}
+
+// acquire blocks until this replica holds the Lease (or ctx is done), then keeps
+// renewing it in the background. The returned context is cancelled when the
+// Lease is lost, i.e. it could not be renewed within the lease duration.
+func (e *leaderElector) acquire(ctx context.Context) (context.Context, error) {
+	retry := e.duration / leaderRetryBackoffRatio
+	logInfo("leader_waiting", "Waiting to acquire lease '%s' as '%s'", e.name, e.identity)
+	for {
+		held, err := e.tryAcquireOrRenew(ctx)
+		if err != nil {
+			logWarn("leader_election_failed", "Lease '%s': %v", e.name, err)
+		}
+		if held {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(retry):
+		}
+	}
+	logInfo("leader_acquired", "Acquired lease '%s' as '%s'", e.name, e.identity)
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer cancel()
+		lastRenew := time.Now()
+		ticker := time.NewTicker(retry)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-leaderCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			held, err := e.tryAcquireOrRenew(leaderCtx)
+			switch {
+			case held:
+				lastRenew = time.Now()
+				continue
+			case err != nil && time.Since(lastRenew) < e.duration:
+				logWarn("leader_renew_failed", "Could not renew lease '%s': %v", e.name, err)
+				continue
+			}
+			return
+		}
+	}()
+	return leaderCtx, nil
+}
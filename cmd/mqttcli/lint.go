@@ -0,0 +1,163 @@
+// lint.go
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// lintRules are the topic naming conventions checked by lint-topics.
+type lintRules struct {
+	MaxDepth       int
+	AllowUppercase bool
+	AllowSpaces    bool
+}
+
+// lintTopic returns the convention violations found in topic.
+func lintTopic(topic string, rules lintRules) []string {
+	var problems []string
+	levels := strings.Split(topic, "/")
+	if rules.MaxDepth > 0 && len(levels) > rules.MaxDepth {
+		problems = append(problems, fmt.Sprintf("depth %d exceeds %d", len(levels), rules.MaxDepth))
+	}
+	if strings.HasPrefix(topic, "/") {
+		problems = append(problems, "leading '/'")
+	}
+	if strings.HasSuffix(topic, "/") {
+		problems = append(problems, "trailing '/'")
+	}
+	if strings.Contains(topic, "//") {
+		problems = append(problems, "empty level")
+	}
+	if strings.ContainsAny(topic, "+#") {
+		problems = append(problems, "wildcard character in published topic")
+	}
+	if !rules.AllowSpaces && strings.ContainsFunc(topic, unicode.IsSpace) {
+		problems = append(problems, "whitespace")
+	}
+	if !rules.AllowUppercase && strings.ContainsFunc(topic, unicode.IsUpper) {
+		problems = append(problems, "uppercase")
+	}
+	return problems
+}
+
+// topicLinter collects the distinct topics seen and their violations, grouped
+// by device (a "device" topic pattern field) or by topic.
+type topicLinter struct {
+	rules   lintRules
+	pattern *topicPattern
+
+	mu       sync.Mutex
+	seen     map[string]bool
+	byDevice map[string]map[string][]string // device -> topic -> problems
+}
+
+func newTopicLinter(rules lintRules, pattern *topicPattern) *topicLinter {
+	return &topicLinter{
+		rules:    rules,
+		pattern:  pattern,
+		seen:     map[string]bool{},
+		byDevice: map[string]map[string][]string{},
+	}
+}
+
+func (l *topicLinter) handler(client mqtt.Client, msg mqtt.Message) {
+	topic := msg.Topic()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.seen[topic] {
+		return
+	}
+	l.seen[topic] = true
+
+	problems := lintTopic(topic, l.rules)
+	if len(problems) == 0 {
+		return
+	}
+	device := topic
+	if fields, ok := l.pattern.Match(topic); ok && fields["device"] != "" {
+		device = fields["device"]
+	}
+	if l.byDevice[device] == nil {
+		l.byDevice[device] = map[string][]string{}
+	}
+	l.byDevice[device][topic] = problems
+}
+
+// report writes violations per device and returns how many topics violated a rule.
+func (l *topicLinter) report(out io.Writer) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	devices := make([]string, 0, len(l.byDevice))
+	for d := range l.byDevice {
+		devices = append(devices, d)
+	}
+	sort.Strings(devices)
+
+	bad := 0
+	for _, d := range devices {
+		topics := make([]string, 0, len(l.byDevice[d]))
+		for t := range l.byDevice[d] {
+			topics = append(topics, t)
+		}
+		sort.Strings(topics)
+		fmt.Fprintf(out, "%s: %d topic(s) with violations\n", sanitizeForTerminal(d), len(topics))
+		for _, t := range topics {
+			fmt.Fprintf(out, "  %-50s %s\n", sanitizeForTerminal(t), strings.Join(l.byDevice[d][t], ", "))
+		}
+		bad += len(topics)
+	}
+	fmt.Fprintf(out, "%d topic(s) observed, %d with violations\n", len(l.seen), bad)
+	return bad
+}
+
+// runLintTopics implements "mqttcli lint-topics": it observes topics for a while
+// and reports those breaking naming conventions. It exits 1 if any do.
+func runLintTopics(args []string) {
+	fs := flag.NewFlagSet("lint-topics", flag.ExitOnError)
+	flags := initCLIFlags(fs)
+	var rules lintRules
+	fs.IntVar(&rules.MaxDepth, "max-depth", 8, "Maximum number of topic levels (0 disables). AWS IoT allows 8.")
+	fs.BoolVar(&rules.AllowUppercase, "allow-uppercase", false, "Do not report uppercase characters.")
+	fs.BoolVar(&rules.AllowSpaces, "allow-spaces", false, "Do not report whitespace.")
+	duration := fs.Duration("duration", 30*time.Second, "How long to observe topics before reporting (0 waits for Ctrl+C).")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s lint-topics [options]\n\n"+
+			"--topic defaults to '#'. Topics are grouped by the 'device' field of --topic-pattern when set.\n\nOptions:\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if len(flags.Topics) == 0 && flags.ConfigPath == "" {
+		flags.Topics = topicFlag{{Topic: "#"}}
+	}
+
+	cfg := buildConfig(flags)
+	pattern, err := parseTopicPattern(cfg.TopicPattern)
+	if err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+
+	ctx := context.Background()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	l := newTopicLinter(rules, pattern)
+	runSubscription(ctx, &cfg, l.handler)
+	if l.report(os.Stdout) > 0 {
+		os.Exit(1)
+	}
+}
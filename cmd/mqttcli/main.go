@@ -3,13 +3,14 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"math"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -19,22 +20,189 @@ import (
 // Config holds all the MQTT connection and subscription details.
 type Config struct {
 	// MQTT connection details
-	BrokerURL string `json:"broker_url"` // e.g. "ssl://your-iot-endpoint.amazonaws.com:8883" or "tcp://localhost:1883"
-	ClientID  string `json:"client_id"`  // e.g. "myTestClient"
-	Username  string `json:"username"`   // optional for AWS IoT; sometimes used for other brokers
-	Password  string `json:"password"`   // optional for AWS IoT; sometimes used for other brokers
-	CAFile    string `json:"ca_file"`    // path to root CA cert (e.g. AmazonRootCA1.pem)
-	CertFile  string `json:"cert_file"`  // path to device/client certificate
-	KeyFile   string `json:"key_file"`   // path to private key
-	Insecure  bool   `json:"insecure"`   // skip server cert validation (not recommended in production)
+	BrokerURL      string   `json:"broker_url"`       // e.g. "ssl://your-iot-endpoint.amazonaws.com:8883" or "tcp://localhost:1883"
+	Protocol       uint     `json:"protocol_version"` // 3 for MQTT 3.1, 4 for MQTT 3.1.1 (default), 5 for MQTT v5
+	AirGapped      bool     `json:"air_gapped"`       // only ever connect to the broker's host and port, ignoring proxies
+	ClientID       string   `json:"client_id"`        // e.g. "myTestClient"
+	Username       string   `json:"username"`         // optional for AWS IoT; sometimes used for other brokers
+	Password       string   `json:"password"`         // optional for AWS IoT; sometimes used for other brokers
+	CAFile         string   `json:"ca_file"`          // path to root CA cert (e.g. AmazonRootCA1.pem)
+	CertFile       string   `json:"cert_file"`        // path to device/client certificate
+	KeyFile        string   `json:"key_file"`         // path to private key
+	ChainFile      string   `json:"chain_file"`       // path to intermediate CA certs sent after the client certificate
+	CAPEM          string   `json:"ca_pem"`           // inline root CA PEM; takes precedence over ca_file
+	CertPEM        string   `json:"cert_pem"`         // inline client certificate PEM; takes precedence over cert_file
+	KeyPEM         string   `json:"key_pem"`          // inline private key PEM; takes precedence over key_file
+	KeyPassword    string   `json:"key_password"`     // passphrase of an encrypted private key (or $MQTTCLI_KEY_PASSWORD)
+	PKCS12File     string   `json:"pkcs12_file"`      // .p12/.pfx bundle with the client certificate, key, and CA chain; replaces cert_file and key_file
+	PKCS12Password string   `json:"pkcs12_password"`  // password of pkcs12_file (or $MQTTCLI_PKCS12_PASSWORD)
+	PKCS11Module   string   `json:"pkcs11_module"`    // PKCS#11 library of a hardware token or HSM holding the client key, which never leaves it
+	PKCS11Slot     *uint    `json:"pkcs11_slot"`      // slot ID of the token (default: the first slot with a token)
+	PKCS11PIN      string   `json:"pkcs11_pin"`       // user PIN of the token (or $MQTTCLI_PKCS11_PIN)
+	PKCS11KeyLabel string   `json:"pkcs11_key_label"` // CKA_LABEL of the private key (default: the only key on the token)
+	Insecure       bool     `json:"insecure"`         // skip server cert validation (not recommended in production)
+	PinSHA256      []string `json:"pin_sha256"`       // SPKI pins; the broker must present one of these keys, CA validation or not
+	ALPN           []string `json:"alpn"`             // TLS ALPN protocols to offer, e.g. "x-amzn-mqtt-ca" for AWS IoT on port 443
+	TLSServerName  string   `json:"tls_server_name"`  // SNI and certificate hostname to use instead of the broker URL's host
+	CRLFile        string   `json:"crl_file"`         // PEM or DER CRLs; fail if the broker's certificate is revoked
+	OCSP           string   `json:"ocsp"`             // OCSP revocation check: "stapled", "must-staple", or "check" (default off)
+	TLSKeyLog      string   `json:"tls_keylog"`       // append TLS session secrets here, for decrypting captures in Wireshark (debugging only)
+	TLSMinVersion  string   `json:"tls_min_version"`  // oldest TLS version to accept: "1.0", "1.1", "1.2" (default), or "1.3"
+	TLSMaxVersion  string   `json:"tls_max_version"`  // newest TLS version to offer (default "1.3")
+	Ciphers        []string `json:"ciphers"`          // TLS 1.2 and older cipher suites to offer, by IANA name (default: Go's secure suites)
+
+	// Certificate expiry checks
+	CertExpiryWarnDays int  `json:"cert_expiry_warn_days"` // warn when a cert expires within this many days (default 30)
+	StrictCertExpiry   bool `json:"strict_cert_expiry"`    // refuse to start if a cert is within the warning window
+
+	// WebSocket (ws:// and wss://) dial options
+	WSSubprotocols     []string          `json:"ws_subprotocols"`      // offered subprotocols, e.g. ["mqtt"] (default) or ["mqttv3.1"]
+	WSCompression      bool              `json:"ws_compression"`       // negotiate permessage-deflate
+	WSHandshakeTimeout Duration          `json:"ws_handshake_timeout"` // limit for the HTTP upgrade (default 10s)
+	WSPath             string            `json:"ws_path"`              // replaces the broker URL's path, e.g. "/mqtt"
+	WSHeaders          map[string]string `json:"ws_headers"`           // extra HTTP headers for the upgrade request; values may use {env:NAME}, {file:PATH}, {exec:COMMAND}
+	WSHeaderCommand    string            `json:"ws_header_command"`    // helper printing 'Name: value' header lines, run for each connection
+	WSHeaderRefresh    Duration          `json:"ws_header_refresh"`    // reuse evaluated dynamic headers this long; zero evaluates them per connection
+
+	// HTTP tunnel (http:// and https:// broker URLs, experimental)
+	TunnelToken string `json:"tunnel_token"` // shared secret expected by the relay
+
+	// MQTT v5 (protocol_version 5) only
+	SessionExpiry   Duration          `json:"session_expiry"`   // keep the session this long after disconnecting; zero starts clean
+	MessageExpiry   Duration          `json:"message_expiry"`   // expiry interval set on published messages
+	UserProperties  map[string]string `json:"user_properties"`  // user properties set on published messages
+	ContentType     string            `json:"content_type"`     // content type set on published messages, e.g. "application/json"
+	CorrelationData string            `json:"correlation_data"` // correlation data set on published messages
+	ResponseTopic   string            `json:"response_topic"`   // response topic set on published messages, e.g. by rpc
+	TopicAliasMax   uint16            `json:"topic_alias_max"`  // topic aliases to use each way for repeated topics; zero disables them
+
+	// MQTT v5 subscription options
+	NoLocal           bool `json:"no_local"`            // don't receive messages this client published itself
+	RetainAsPublished bool `json:"retain_as_published"` // keep the retain flag of messages as published, as a bridge needs
+	RetainHandling    byte `json:"retain_handling"`     // retained messages on subscribing: 0 always (default), 1 only for new subscriptions, 2 never
+
+	// Timeouts; zero uses the defaults
+	ConnectTimeout   Duration `json:"connect_timeout"`   // e.g. "30s"
+	SubscribeTimeout Duration `json:"subscribe_timeout"` // e.g. "10s"
+	ConnectAttempts  int      `json:"connect_attempts"`  // connection attempts before giving up (default 1)
+	TotalTimeout     Duration `json:"total_timeout"`     // overall limit for connecting and subscribing; zero means none
+
+	// Reconnecting after a lost connection
+	NoReconnect       bool     `json:"no_reconnect"`        // exit with status 1 instead of reconnecting
+	ReconnectDelay    Duration `json:"reconnect_delay"`     // first delay before reconnecting (default 1s)
+	ReconnectMaxDelay Duration `json:"reconnect_max_delay"` // delays double up to this (default 30s)
+	ReconnectJitter   float64  `json:"reconnect_jitter"`    // spread each delay by this fraction, e.g. 0.2 for ±20%
+
+	// Adapting to broker limits (max QoS, retain, packet size, shared subscriptions)
+	NoAdapt  bool   `json:"no_adapt"`  // don't cache broker limits or adapt to them
+	CapsFile string `json:"caps_file"` // cache of broker limits (default brokers.json in the user cache directory)
+
+	// Exit conditions; zero runs until interrupted
+	Count        int      `json:"count"`         // exit successfully after this many messages
+	Timeout      Duration `json:"timeout"`       // exit with status 4 if fewer than count (or no) messages arrive within this long of subscribing
+	SkipRetained bool     `json:"skip_retained"` // ignore retained messages, e.g. the burst sent on subscribing
+	RetainedOnly bool     `json:"retained_only"` // print the retained messages and exit
+
+	// Shutting down on SIGINT/SIGTERM or after count
+	UnsubscribeOnExit bool     `json:"unsubscribe_on_exit"` // unsubscribe before disconnecting, so a persistent session stops queuing messages
+	DrainTimeout      Duration `json:"drain_timeout"`       // longest wait to unsubscribe and finish in-flight QoS 1/2 publishes (default 1s)
+	MetricsFile       string   `json:"metrics_file"`        // write a JSON snapshot of messages, bytes, errors, and latencies here on exit
+	InflightInterval  Duration `json:"inflight_interval"`   // log the QoS 1/2 packet IDs awaiting acknowledgement this often; zero only on SIGUSR1
+	HistoryListen     string   `json:"history_listen"`      // serve the last messages of each topic over HTTP here, e.g. 127.0.0.1:8787
+	HistorySize       int      `json:"history_size"`        // messages kept per topic for history_listen (default 100)
+	HistoryMaxBytes   string   `json:"history_max_bytes"`   // cap on all buffered messages, e.g. "16MiB" (default 64MiB)
+
+	// Dropping stale messages, e.g. a queued backlog after reconnecting to a session
+	MaxAge         Duration `json:"max_age"`         // drop messages whose timestamp field is older than this
+	TimestampField string   `json:"timestamp_field"` // dotted path of the payload's JSON timestamp (default "timestamp")
+	LatencyBudget  Duration `json:"latency_budget"`  // warn when handling a message takes longer than this, naming the slow stages
+	SkipBacklog    string   `json:"skip_backlog"`    // after reconnecting, skip up to this many queued messages ("500"), or those older than this ("10m")
 
 	// Subscription details
-	Topic       string `json:"topic"`        // e.g. "iot/gnss/+/data"
-	QoS         byte   `json:"qos"`          // 0, 1, or 2
-	Quiet       bool   `json:"quiet"`        // if true, don’t print incoming messages
-	PrintErrors bool   `json:"print_errors"` // if true, log or print errors verbosely
+	Topic         string              `json:"topic"`          // e.g. "iot/gnss/+/data"
+	Topics        []TopicSubscription `json:"topics"`         // more filters, each with an optional qos
+	TopicsFile    string              `json:"topics_file"`    // more filters, one per line, followed while subscribed
+	ShareGroup    string              `json:"share_group"`    // subscribe to every filter as "$share/GROUP/filter"
+	QoS           byte                `json:"qos"`            // 0, 1, or 2
+	Quiet         bool                `json:"quiet"`          // if true, don’t print incoming messages
+	PrintErrors   bool                `json:"print_errors"`   // if true, log or print errors verbosely
+	Raw           bool                `json:"raw"`            // print topics and payloads as received, without escaping control characters
+	PayloadFormat string              `json:"payload_format"` // "string" (default), "raw", "hex", or "base64"
+	Pretty        bool                `json:"pretty"`         // indent JSON payloads, colored when stdout is a terminal
+	Format        string              `json:"format"`         // text message lines: "short" (default), "full", or "payload-only"
+	Timestamp     string              `json:"timestamp"`      // prefix text message lines with "unix", "rfc3339", or "relative" time; "none" (default)
+	Template      string              `json:"template"`       // Go text/template for each message line, e.g. "{{.Topic}} {{.Payload | json \"temp\"}}"
+	EventLog      string              `json:"event_log"`      // Windows: also write events to the Application log under this source
+	ReadOnly      bool                `json:"read_only"`      // refuse every publish and any command that publishes
+	Record        string              `json:"record"`         // save the command line and received messages to this file for "mqttcli play"
+	Output        string              `json:"output"`         // "text" (default) or "json" for JSON Lines messages on stdout and JSON status records on stderr
 
-	// Optional: Publish details (could be extended to allow a publish payload, etc.)
+	ExecSinks       []string `json:"exec_sinks"`       // commands that read each message as a JSON line on stdin
+	Exec            string   `json:"exec"`             // command run per message, payload on stdin and MQTT_* variables
+	ExecConcurrency int      `json:"exec_concurrency"` // most exec commands running at once (default 1)
+	ExecTimeout     Duration `json:"exec_timeout"`     // kill an exec command running longer than this; zero means no limit
+	ExecPartition   string   `json:"exec_partition"`   // "topic" or a topic_pattern field: run commands for each value in order
+	OutFIFO         string   `json:"out_fifo"`         // named pipe to write each message to as a JSON line
+	OutFIFOBlock    bool     `json:"out_fifo_block"`   // wait for a slow FIFO reader instead of dropping messages
+	DBusSignal      string   `json:"dbus_signal"`      // "session" or "system": emit a D-Bus signal per message (Linux)
+	OutDir          string   `json:"out_dir"`          // write each payload to its own file in this directory
+	OutName         string   `json:"out_name"`         // file name template for out_dir (default "{topic}_{timestamp}")
+	AtLeastOnce     bool     `json:"at_least_once"`    // MQTT v5: acknowledge each message only once exec or out_dir has it
+
+	Shard string `json:"shard"` // "I/N": only process topics hashing to shard I of N
+
+	// Payload decoding
+	Decoders         []DecoderRule `json:"decoders"`          // first matching topic filter wins
+	ProtoDescriptors string        `json:"proto_descriptors"` // FileDescriptorSet for protobuf:Type decoders
+
+	// Output shaping
+	TopicPattern  string            `json:"topic_pattern"`  // e.g. "iot/gnss/{device}/data"; names fields parsed from topics
+	TopicRewrites []TopicRewrite    `json:"topic_rewrites"` // applied in order, first match wins
+	TopicAbbrev   bool              `json:"topic_abbrev"`   // automatically alias long topic prefixes in text output
+	TopicAliases  map[string]string `json:"topic_aliases"`  // prefix -> alias for text output, e.g. "$aws/things/myThing/": "thing:"
+
+	// Publish guards, checked by "pub" before each message is sent
+	Rate            float64            `json:"rate"`              // with pub --lines, most messages per second; zero is unlimited
+	MaxPayloadSize  string             `json:"max_payload_size"`  // refuse payloads bigger than this, e.g. "128KB" for AWS IoT
+	TopicRateLimits map[string]float64 `json:"topic_rate_limits"` // topic filter -> most messages per second to the topics it matches
+	GuardAction     string             `json:"guard_action"`      // "block" (default) refuses or holds back publishes over a limit, "warn" logs and sends them
+	MaxPacketSize   string             `json:"max_packet_size"`   // the broker's maximum packet size, if it doesn't advertise one, e.g. "128KB"
+	Chunk           bool               `json:"chunk"`             // publish payloads over the maximum packet size in chunks, for reassemble to put together
+	Reassemble      bool               `json:"reassemble"`        // put chunked payloads back together before handling them
+	Delta           bool               `json:"delta"`             // publish retained documents as deltas against the one retained before
+	Reconstruct     bool               `json:"reconstruct"`       // apply the deltas delta publishes, handling the documents they produce
+
+	fileTopics []TopicSubscription // read from TopicsFile
+}
+
+// Default timeouts for the connect and subscribe phases.
+const (
+	defaultConnectTimeout   = 30 * time.Second
+	defaultSubscribeTimeout = 10 * time.Second
+)
+
+// Duration is a time.Duration that reads from JSON as a string such as "30s"
+// or a number of seconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch t := v.(type) {
+	case float64:
+		*d = Duration(t * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(t)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", b)
+	}
+	return nil
 }
 
 // loadConfig reads a JSON file into a Config struct.
@@ -50,11 +218,62 @@ func loadConfig(configPath string) (*Config, error) {
 	return &cfg, nil
 }
 
+// Environment variables holding inline PEM material, for containers that
+// mount secrets as env vars rather than files.
+const (
+	envCAPEM   = "MQTTCLI_CA_PEM"
+	envCertPEM = "MQTTCLI_CERT_PEM"
+	envKeyPEM  = "MQTTCLI_KEY_PEM"
+)
+
+// envReadOnly set to any non-empty value forces --read-only, so an operator
+// can make a whole shell session safe for production brokers.
+const envReadOnly = "MQTTCLI_READ_ONLY"
+
+// overrideWithEnv sets any non-empty environment variables into the Config struct.
+func overrideWithEnv(cfg *Config) {
+	if v := os.Getenv(envCAPEM); v != "" {
+		cfg.CAPEM = v
+	}
+	if v := os.Getenv(envCertPEM); v != "" {
+		cfg.CertPEM = v
+	}
+	if v := os.Getenv(envKeyPEM); v != "" {
+		cfg.KeyPEM = v
+	}
+	if v := os.Getenv(envKeyPassword); v != "" {
+		cfg.KeyPassword = v
+	}
+	if v := os.Getenv(envPKCS12Password); v != "" {
+		cfg.PKCS12Password = v
+	}
+	if v := os.Getenv(envPKCS11PIN); v != "" {
+		cfg.PKCS11PIN = v
+	}
+	if os.Getenv(envReadOnly) != "" {
+		cfg.ReadOnly = true
+	}
+}
+
 // overrideWithFlags sets any non-zero CLI flags into the Config struct to allow easy overrides.
-func overrideWithFlags(cfg *Config, flags *cliFlags) {
+func overrideWithFlags(cfg *Config, flags *cliFlags) error {
+	hasTLSFiles := flags.CAFile != "" || flags.CertFile != "" || flags.KeyFile != "" || flags.PKCS12File != "" || flags.PKCS11Module != ""
+	if u := flags.Mosquitto.brokerURL(hasTLSFiles); u != "" {
+		cfg.BrokerURL = u
+	}
 	if flags.BrokerURL != "" {
 		cfg.BrokerURL = flags.BrokerURL
 	}
+	if flags.AirGapped {
+		cfg.AirGapped = true
+	}
+	if flags.Protocol != "" {
+		v, err := parseProtocolVersion(flags.Protocol)
+		if err != nil {
+			return err
+		}
+		cfg.Protocol = v
+	}
 	if flags.ClientID != "" {
 		cfg.ClientID = flags.ClientID
 	}
@@ -64,17 +283,50 @@ func overrideWithFlags(cfg *Config, flags *cliFlags) {
 	if flags.Password != "" {
 		cfg.Password = flags.Password
 	}
-	if flags.Topic != "" {
-		cfg.Topic = flags.Topic
+	if len(flags.Topics) > 0 {
+		cfg.Topic, cfg.Topics = "", flags.Topics
+	}
+	if flags.TopicsFile != "" {
+		cfg.TopicsFile = flags.TopicsFile
 	}
+	if flags.ShareGroup != "" {
+		cfg.ShareGroup = flags.ShareGroup
+	}
+	// A file flag also replaces inline PEM from the config or environment,
+	// which would otherwise take precedence over it
 	if flags.CAFile != "" {
-		cfg.CAFile = flags.CAFile
+		cfg.CAFile, cfg.CAPEM = flags.CAFile, ""
 	}
 	if flags.CertFile != "" {
-		cfg.CertFile = flags.CertFile
+		cfg.CertFile, cfg.CertPEM = flags.CertFile, ""
 	}
 	if flags.KeyFile != "" {
-		cfg.KeyFile = flags.KeyFile
+		cfg.KeyFile, cfg.KeyPEM = flags.KeyFile, ""
+	}
+	if flags.KeyPassword != "" {
+		cfg.KeyPassword = flags.KeyPassword
+	}
+	if flags.PKCS12File != "" {
+		cfg.PKCS12File = flags.PKCS12File
+	}
+	if flags.PKCS12Password != "" {
+		cfg.PKCS12Password = flags.PKCS12Password
+	}
+	if flags.PKCS11Module != "" {
+		cfg.PKCS11Module = flags.PKCS11Module
+	}
+	if flags.PKCS11Slot >= 0 {
+		slot := uint(flags.PKCS11Slot)
+		cfg.PKCS11Slot = &slot
+	}
+	if flags.PKCS11PIN != "" {
+		cfg.PKCS11PIN = flags.PKCS11PIN
+	}
+	if flags.PKCS11KeyLabel != "" {
+		cfg.PKCS11KeyLabel = flags.PKCS11KeyLabel
+	}
+	if flags.ChainFile != "" {
+		cfg.ChainFile = flags.ChainFile
 	}
 	if flags.QoS >= 0 {
 		cfg.QoS = byte(flags.QoS)
@@ -82,98 +334,686 @@ func overrideWithFlags(cfg *Config, flags *cliFlags) {
 	if flags.Insecure {
 		cfg.Insecure = true
 	}
+	if len(flags.PinSHA256) > 0 {
+		cfg.PinSHA256 = flags.PinSHA256
+	}
+	if len(flags.ALPN) > 0 {
+		cfg.ALPN = flags.ALPN
+	}
+	if flags.TLSServerName != "" {
+		cfg.TLSServerName = flags.TLSServerName
+	}
+	if flags.CRLFile != "" {
+		cfg.CRLFile = flags.CRLFile
+	}
+	if flags.OCSP != "" {
+		cfg.OCSP = flags.OCSP
+	}
+	if flags.TLSKeyLog != "" {
+		cfg.TLSKeyLog = flags.TLSKeyLog
+	}
+	if flags.TLSMinVersion != "" {
+		cfg.TLSMinVersion = flags.TLSMinVersion
+	}
+	if flags.TLSMaxVersion != "" {
+		cfg.TLSMaxVersion = flags.TLSMaxVersion
+	}
+	if len(flags.Ciphers) > 0 {
+		cfg.Ciphers = flags.Ciphers
+	}
+	if flags.CertExpiryWarnDays > 0 {
+		cfg.CertExpiryWarnDays = flags.CertExpiryWarnDays
+	}
+	if flags.StrictCertExpiry {
+		cfg.StrictCertExpiry = true
+	}
 	if flags.Quiet {
 		cfg.Quiet = true
 	}
 	if flags.PrintErrors {
 		cfg.PrintErrors = true
 	}
+	if flags.Raw {
+		cfg.Raw = true
+	}
+	if flags.PayloadFormat != "" {
+		cfg.PayloadFormat = flags.PayloadFormat
+	}
+	if flags.Pretty {
+		cfg.Pretty = true
+	}
+	if flags.Format != "" {
+		cfg.Format = flags.Format
+	}
+	if flags.Timestamp != "" {
+		cfg.Timestamp = flags.Timestamp
+	}
+	if flags.Template != "" {
+		cfg.Template = flags.Template
+	}
+	if flags.ReadOnly {
+		cfg.ReadOnly = true
+	}
+	if flags.Record != "" {
+		cfg.Record = flags.Record
+	}
+	if flags.Output != "" {
+		cfg.Output = flags.Output
+	}
+	if flags.EventLog != "" {
+		cfg.EventLog = flags.EventLog
+	}
+	if flags.ConnectTimeout > 0 {
+		cfg.ConnectTimeout = Duration(flags.ConnectTimeout)
+	}
+	if flags.SubscribeTimeout > 0 {
+		cfg.SubscribeTimeout = Duration(flags.SubscribeTimeout)
+	}
+	if flags.ConnectAttempts > 0 {
+		cfg.ConnectAttempts = flags.ConnectAttempts
+	}
+	if flags.WSSubprotocols != "" {
+		cfg.WSSubprotocols = strings.Split(flags.WSSubprotocols, ",")
+	}
+	if flags.WSCompression {
+		cfg.WSCompression = true
+	}
+	if flags.WSHandshakeTimeout > 0 {
+		cfg.WSHandshakeTimeout = Duration(flags.WSHandshakeTimeout)
+	}
+	if flags.WSPath != "" {
+		cfg.WSPath = flags.WSPath
+	}
+	if len(flags.WSHeaders) > 0 {
+		if cfg.WSHeaders == nil {
+			cfg.WSHeaders = map[string]string{}
+		}
+		for name, value := range flags.WSHeaders {
+			cfg.WSHeaders[name] = value
+		}
+	}
+	if flags.WSHeaderCommand != "" {
+		cfg.WSHeaderCommand = flags.WSHeaderCommand
+	}
+	if flags.WSHeaderRefresh > 0 {
+		cfg.WSHeaderRefresh = Duration(flags.WSHeaderRefresh)
+	}
+	if flags.TunnelToken != "" {
+		cfg.TunnelToken = flags.TunnelToken
+	}
+	if flags.SessionExpiry > 0 {
+		cfg.SessionExpiry = Duration(flags.SessionExpiry)
+	}
+	if flags.MessageExpiry > 0 {
+		cfg.MessageExpiry = Duration(flags.MessageExpiry)
+	}
+	if flags.TopicAliasMax > 0 {
+		cfg.TopicAliasMax = uint16(min(flags.TopicAliasMax, 65535)) // the most MQTT allows
+	}
+	if len(flags.UserProperties) > 0 {
+		if cfg.UserProperties == nil {
+			cfg.UserProperties = map[string]string{}
+		}
+		for key, value := range flags.UserProperties {
+			cfg.UserProperties[key] = value
+		}
+	}
+	if flags.ContentType != "" {
+		cfg.ContentType = flags.ContentType
+	}
+	if flags.CorrelationData != "" {
+		cfg.CorrelationData = flags.CorrelationData
+	}
+	if flags.NoLocal {
+		cfg.NoLocal = true
+	}
+	if flags.RetainAsPublished {
+		cfg.RetainAsPublished = true
+	}
+	if flags.RetainHandling > 0 {
+		cfg.RetainHandling = byte(flags.RetainHandling)
+	}
+	if flags.TotalTimeout > 0 {
+		cfg.TotalTimeout = Duration(flags.TotalTimeout)
+	}
+	if flags.NoReconnect {
+		cfg.NoReconnect = true
+	}
+	if flags.ReconnectDelay > 0 {
+		cfg.ReconnectDelay = Duration(flags.ReconnectDelay)
+	}
+	if flags.ReconnectMaxDelay > 0 {
+		cfg.ReconnectMaxDelay = Duration(flags.ReconnectMaxDelay)
+	}
+	if flags.ReconnectJitter > 0 {
+		cfg.ReconnectJitter = flags.ReconnectJitter
+	}
+	if flags.NoAdapt {
+		cfg.NoAdapt = true
+	}
+	if flags.CapsFile != "" {
+		cfg.CapsFile = flags.CapsFile
+	}
+	if flags.Count > 0 {
+		cfg.Count = flags.Count
+	}
+	if flags.Timeout > 0 {
+		cfg.Timeout = Duration(flags.Timeout)
+	}
+	if flags.SkipRetained {
+		cfg.SkipRetained = true
+	}
+	if flags.RetainedOnly {
+		cfg.RetainedOnly = true
+	}
+	if flags.UnsubscribeOnExit {
+		cfg.UnsubscribeOnExit = true
+	}
+	if flags.DrainTimeout > 0 {
+		cfg.DrainTimeout = Duration(flags.DrainTimeout)
+	}
+	if flags.MetricsFile != "" {
+		cfg.MetricsFile = flags.MetricsFile
+	}
+	if flags.InflightInterval > 0 {
+		cfg.InflightInterval = Duration(flags.InflightInterval)
+	}
+	if flags.HistoryListen != "" {
+		cfg.HistoryListen = flags.HistoryListen
+	}
+	if flags.HistorySize > 0 {
+		cfg.HistorySize = flags.HistorySize
+	}
+	if flags.HistoryMaxBytes != "" {
+		cfg.HistoryMaxBytes = flags.HistoryMaxBytes
+	}
+	if flags.Rate != 0 {
+		cfg.Rate = flags.Rate
+	}
+	if flags.MaxPayloadSize != "" {
+		cfg.MaxPayloadSize = flags.MaxPayloadSize
+	}
+	if len(flags.TopicRateLimits) > 0 {
+		if cfg.TopicRateLimits == nil {
+			cfg.TopicRateLimits = map[string]float64{}
+		}
+		for filter, rate := range flags.TopicRateLimits {
+			cfg.TopicRateLimits[filter] = rate
+		}
+	}
+	if flags.GuardAction != "" {
+		cfg.GuardAction = flags.GuardAction
+	}
+	if flags.MaxPacketSize != "" {
+		cfg.MaxPacketSize = flags.MaxPacketSize
+	}
+	if flags.Chunk {
+		cfg.Chunk = true
+	}
+	if flags.Reassemble {
+		cfg.Reassemble = true
+	}
+	if flags.Delta {
+		cfg.Delta = true
+	}
+	if flags.Reconstruct {
+		cfg.Reconstruct = true
+	}
+	if flags.MaxAge > 0 {
+		cfg.MaxAge = Duration(flags.MaxAge)
+	}
+	if flags.TimestampField != "" {
+		cfg.TimestampField = flags.TimestampField
+	}
+	if flags.LatencyBudget > 0 {
+		cfg.LatencyBudget = Duration(flags.LatencyBudget)
+	}
+	if flags.SkipBacklog != "" {
+		cfg.SkipBacklog = flags.SkipBacklog
+	}
+	if flags.Shard != "" {
+		cfg.Shard = flags.Shard
+	}
+	if len(flags.ExecSinks) > 0 {
+		cfg.ExecSinks = flags.ExecSinks
+	}
+	if flags.Exec != "" {
+		cfg.Exec = flags.Exec
+	}
+	if flags.ExecConcurrency != 0 {
+		cfg.ExecConcurrency = flags.ExecConcurrency
+	}
+	if flags.ExecTimeout != 0 {
+		cfg.ExecTimeout = Duration(flags.ExecTimeout)
+	}
+	if flags.ExecPartition != "" {
+		cfg.ExecPartition = flags.ExecPartition
+	}
+	if flags.OutFIFO != "" {
+		cfg.OutFIFO = flags.OutFIFO
+	}
+	if flags.OutFIFOBlock {
+		cfg.OutFIFOBlock = true
+	}
+	if flags.DBusSignal != "" {
+		cfg.DBusSignal = flags.DBusSignal
+	}
+	if flags.OutDir != "" {
+		cfg.OutDir = flags.OutDir
+	}
+	if flags.OutName != "" {
+		cfg.OutName = flags.OutName
+	}
+	if flags.AtLeastOnce {
+		cfg.AtLeastOnce = true
+	}
+	if len(flags.Decoders) > 0 {
+		cfg.Decoders = flags.Decoders
+	}
+	if flags.ProtoDescriptors != "" {
+		cfg.ProtoDescriptors = flags.ProtoDescriptors
+	}
+	if flags.TopicPattern != "" {
+		cfg.TopicPattern = flags.TopicPattern
+	}
+	if len(flags.Rewrites) > 0 {
+		cfg.TopicRewrites = flags.Rewrites
+	}
+	if flags.TopicAbbrev {
+		cfg.TopicAbbrev = true
+	}
+	if len(flags.TopicAliases) > 0 {
+		if cfg.TopicAliases == nil {
+			cfg.TopicAliases = map[string]string{}
+		}
+		for prefix, alias := range flags.TopicAliases {
+			cfg.TopicAliases[prefix] = alias
+		}
+	}
+	return nil
 }
 
 type cliFlags struct {
-	ConfigPath  string
-	BrokerURL   string
-	ClientID    string
-	Username    string
-	Password    string
-	Topic       string
-	CAFile      string
-	CertFile    string
-	KeyFile     string
-	QoS         int
-	Insecure    bool
-	Quiet       bool
-	PrintErrors bool
-}
-
-// initCLIFlags defines our command-line flags with usage text.
-func initCLIFlags() *cliFlags {
-	var f cliFlags
+	ConfigPath     string
+	BrokerURL      string
+	Protocol       string
+	AirGapped      bool
+	ClientID       string
+	Username       string
+	Password       string
+	Topics         topicFlag
+	TopicsFile     string
+	ShareGroup     string
+	CAFile         string
+	CertFile       string
+	KeyFile        string
+	KeyPassword    string
+	PKCS12File     string
+	PKCS12Password string
+	PKCS11Module   string
+	PKCS11Slot     int
+	PKCS11PIN      string
+	PKCS11KeyLabel string
+	ChainFile      string
+	QoS            int
+	Insecure       bool
+	PinSHA256      stringsFlag
+	ALPN           stringsFlag
+	TLSServerName  string
+	CRLFile        string
+	OCSP           string
+	TLSKeyLog      string
+	TLSMinVersion  string
+	TLSMaxVersion  string
+	Ciphers        stringsFlag
+	Quiet          bool
+	PrintErrors    bool
+	Raw            bool
+	PayloadFormat  string
+	Pretty         bool
+	Format         string
+	Timestamp      string
+	Template       string
+	ReadOnly       bool
+	Record         string
+	Output         string
+	EventLog       string
+
+	ConnectTimeout   time.Duration
+	SubscribeTimeout time.Duration
+	ConnectAttempts  int
+	TotalTimeout     time.Duration
+
+	NoReconnect       bool
+	ReconnectDelay    time.Duration
+	ReconnectMaxDelay time.Duration
+	ReconnectJitter   float64
+
+	NoAdapt  bool
+	CapsFile string
+
+	Count        int
+	Timeout      time.Duration
+	SkipRetained bool
+	RetainedOnly bool
+
+	UnsubscribeOnExit bool
+	DrainTimeout      time.Duration
+	MetricsFile       string
+	InflightInterval  time.Duration
+	HistoryListen     string
+	HistorySize       int
+	HistoryMaxBytes   string
+
+	Rate            float64
+	MaxPayloadSize  string
+	TopicRateLimits rateLimitFlag
+	GuardAction     string
+	MaxPacketSize   string
+	Chunk           bool
+	Reassemble      bool
+	Delta           bool
+	Reconstruct     bool
+
+	MaxAge         time.Duration
+	TimestampField string
+	LatencyBudget  time.Duration
+	SkipBacklog    string
+
+	SessionExpiry   time.Duration
+	MessageExpiry   time.Duration
+	TopicAliasMax   int
+	UserProperties  propertyFlag
+	ContentType     string
+	CorrelationData string
+
+	NoLocal           bool
+	RetainAsPublished bool
+	RetainHandling    int
+
+	WSSubprotocols     string
+	WSCompression      bool
+	WSHandshakeTimeout time.Duration
+	WSPath             string
+	WSHeaders          headerFlag
+	WSHeaderCommand    string
+	WSHeaderRefresh    time.Duration
+
+	TunnelToken string
+
+	CertExpiryWarnDays int
+	StrictCertExpiry   bool
+
+	ExecSinks        stringsFlag
+	Exec             string
+	ExecConcurrency  int
+	ExecTimeout      time.Duration
+	ExecPartition    string
+	OutFIFO          string
+	OutFIFOBlock     bool
+	DBusSignal       string
+	OutDir           string
+	OutName          string
+	AtLeastOnce      bool
+	Shard            string
+	Decoders         decoderFlag
+	ProtoDescriptors string
+
+	TopicPattern string
+	Rewrites     rewriteFlag
+	TopicAbbrev  bool
+	TopicAliases aliasFlag
+
+	Mosquitto mosquittoFlags
+}
+
+// stringsFlag collects a repeated string flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return fmt.Sprint(*s)
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// rewriteFlag collects repeated --rewrite flags.
+type rewriteFlag []TopicRewrite
+
+func (r *rewriteFlag) String() string {
+	return fmt.Sprint(*r)
+}
+
+func (r *rewriteFlag) Set(s string) error {
+	rule, err := parseTopicRewrite(s)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+// decoderFlag collects repeated --decoder flags.
+type decoderFlag []DecoderRule
 
-	flag.StringVar(&f.ConfigPath, "config", "", "Path to JSON config file (optional). If provided, this file is loaded first.")
-	flag.StringVar(&f.BrokerURL, "broker", "", "Broker URL, e.g. 'ssl://<endpoint>:8883' or 'tcp://localhost:1883'")
-	flag.StringVar(&f.ClientID, "clientid", "", "MQTT client ID (must be unique per broker).")
-	flag.StringVar(&f.Username, "username", "", "MQTT username if broker requires it.")
-	flag.StringVar(&f.Password, "password", "", "MQTT password if broker requires it.")
-	flag.StringVar(&f.Topic, "topic", "", "MQTT topic to subscribe to.")
-	flag.StringVar(&f.CAFile, "cafile", "", "Path to root CA certificate file (e.g. AmazonRootCA1.pem).")
-	flag.StringVar(&f.CertFile, "certfile", "", "Path to client certificate file (x.509).")
-	flag.StringVar(&f.KeyFile, "keyfile", "", "Path to client private key file.")
-	flag.IntVar(&f.QoS, "qos", -1, "QoS level for subscription (0, 1, or 2).")
-	flag.BoolVar(&f.Insecure, "insecure", false, "Skip TLS server cert verification (NOT recommended).")
-	flag.BoolVar(&f.Quiet, "quiet", false, "If set, do not print incoming messages.")
-	flag.BoolVar(&f.PrintErrors, "verbose-errors", false, "Print errors verbosely if set.")
-
-	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(),
-			`Usage: %s [options]
-
-This utility subscribes to an MQTT topic using Eclipse Paho, supporting optional TLS for
-AWS IoT Core or other brokers. Configuration can come from both a JSON file and CLI flags.
-CLI flags override JSON values.
-
-Options:
-`, filepath.Base(os.Args[0]))
-		flag.PrintDefaults()
-
-		fmt.Println(`
-Examples:
-
-  # Basic local broker usage:
-  mqttcli --broker "tcp://localhost:1883" --clientid "testClient" \
-          --topic "my/test/topic" --qos 1
-
-  # Using AWS IoT Core with mutual TLS:
-  mqttcli --broker "ssl://<endpoint>.amazonaws.com:8883" \
-          --clientid "myThing" \
-          --cafile "AmazonRootCA1.pem" \
-          --certfile "deviceCert.crt" \
-          --keyfile "deviceKey.key" \
-          --topic "iot/gnss/myThing/data" --qos 1
-
-  # JSON config usage:
-  mqttcli --config /path/to/config.json
-`)
+func (d *decoderFlag) String() string {
+	return fmt.Sprint(*d)
+}
+
+func (d *decoderFlag) Set(s string) error {
+	rule, err := parseDecoderRule(s)
+	if err != nil {
+		return err
 	}
+	*d = append(*d, rule)
+	return nil
+}
+
+// initCLIFlags defines our command-line flags on fs. Every mode shares these
+// connection and output flags.
+func initCLIFlags(fs *flag.FlagSet) *cliFlags {
+	var f cliFlags
+
+	fs.StringVar(&f.ConfigPath, "config", "", "Path to JSON config file (optional). If provided, this file is loaded first.")
+	fs.StringVar(&f.BrokerURL, "broker", "", "Broker URL, e.g. 'ssl://<endpoint>:8883' or 'tcp://localhost:1883'")
+	fs.StringVar(&f.ClientID, "clientid", "", "MQTT client ID (must be unique per broker).")
+	fs.StringVar(&f.Username, "username", "", "MQTT username if broker requires it.")
+	fs.StringVar(&f.Password, secretFlag("password"), "", "MQTT password if broker requires it.")
+	fs.Var(&f.Topics, "topic", "MQTT topic to subscribe to, as FILTER or FILTER@QOS. Repeatable or comma-separated.")
+	fs.StringVar(&f.TopicsFile, "topics-file", "", "Also subscribe to the filters in this file, one per line as FILTER or FILTER QOS, following changes to it.")
+	fs.StringVar(&f.ShareGroup, "share-group", "", "Subscribe as a member of this shared subscription group ($share/GROUP/FILTER), so the broker spreads messages across members.")
+	fs.StringVar(&f.CAFile, "cafile", "", "Path to root CA certificate file (e.g. AmazonRootCA1.pem).")
+	fs.StringVar(&f.CertFile, "certfile", "", "Path to client certificate file (x.509).")
+	fs.StringVar(&f.KeyFile, "keyfile", "", "Path to client private key file.")
+	fs.StringVar(&f.KeyPassword, secretFlag("key-password"), "", "Passphrase of an encrypted private key (default $MQTTCLI_KEY_PASSWORD, else prompted for on a terminal).")
+	fs.StringVar(&f.PKCS12File, "pkcs12", "", "Path to a PKCS#12 (.p12/.pfx) bundle holding the client certificate, key, and CA chain, instead of --certfile and --keyfile.")
+	fs.StringVar(&f.PKCS12Password, secretFlag("pkcs12-password"), "", "Password of the --pkcs12 bundle (default $MQTTCLI_PKCS12_PASSWORD, else empty, then prompted for on a terminal).")
+	fs.StringVar(&f.PKCS11Module, "pkcs11-module", "", "Path to the PKCS#11 library of a hardware token or HSM holding the client key (e.g. /usr/lib/softhsm/libsofthsm2.so); the key never leaves the token.")
+	fs.IntVar(&f.PKCS11Slot, "pkcs11-slot", -1, "Slot ID of the PKCS#11 token (default the first slot with a token).")
+	fs.StringVar(&f.PKCS11PIN, secretFlag("pkcs11-pin"), "", "User PIN of the PKCS#11 token (default $MQTTCLI_PKCS11_PIN, else prompted for on a terminal).")
+	fs.StringVar(&f.PKCS11KeyLabel, "pkcs11-key-label", "", "Label (CKA_LABEL) of the private key on the PKCS#11 token (default the only key on it).")
+	fs.StringVar(&f.ChainFile, "chainfile", "", "Path to intermediate CA certificates to send after the client certificate.")
+	fs.StringVar(&f.Protocol, "protocol", "", "MQTT protocol version: 3 (3.1), 4 (3.1.1, default), or 5.")
+	fs.BoolVar(&f.AirGapped, "air-gapped", false, "Only ever connect to the broker's host and port; proxies are ignored and other connections refused.")
+	fs.DurationVar(&f.SessionExpiry, "session-expiry", 0, "MQTT v5: keep the session on the broker this long after disconnecting (0 starts a clean session).")
+	fs.DurationVar(&f.MessageExpiry, "message-expiry", 0, "MQTT v5: expiry interval for published messages.")
+	fs.IntVar(&f.TopicAliasMax, "topic-alias-max", 0, "MQTT v5: use up to this many topic aliases each way, sending repeated long topics as 2-byte numbers (0 disables).")
+	fs.Var(&f.UserProperties, "property", "MQTT v5: user property for published messages, as KEY=VALUE. Repeatable.")
+	fs.StringVar(&f.ContentType, "content-type", "", "MQTT v5: content type for published messages, e.g. 'application/json'.")
+	fs.StringVar(&f.CorrelationData, "correlation-data", "", "MQTT v5: correlation data for published messages.")
+	fs.BoolVar(&f.NoLocal, "no-local", false, "MQTT v5: don't receive messages published on this connection.")
+	fs.BoolVar(&f.RetainAsPublished, "retain-as-published", false, "MQTT v5: keep the retain flag of forwarded messages as published.")
+	fs.IntVar(&f.RetainHandling, "retain-handling", 0, "MQTT v5: retained messages on subscribing: 0 always (default), 1 only for new subscriptions, 2 never.")
+	fs.StringVar(&f.WSSubprotocols, "ws-subprotocol", "", "WebSocket subprotocols to offer, comma-separated (default 'mqtt'; some brokers want 'mqttv3.1').")
+	fs.BoolVar(&f.WSCompression, "ws-compression", false, "Negotiate WebSocket permessage-deflate compression.")
+	fs.DurationVar(&f.WSHandshakeTimeout, "ws-handshake-timeout", 0, "Time limit for the WebSocket upgrade handshake (default 10s).")
+	fs.StringVar(&f.WSPath, "ws-path", "", "Path of the WebSocket endpoint, replacing the broker URL's path (e.g. '/mqtt').")
+	fs.Var(&f.WSHeaders, secretFlag("ws-header"), "Extra HTTP header 'Name: value' for the WebSocket upgrade request; values may use {env:NAME}, {file:PATH}, and {exec:COMMAND}. Repeatable.")
+	fs.StringVar(&f.WSHeaderCommand, "ws-header-command", "", "Helper command printing 'Name: value' lines to add as WebSocket upgrade headers, run for each connection.")
+	fs.DurationVar(&f.WSHeaderRefresh, "ws-header-refresh", 0, "Reuse headers from helpers and placeholders for this long instead of evaluating them for every connection.")
+	fs.StringVar(&f.TunnelToken, secretFlag("tunnel-token"), "", "Experimental: shared secret for an http:// or https:// tunnel relay (see 'mqttcli relay').")
+	fs.IntVar(&f.QoS, "qos", -1, "QoS level for subscription (0, 1, or 2).")
+	fs.BoolVar(&f.Insecure, "insecure", false, "Skip TLS server cert verification (NOT recommended).")
+	fs.Var(&f.PinSHA256, "pin-sha256", "Only accept a broker presenting this key: the base64 SHA-256 of its SubjectPublicKeyInfo ('sha256//...'), checked on top of CA validation. Repeatable.")
+	fs.Var(&f.ALPN, "alpn", "TLS ALPN protocol to offer, e.g. 'x-amzn-mqtt-ca' for AWS IoT mutual TLS on port 443 (the default there). Repeatable or comma-separated.")
+	fs.StringVar(&f.TLSServerName, "tls-server-name", "", "Server name to send (SNI) and verify the broker's certificate against, instead of the broker URL's host.")
+	fs.StringVar(&f.CRLFile, "crl-file", "", "Path to PEM or DER CRLs; refuse the broker if its certificate is revoked.")
+	fs.StringVar(&f.OCSP, "ocsp", "", "Check the broker's certificate with OCSP: stapled (check a stapled response), must-staple (require one), or check (also ask the responder).")
+	fs.StringVar(&f.TLSKeyLog, "tls-keylog", "", "Append TLS session secrets to this file, for decrypting your own captures in Wireshark. Debugging only: the file decrypts the traffic.")
+	fs.StringVar(&f.TLSMinVersion, "tls-min-version", "", "Oldest TLS version to accept: 1.0, 1.1, 1.2 (default), or 1.3.")
+	fs.StringVar(&f.TLSMaxVersion, "tls-max-version", "", "Newest TLS version to offer: 1.0, 1.1, 1.2, or 1.3 (default).")
+	fs.Var(&f.Ciphers, "ciphers", "TLS 1.2 and older cipher suite to offer, by IANA name, e.g. 'TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256'. Repeatable or comma-separated.")
+	fs.IntVar(&f.CertExpiryWarnDays, "cert-expiry-warn-days", 0, "Warn when a CA or client cert expires within this many days (default 30).")
+	fs.BoolVar(&f.StrictCertExpiry, "strict-cert-expiry", false, "Refuse to start if a CA or client cert is within the expiry warning window.")
+	fs.DurationVar(&f.ConnectTimeout, "connect-timeout", 0, "Give up connecting after this long (default 30s).")
+	fs.DurationVar(&f.SubscribeTimeout, "subscribe-timeout", 0, "Give up waiting for SUBACK after this long (default 10s).")
+	fs.IntVar(&f.ConnectAttempts, "connect-attempts", 0, "Connection attempts before giving up with exit status 3 (default 1).")
+	fs.DurationVar(&f.TotalTimeout, "total-timeout", 0, "Overall time limit for connecting and subscribing, across all attempts; exits with status 3.")
+	fs.BoolVar(&f.NoReconnect, "no-reconnect", false, "Exit with status 1 when the connection is lost instead of reconnecting and resubscribing.")
+	fs.DurationVar(&f.ReconnectDelay, "reconnect-delay", 0, "Delay before the first reconnect attempt; later delays double (default 1s).")
+	fs.DurationVar(&f.ReconnectMaxDelay, "reconnect-max-delay", 0, "Longest delay between reconnect attempts (default 30s).")
+	fs.Float64Var(&f.ReconnectJitter, "reconnect-jitter", 0, "Randomly spread reconnect delays by this fraction, e.g. 0.2 for ±20%.")
+	fs.BoolVar(&f.NoAdapt, "no-adapt", false, "Don't cache broker limits or lower QoS, drop retain, and so on to fit them.")
+	fs.StringVar(&f.CapsFile, "caps-file", "", "File caching the limits of each broker (default brokers.json in the user cache directory).")
+	fs.BoolVar(&f.Quiet, "quiet", false, "If set, do not print incoming messages.")
+	fs.BoolVar(&f.PrintErrors, "verbose-errors", false, "Print errors verbosely if set.")
+	fs.BoolVar(&f.Raw, "raw", false, "Print topics and payloads as received, without escaping control characters and ANSI sequences.")
+	fs.StringVar(&f.PayloadFormat, "payload-format", "", "How to print payloads: string (default, escaped), raw (bytes as received), hex, or base64.")
+	fs.BoolVar(&f.Pretty, "pretty", false, "Indent JSON object and array payloads, with colors when stdout is a terminal (unless $NO_COLOR is set).")
+	fs.StringVar(&f.Format, "format", "", "Text message lines: short (default), full (adds retained flag, message ID, and size), or payload-only.")
+	fs.StringVar(&f.Timestamp, "timestamp", "", "Prefix text message lines with the arrival time: none (default), unix, rfc3339, or relative.")
+	fs.StringVar(&f.Template, "template", "", "Print each message with this Go template instead, e.g. '{{.Topic}} {{.Payload | json \"temp\"}}'.")
+	fs.BoolVar(&f.ReadOnly, "read-only", false, "Refuse every publish, and refuse commands that publish (pub, explode, aggregate --publish). Also set by $MQTTCLI_READ_ONLY.")
+	fs.StringVar(&f.MetricsFile, "metrics-file", "", "On exit, write a JSON snapshot of messages, bytes, errors, and latency percentiles to this file (compare runs with 'mqttcli metrics diff').")
+	fs.DurationVar(&f.InflightInterval, "inflight-interval", 0, "Log the QoS 1/2 in-flight window (packet IDs awaiting PUBACK, PUBREC, or PUBCOMP, their age, and retransmissions) this often. 'kill -USR1' logs it any time.")
+	fs.StringVar(&f.Record, "record", "", "Save the command line and every received message to this file, to show again with 'mqttcli play'.")
+	fs.StringVar(&f.EventLog, "eventlog", "", "Windows: also write lifecycle events, warnings, and errors to the Application event log under this source name.")
+	fs.StringVar(&f.Output, "output", "", "Output format: 'text' (default) or 'json' for one JSON object per message on stdout and structured status and error records on stderr.")
+	fs.StringVar(&f.Shard, "shard", "", "Only process topics in shard 'I/N' (hash of topic modulo N), e.g. '2/5'.")
+	fs.Var(&f.Decoders, "decoder", "Decoder chain 'FILTER=DECODER[,DECODER...]' (gzip, zlib, base64, hex, cbor, nmea, protobuf[:Type], or sniff to detect the format per message). Repeatable.")
+	fs.StringVar(&f.ProtoDescriptors, "proto-descriptors", "", "FileDescriptorSet used by protobuf:Type decoders (protoc --include_imports --descriptor_set_out).")
+	fs.StringVar(&f.TopicPattern, "topic-pattern", "", "Parse named fields from topics, e.g. 'iot/gnss/{device}/data'.")
+	fs.Var(&f.Rewrites, "rewrite", "Topic rewrite rule 'MATCH=>REPLACE' for printed topics, e.g. '^iot/gnss/(.+)/data$=>fleet/${1}/position'. Repeatable.")
+	fs.BoolVar(&f.TopicAbbrev, "topic-abbrev", false, "Shorten long topic prefixes in text output to numbered aliases (~1, ~2, ...).")
+	fs.Var(&f.TopicAliases, "topic-alias", "Display alias 'PREFIX=ALIAS' for text output, e.g. '$aws/things/myThing/=thing:'. Repeatable.")
+	initMosquittoFlags(fs, &f)
 
 	return &f
 }
 
-// messageHandler prints incoming messages (unless quiet).
-func messageHandler(cfg *Config) mqtt.MessageHandler {
+// messageRecord is one received message in --output json mode.
+type messageRecord struct {
+	Topic           string             `json:"topic"`
+	QoS             byte               `json:"qos"`
+	Retained        bool               `json:"retained"`
+	Timestamp       string             `json:"timestamp"`
+	Payload         string             `json:"payload"`
+	PayloadEncoding string             `json:"payload_encoding,omitempty"` // "base64" when the payload is not valid UTF-8
+	Fields          map[string]string  `json:"fields,omitempty"`           // matched by --topic-pattern
+	Properties      *messageProperties `json:"properties,omitempty"`       // MQTT v5 properties
+}
+
+// messageHandler prints incoming messages (unless quiet), with topics passed through rw
+// and then ab, and any fields matched by tp printed before the payload. With
+// --output json each message is printed as a messageRecord line instead, with
+// the topic as received.
+func messageHandler(cfg *Config, tp *topicPattern, rw *topicRewriter, ab *topicAbbreviator) mqtt.MessageHandler {
+	color := cfg.Pretty && stdoutIsTerminal()
+	stamps := newStamper(cfg.Timestamp)
+	tmpl, _ := parseMessageTemplate(cfg.Template) // checked with the rest of the config
 	return func(client mqtt.Client, msg mqtt.Message) {
-		if !cfg.Quiet {
-			fmt.Printf("[MSG RECEIVED] Topic=%s QoS=%d Payload=%s\n",
-				msg.Topic(), msg.Qos(), msg.Payload())
+		if cfg.Quiet {
+			return
+		}
+		if cfg.Output == outputJSON {
+			rec := newMessageRecord(msg, tp)
+			encodeRecordPayload(&rec, msg.Payload(), cfg.PayloadFormat)
+			line, _ := json.Marshal(rec)
+			fmt.Printf("%s\n", line)
+			return
+		}
+		if tmpl != nil {
+			line, err := tmpl.render(msg, tp)
+			if err != nil {
+				logWarn("template_failed", "Template failed for a message on '%s': %v", msg.Topic(), err)
+				return
+			}
+			if !cfg.Raw {
+				line = sanitizeForTerminal(line)
+			}
+			fmt.Println(line)
+			return
 		}
+		stamp := stamps.stamp(time.Now())
+		fields := ""
+		if m, ok := tp.Match(msg.Topic()); ok && len(m) > 0 {
+			fields = tp.formatFields(m) + " "
+		}
+		if props := messagePropertiesOf(msg).format(); props != "" {
+			fields += props + " "
+		}
+		prefix := stamp + metadata(cfg.Format, ab.Abbreviate(rw.Rewrite(msg.Topic())), msg, fields)
+		if !cfg.Raw {
+			prefix = sanitizeForTerminal(prefix)
+		}
+		if cfg.Pretty {
+			if payload, ok := prettyPayload(msg.Payload(), cfg.Raw, color); ok {
+				fmt.Println(prefix + payload)
+				return
+			}
+		}
+		fmt.Println(prefix + formatPayload(msg.Payload(), cfg.PayloadFormat, cfg.Raw))
+	}
+}
+
+// Delays between connection attempts double from connectRetryDelay up to connectRetryMaxDelay.
+const (
+	connectRetryDelay    = time.Second
+	connectRetryMaxDelay = 30 * time.Second
+)
+
+// connectWithRetry makes up to cfg.ConnectAttempts connection attempts, waiting
+// between them, and stops early on errors that retrying won't fix or when ctx
+// is done. It returns the last error.
+func connectWithRetry(ctx context.Context, cfg *Config) (mqtt.Client, error) {
+	delay := connectRetryDelay
+	for attempt := 1; ; attempt++ {
+		client, err := connectReconnecting(ctx, cfg)
+		if err == nil {
+			return client, nil
+		}
+		if attempt >= cfg.ConnectAttempts || !isRetryable(err) || ctx.Err() != nil {
+			return nil, err
+		}
+		logWarn("connect_retry", "Connection attempt %d/%d failed: %v; retrying in %s",
+			attempt, cfg.ConnectAttempts, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, err
+		}
+		delay = min(delay*2, connectRetryMaxDelay)
 	}
 }
 
 // connectMQTT sets up and connects an MQTT client based on the provided Config.
-func connectMQTT(cfg *Config) (mqtt.Client, error) {
+// It gives up when cfg.ConnectTimeout elapses or ctx is done. onLost is called
+// if the connection drops later; the client doesn't reconnect by itself.
+func connectMQTT(ctx context.Context, cfg *Config, onLost func(error)) (mqtt.Client, error) {
+	startInflightReporting(cfg)
+	if cfg.Protocol == 5 {
+		return connectMQTTv5(ctx, cfg, onLost)
+	}
+
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(cfg.BrokerURL)
 	opts.SetClientID(cfg.ClientID)
+	opts.SetConnectTimeout(time.Duration(cfg.ConnectTimeout))
+	if cfg.Protocol != 0 {
+		opts.SetProtocolVersion(cfg.Protocol)
+	}
 	if cfg.Username != "" {
 		opts.SetUsername(cfg.Username)
 	}
@@ -185,34 +1025,70 @@ func connectMQTT(cfg *Config) (mqtt.Client, error) {
 	if err := configureTLS(opts, cfg); err != nil {
 		return nil, err
 	}
+	if isWebSocketURL(cfg.BrokerURL) {
+		header, err := wsHeader(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if header != nil {
+			opts.SetHTTPHeaders(header)
+		}
+	}
+	switch {
+	case isWebSocketURL(cfg.BrokerURL) && (hasWebSocketOptions(cfg) || airGap != nil):
+		opts.SetCustomOpenConnectionFn(openWebSocket(cfg))
+	case isTunnelURL(cfg.BrokerURL):
+		opts.SetCustomOpenConnectionFn(openTunnel(cfg))
+	case airGap != nil:
+		opts.SetCustomOpenConnectionFn(openEgress)
+	}
 
 	// OnConnectionLost
+	opts.SetAutoReconnect(false)
+	opts.SetStore(newInflightStore(inflight))
 	opts.OnConnectionLost = func(client mqtt.Client, err error) {
 		if cfg.PrintErrors {
-			log.Printf("[ERROR] MQTT connection lost: %v", err)
+			logError("connection_lost", true, "MQTT connection lost: %v", err)
 		}
+		onLost(err)
 	}
 
 	// Create and start connection
 	client := mqtt.NewClient(opts)
-	token := client.Connect()
-	token.Wait()
-	if err := token.Error(); err != nil {
+	if err := waitToken(ctx, client.Connect(), time.Duration(cfg.ConnectTimeout), "connect"); err != nil {
+		client.Disconnect(0)
 		return nil, err
 	}
 
 	return client, nil
 }
 
-func configureTLS(opts *mqtt.ClientOptions, cfg *Config) error {
-	// Only configure TLS if scheme is "ssl" or user provided CA/cert files
-	isSSL := false
-	if len(cfg.BrokerURL) > 5 {
-		isSSL = (cfg.BrokerURL[0:5] == "ssl://")
+// hasTLSMaterial reports whether any CA or client certificate was configured.
+func hasTLSMaterial(cfg *Config) bool {
+	return cfg.CAFile != "" || cfg.CertFile != "" || cfg.KeyFile != "" ||
+		cfg.CAPEM != "" || cfg.CertPEM != "" || cfg.KeyPEM != "" || cfg.PKCS12File != "" || cfg.PKCS11Module != ""
+}
+
+// hasTLSOptions reports whether any setting of the TLS handshake itself was
+// configured.
+func hasTLSOptions(cfg *Config) bool {
+	return len(cfg.PinSHA256) > 0 || len(cfg.ALPN) > 0 || cfg.TLSServerName != "" || cfg.CRLFile != "" || cfg.OCSP != "" || cfg.TLSKeyLog != "" || cfg.TLSMinVersion != "" || cfg.TLSMaxVersion != "" || len(cfg.Ciphers) > 0
+}
+
+// isTLSBrokerURL reports whether a broker URL's scheme is one that uses TLS.
+func isTLSBrokerURL(broker string) bool {
+	scheme, _, _ := strings.Cut(broker, "://")
+	switch strings.ToLower(scheme) {
+	case "ssl", "tls", "mqtts", "tcps", "wss", "https":
+		return true
 	}
+	return false
+}
 
-	if isSSL || cfg.CAFile != "" || cfg.CertFile != "" || cfg.KeyFile != "" {
-		tlsConfig, err := NewTLSConfig(cfg.CAFile, cfg.CertFile, cfg.KeyFile, cfg.Insecure)
+func configureTLS(opts *mqtt.ClientOptions, cfg *Config) error {
+	// Only configure TLS for a TLS scheme or when user provided CA/cert files
+	if isTLSBrokerURL(cfg.BrokerURL) || hasTLSMaterial(cfg) || hasTLSOptions(cfg) {
+		tlsConfig, err := NewTLSConfig(cfg)
 		if err != nil {
 			return err
 		}
@@ -221,71 +1097,421 @@ func configureTLS(opts *mqtt.ClientOptions, cfg *Config) error {
 	return nil
 }
 
-// subscribeToTopic subscribes to the configured topic and waits for messages.
-func subscribeToTopic(client mqtt.Client, cfg *Config, handler mqtt.MessageHandler) error {
-	token := client.Subscribe(cfg.Topic, cfg.QoS, handler)
-	token.Wait()
-	return token.Error()
+// subscribeToTopic subscribes to the configured topics and waits for the SUBACK.
+func subscribeToTopic(ctx context.Context, client mqtt.Client, cfg *Config, handler mqtt.MessageHandler) error {
+	subs := cfg.subscriptions()
+	token := client.SubscribeMultiple(subs, handler)
+	if err := waitToken(ctx, token, time.Duration(cfg.SubscribeTimeout), "subscribe"); err != nil {
+		return err
+	}
+	// MQTT 3.1.1 brokers refuse individual filters with a 0x80 return code
+	if st, ok := token.(*mqtt.SubscribeToken); ok {
+		for topic, code := range st.Result() {
+			if code == 0x80 {
+				return fmt.Errorf("broker refused the subscription to '%s'", topic)
+			}
+		}
+	}
+	return nil
+}
+
+// phaseError reports which phase (connect, subscribe, ...) timed out or was interrupted.
+type phaseError struct {
+	phase string
+	err   error
 }
 
-func main() {
-	// 1. Parse CLI flags
-	flags := initCLIFlags()
-	flag.Parse()
+func (e *phaseError) Error() string { return fmt.Sprintf("%s %v", e.phase, e.err) }
+func (e *phaseError) Unwrap() error { return e.err }
+
+// errTimeout marks a phaseError caused by the phase's timeout elapsing.
+var errTimeout = errors.New("timed out")
+
+// waitToken waits for token to complete, giving up when timeout elapses or
+// ctx is done, so a hung broker can't block shutdown.
+func waitToken(ctx context.Context, token mqtt.Token, timeout time.Duration, phase string) error {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-expired:
+		return &phaseError{phase, fmt.Errorf("%w after %s", errTimeout, timeout)}
+	case <-ctx.Done():
+		return &phaseError{phase, fmt.Errorf("interrupted: %w", ctx.Err())}
+	}
+}
+
+// phaseErrorCode returns the event code for a failed phase: "<phase>_timeout"
+// when it timed out, otherwise "<phase>_failed".
+func phaseErrorCode(phase string, err error) string {
+	if errors.Is(err, errTimeout) {
+		return phase + "_timeout"
+	}
+	return phase + "_failed"
+}
 
-	// 2. Load config file if provided
+// buildConfig loads the config file (if any), applies environment and flag
+// overrides, and validates the minimal required fields.
+func buildConfig(flags *cliFlags) Config {
+	// Honour --output json for errors raised while loading the config itself
+	jsonEvents = flags.Output == outputJSON
+
+	// Load config file if provided
 	var cfg Config
 	if flags.ConfigPath != "" {
 		loadedCfg, err := loadConfig(flags.ConfigPath)
 		if err != nil {
-			log.Fatalf("[ERROR] could not load config file: %v\n", err)
+			fatal("config_load_failed", false, "could not load config file: %v", err)
 		}
 		cfg = *loadedCfg
 	}
 
-	// 3. Override config with CLI flags (if set)
-	overrideWithFlags(&cfg, flags)
+	// Override config with environment, then CLI flags (if set)
+	overrideWithEnv(&cfg)
+	if err := overrideWithFlags(&cfg, flags); err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+	switch cfg.Output {
+	case "", outputText, outputJSON:
+		jsonEvents = cfg.Output == outputJSON
+	default:
+		fatal("config_invalid", false, "Unknown output format '%s'; use 'text' or 'json'.", cfg.Output)
+	}
+	if cfg.EventLog != "" && eventLog == nil {
+		w, err := openEventLog(cfg.EventLog)
+		if err != nil {
+			fatal("config_invalid", false, "%v", err)
+		}
+		eventLog = w
+	}
 
-	// 4. Validate minimal required fields
+	// Validate minimal required fields
 	if cfg.BrokerURL == "" {
-		log.Fatalf("[ERROR] Broker URL is not set. Provide via --broker or config file.")
+		fatal("config_invalid", false, "Broker URL is not set. Provide via --broker or config file.")
 	}
 	if cfg.ClientID == "" {
-		log.Fatalf("[ERROR] Client ID is not set. Provide via --clientid or config file.")
+		fatal("config_invalid", false, "Client ID is not set. Provide via --clientid or config file.")
+	}
+	if cfg.TopicsFile != "" {
+		subs, err := loadTopicsFile(cfg.TopicsFile)
+		if err != nil {
+			fatal("config_invalid", false, "%v", err)
+		}
+		cfg.fileTopics = subs
+	}
+	if len(cfg.subscriptions()) == 0 {
+		fatal("config_invalid", false, "Topic is not set. Provide via --topic, --topics-file, or config file.")
+	}
+	if cfg.ShareGroup != "" {
+		if err := validShareGroup(cfg.ShareGroup); err != nil {
+			fatal("config_invalid", false, "%v", err)
+		}
+	}
+	for filter := range cfg.subscriptions() {
+		if isSharedSubscription(filter) {
+			if err := validSharedFilter(filter); err != nil {
+				fatal("config_invalid", false, "%v", err)
+			}
+		}
+	}
+	if cfg.Protocol != 0 && cfg.Protocol != 3 && cfg.Protocol != 4 && cfg.Protocol != 5 {
+		fatal("config_invalid", false, "Unsupported protocol_version %d; use 3 (MQTT 3.1), 4 (MQTT 3.1.1), or 5 (MQTT v5).", cfg.Protocol)
 	}
-	if cfg.Topic == "" {
-		log.Fatalf("[ERROR] Topic is not set. Provide via --topic or config file.")
+	if cfg.Protocol != 5 && (cfg.SessionExpiry > 0 || cfg.MessageExpiry > 0) {
+		fatal("config_invalid", false, "session_expiry and message_expiry need protocol_version 5.")
+	}
+	if cfg.Protocol != 5 && (len(cfg.UserProperties) > 0 || cfg.ContentType != "" || cfg.CorrelationData != "" || cfg.ResponseTopic != "") {
+		fatal("config_invalid", false, "user_properties, content_type, correlation_data, and response_topic need protocol_version 5.")
+	}
+	if cfg.Protocol != 5 && cfg.TopicAliasMax > 0 {
+		fatal("config_invalid", false, "topic_alias_max needs protocol_version 5.")
+	}
+	if cfg.Protocol != 5 && (cfg.NoLocal || cfg.RetainAsPublished || cfg.RetainHandling != 0) {
+		fatal("config_invalid", false, "no_local, retain_as_published, and retain_handling need protocol_version 5.")
+	}
+	if cfg.RetainHandling > 2 {
+		fatal("config_invalid", false, "Unsupported retain_handling %d; use 0, 1, or 2.", cfg.RetainHandling)
+	}
+	if cfg.RetainedOnly && cfg.RetainHandling != 0 {
+		fatal("config_invalid", false, "retained_only needs the broker to send retained messages, so retain_handling must be 0.")
+	}
+	if err := validPayloadFormat(cfg.PayloadFormat); err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+	if cfg.Pretty && (cfg.Output == outputJSON || (cfg.PayloadFormat != "" && cfg.PayloadFormat != payloadString)) {
+		fatal("config_invalid", false, "pretty needs text output and the default payload_format.")
+	}
+	if err := validTextFormat(cfg.Format); err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+	if err := validTimestamp(cfg.Timestamp); err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+	if cfg.Output == outputJSON && (cfg.Format != "" || (cfg.Timestamp != "" && cfg.Timestamp != timestampNone)) {
+		fatal("config_invalid", false, "format and timestamp need text output; JSON records always carry a timestamp.")
+	}
+	if _, err := parseMessageTemplate(cfg.Template); err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+	if cfg.Template != "" && (cfg.Output == outputJSON || cfg.Pretty || cfg.Format != "" || (cfg.Timestamp != "" && cfg.Timestamp != timestampNone)) {
+		fatal("config_invalid", false, "template replaces the whole line and can't be combined with output json, pretty, format, or timestamp.")
+	}
+	if cfg.PKCS12File != "" && (cfg.CertFile != "" || cfg.KeyFile != "" || cfg.CertPEM != "" || cfg.KeyPEM != "") {
+		fatal("config_invalid", false, "pkcs12_file holds the client certificate and key; don't also set cert_file, key_file, cert_pem, or key_pem.")
+	}
+	if cfg.PKCS11Module != "" && (cfg.KeyFile != "" || cfg.KeyPEM != "" || cfg.PKCS12File != "") {
+		fatal("config_invalid", false, "pkcs11_module keeps the client key on the token; don't also set key_file, key_pem, or pkcs12_file.")
+	}
+	if _, err := parsePins(cfg.PinSHA256); err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+	if len(cfg.PinSHA256) > 0 && !isTLSBrokerURL(cfg.BrokerURL) {
+		fatal("config_invalid", false, "pin_sha256 needs a TLS broker URL (ssl://, mqtts://, or wss://).")
+	}
+	if len(cfg.ALPN) > 0 && !isTLSBrokerURL(cfg.BrokerURL) {
+		fatal("config_invalid", false, "alpn needs a TLS broker URL (ssl://, mqtts://, or wss://).")
+	}
+	if err := validOCSPMode(cfg.OCSP); err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+	if (cfg.CRLFile != "" || (cfg.OCSP != "" && cfg.OCSP != "off")) && !isTLSBrokerURL(cfg.BrokerURL) {
+		fatal("config_invalid", false, "crl_file and ocsp need a TLS broker URL (ssl://, mqtts://, or wss://).")
+	}
+	if cfg.TLSKeyLog != "" && !isTLSBrokerURL(cfg.BrokerURL) {
+		fatal("config_invalid", false, "tls_keylog needs a TLS broker URL (ssl://, mqtts://, or wss://).")
+	}
+	if cfg.TLSServerName != "" {
+		if !isTLSBrokerURL(cfg.BrokerURL) {
+			fatal("config_invalid", false, "tls_server_name needs a TLS broker URL (ssl://, mqtts://, or wss://).")
+		}
+		if strings.ContainsAny(cfg.TLSServerName, "/: ") {
+			fatal("config_invalid", false, "tls_server_name '%s' should be a host name, without scheme or port.", cfg.TLSServerName)
+		}
+	}
+	if err := checkTLSVersions(&cfg); err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+	if (cfg.TLSMinVersion != "" || cfg.TLSMaxVersion != "" || len(cfg.Ciphers) > 0) && !isTLSBrokerURL(cfg.BrokerURL) {
+		fatal("config_invalid", false, "tls_min_version, tls_max_version, and ciphers need a TLS broker URL (ssl://, mqtts://, or wss://).")
+	}
+	if cfg.AirGapped {
+		if err := startAirGap(&cfg); err != nil {
+			fatal("config_invalid", false, "%v", err)
+		}
+	}
+	if cfg.PKCS11Module == "" && (cfg.PKCS11Slot != nil || cfg.PKCS11KeyLabel != "") {
+		fatal("config_invalid", false, "pkcs11_slot and pkcs11_key_label need pkcs11_module.")
+	}
+	if cfg.WSPath != "" {
+		if !isWebSocketURL(cfg.BrokerURL) {
+			fatal("config_invalid", false, "ws_path needs a ws:// or wss:// broker URL.")
+		}
+		cfg.BrokerURL = withWebSocketPath(cfg.BrokerURL, cfg.WSPath)
+	}
+	if cfg.WSHeaderCommand != "" && !isWebSocketURL(cfg.BrokerURL) {
+		fatal("config_invalid", false, "ws_header_command needs a ws:// or wss:// broker URL.")
+	}
+	if cfg.SkipRetained && cfg.RetainedOnly {
+		fatal("config_invalid", false, "skip_retained and retained_only can't both be set.")
+	}
+	if cfg.MaxAge < 0 {
+		fatal("config_invalid", false, "max_age must not be negative.")
+	}
+	if cfg.LatencyBudget < 0 {
+		fatal("config_invalid", false, "latency_budget must not be negative.")
+	}
+	if math.IsNaN(cfg.Rate) || cfg.Rate < 0 || cfg.Rate > maxPublishRate {
+		fatal("config_invalid", false, "rate must be between 0 (unlimited) and %g messages per second, got %v.", float64(maxPublishRate), cfg.Rate)
+	}
+	if cfg.DrainTimeout <= 0 {
+		cfg.DrainTimeout = Duration(defaultDrainTimeout)
+	}
+	if cfg.ConnectTimeout <= 0 {
+		cfg.ConnectTimeout = Duration(defaultConnectTimeout)
+	}
+	if cfg.SubscribeTimeout <= 0 {
+		cfg.SubscribeTimeout = Duration(defaultSubscribeTimeout)
+	}
+	if cfg.ReconnectDelay <= 0 {
+		cfg.ReconnectDelay = Duration(connectRetryDelay)
+	}
+	if cfg.ReconnectMaxDelay <= 0 {
+		cfg.ReconnectMaxDelay = Duration(connectRetryMaxDelay)
+	}
+	if cfg.ReconnectJitter < 0 || cfg.ReconnectJitter > 1 {
+		fatal("config_invalid", false, "reconnect_jitter must be between 0 and 1, got %v.", cfg.ReconnectJitter)
+	}
+	if cfg.ExecConcurrency < 0 {
+		fatal("config_invalid", false, "exec_concurrency must not be negative, got %d.", cfg.ExecConcurrency)
+	}
+	if cfg.ExecPartition != "" && cfg.Exec == "" {
+		fatal("config_invalid", false, "exec_partition needs exec.")
+	}
+	if cfg.AtLeastOnce {
+		if err := checkAtLeastOnce(&cfg); err != nil {
+			fatal("config_invalid", false, "%v.", err)
+		}
+	}
+	if cfg.HistorySize < 0 {
+		fatal("config_invalid", false, "history_size must not be negative, got %d.", cfg.HistorySize)
+	}
+	if cfg.HistoryListen == "" && (cfg.HistorySize != 0 || cfg.HistoryMaxBytes != "") {
+		fatal("config_invalid", false, "history_size and history_max_bytes need history_listen.")
+	}
+	if cfg.ConnectAttempts <= 0 {
+		cfg.ConnectAttempts = 1
 	}
 	// For QoS, if not set, default to 0.
 	if cfg.QoS != 0 && cfg.QoS != 1 && cfg.QoS != 2 {
 		cfg.QoS = 0
 	}
+	return cfg
+}
 
-	// 5. Connect to MQTT broker
-	client, err := connectMQTT(&cfg)
+// runSubscription connects, subscribes with handler, and blocks until SIGINT/SIGTERM
+// or until ctx is done.
+func runSubscription(ctx context.Context, cfg *Config, handler mqtt.MessageHandler) {
+	// Registered first, so it runs after every other deferred cleanup
+	ctx, cancelRun := context.WithCancelCause(ctx)
+	defer exitIfConnectionLost(ctx)
+
+	decoder, err := newPayloadDecoder(cfg.Decoders, cfg.ProtoDescriptors)
+	if err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+	shard, err := parseShard(cfg.Shard)
+	if err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+	counter := newMessageCounter(cfg.Count)
+	metrics := newMetricsRecorder(cfg)
+	defer metrics.write()
+	retained := newRetainedFilter(cfg)
+	ages := newAgeFilter(cfg)
+	chunks := newChunkAssembler(cfg)
+	deltas := newDeltaReconstructor(cfg)
+	backlog, err := parseSkipBacklog(cfg)
 	if err != nil {
-		log.Fatalf("[ERROR] MQTT connection failed: %v", err)
+		fatal("config_invalid", false, "%v", err)
 	}
+	recorder, err := newSessionRecorder(cfg)
+	if err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+	defer recorder.Close()
+	pipeline.start(cfg)
+	handler = pipeline.stage("record", recorder.wrap(pipeline.stage("handler", handler)))
+	handler = pipeline.stage("filters", metrics.wrap(chunks.wrap(deltas.wrap(retained.wrap(backlog.wrap(ages.wrap(shard.wrap(pipeline.stage("decode", decoder.wrap(counter.wrap(handler)))))))))))
+
+	// Handle graceful shutdown, including Ctrl+C while connecting or subscribing
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Connect to MQTT broker
+	client, setupCtx, cancelSetup := connectWithBudget(ctx, cfg)
+	defer cancelSetup()
 	defer client.Disconnect(250)
+	watchConnection(client, cancelRun)
+	backlog.watch(client)
 
-	log.Printf("[INFO] Connected to %s as clientID='%s'", cfg.BrokerURL, cfg.ClientID)
+	// Subscribe to topic
+	if err := subscribeToTopic(setupCtx, client, cfg, handler); err != nil {
+		client.Disconnect(0)
+		exitSetupFailure(ctx, setupCtx, cfg, "subscribe", err, "Failed to subscribe to %s: %v", describeSubscriptions(cfg.subscriptions()), err)
+	}
+	logInfo("subscribed", "Subscribed to %s", describeSubscriptions(cfg.subscriptions()))
+	cancelSetup()
+	stopTopics := watchTopicsFile(ctx, client, cfg, handler)
 
-	// 6. Subscribe to topic
-	if err := subscribeToTopic(client, &cfg, messageHandler(&cfg)); err != nil {
-		log.Fatalf("[ERROR] Failed to subscribe to topic '%s': %v\n", cfg.Topic, err)
+	if !counter.wait(retained.watch(ctx), time.Duration(cfg.Timeout)) {
+		client.Disconnect(250)
+		fatalStatus(exitNoMessages, "timeout", true, "Received %d of %d message(s) within %s.",
+			counter.received(), counter.wanted(), time.Duration(cfg.Timeout))
+	}
+	logInfo("shutting_down", "Shutting down...")
+	stopTopics()
+	if connectionLost(ctx) == nil {
+		drain(client, cfg)
 	}
-	log.Printf("[INFO] Subscribed to topic '%s' with QoS=%d", cfg.Topic, cfg.QoS)
+	ages.report()
+	pipeline.report()
+	logInfo("exited", "Exiting.")
+}
 
-	// 7. Handle graceful shutdown
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer stop()
+// connectionLostError is the cause of a run canceled by a lost connection
+// that no_reconnect keeps from being restored.
+type connectionLostError struct {
+	err error
+}
 
-	<-ctx.Done()
-	log.Println("[INFO] Shutting down...")
-	// Optional cleanup, e.g. unsubscribe:
-	// client.Unsubscribe(cfg.Topic).Wait()
+func (e *connectionLostError) Error() string { return "MQTT connection lost: " + e.err.Error() }
+func (e *connectionLostError) Unwrap() error { return e.err }
 
-	// Wait briefly to ensure final logs/messages are handled
-	time.Sleep(1 * time.Second)
-	log.Println("[INFO] Exiting.")
+// watchConnection cancels the run, with the error as its cause, when client
+// loses its connection for good.
+func watchConnection(client mqtt.Client, cancel context.CancelCauseFunc) {
+	if r, ok := client.(*reconnectingClient); ok {
+		r.onFailure(func(err error) { cancel(&connectionLostError{err}) })
+	}
+}
+
+// connectionLost returns the error that lost the connection if that's what
+// ended ctx, or nil.
+func connectionLost(ctx context.Context) error {
+	var lost *connectionLostError
+	if errors.As(context.Cause(ctx), &lost) {
+		return lost
+	}
+	return nil
+}
+
+// exitIfConnectionLost exits with status 1 if a lost connection ended ctx.
+func exitIfConnectionLost(ctx context.Context) {
+	if err := connectionLost(ctx); err != nil {
+		fatal("connection_lost", true, "%v", err)
+	}
+}
+
+// connectWithBudget connects within cfg's retry budget, exiting on failure. The
+// returned setup context carries the rest of the total timeout for any further
+// setup steps; cancel it once setup is complete.
+func connectWithBudget(ctx context.Context, cfg *Config) (mqtt.Client, context.Context, context.CancelFunc) {
+	// Bound the time spent getting connected (and subscribed)
+	setupCtx, cancelSetup := ctx, context.CancelFunc(func() {})
+	if cfg.TotalTimeout > 0 {
+		setupCtx, cancelSetup = context.WithTimeout(ctx, time.Duration(cfg.TotalTimeout))
+	}
+
+	client, err := connectWithRetry(setupCtx, cfg)
+	if err != nil {
+		exitSetupFailure(ctx, setupCtx, cfg, "connect", err, "MQTT connection failed: %v", err)
+	}
+	logInfo("connected", "Connected to %s as clientID='%s'", cfg.BrokerURL, cfg.ClientID)
+	return client, setupCtx, cancelSetup
+}
+
+// exitSetupFailure reports a failed connect or subscribe phase and exits. When a
+// retry budget is configured and a retryable failure used it up (or the total
+// timeout hit), the exit status is exitBudgetExhausted, so automation can tell
+// "gave up" from "misconfigured".
+func exitSetupFailure(ctx, setupCtx context.Context, cfg *Config, phase string, err error, format string, args ...interface{}) {
+	retryable := isRetryable(err)
+	budgeted := cfg.ConnectAttempts > 1 || cfg.TotalTimeout > 0
+	if budgeted && ctx.Err() == nil && (retryable || setupCtx.Err() != nil) {
+		if setupCtx.Err() != nil {
+			format += " (total timeout reached)"
+		}
+		fatalStatus(exitBudgetExhausted, "budget_exhausted", true, format, args...)
+	}
+	fatal(phaseErrorCode(phase, err), retryable, format, args...)
+}
+
+func main() {
+	dispatch(os.Args[1:])
+	closePKCS11()
 }
@@ -0,0 +1,42 @@
+// main_test.go
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+// parseTestFlags parses args as the common subscriber flags.
+func parseTestFlags(t *testing.T, args ...string) *cliFlags {
+	t.Helper()
+	fs := flag.NewFlagSet("sub", flag.ContinueOnError)
+	f := initCLIFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestInlinePEMPrecedence(t *testing.T) {
+	t.Setenv(envCAPEM, "env ca")
+	t.Setenv(envCertPEM, "env cert")
+	t.Setenv(envKeyPEM, "env key")
+	for _, tc := range []struct {
+		name          string
+		args          []string
+		ca, cert, key string
+	}{
+		{"environment over config", nil, "env ca", "env cert", "env key"},
+		{"file flags over environment", []string{"--cafile", "ca.pem", "--certfile", "c.pem", "--keyfile", "c.key"}, "", "", ""},
+		{"only the file flag given", []string{"--cafile", "ca.pem"}, "", "env cert", "env key"},
+	} {
+		cfg := Config{CAPEM: "config ca", CertPEM: "config cert", KeyPEM: "config key"}
+		overrideWithEnv(&cfg)
+		if err := overrideWithFlags(&cfg, parseTestFlags(t, tc.args...)); err != nil {
+			t.Fatal(err)
+		}
+		if cfg.CAPEM != tc.ca || cfg.CertPEM != tc.cert || cfg.KeyPEM != tc.key {
+			t.Errorf("%s: got inline %q, %q, %q, want %q, %q, %q", tc.name, cfg.CAPEM, cfg.CertPEM, cfg.KeyPEM, tc.ca, tc.cert, tc.key)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// maxage.go
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// defaultTimestampField is where --max-age looks for a payload's timestamp.
+const defaultTimestampField = "timestamp"
+
+// ageFilter implements --max-age: it drops messages whose JSON timestamp field
+// is older than maxAge. Messages without one pass, since their age can't be
+// told; brokers already discard MQTT v5 messages whose expiry has run out.
+type ageFilter struct {
+	maxAge  time.Duration
+	field   string
+	dropped atomic.Int64
+}
+
+func newAgeFilter(cfg *Config) *ageFilter {
+	field := cfg.TimestampField
+	if field == "" {
+		field = defaultTimestampField
+	}
+	return &ageFilter{maxAge: time.Duration(cfg.MaxAge), field: field}
+}
+
+// stale reports whether msg is too old to handle.
+func (f *ageFilter) stale(msg mqtt.Message) bool {
+	if v, ok := lookupJSONField(msg.Payload(), f.field); ok {
+		if sent, ok := parseTimestamp(v); ok {
+			return time.Since(sent) > f.maxAge
+		}
+	}
+	return false
+}
+
+func (f *ageFilter) wrap(next mqtt.MessageHandler) mqtt.MessageHandler {
+	if f.maxAge <= 0 {
+		return next
+	}
+	return func(client mqtt.Client, msg mqtt.Message) {
+		if f.stale(msg) {
+			if f.dropped.Add(1) == 1 {
+				logInfo("stale_dropped", "Dropping messages older than %s, starting with one on '%s'", f.maxAge, msg.Topic())
+			}
+			return
+		}
+		next(client, msg)
+	}
+}
+
+// report logs how many messages were dropped as stale.
+func (f *ageFilter) report() {
+	if n := f.dropped.Load(); n > 0 {
+		logInfo("stale_summary", "Dropped %d message(s) older than %s", n, f.maxAge)
+	}
+}
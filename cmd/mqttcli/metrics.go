@@ -0,0 +1,365 @@
+// metrics.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// latencySamples is how many latencies a run keeps for percentiles; longer
+// runs keep a uniform random sample of this size.
+const latencySamples = 100000
+
+// Warnings and errors logged so far, for the metrics snapshot.
+var warningEvents, errorEvents atomic.Int64
+
+// activeMetrics is the recorder writing --metrics-file, so a fatal exit can
+// still write the snapshot.
+var activeMetrics *metricsRecorder
+
+// latencySummary is a latency distribution in a metrics snapshot, in
+// milliseconds.
+type latencySummary struct {
+	Count int64   `json:"count"`
+	Min   float64 `json:"min_ms"`
+	Mean  float64 `json:"mean_ms"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P99   float64 `json:"p99_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+// metricsSnapshot is what --metrics-file holds, and what "mqttcli metrics
+// diff" compares.
+type metricsSnapshot struct {
+	Started           string                     `json:"started"`
+	DurationSeconds   float64                    `json:"duration_seconds"`
+	Broker            string                     `json:"broker"`
+	ClientID          string                     `json:"client_id"`
+	MessagesReceived  int64                      `json:"messages_received"`
+	BytesReceived     int64                      `json:"bytes_received"`
+	MessagesPublished int64                      `json:"messages_published"`
+	BytesPublished    int64                      `json:"bytes_published"`
+	Warnings          int64                      `json:"warnings"`
+	Errors            int64                      `json:"errors"`
+	DeliveryLatency   *latencySummary            `json:"delivery_latency,omitempty"` // receive time minus the payload's timestamp field
+	PublishLatency    *latencySummary            `json:"publish_latency,omitempty"`  // until the broker acknowledged (QoS 1/2) or the publish was sent (QoS 0)
+	Throttling        map[string]int64           `json:"throttling,omitempty"`       // signs of broker throttling, by kind
+	PipelineLatency   map[string]*latencySummary `json:"pipeline_latency,omitempty"` // handling time by stage, with latency_budget
+	CertExpiryDays    map[string]int             `json:"cert_expiry_days,omitempty"` // fewest days until a client, ca, or intermediate certificate expires
+}
+
+// latencyRecorder keeps latencies for percentiles, sampling once it holds
+// latencySamples of them.
+type latencyRecorder struct {
+	count   int64
+	sum     time.Duration
+	min     time.Duration
+	max     time.Duration
+	samples []time.Duration
+}
+
+func (l *latencyRecorder) add(d time.Duration, rng *rand.Rand) {
+	l.count++
+	l.sum += d
+	if l.count == 1 || d < l.min {
+		l.min = d
+	}
+	if d > l.max {
+		l.max = d
+	}
+	if len(l.samples) < latencySamples {
+		l.samples = append(l.samples, d)
+	} else if i := rng.Int63n(l.count); i < latencySamples {
+		l.samples[i] = d
+	}
+}
+
+func (l *latencyRecorder) summary() *latencySummary {
+	if l.count == 0 {
+		return nil
+	}
+	s := append([]time.Duration(nil), l.samples...)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	ms := func(d time.Duration) float64 { return math.Round(float64(d)/float64(time.Microsecond)) / 1000 }
+	return &latencySummary{
+		Count: l.count,
+		Min:   ms(l.min),
+		Mean:  ms(l.sum / time.Duration(l.count)),
+		P50:   ms(percentile(s, 50)),
+		P90:   ms(percentile(s, 90)),
+		P99:   ms(percentile(s, 99)),
+		Max:   ms(l.max),
+	}
+}
+
+// metricsRecorder counts what a run received and published, for the
+// snapshot written to --metrics-file on exit.
+type metricsRecorder struct {
+	path    string
+	cfg     *Config
+	field   string // payload timestamp for delivery latency
+	started time.Time
+
+	mu       sync.Mutex
+	rng      *rand.Rand
+	rxCount  int64
+	rxBytes  int64
+	txCount  int64
+	txBytes  int64
+	delivery latencyRecorder
+	publish  latencyRecorder
+	written  bool
+}
+
+// newMetricsRecorder returns nil without metrics_file.
+func newMetricsRecorder(cfg *Config) *metricsRecorder {
+	if cfg.MetricsFile == "" {
+		return nil
+	}
+	field := cfg.TimestampField
+	if field == "" {
+		field = defaultTimestampField
+	}
+	m := &metricsRecorder{path: cfg.MetricsFile, cfg: cfg, field: field, started: time.Now(),
+		rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	activeMetrics = m
+	return m
+}
+
+// wrap counts every message reaching next, and its delivery latency when the
+// payload carries a timestamp.
+func (m *metricsRecorder) wrap(next mqtt.MessageHandler) mqtt.MessageHandler {
+	if m == nil {
+		return next
+	}
+	return func(client mqtt.Client, msg mqtt.Message) {
+		now := time.Now()
+		var sent time.Time
+		v, ok := lookupJSONField(msg.Payload(), m.field)
+		if ok {
+			sent, ok = parseTimestamp(v)
+		}
+		m.mu.Lock()
+		m.rxCount++
+		m.rxBytes += int64(len(msg.Payload()))
+		if ok {
+			m.delivery.add(now.Sub(sent), m.rng)
+		}
+		m.mu.Unlock()
+		next(client, msg)
+	}
+}
+
+// published counts a publish of size bytes that took this long to complete.
+func (m *metricsRecorder) published(size int, took time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.txCount++
+	m.txBytes += int64(size)
+	m.publish.add(took, m.rng)
+}
+
+// write saves the snapshot, once; later calls do nothing.
+func (m *metricsRecorder) write() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	if m.written {
+		m.mu.Unlock()
+		return
+	}
+	m.written = true
+	snap := metricsSnapshot{
+		Started:           m.started.UTC().Format(time.RFC3339),
+		DurationSeconds:   math.Round(time.Since(m.started).Seconds()*1000) / 1000,
+		Broker:            redactedBroker(m.cfg.BrokerURL),
+		ClientID:          m.cfg.ClientID,
+		MessagesReceived:  m.rxCount,
+		BytesReceived:     m.rxBytes,
+		MessagesPublished: m.txCount,
+		BytesPublished:    m.txBytes,
+		Warnings:          warningEvents.Load(),
+		Errors:            errorEvents.Load(),
+		DeliveryLatency:   m.delivery.summary(),
+		PublishLatency:    m.publish.summary(),
+		Throttling:        throttle.snapshot(),
+		PipelineLatency:   pipeline.snapshot(),
+		CertExpiryDays:    certExpirySnapshot(),
+	}
+	m.mu.Unlock()
+	data, _ := json.MarshalIndent(snap, "", "  ")
+	if err := ioutil.WriteFile(m.path, append(data, '\n'), 0o644); err != nil {
+		logError("metrics_failed", false, "Could not write metrics to '%s': %v", m.path, err)
+		return
+	}
+	logInfo("metrics_written", "Wrote metrics to '%s'", m.path)
+}
+
+// redactedBroker hides any password in a broker URL.
+func redactedBroker(broker string) string {
+	if u, err := url.Parse(broker); err == nil {
+		return u.Redacted()
+	}
+	return broker
+}
+
+// metricRow is one compared value in "metrics diff".
+type metricRow struct {
+	name string
+	get  func(s *metricsSnapshot) (float64, bool)
+}
+
+// metricRate divides n by the run's duration.
+func metricRate(n func(s *metricsSnapshot) int64) func(s *metricsSnapshot) (float64, bool) {
+	return func(s *metricsSnapshot) (float64, bool) {
+		if s.DurationSeconds <= 0 {
+			return 0, false
+		}
+		return float64(n(s)) / s.DurationSeconds, true
+	}
+}
+
+func metricCount(n func(s *metricsSnapshot) int64) func(s *metricsSnapshot) (float64, bool) {
+	return func(s *metricsSnapshot) (float64, bool) { return float64(n(s)), true }
+}
+
+func metricLatency(l func(s *metricsSnapshot) *latencySummary, v func(l *latencySummary) float64) func(s *metricsSnapshot) (float64, bool) {
+	return func(s *metricsSnapshot) (float64, bool) {
+		if ls := l(s); ls != nil {
+			return v(ls), true
+		}
+		return 0, false
+	}
+}
+
+// metricRows lists the values "metrics diff" compares, in order.
+func metricRows() []metricRow {
+	rows := []metricRow{
+		{"duration_seconds", func(s *metricsSnapshot) (float64, bool) { return s.DurationSeconds, true }},
+		{"messages_received", metricCount(func(s *metricsSnapshot) int64 { return s.MessagesReceived })},
+		{"messages_received_per_second", metricRate(func(s *metricsSnapshot) int64 { return s.MessagesReceived })},
+		{"bytes_received", metricCount(func(s *metricsSnapshot) int64 { return s.BytesReceived })},
+		{"messages_published", metricCount(func(s *metricsSnapshot) int64 { return s.MessagesPublished })},
+		{"messages_published_per_second", metricRate(func(s *metricsSnapshot) int64 { return s.MessagesPublished })},
+		{"bytes_published", metricCount(func(s *metricsSnapshot) int64 { return s.BytesPublished })},
+		{"warnings", metricCount(func(s *metricsSnapshot) int64 { return s.Warnings })},
+		{"errors", metricCount(func(s *metricsSnapshot) int64 { return s.Errors })},
+		{"throttling", metricCount(func(s *metricsSnapshot) int64 {
+			var n int64
+			for _, c := range s.Throttling {
+				n += c
+			}
+			return n
+		})},
+	}
+	for _, l := range []struct {
+		name string
+		get  func(s *metricsSnapshot) *latencySummary
+	}{
+		{"delivery_latency", func(s *metricsSnapshot) *latencySummary { return s.DeliveryLatency }},
+		{"publish_latency", func(s *metricsSnapshot) *latencySummary { return s.PublishLatency }},
+	} {
+		for _, v := range []struct {
+			name string
+			get  func(l *latencySummary) float64
+		}{
+			{"mean_ms", func(l *latencySummary) float64 { return l.Mean }},
+			{"p50_ms", func(l *latencySummary) float64 { return l.P50 }},
+			{"p90_ms", func(l *latencySummary) float64 { return l.P90 }},
+			{"p99_ms", func(l *latencySummary) float64 { return l.P99 }},
+			{"max_ms", func(l *latencySummary) float64 { return l.Max }},
+		} {
+			rows = append(rows, metricRow{l.name + "." + v.name, metricLatency(l.get, v.get)})
+		}
+	}
+	for _, kind := range []string{"client", "ca", "intermediate"} {
+		rows = append(rows, metricRow{"cert_expiry_days." + kind, func(s *metricsSnapshot) (float64, bool) {
+			d, ok := s.CertExpiryDays[kind]
+			return float64(d), ok
+		}})
+	}
+	return rows
+}
+
+// readMetricsSnapshot loads a file written with --metrics-file.
+func readMetricsSnapshot(path string) (*metricsSnapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s metricsSnapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("'%s' is not a metrics snapshot: %v", path, err)
+	}
+	return &s, nil
+}
+
+// diffMetrics prints each metric of both runs and the change from a to b.
+// Metrics neither run has, such as latencies of a run without payload
+// timestamps, are left out.
+func diffMetrics(out io.Writer, a, b *metricsSnapshot) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "METRIC\tRUN 1\tRUN 2\tCHANGE\t\n")
+	num := func(v float64, ok bool) string {
+		if !ok {
+			return "-"
+		}
+		return fmt.Sprintf("%.6g", v)
+	}
+	for _, r := range metricRows() {
+		va, okA := r.get(a)
+		vb, okB := r.get(b)
+		if !okA && !okB {
+			continue
+		}
+		change := ""
+		if okA && okB {
+			change = fmt.Sprintf("%+.6g", vb-va)
+			if va != 0 {
+				change += fmt.Sprintf(" (%+.1f%%)", (vb-va)/math.Abs(va)*100)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t\n", r.name, num(va, okA), num(vb, okB), change)
+	}
+	w.Flush()
+}
+
+// runMetrics implements "mqttcli metrics diff".
+func runMetrics(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s metrics diff RUN1.json RUN2.json\n\n"+
+			"Compares two snapshots written with --metrics-file.\n", filepath.Base(os.Args[0]))
+		os.Exit(2)
+	}
+	if len(args) != 3 || args[0] != "diff" {
+		usage()
+	}
+	a, err := readMetricsSnapshot(args[1])
+	if err != nil {
+		fatal("metrics_failed", false, "%v", err)
+	}
+	b, err := readMetricsSnapshot(args[2])
+	if err != nil {
+		fatal("metrics_failed", false, "%v", err)
+	}
+	diffMetrics(os.Stdout, a, b)
+}
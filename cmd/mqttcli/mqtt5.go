@@ -0,0 +1,572 @@
+// mqtt5.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/session/state"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// reasonCodeError is a failure reported by an MQTT v5 broker through a reason
+// code, with the broker's optional reason string.
+type reasonCodeError struct {
+	packet string // CONNACK, SUBACK, PUBACK, DISCONNECT
+	code   byte
+	name   string // e.g. "Not authorized"
+	reason string // broker's reason string, if any
+}
+
+func (e *reasonCodeError) Error() string {
+	msg := fmt.Sprintf("%s reason code 0x%02X (%s)", e.packet, e.code, e.name)
+	if e.reason != "" {
+		msg += ": " + e.reason
+	}
+	return msg
+}
+
+// retryable reports whether the broker said to come back later, as opposed to
+// refusing the request.
+func (e *reasonCodeError) retryable() bool {
+	switch e.code {
+	case 0x88, 0x89, 0x97, 0x9F: // server unavailable, server busy, quota exceeded, connection rate exceeded
+		return true
+	}
+	return false
+}
+
+// reasonName shortens the paho reason descriptions ("Not authorized - The
+// Client is not authorized to connect.") to their name.
+func reasonName(s string) string {
+	name, _, _ := strings.Cut(s, " - ")
+	return name
+}
+
+// v5Token is a completed-or-pending operation on a v5Client, satisfying mqtt.Token.
+type v5Token struct {
+	done chan struct{}
+	err  error
+}
+
+func newV5Token(op func() error) *v5Token {
+	t := &v5Token{done: make(chan struct{})}
+	go func() {
+		t.err = op()
+		close(t.done)
+	}()
+	return t
+}
+
+func (t *v5Token) Wait() bool { <-t.done; return true }
+
+func (t *v5Token) WaitTimeout(d time.Duration) bool {
+	select {
+	case <-t.done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+func (t *v5Token) Done() <-chan struct{} { return t.done }
+
+func (t *v5Token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// v5Message adapts a received v5 PUBLISH to mqtt.Message.
+type v5Message struct {
+	p *paho.Publish
+}
+
+func (m *v5Message) Duplicate() bool   { return false }
+func (m *v5Message) Qos() byte         { return m.p.QoS }
+func (m *v5Message) Retained() bool    { return m.p.Retain }
+func (m *v5Message) Topic() string     { return m.p.Topic }
+func (m *v5Message) MessageID() uint16 { return m.p.PacketID }
+func (m *v5Message) Payload() []byte   { return m.p.Payload }
+func (m *v5Message) Ack()              {}
+
+// v5Route is a subscription filter and the handler for messages matching it.
+type v5Route struct {
+	filter  string
+	handler mqtt.MessageHandler
+}
+
+// v5Client adapts a paho.golang MQTT v5 connection to the mqtt.Client
+// interface, so every mode works unchanged with protocol_version 5.
+type v5Client struct {
+	cfg       *Config
+	c         *paho.Client
+	connected atomic.Bool
+
+	mu     sync.Mutex
+	routes []v5Route
+
+	// A resumed session can deliver queued messages right after the CONNACK,
+	// before anything has subscribed on this connection; they wait in early
+	// until the first route is registered, see releaseEarly
+	holding bool
+	early   []*paho.Publish
+
+	inflight sync.WaitGroup // publishes not yet acknowledged, see Disconnect
+	aliases  *topicAliases
+
+	// With at_least_once, received messages are acknowledged by route once
+	// handled, unless withholdAcks was called; see ack.go
+	manualAcks bool
+	withheld   atomic.Bool
+	onLost     func(error)
+
+	caps brokerCaps // advertised in the CONNACK
+}
+
+// capsFromConnack returns the limits a v5 broker advertised. Absent
+// properties mean the feature is available.
+func capsFromConnack(p *paho.ConnackProperties) brokerCaps {
+	maxQoS := byte(2)
+	caps := brokerCaps{MaxQoS: &maxQoS}
+	if p == nil {
+		return caps
+	}
+	if p.MaximumQoS != nil {
+		caps.MaxQoS = p.MaximumQoS
+	}
+	retain, shared, wildcard := p.RetainAvailable, p.SharedSubAvailable, p.WildcardSubAvailable
+	caps.RetainAvailable, caps.SharedSubs, caps.WildcardSubs = &retain, &shared, &wildcard
+	if p.MaximumPacketSize != nil {
+		caps.MaxPacketSize = *p.MaximumPacketSize
+	}
+	return caps
+}
+
+func (v *v5Client) brokerCaps() brokerCaps { return v.caps }
+
+// connectMQTTv5 dials the broker and completes the v5 CONNECT/CONNACK exchange.
+func connectMQTTv5(ctx context.Context, cfg *Config, onLost func(error)) (mqtt.Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.ConnectTimeout))
+	defer cancel()
+	connectErr := func(err error) error {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return &phaseError{"connect", fmt.Errorf("%w after %s", errTimeout, time.Duration(cfg.ConnectTimeout))}
+		}
+		return err
+	}
+
+	conn, err := dialBroker(ctx, cfg)
+	if err != nil {
+		return nil, connectErr(err)
+	}
+
+	v := &v5Client{cfg: cfg, manualAcks: cfg.AtLeastOnce, onLost: onLost, holding: cfg.SessionExpiry > 0}
+	sess := &inflightSession{SessionManager: state.NewInMemory(), w: inflight}
+	v.c = paho.NewClient(paho.ClientConfig{
+		ClientID:          cfg.ClientID,
+		Conn:              packets.NewThreadSafeConn(conn),
+		Session:           sess,
+		OnPublishReceived: []func(paho.PublishReceived) (bool, error){v.route},
+
+		EnableManualAcknowledgment: v.manualAcks,
+		SendAcksInterval:           v5AckInterval,
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			v.connected.Store(false)
+			err := &reasonCodeError{packet: "DISCONNECT", code: d.ReasonCode,
+				name: reasonName((&packets.Disconnect{ReasonCode: d.ReasonCode}).Reason())}
+			if d.Properties != nil {
+				err.reason = d.Properties.ReasonString
+			}
+			throttle.reasonCode(err)
+			if cfg.PrintErrors {
+				logError("connection_lost", err.retryable(), "MQTT connection closed by broker: %v", err)
+			}
+			onLost(err)
+		},
+		OnClientError: func(err error) {
+			v.connected.Store(false)
+			if cfg.PrintErrors {
+				logError("connection_lost", true, "MQTT connection lost: %v", err)
+			}
+			onLost(err)
+		},
+	})
+
+	cp := &paho.Connect{
+		ClientID:   cfg.ClientID,
+		KeepAlive:  30,
+		CleanStart: cfg.SessionExpiry == 0,
+		Properties: &paho.ConnectProperties{RequestProblemInfo: true},
+	}
+	if cfg.SessionExpiry > 0 {
+		secs := uint32(time.Duration(cfg.SessionExpiry) / time.Second)
+		cp.Properties.SessionExpiryInterval = &secs
+	}
+	if cfg.TopicAliasMax > 0 {
+		cp.Properties.TopicAliasMaximum = &cfg.TopicAliasMax
+	}
+	v.aliases = newTopicAliases(0, cfg.TopicAliasMax)
+	if cfg.Username != "" {
+		cp.Username, cp.UsernameFlag = cfg.Username, true
+	}
+	if cfg.Password != "" {
+		cp.Password, cp.PasswordFlag = []byte(cfg.Password), true
+	}
+
+	ca, err := v.c.Connect(ctx, cp)
+	if err != nil {
+		sess.Close()
+		if ca != nil && ca.ReasonCode >= 0x80 {
+			rc := &reasonCodeError{packet: "CONNACK", code: ca.ReasonCode,
+				name: reasonName((&packets.Connack{ReasonCode: ca.ReasonCode}).Reason())}
+			if ca.Properties != nil {
+				rc.reason = ca.Properties.ReasonString
+			}
+			throttle.reasonCode(rc)
+			return nil, rc
+		}
+		return nil, connectErr(err)
+	}
+	v.connected.Store(true)
+	// paho only closes sessions it created; closing releases blocked publishes
+	go func() {
+		<-v.c.Done()
+		sess.Close()
+	}()
+	v.caps = capsFromConnack(ca.Properties)
+	if cfg.TopicAliasMax > 0 {
+		v.aliases.max = cfg.TopicAliasMax
+		if ca.Properties == nil || ca.Properties.TopicAliasMaximum == nil {
+			v.aliases.max = 0
+		} else if *ca.Properties.TopicAliasMaximum < v.aliases.max {
+			v.aliases.max = *ca.Properties.TopicAliasMaximum
+		}
+		if v.aliases.max < cfg.TopicAliasMax {
+			logInfo("topic_aliases_limited", "Broker accepts %d topic aliases; using that many of the %d requested", v.aliases.max, cfg.TopicAliasMax)
+		}
+	}
+	if ca.SessionPresent {
+		logInfo("session_resumed", "Resumed the existing session for clientID='%s'", cfg.ClientID)
+	} else {
+		v.releaseEarly()
+	}
+	return v, nil
+}
+
+// dialBroker opens the network connection for a v5 client: plain TCP for
+// tcp:// and mqtt://, TLS for ssl://, tls://, and mqtts://, and a WebSocket for
+// ws:// and wss://, and an HTTP tunnel for http:// and https://.
+func dialBroker(ctx context.Context, cfg *Config) (net.Conn, error) {
+	u, err := url.Parse(cfg.BrokerURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker URL '%s': %v", cfg.BrokerURL, err)
+	}
+	useTLS := false
+	switch u.Scheme {
+	case "tcp", "mqtt":
+	case "ssl", "tls", "mqtts", "tcps":
+		useTLS = true
+	case "ws", "wss":
+		var tlsConfig *tls.Config
+		if u.Scheme == "wss" || hasTLSMaterial(cfg) {
+			if tlsConfig, err = NewTLSConfig(cfg); err != nil {
+				return nil, err
+			}
+		}
+		header, err := wsHeader(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return dialWebSocket(cfg, cfg.BrokerURL, tlsConfig, header)
+	case "http", "https":
+		var tlsConfig *tls.Config
+		if u.Scheme == "https" || hasTLSMaterial(cfg) {
+			if tlsConfig, err = NewTLSConfig(cfg); err != nil {
+				return nil, err
+			}
+		}
+		return dialTunnel(ctx, cfg.BrokerURL, tlsConfig, cfg.TunnelToken)
+	default:
+		return nil, fmt.Errorf("broker scheme '%s' is not supported with MQTT v5", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), map[bool]string{false: "1883", true: "8883"}[useTLS])
+	}
+
+	if !useTLS && !hasTLSMaterial(cfg) {
+		return egressDialer(0).DialContext(ctx, "tcp", host)
+	}
+	tlsConfig, err := NewTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	d := tls.Dialer{NetDialer: egressDialer(0), Config: tlsConfig}
+	return d.DialContext(ctx, "tcp", host)
+}
+
+func (v *v5Client) route(pr paho.PublishReceived) (bool, error) {
+	// Leave everything after a withheld acknowledgement for the broker to
+	// send again
+	if v.withheld.Load() {
+		return false, nil
+	}
+	if err := v.aliases.resolve(pr.Packet); err != nil {
+		logWarn("topic_alias_invalid", "Dropped a message: %v", err)
+		v.ack(pr.Packet)
+		return false, nil
+	}
+	v.mu.Lock()
+	if v.holding {
+		v.early = append(v.early, pr.Packet)
+		v.mu.Unlock()
+		return true, nil
+	}
+	routes := append([]v5Route(nil), v.routes...)
+	v.mu.Unlock()
+	return v.deliver(pr.Packet, routes), nil
+}
+
+// deliver hands p to every route matching its topic, then acknowledges it.
+func (v *v5Client) deliver(p *paho.Publish, routes []v5Route) bool {
+	msg := &v5Message{p}
+	handled := false
+	for _, r := range routes {
+		if topicMatches(sharedSubscriptionFilter(r.filter), msg.Topic()) {
+			r.handler(v, msg)
+			handled = true
+		}
+	}
+	v.ack(p)
+	return handled
+}
+
+// releaseEarly stops holding messages and delivers those that arrived before
+// the first route was registered.
+func (v *v5Client) releaseEarly() {
+	v.mu.Lock()
+	early := v.early
+	v.holding, v.early = false, nil
+	routes := append([]v5Route(nil), v.routes...)
+	v.mu.Unlock()
+	for _, p := range early {
+		if v.withheld.Load() {
+			return
+		}
+		v.deliver(p, routes)
+	}
+}
+
+// ack acknowledges a handled message with at_least_once, unless its
+// acknowledgement was withheld.
+func (v *v5Client) ack(p *paho.Publish) {
+	if v.manualAcks && !v.withheld.Load() {
+		v.c.Ack(p)
+	}
+}
+
+// withholdAcks stops acknowledging messages on this connection, starting with
+// the one being handled, and reports whether they are acknowledged by hand at
+// all. A non-nil reason also closes the connection, so the broker sends the
+// messages again on the next one.
+func (v *v5Client) withholdAcks(reason error) bool {
+	if !v.manualAcks {
+		return false
+	}
+	if !v.withheld.Swap(true) && reason != nil {
+		// Report the loss first, so it's put down to reason rather than to
+		// the closed connection
+		go func() {
+			if v.onLost != nil {
+				v.onLost(reason)
+			}
+			v.Disconnect(0)
+		}()
+	}
+	return true
+}
+
+// sharedSubscriptionFilter strips a "$share/GROUP/" prefix, leaving the filter
+// that messages are matched against.
+func sharedSubscriptionFilter(filter string) string {
+	if rest, ok := strings.CutPrefix(filter, "$share/"); ok {
+		if _, f, ok := strings.Cut(rest, "/"); ok {
+			return f
+		}
+	}
+	return filter
+}
+
+func (v *v5Client) IsConnected() bool      { return v.connected.Load() }
+func (v *v5Client) IsConnectionOpen() bool { return v.connected.Load() }
+
+// Connect is a no-op: connectMQTTv5 returns an already connected client.
+func (v *v5Client) Connect() mqtt.Token { return newV5Token(func() error { return nil }) }
+
+// Disconnect waits up to quiesce milliseconds for in-flight publishes to be
+// acknowledged, like the MQTT 3 client, then sends DISCONNECT.
+func (v *v5Client) Disconnect(quiesce uint) {
+	if quiesce > 0 && v.connected.Load() {
+		done := make(chan struct{})
+		go func() {
+			v.inflight.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Duration(quiesce) * time.Millisecond):
+		}
+	}
+	if v.manualAcks && v.connected.Load() {
+		// paho sends acknowledgements on a timer; let it send the last ones
+		time.Sleep(2 * v5AckInterval)
+	}
+	if v.connected.Swap(false) {
+		v.c.Disconnect(&paho.Disconnect{ReasonCode: 0})
+	}
+}
+
+func (v *v5Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var data []byte
+	switch p := payload.(type) {
+	case []byte:
+		data = p
+	case string:
+		data = []byte(p)
+	default:
+		return newV5Token(func() error { return fmt.Errorf("unsupported payload type %T", payload) })
+	}
+	pb := &paho.Publish{Topic: topic, QoS: qos, Retain: retained, Payload: data,
+		Properties: publishProperties(v.cfg)}
+	v.aliases.apply(pb)
+	v.inflight.Add(1)
+	return newV5Token(func() error {
+		defer v.inflight.Done()
+		resp, err := v.c.Publish(context.Background(), pb)
+		if err == nil {
+			v.aliases.published(pb.Topic)
+		}
+		if resp != nil && resp.ReasonCode >= 0x80 {
+			rc := &reasonCodeError{packet: "PUBACK", code: resp.ReasonCode,
+				name: reasonName((&packets.Puback{ReasonCode: resp.ReasonCode}).Reason())}
+			if resp.Properties != nil {
+				rc.reason = resp.Properties.ReasonString
+			}
+			throttle.reasonCode(rc)
+			return rc
+		}
+		return err
+	})
+}
+
+func (v *v5Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return v.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+func (v *v5Client) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	sub := &paho.Subscribe{}
+	for topic, qos := range filters {
+		sub.Subscriptions = append(sub.Subscriptions, paho.SubscribeOptions{Topic: topic, QoS: qos,
+			NoLocal: v.cfg.NoLocal, RetainAsPublished: v.cfg.RetainAsPublished, RetainHandling: v.cfg.RetainHandling})
+	}
+	// Register routes first, so retained messages sent right after the SUBACK are delivered
+	v.mu.Lock()
+	for _, s := range sub.Subscriptions {
+		v.setRoute(s.Topic, callback)
+	}
+	v.mu.Unlock()
+	v.releaseEarly()
+
+	return newV5Token(func() error {
+		sa, err := v.c.Subscribe(context.Background(), sub)
+		// 0x91 means the broker still holds the packet identifier, e.g. for a
+		// queued message of a resumed session not yet acknowledged; it frees
+		// it once the PUBACK arrives
+		for retry := 0; retry < 3 && sa != nil && bytes.IndexByte(sa.Reasons, 0x91) >= 0; retry++ {
+			time.Sleep(50 * time.Millisecond << retry)
+			sa, err = v.c.Subscribe(context.Background(), sub)
+		}
+		if sa != nil {
+			reasons := &packets.Suback{Reasons: sa.Reasons}
+			for i, code := range sa.Reasons {
+				if code >= 0x80 {
+					rc := &reasonCodeError{packet: "SUBACK", code: code, name: reasonName(reasons.Reason(i))}
+					if sa.Properties != nil {
+						rc.reason = sa.Properties.ReasonString
+					}
+					throttle.reasonCode(rc)
+					if len(sub.Subscriptions) == 1 {
+						return rc
+					}
+					return fmt.Errorf("'%s': %w", sub.Subscriptions[i].Topic, rc)
+				}
+			}
+		}
+		return err
+	})
+}
+
+func (v *v5Client) Unsubscribe(topics ...string) mqtt.Token {
+	v.mu.Lock()
+	kept := v.routes[:0]
+	for _, r := range v.routes {
+		keep := true
+		for _, t := range topics {
+			if r.filter == t {
+				keep = false
+			}
+		}
+		if keep {
+			kept = append(kept, r)
+		}
+	}
+	v.routes = kept
+	v.mu.Unlock()
+
+	return newV5Token(func() error {
+		_, err := v.c.Unsubscribe(context.Background(), &paho.Unsubscribe{Topics: topics})
+		return err
+	})
+}
+
+func (v *v5Client) AddRoute(topic string, callback mqtt.MessageHandler) {
+	v.mu.Lock()
+	v.setRoute(topic, callback)
+	v.mu.Unlock()
+	v.releaseEarly()
+}
+
+// setRoute sends messages matching filter to callback, replacing any earlier
+// route for the same filter, as the MQTT 3 client's router does; v.mu must be
+// held.
+func (v *v5Client) setRoute(filter string, callback mqtt.MessageHandler) {
+	for i, r := range v.routes {
+		if r.filter == filter {
+			v.routes[i].handler = callback
+			return
+		}
+	}
+	v.routes = append(v.routes, v5Route{filter, callback})
+}
+
+func (v *v5Client) OptionsReader() mqtt.ClientOptionsReader {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(v.cfg.BrokerURL)
+	opts.SetClientID(v.cfg.ClientID)
+	return mqtt.NewOptionsReader(opts)
+}
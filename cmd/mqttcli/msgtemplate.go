@@ -0,0 +1,82 @@
+// msgtemplate.go
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// templateMessage is what --template sees for each message.
+type templateMessage struct {
+	Topic      string
+	QoS        byte
+	Retained   bool
+	MessageID  uint16
+	Payload    string
+	Time       time.Time
+	Fields     map[string]string  // matched by --topic-pattern
+	Properties *messageProperties // MQTT v5 properties, nil without any
+}
+
+// templateFuncs are available to --template besides the text/template builtins.
+var templateFuncs = template.FuncMap{
+	// json "a.b" .Payload: the value at a dotted path, strings as-is and
+	// anything else as JSON; empty if the payload has no such field
+	"json": func(path, payload string) string {
+		v, ok := lookupJSONField([]byte(payload), path)
+		if !ok {
+			return ""
+		}
+		return string(leafPayload(v))
+	},
+	"hex":    func(s string) string { return hex.EncodeToString([]byte(s)) },
+	"base64": func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+	"upper":  strings.ToUpper,
+	"lower":  strings.ToLower,
+}
+
+// messageTemplate renders each message with a user-supplied template, e.g.
+// '{{.Topic}} {{.Payload | json "temp"}}', in place of the usual line.
+type messageTemplate struct {
+	t *template.Template
+}
+
+// parseMessageTemplate returns nil for an empty template.
+func parseMessageTemplate(text string) (*messageTemplate, error) {
+	if text == "" {
+		return nil, nil
+	}
+	t, err := template.New("message").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %v", err)
+	}
+	return &messageTemplate{t: t}, nil
+}
+
+// render returns the line for msg; tp supplies .Fields.
+func (m *messageTemplate) render(msg mqtt.Message, tp *topicPattern) (string, error) {
+	data := templateMessage{
+		Topic:      msg.Topic(),
+		QoS:        msg.Qos(),
+		Retained:   msg.Retained(),
+		MessageID:  msg.MessageID(),
+		Payload:    string(msg.Payload()),
+		Time:       time.Now(),
+		Properties: messagePropertiesOf(msg),
+	}
+	if fields, ok := tp.Match(msg.Topic()); ok {
+		data.Fields = fields
+	}
+	var b bytes.Buffer
+	if err := m.t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
@@ -0,0 +1,154 @@
+// outdir.go
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultOutName names files written by --out-dir unless --out-name is set.
+const defaultOutName = "{topic}_{timestamp}"
+
+// outNamePlaceholder matches the "{name}" placeholders of --out-name.
+var outNamePlaceholder = regexp.MustCompile(`\{([A-Za-z0-9_]*)\}`)
+
+// dirSink writes each message's payload, exactly as received, to its own file
+// below dir. Names come from a template of placeholders: {topic} (levels
+// joined with "_"), {timestamp}, {seq}, {qos}, and any --topic-pattern field.
+// Substituted values are made safe as file names; "/" in the template itself
+// makes subdirectories.
+type dirSink struct {
+	dir   string
+	name  string
+	seq   int
+	files int
+	sync  bool // flush each file to disk before Write returns, for at_least_once
+}
+
+func newDirSink(dir, name, topicPattern string) (*dirSink, error) {
+	if name == "" {
+		name = defaultOutName
+	}
+	known := map[string]bool{"topic": true, "timestamp": true, "seq": true, "qos": true}
+	tp, err := parseTopicPattern(topicPattern)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range tp.Names() {
+		known[n] = true
+	}
+	for _, m := range outNamePlaceholder.FindAllStringSubmatch(name, -1) {
+		if !known[m[1]] {
+			return nil, fmt.Errorf("unknown placeholder '%s' in out_name", m[0])
+		}
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create out_dir: %v", err)
+	}
+	return &dirSink{dir: dir, name: name}, nil
+}
+
+// path returns the file for rec, within s.dir.
+func (s *dirSink) path(rec messageRecord) (string, error) {
+	ts := rec.Timestamp
+	if t, err := time.Parse(time.RFC3339Nano, rec.Timestamp); err == nil {
+		ts = t.Format("20060102T150405.000000000Z")
+	}
+	name := outNamePlaceholder.ReplaceAllStringFunc(s.name, func(p string) string {
+		var v string
+		switch key := p[1 : len(p)-1]; key {
+		case "topic":
+			v = strings.ReplaceAll(rec.Topic, "/", "_")
+		case "timestamp":
+			v = ts
+		case "seq":
+			v = strconv.Itoa(s.seq)
+		case "qos":
+			v = strconv.Itoa(int(rec.QoS))
+		default:
+			v = rec.Fields[key]
+		}
+		v = unsafeFileChars.ReplaceAllString(v, "_")
+		if v == "" || v == "." || v == ".." {
+			v = "_"
+		}
+		return v
+	})
+	path := filepath.Join(s.dir, name)
+	if rel, err := filepath.Rel(s.dir, path); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("out_name '%s' leaves out_dir", s.name)
+	}
+	return path, nil
+}
+
+func (s *dirSink) Write(rec messageRecord) error {
+	s.seq++
+	payload := []byte(rec.Payload)
+	if rec.PayloadEncoding == "base64" {
+		payload, _ = base64.StdEncoding.DecodeString(rec.Payload)
+	}
+	path, err := s.path(rec)
+	if err == nil {
+		err = writeNewFile(path, payload, s.sync)
+	}
+	if err != nil {
+		logWarn("out_dir_failed", "Could not write message from '%s': %v", rec.Topic, err)
+		return err
+	}
+	s.files++
+	return nil
+}
+
+// writeNewFile writes data to path, or to path.1, path.2, ... if it exists,
+// through a temporary file so readers never see a partial payload. With sync,
+// the file and its directory entry are on disk when it returns.
+func writeNewFile(path string, data []byte, sync bool) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".mqttcli-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil && sync {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	target := path
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			break
+		}
+		target = fmt.Sprintf("%s.%d", path, i)
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil || !sync {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if cerr := dir.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *dirSink) Close() error {
+	logInfo("out_dir_written", "Wrote %d message(s) to %s", s.files, s.dir)
+	return nil
+}
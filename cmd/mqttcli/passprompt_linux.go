@@ -0,0 +1,34 @@
+//go:build linux
+
+// passprompt_linux.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// promptPassword asks for a password on the terminal without echoing it.
+func promptPassword(prompt string) ([]byte, error) {
+	if !stdinIsTerminal() {
+		return nil, errors.New("stdin is not a terminal to prompt on")
+	}
+	fd := int(os.Stdin.Fd())
+	saved, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, errors.New("stdin is not a terminal to prompt on")
+	}
+	quiet := *saved
+	quiet.Lflag &^= unix.ECHO
+	quiet.Lflag |= unix.ICANON | unix.ISIG
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &quiet); err != nil {
+		return nil, err
+	}
+	defer unix.IoctlSetTermios(fd, unix.TCSETS, saved)
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+	return readPasswordLine(os.Stdin)
+}
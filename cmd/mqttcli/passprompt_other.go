@@ -0,0 +1,10 @@
+//go:build !linux
+
+// passprompt_other.go
+package main
+
+import "errors"
+
+func promptPassword(prompt string) ([]byte, error) {
+	return nil, errors.New("password prompts are only supported on Linux")
+}
@@ -0,0 +1,51 @@
+// payloadformat.go
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+)
+
+// Payload formats selected with --payload-format.
+const (
+	payloadString = "string" // text, with control characters escaped unless --raw (default)
+	payloadRaw    = "raw"    // bytes as received
+	payloadHex    = "hex"
+	payloadBase64 = "base64"
+)
+
+func validPayloadFormat(format string) error {
+	switch format {
+	case "", payloadString, payloadRaw, payloadHex, payloadBase64:
+		return nil
+	}
+	return fmt.Errorf("unknown payload format '%s'; use string, raw, hex, or base64", format)
+}
+
+// formatPayload renders a payload for text output.
+func formatPayload(payload []byte, format string, raw bool) string {
+	switch format {
+	case payloadHex:
+		return hex.EncodeToString(payload)
+	case payloadBase64:
+		return base64.StdEncoding.EncodeToString(payload)
+	case payloadRaw:
+		return string(payload)
+	}
+	if raw {
+		return string(payload)
+	}
+	return sanitizeForTerminal(string(payload))
+}
+
+// encodeRecordPayload applies --payload-format hex or base64 to a JSON record;
+// other formats keep the default of text, or base64 for invalid UTF-8.
+func encodeRecordPayload(rec *messageRecord, payload []byte, format string) {
+	switch format {
+	case payloadHex:
+		rec.Payload, rec.PayloadEncoding = hex.EncodeToString(payload), payloadHex
+	case payloadBase64:
+		rec.Payload, rec.PayloadEncoding = base64.StdEncoding.EncodeToString(payload), payloadBase64
+	}
+}
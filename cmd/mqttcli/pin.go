@@ -0,0 +1,65 @@
+// pin.go
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// spkiPin is the pin of a certificate's key: the base64 SHA-256 of its
+// SubjectPublicKeyInfo, as used by HPKP and curl --pinnedpubkey.
+func spkiPin(c *x509.Certificate) string {
+	sum := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// parsePins normalizes pins to base64. Each is base64, optionally prefixed
+// "sha256//" as curl and openssl print them, or 64 hex digits; a value may
+// hold several separated by commas.
+func parsePins(values []string) (map[string]bool, error) {
+	pins := map[string]bool{}
+	for _, v := range values {
+		for _, p := range strings.Split(v, ",") {
+			p = strings.TrimPrefix(strings.TrimSpace(p), "sha256//")
+			if p == "" {
+				continue
+			}
+			sum, err := base64.StdEncoding.DecodeString(p)
+			if err != nil || len(sum) != sha256.Size {
+				if sum, err = hex.DecodeString(p); err != nil || len(sum) != sha256.Size {
+					return nil, fmt.Errorf("invalid pin_sha256 '%s', expected the base64 or hex SHA-256 of a public key", p)
+				}
+			}
+			pins[base64.StdEncoding.EncodeToString(sum)] = true
+		}
+	}
+	return pins, nil
+}
+
+// verifyPins returns a check that the broker presented a pinned key, run
+// after (and regardless of) CA validation. A verified chain matches on any
+// of its keys, so an intermediate or root can be pinned; without
+// verification (insecure) only the broker's own key is trusted to match.
+func verifyPins(pins map[string]bool) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("the broker presented no certificate to check against pin_sha256")
+		}
+		candidates := []*x509.Certificate{cs.PeerCertificates[0]}
+		for _, chain := range cs.VerifiedChains {
+			candidates = append(candidates, chain...)
+		}
+		for _, c := range candidates {
+			if pins[spkiPin(c)] {
+				return nil
+			}
+		}
+		leaf := cs.PeerCertificates[0]
+		return fmt.Errorf("the broker's certificate '%s' matches no pin_sha256; its key pins as sha256//%s", leaf.Subject.CommonName, spkiPin(leaf))
+	}
+}
@@ -0,0 +1,102 @@
+// pkcs11.go
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// envPKCS11PIN holds the user PIN of a PKCS#11 token, so it needn't appear
+// on the command line.
+const envPKCS11PIN = "MQTTCLI_PKCS11_PIN"
+
+// errPKCS11PIN reports a wrong token PIN.
+var errPKCS11PIN = errors.New("incorrect PKCS#11 PIN")
+
+// rsaDigestInfo is the DER DigestInfo prefix a token signing with raw
+// PKCS#1 v1.5 (CKM_RSA_PKCS) needs in front of each digest.
+var rsaDigestInfo = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// pkcs11PSSHashes maps a hash to its PKCS#11 mechanism and MGF1 codes, for
+// RSA-PSS parameters.
+var pkcs11PSSHashes = map[crypto.Hash][2]uint{
+	crypto.SHA1:   {0x220, 1},
+	crypto.SHA256: {0x250, 2},
+	crypto.SHA384: {0x260, 3},
+	crypto.SHA512: {0x270, 4},
+}
+
+// pssSaltLength resolves the salt length of opts for a token, which needs
+// an actual number.
+func pssSaltLength(opts *rsa.PSSOptions, pub *rsa.PublicKey) int {
+	switch opts.SaltLength {
+	case rsa.PSSSaltLengthEqualsHash:
+		return opts.Hash.Size()
+	case rsa.PSSSaltLengthAuto:
+		return (pub.N.BitLen()-1+7)/8 - 2 - opts.Hash.Size()
+	}
+	return opts.SaltLength
+}
+
+// ecdsaDER converts the r||s signature tokens return to the ASN.1 form
+// crypto/tls expects.
+func ecdsaDER(raw []byte) ([]byte, error) {
+	if len(raw) == 0 || len(raw)%2 != 0 {
+		return nil, fmt.Errorf("malformed ECDSA signature of %d bytes from the token", len(raw))
+	}
+	n := len(raw) / 2
+	return asn1.Marshal(struct{ R, S *big.Int }{new(big.Int).SetBytes(raw[:n]), new(big.Int).SetBytes(raw[n:])})
+}
+
+// pkcs11CertFile returns the client certificate given with cert_file or
+// cert_pem for a token key, or nil if there is none.
+func pkcs11CertFile(cfg *Config) (*x509.Certificate, error) {
+	certPEM, err := readPEM(cfg.CertPEM, cfg.CertFile)
+	if err != nil || certPEM == nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New("no PEM certificate in the client certificate")
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return leaf, checkPKCS11Key(leaf)
+}
+
+// checkPKCS11Key rejects certificates for keys the token signer can't use.
+func checkPKCS11Key(leaf *x509.Certificate) error {
+	switch leaf.PublicKey.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return nil
+	}
+	return fmt.Errorf("unsupported PKCS#11 key type %T; use RSA or ECDSA", leaf.PublicKey)
+}
+
+// pkcs11PIN returns the token PIN: pkcs11_pin, else one typed at a terminal
+// prompt, which is kept for reconnecting.
+func pkcs11PIN(cfg *Config) ([]byte, error) {
+	if cfg.PKCS11PIN != "" {
+		return []byte(cfg.PKCS11PIN), nil
+	}
+	pin, err := promptPassword("PIN for the PKCS#11 token: ")
+	if err != nil {
+		return nil, fmt.Errorf("the PKCS#11 token needs a PIN; set --pkcs11-pin or $%s (%v)", envPKCS11PIN, err)
+	}
+	cfg.PKCS11PIN = string(pin)
+	return pin, nil
+}
@@ -0,0 +1,540 @@
+//go:build cgo && unix
+
+// pkcs11_cgo.go
+package main
+
+/*
+#cgo linux LDFLAGS: -ldl
+#include <dlfcn.h>
+#include <stdlib.h>
+#include <string.h>
+
+// The parts of the PKCS#11 API we use, laid out as in pkcs11.h
+typedef unsigned long CK_ULONG;
+typedef CK_ULONG CK_RV;
+
+typedef struct { unsigned char major, minor; } CK_VERSION;
+typedef struct { CK_ULONG type; void *value; CK_ULONG len; } CK_ATTRIBUTE;
+typedef struct { CK_ULONG mechanism; void *parameter; CK_ULONG len; } CK_MECHANISM;
+typedef struct { CK_ULONG hash_alg; CK_ULONG mgf; CK_ULONG salt_len; } CK_RSA_PKCS_PSS_PARAMS;
+typedef struct { void *create, *destroy, *lock, *unlock; CK_ULONG flags; void *reserved; } CK_C_INITIALIZE_ARGS;
+
+typedef struct {
+	CK_VERSION version;
+	CK_RV (*C_Initialize)(void *);
+	CK_RV (*C_Finalize)(void *);
+	void *C_GetInfo, *C_GetFunctionList;
+	CK_RV (*C_GetSlotList)(unsigned char, CK_ULONG *, CK_ULONG *);
+	void *C_GetSlotInfo, *C_GetTokenInfo, *C_GetMechanismList, *C_GetMechanismInfo;
+	void *C_InitToken, *C_InitPIN, *C_SetPIN;
+	CK_RV (*C_OpenSession)(CK_ULONG, CK_ULONG, void *, void *, CK_ULONG *);
+	CK_RV (*C_CloseSession)(CK_ULONG);
+	void *C_CloseAllSessions, *C_GetSessionInfo, *C_GetOperationState, *C_SetOperationState;
+	CK_RV (*C_Login)(CK_ULONG, CK_ULONG, unsigned char *, CK_ULONG);
+	void *C_Logout, *C_CreateObject, *C_CopyObject, *C_DestroyObject, *C_GetObjectSize;
+	CK_RV (*C_GetAttributeValue)(CK_ULONG, CK_ULONG, CK_ATTRIBUTE *, CK_ULONG);
+	void *C_SetAttributeValue;
+	CK_RV (*C_FindObjectsInit)(CK_ULONG, CK_ATTRIBUTE *, CK_ULONG);
+	CK_RV (*C_FindObjects)(CK_ULONG, CK_ULONG *, CK_ULONG, CK_ULONG *);
+	CK_RV (*C_FindObjectsFinal)(CK_ULONG);
+	void *C_EncryptInit, *C_Encrypt, *C_EncryptUpdate, *C_EncryptFinal;
+	void *C_DecryptInit, *C_Decrypt, *C_DecryptUpdate, *C_DecryptFinal;
+	void *C_DigestInit, *C_Digest, *C_DigestUpdate, *C_DigestKey, *C_DigestFinal;
+	CK_RV (*C_SignInit)(CK_ULONG, CK_MECHANISM *, CK_ULONG);
+	CK_RV (*C_Sign)(CK_ULONG, unsigned char *, CK_ULONG, unsigned char *, CK_ULONG *);
+} CK_FUNCTION_LIST;
+
+static const char *p11_load(const char *path, void **handle, CK_FUNCTION_LIST **fl) {
+	void *h = dlopen(path, RTLD_NOW | RTLD_LOCAL);
+	if (h == NULL) {
+		return dlerror();
+	}
+	CK_RV (*get)(CK_FUNCTION_LIST **) = (CK_RV (*)(CK_FUNCTION_LIST **))dlsym(h, "C_GetFunctionList");
+	if (get == NULL) {
+		dlclose(h);
+		return "not a PKCS#11 module: no C_GetFunctionList";
+	}
+	if (get(fl) != 0 || *fl == NULL) {
+		dlclose(h);
+		return "C_GetFunctionList failed";
+	}
+	*handle = h;
+	return NULL;
+}
+
+static void p11_unload(void *handle) {
+	dlclose(handle);
+}
+
+static CK_RV p11_initialize(CK_FUNCTION_LIST *f) {
+	CK_C_INITIALIZE_ARGS args;
+	memset(&args, 0, sizeof args);
+	args.flags = 2; // CKF_OS_LOCKING_OK
+	return f->C_Initialize(&args);
+}
+
+static CK_RV p11_finalize(CK_FUNCTION_LIST *f) {
+	return f->C_Finalize(NULL);
+}
+
+static CK_RV p11_slots(CK_FUNCTION_LIST *f, CK_ULONG *slots, CK_ULONG *count) {
+	return f->C_GetSlotList(1, slots, count);
+}
+
+static CK_RV p11_open(CK_FUNCTION_LIST *f, CK_ULONG slot, CK_ULONG *session) {
+	return f->C_OpenSession(slot, 4, NULL, NULL, session); // CKF_SERIAL_SESSION
+}
+
+static CK_RV p11_close(CK_FUNCTION_LIST *f, CK_ULONG session) {
+	return f->C_CloseSession(session);
+}
+
+static CK_RV p11_login(CK_FUNCTION_LIST *f, CK_ULONG session, void *pin, CK_ULONG len) {
+	return f->C_Login(session, 1, pin, len); // CKU_USER
+}
+
+// p11_find finds objects of a class, optionally with a label or ID.
+static CK_RV p11_find(CK_FUNCTION_LIST *f, CK_ULONG session, CK_ULONG cls, void *label, CK_ULONG label_len,
+		void *id, CK_ULONG id_len, CK_ULONG *found, CK_ULONG max, CK_ULONG *count) {
+	CK_ATTRIBUTE t[3];
+	CK_ULONG n = 0;
+	t[n].type = 0; t[n].value = &cls; t[n].len = sizeof cls; n++; // CKA_CLASS
+	if (label != NULL) {
+		t[n].type = 3; t[n].value = label; t[n].len = label_len; n++; // CKA_LABEL
+	}
+	if (id != NULL) {
+		t[n].type = 0x102; t[n].value = id; t[n].len = id_len; n++; // CKA_ID
+	}
+	CK_RV rv = f->C_FindObjectsInit(session, t, n);
+	if (rv != 0) {
+		return rv;
+	}
+	rv = f->C_FindObjects(session, found, max, count);
+	f->C_FindObjectsFinal(session);
+	return rv;
+}
+
+static CK_RV p11_attr(CK_FUNCTION_LIST *f, CK_ULONG session, CK_ULONG obj, CK_ULONG type, void *buf, CK_ULONG *len) {
+	CK_ATTRIBUTE a = {type, buf, *len};
+	CK_RV rv = f->C_GetAttributeValue(session, obj, &a, 1);
+	*len = a.len;
+	return rv;
+}
+
+// p11_sign signs data, with RSA-PSS parameters when pss_hash is set.
+static CK_RV p11_sign(CK_FUNCTION_LIST *f, CK_ULONG session, CK_ULONG key, CK_ULONG mech,
+		CK_ULONG pss_hash, CK_ULONG pss_mgf, CK_ULONG pss_salt,
+		void *data, CK_ULONG len, void *sig, CK_ULONG *sig_len) {
+	CK_RSA_PKCS_PSS_PARAMS pss = {pss_hash, pss_mgf, pss_salt};
+	CK_MECHANISM m = {mech, NULL, 0};
+	if (pss_hash != 0) {
+		m.parameter = &pss;
+		m.len = sizeof pss;
+	}
+	CK_RV rv = f->C_SignInit(session, &m, key);
+	if (rv != 0) {
+		return rv;
+	}
+	return f->C_Sign(session, data, len, sig, sig_len);
+}
+*/
+import "C"
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"unsafe"
+)
+
+// PKCS#11 constants used from Go.
+const (
+	ckoCertificate                = 1
+	ckoPrivateKey                 = 3
+	ckaValue                      = 0x11
+	ckaID                         = 0x102
+	ckmRSAPKCS                    = 0x1
+	ckmRSAPKCSPSS                 = 0xd
+	ckmECDSA                      = 0x1041
+	ckrPINIncorrect               = 0xa0
+	ckrUserAlreadyLoggedIn        = 0x100
+	ckrCryptokiAlreadyInitialized = 0x191
+)
+
+// ckrSessionLost are the return values after which the session, or the
+// handles found with it, no longer work: the token was removed and perhaps
+// put back, or the module dropped the session. A new session, logged in
+// again, may.
+var ckrSessionLost = map[C.CK_RV]bool{
+	0x32:  true, // CKR_DEVICE_REMOVED
+	0x60:  true, // CKR_KEY_HANDLE_INVALID
+	0xb0:  true, // CKR_SESSION_CLOSED
+	0xb3:  true, // CKR_SESSION_HANDLE_INVALID
+	0xe0:  true, // CKR_TOKEN_NOT_PRESENT
+	0x101: true, // CKR_USER_NOT_LOGGED_IN
+}
+
+// ckrNames names the return values users are most likely to see.
+var ckrNames = map[C.CK_RV]string{
+	0x3:   "CKR_SLOT_ID_INVALID",
+	0x5:   "CKR_GENERAL_ERROR",
+	0x6:   "CKR_FUNCTION_FAILED",
+	0x7:   "CKR_ARGUMENTS_BAD",
+	0x30:  "CKR_DEVICE_ERROR",
+	0x32:  "CKR_DEVICE_REMOVED",
+	0x60:  "CKR_KEY_HANDLE_INVALID",
+	0x68:  "CKR_KEY_FUNCTION_NOT_PERMITTED",
+	0x70:  "CKR_MECHANISM_INVALID",
+	0x71:  "CKR_MECHANISM_PARAM_INVALID",
+	0xa0:  "CKR_PIN_INCORRECT",
+	0xa4:  "CKR_PIN_LOCKED",
+	0xb0:  "CKR_SESSION_CLOSED",
+	0xb3:  "CKR_SESSION_HANDLE_INVALID",
+	0xe0:  "CKR_TOKEN_NOT_PRESENT",
+	0x101: "CKR_USER_NOT_LOGGED_IN",
+	0x150: "CKR_BUFFER_TOO_SMALL",
+}
+
+func pkcs11Error(fn string, rv C.CK_RV) error {
+	name, ok := ckrNames[rv]
+	if !ok {
+		name = fmt.Sprintf("0x%x", uint64(rv))
+	}
+	return fmt.Errorf("PKCS#11 %s failed: %s", fn, name)
+}
+
+// pkcs11Identity caches the client certificate of a token, since reconnecting
+// calls NewTLSConfig again and the token must only be logged in to once.
+var pkcs11Identity struct {
+	mu   sync.Mutex
+	key  string
+	cert tls.Certificate
+}
+
+// loadPKCS11 returns a client certificate whose private key stays on the
+// token in pkcs11_module. The certificate comes from cert_file or cert_pem,
+// else from the token, next to the key.
+func loadPKCS11(cfg *Config) (tls.Certificate, error) {
+	slotKey := "first"
+	if cfg.PKCS11Slot != nil {
+		slotKey = fmt.Sprint(*cfg.PKCS11Slot)
+	}
+	cacheKey := cfg.PKCS11Module + "\x00" + slotKey + "\x00" + cfg.PKCS11KeyLabel
+	pkcs11Identity.mu.Lock()
+	defer pkcs11Identity.mu.Unlock()
+	if pkcs11Identity.key == cacheKey {
+		// A certificate file is read again, so a renewed certificate is used
+		leaf, err := pkcs11CertFile(cfg)
+		if err != nil || leaf == nil {
+			return pkcs11Identity.cert, err
+		}
+		signer := *pkcs11Identity.cert.PrivateKey.(*pkcs11Signer)
+		signer.pub = leaf.PublicKey
+		return tls.Certificate{Certificate: [][]byte{leaf.Raw}, PrivateKey: &signer, Leaf: leaf}, nil
+	}
+
+	path := C.CString(cfg.PKCS11Module)
+	defer C.free(unsafe.Pointer(path))
+	t := &pkcs11Token{keyLabel: cfg.PKCS11KeyLabel}
+	if msg := C.p11_load(path, &t.handle, &t.fl); msg != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to load PKCS#11 module '%s': %s", cfg.PKCS11Module, C.GoString(msg))
+	}
+	switch rv := C.p11_initialize(t.fl); rv {
+	case 0:
+		t.initialized = true
+	case ckrCryptokiAlreadyInitialized:
+	default:
+		t.close()
+		return tls.Certificate{}, pkcs11Error("C_Initialize", rv)
+	}
+
+	if cfg.PKCS11Slot != nil {
+		t.slot = C.CK_ULONG(*cfg.PKCS11Slot)
+	} else {
+		slots := make([]C.CK_ULONG, 64)
+		count := C.CK_ULONG(len(slots))
+		if rv := C.p11_slots(t.fl, &slots[0], &count); rv != 0 {
+			t.close()
+			return tls.Certificate{}, pkcs11Error("C_GetSlotList", rv)
+		}
+		if count == 0 {
+			t.close()
+			return tls.Certificate{}, fmt.Errorf("no PKCS#11 token found by '%s'", cfg.PKCS11Module)
+		}
+		t.slot = slots[0]
+	}
+	cert, err := t.identity(cfg)
+	if err != nil {
+		t.close()
+		return tls.Certificate{}, fmt.Errorf("PKCS#11 slot %d: %v", uint64(t.slot), err)
+	}
+	logInfo("pkcs11_key", "Signing with the private key on PKCS#11 slot %d for certificate '%s'", uint64(t.slot), cert.Leaf.Subject.CommonName)
+	pkcs11Identity.key, pkcs11Identity.cert = cacheKey, cert
+	return cert, nil
+}
+
+// closePKCS11 closes the token session, finalizes the module if mqttcli
+// initialized it, and unloads it, before exiting.
+func closePKCS11() {
+	pkcs11Identity.mu.Lock()
+	defer pkcs11Identity.mu.Unlock()
+	if s, ok := pkcs11Identity.cert.PrivateKey.(*pkcs11Signer); ok {
+		s.t.mu.Lock()
+		s.t.close()
+		s.t.mu.Unlock()
+	}
+	pkcs11Identity.key, pkcs11Identity.cert = "", tls.Certificate{}
+}
+
+// pkcs11Token is a logged-in session on a token, opened again when the
+// token drops it.
+type pkcs11Token struct {
+	handle      unsafe.Pointer // from dlopen
+	fl          *C.CK_FUNCTION_LIST
+	initialized bool // by mqttcli, so it's finalized on exit
+	slot        C.CK_ULONG
+	pin         []byte
+	keyLabel    string // pkcs11_key_label, to find the key again
+	keyID       []byte // the key's CKA_ID, likewise
+
+	mu      sync.Mutex // sessions aren't safe for concurrent use
+	session C.CK_ULONG
+	open    bool
+	key     C.CK_ULONG
+}
+
+// openSession opens a session on the token and logs in to it.
+func (t *pkcs11Token) openSession() error {
+	var session C.CK_ULONG
+	if rv := C.p11_open(t.fl, t.slot, &session); rv != 0 {
+		return pkcs11Error("C_OpenSession", rv)
+	}
+	cpin := C.CBytes(t.pin)
+	defer C.free(cpin)
+	switch rv := C.p11_login(t.fl, session, cpin, C.CK_ULONG(len(t.pin))); rv {
+	case 0, ckrUserAlreadyLoggedIn:
+	case ckrPINIncorrect:
+		C.p11_close(t.fl, session)
+		return errPKCS11PIN
+	default:
+		C.p11_close(t.fl, session)
+		return pkcs11Error("C_Login", rv)
+	}
+	t.session, t.open = session, true
+	return nil
+}
+
+// reopen replaces a lost session with a new one, logged in again, and finds
+// the key in it again, since a reinserted token hands out new handles.
+// t.mu must be held.
+func (t *pkcs11Token) reopen() error {
+	if t.open {
+		C.p11_close(t.fl, t.session)
+		t.open = false
+	}
+	if err := t.openSession(); err != nil {
+		return err
+	}
+	keys, err := t.find(ckoPrivateKey, t.keyLabel, t.keyID)
+	if err == nil && len(keys) != 1 {
+		err = fmt.Errorf("%d private keys match the one found before", len(keys))
+	}
+	if err != nil {
+		C.p11_close(t.fl, t.session)
+		t.open = false
+		return err
+	}
+	t.key = keys[0]
+	logInfo("pkcs11_reopened", "Opened a new session on PKCS#11 slot %d and logged in again", uint64(t.slot))
+	return nil
+}
+
+// close ends the session, finalizes the module if mqttcli initialized it,
+// and unloads it. t.mu must be held once the token is in use.
+func (t *pkcs11Token) close() {
+	if t.fl == nil {
+		return
+	}
+	if t.open {
+		C.p11_close(t.fl, t.session)
+		t.open = false
+	}
+	if t.initialized {
+		C.p11_finalize(t.fl)
+	}
+	C.p11_unload(t.handle)
+	t.fl = nil
+}
+
+func (t *pkcs11Token) identity(cfg *Config) (tls.Certificate, error) {
+	pin, err := pkcs11PIN(cfg)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	t.pin = pin
+	if err := t.openSession(); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	keys, err := t.find(ckoPrivateKey, cfg.PKCS11KeyLabel, nil)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	switch {
+	case len(keys) == 0 && cfg.PKCS11KeyLabel != "":
+		return tls.Certificate{}, fmt.Errorf("no private key labelled '%s'", cfg.PKCS11KeyLabel)
+	case len(keys) == 0:
+		return tls.Certificate{}, fmt.Errorf("no private key on the token")
+	case len(keys) > 1:
+		return tls.Certificate{}, fmt.Errorf("%d private keys match; choose one with --pkcs11-key-label", len(keys))
+	}
+	t.key = keys[0]
+	// The certificate shares the key's CKA_ID, or failing that its label
+	id, _ := t.attr(t.key, ckaID)
+	t.keyID = id
+
+	leaf, err := pkcs11CertFile(cfg)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if leaf == nil {
+		var certs []C.CK_ULONG
+		if len(id) > 0 {
+			certs, err = t.find(ckoCertificate, "", id)
+		} else if cfg.PKCS11KeyLabel != "" {
+			certs, err = t.find(ckoCertificate, cfg.PKCS11KeyLabel, nil)
+		}
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		if len(certs) == 0 {
+			return tls.Certificate{}, fmt.Errorf("no certificate for the private key on the token; give it with --certfile")
+		}
+		der, err := t.attr(certs[0], ckaValue)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		if leaf, err = x509.ParseCertificate(der); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := checkPKCS11Key(leaf); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	signer := &pkcs11Signer{t: t, pub: leaf.PublicKey}
+	return tls.Certificate{Certificate: [][]byte{leaf.Raw}, PrivateKey: signer, Leaf: leaf}, nil
+}
+
+func (t *pkcs11Token) find(class C.CK_ULONG, label string, id []byte) ([]C.CK_ULONG, error) {
+	var clabel, cid unsafe.Pointer
+	if label != "" {
+		clabel = C.CBytes([]byte(label))
+		defer C.free(clabel)
+	}
+	if len(id) > 0 {
+		cid = C.CBytes(id)
+		defer C.free(cid)
+	}
+	found := make([]C.CK_ULONG, 16)
+	var count C.CK_ULONG
+	rv := C.p11_find(t.fl, t.session, class, clabel, C.CK_ULONG(len(label)), cid, C.CK_ULONG(len(id)),
+		&found[0], C.CK_ULONG(len(found)), &count)
+	if rv != 0 {
+		return nil, pkcs11Error("C_FindObjects", rv)
+	}
+	return found[:count], nil
+}
+
+func (t *pkcs11Token) attr(obj, typ C.CK_ULONG) ([]byte, error) {
+	var n C.CK_ULONG
+	if rv := C.p11_attr(t.fl, t.session, obj, typ, nil, &n); rv != 0 {
+		return nil, pkcs11Error("C_GetAttributeValue", rv)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	buf := C.malloc(C.size_t(n))
+	defer C.free(buf)
+	if rv := C.p11_attr(t.fl, t.session, obj, typ, buf, &n); rv != 0 {
+		return nil, pkcs11Error("C_GetAttributeValue", rv)
+	}
+	return C.GoBytes(buf, C.int(n)), nil
+}
+
+// pkcs11Signer signs TLS handshakes with a key that stays on the token.
+type pkcs11Signer struct {
+	t   *pkcs11Token
+	pub crypto.PublicKey
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey { return s.pub }
+
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var mech, pssHash, pssMGF, pssSalt C.CK_ULONG
+	var size int
+	data := digest
+	switch pub := s.pub.(type) {
+	case *ecdsa.PublicKey:
+		mech, size = ckmECDSA, 2*((pub.Curve.Params().BitSize+7)/8)
+	case *rsa.PublicKey:
+		size = pub.Size()
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			h, ok := pkcs11PSSHashes[pss.Hash]
+			if !ok {
+				return nil, fmt.Errorf("unsupported RSA-PSS hash %v", pss.Hash)
+			}
+			mech, pssHash, pssMGF, pssSalt = ckmRSAPKCSPSS, C.CK_ULONG(h[0]), C.CK_ULONG(h[1]), C.CK_ULONG(pssSaltLength(pss, pub))
+		} else {
+			prefix, ok := rsaDigestInfo[opts.HashFunc()]
+			if !ok {
+				return nil, fmt.Errorf("unsupported RSA hash %v", opts.HashFunc())
+			}
+			mech, data = ckmRSAPKCS, append(append([]byte(nil), prefix...), digest...)
+		}
+	}
+	cdata := C.CBytes(data)
+	defer C.free(cdata)
+	sig := C.malloc(C.size_t(size))
+	defer C.free(sig)
+	n := C.CK_ULONG(size)
+
+	t := s.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.fl == nil {
+		return nil, errors.New("the PKCS#11 module was closed")
+	}
+	sign := func() C.CK_RV {
+		n = C.CK_ULONG(size)
+		return C.p11_sign(t.fl, t.session, t.key, mech, pssHash, pssMGF, pssSalt, cdata, C.CK_ULONG(len(data)), sig, &n)
+	}
+	// A session lost earlier, e.g. to the token being pulled, is opened
+	// again once the token is back
+	var rv C.CK_RV
+	if t.open {
+		rv = sign()
+	}
+	if !t.open || ckrSessionLost[rv] {
+		if t.open {
+			logWarn("pkcs11_session_lost", "PKCS#11 session on slot %d lost (%v); opening a new one", uint64(t.slot), pkcs11Error("C_Sign", rv))
+		}
+		if err := t.reopen(); err != nil {
+			return nil, fmt.Errorf("PKCS#11 slot %d: %v", uint64(t.slot), err)
+		}
+		rv = sign()
+	}
+	if rv != 0 {
+		return nil, pkcs11Error("C_Sign", rv)
+	}
+	out := C.GoBytes(sig, C.int(n))
+	if mech == ckmECDSA {
+		return ecdsaDER(out)
+	}
+	return out, nil
+}
@@ -0,0 +1,18 @@
+//go:build !cgo || !unix
+
+// pkcs11_other.go
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// loadPKCS11 fails: tokens are reached through their C library, which
+// needs a cgo build on Linux or macOS.
+func loadPKCS11(cfg *Config) (tls.Certificate, error) {
+	return tls.Certificate{}, errors.New("this build of mqttcli has no PKCS#11 support; build it with CGO_ENABLED=1 on Linux or macOS")
+}
+
+// closePKCS11 has nothing to close without PKCS#11 support.
+func closePKCS11() {}
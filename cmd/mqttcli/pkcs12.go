@@ -0,0 +1,522 @@
+// pkcs12.go
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/bits"
+	"unicode/utf16"
+)
+
+// envPKCS12Password holds the password of a PKCS#12 bundle, so it needn't
+// appear on the command line.
+const envPKCS12Password = "MQTTCLI_PKCS12_PASSWORD"
+
+// errPKCS12Password reports a missing or wrong bundle password.
+var errPKCS12Password = errors.New("incorrect PKCS#12 password")
+
+// OIDs of PKCS#7 content, PKCS#12 bags, and the algorithms bundles use.
+var (
+	oidDataContent      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEncryptedContent = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+	oidKeyBag           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 1}
+	oidShroudedKeyBag   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidPBEWithSHA3DES   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidPBEWithSHARC240  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 6}
+	oidSHA1             = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+)
+
+type pfxPDU struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  pfxMacData `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type pfxMacData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type digestInfo struct {
+	Algorithm pkixAlgorithm
+	Digest    []byte
+}
+
+type encryptedData struct {
+	Version              int
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkixAlgorithm
+	EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue `asn1:"tag:0,explicit"`
+	Attributes asn1.RawValue `asn1:"optional"`
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+// pkcs12Bundle is what a .p12/.pfx file holds.
+type pkcs12Bundle struct {
+	key   crypto.PrivateKey
+	certs []*x509.Certificate
+}
+
+// bmpPassword encodes a password as PKCS#12 key derivation expects:
+// big-endian UTF-16 with a terminating NUL.
+func bmpPassword(password string) []byte {
+	var b []byte
+	for _, r := range utf16.Encode([]rune(password)) {
+		b = append(b, byte(r>>8), byte(r))
+	}
+	return append(b, 0, 0)
+}
+
+// pkcs12KDF derives size bytes of key material of the given purpose (1 for a
+// key, 2 for an IV, 3 for a MAC key) from password (RFC 7292, appendix B).
+func pkcs12KDF(h func() hash.Hash, id byte, password, salt []byte, iterations, size int) []byte {
+	hh := h()
+	v := hh.BlockSize()
+	fill := func(b []byte) []byte {
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+	var I []byte
+	if len(salt) > 0 {
+		I = fill(salt)
+	}
+	I = append(I, fill(password)...)
+	var out []byte
+	for {
+		hh.Reset()
+		hh.Write(bytes.Repeat([]byte{id}, v))
+		hh.Write(I)
+		a := hh.Sum(nil)
+		for i := 1; i < iterations; i++ {
+			hh.Reset()
+			hh.Write(a)
+			a = hh.Sum(a[:0])
+		}
+		out = append(out, a...)
+		if len(out) >= size {
+			return out[:size]
+		}
+		// Each v-byte block of I becomes I + B + 1, with B the hash repeated
+		b := fill(a)
+		for k := 0; k < len(I); k += v {
+			carry := 1
+			for m := v - 1; m >= 0; m-- {
+				carry += int(I[k+m]) + int(b[m])
+				I[k+m] = byte(carry)
+				carry >>= 8
+			}
+		}
+	}
+}
+
+// verifyPKCS12MAC checks the bundle's integrity MAC, which is how a wrong
+// password shows up.
+func verifyPKCS12MAC(m *pfxMacData, data []byte, password string) error {
+	var h func() hash.Hash
+	switch alg := m.Mac.Algorithm.Algorithm; {
+	case alg.Equal(oidSHA1):
+		h = sha1.New
+	case alg.Equal(oidSHA256):
+		h = sha256.New
+	case alg.Equal(oidSHA384):
+		h = sha512.New384
+	case alg.Equal(oidSHA512):
+		h = sha512.New
+	default:
+		return fmt.Errorf("unsupported PKCS#12 MAC %s", alg)
+	}
+	key := pkcs12KDF(h, 3, bmpPassword(password), m.MacSalt, m.Iterations, h().Size())
+	mac := hmac.New(h, key)
+	mac.Write(data)
+	if !hmac.Equal(mac.Sum(nil), m.Mac.Digest) {
+		return errPKCS12Password
+	}
+	return nil
+}
+
+// decryptPKCS12 decrypts a bag or content encrypted with PBES2, or with the
+// legacy PKCS#12 schemes older tools still produce: SHA-1 with 3DES, or with
+// 40-bit RC2.
+func decryptPKCS12(alg pkixAlgorithm, data []byte, password string) ([]byte, error) {
+	if alg.Algorithm.Equal(oidPBES2) {
+		plain, err := decryptPBES2(alg.Parameters.FullBytes, data, []byte(password))
+		if errors.Is(err, errKeyPassword) {
+			err = errPKCS12Password
+		}
+		return plain, err
+	}
+	var keyLen int
+	var newCipher func([]byte) (cipher.Block, error)
+	switch {
+	case alg.Algorithm.Equal(oidPBEWithSHA3DES):
+		keyLen, newCipher = 24, des.NewTripleDESCipher
+	case alg.Algorithm.Equal(oidPBEWithSHARC240):
+		keyLen, newCipher = 5, func(key []byte) (cipher.Block, error) { return newRC2(key, 40), nil }
+	default:
+		return nil, fmt.Errorf("unsupported PKCS#12 encryption %s", alg.Algorithm)
+	}
+	var p pbeParams
+	if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &p); err != nil {
+		return nil, fmt.Errorf("invalid PKCS#12 encryption parameters: %v", err)
+	}
+	pw := bmpPassword(password)
+	block, err := newCipher(pkcs12KDF(sha1.New, 1, pw, p.Salt, p.Iterations, keyLen))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errors.New("malformed encrypted data")
+	}
+	iv := pkcs12KDF(sha1.New, 2, pw, p.Salt, p.Iterations, block.BlockSize())
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+	plain, err = unpad(plain, block.BlockSize())
+	if err != nil {
+		return nil, errPKCS12Password
+	}
+	return plain, nil
+}
+
+// decodePKCS12 returns the private key and certificates in a PFX file.
+func decodePKCS12(der []byte, password string) (*pkcs12Bundle, error) {
+	var pfx pfxPDU
+	if rest, err := asn1.Unmarshal(der, &pfx); err != nil || len(rest) > 0 {
+		if err == nil {
+			err = errors.New("trailing data")
+		}
+		return nil, fmt.Errorf("not a PKCS#12 bundle: %v", err)
+	}
+	if !pfx.AuthSafe.ContentType.Equal(oidDataContent) {
+		return nil, errors.New("only password-protected PKCS#12 bundles are supported")
+	}
+	var data []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &data); err != nil {
+		return nil, fmt.Errorf("invalid PKCS#12 content: %v", err)
+	}
+	if len(pfx.MacData.Mac.Algorithm.Algorithm) > 0 {
+		if err := verifyPKCS12MAC(&pfx.MacData, data, password); err != nil {
+			return nil, err
+		}
+	}
+
+	var safes []contentInfo
+	if _, err := asn1.Unmarshal(data, &safes); err != nil {
+		return nil, fmt.Errorf("invalid PKCS#12 content: %v", err)
+	}
+	var bundle pkcs12Bundle
+	for _, ci := range safes {
+		var contents []byte
+		switch {
+		case ci.ContentType.Equal(oidDataContent):
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &contents); err != nil {
+				return nil, fmt.Errorf("invalid PKCS#12 content: %v", err)
+			}
+		case ci.ContentType.Equal(oidEncryptedContent):
+			var ed encryptedData
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+				return nil, fmt.Errorf("invalid PKCS#12 encrypted content: %v", err)
+			}
+			var err error
+			eci := ed.EncryptedContentInfo
+			if contents, err = decryptPKCS12(eci.ContentEncryptionAlgorithm, eci.EncryptedContent, password); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unsupported PKCS#12 content %s", ci.ContentType)
+		}
+		var bags []safeBag
+		if _, err := asn1.Unmarshal(contents, &bags); err != nil {
+			return nil, fmt.Errorf("invalid PKCS#12 bags: %v", err)
+		}
+		for _, bag := range bags {
+			if err := bundle.add(bag, password); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &bundle, nil
+}
+
+// add takes the key or certificate from bag; bags of other kinds, such as
+// CRLs and secrets, are skipped.
+func (b *pkcs12Bundle) add(bag safeBag, password string) error {
+	switch {
+	case bag.ID.Equal(oidCertBag):
+		var cb certBag
+		if _, err := asn1.Unmarshal(bag.Value.Bytes, &cb); err != nil {
+			return fmt.Errorf("invalid PKCS#12 certificate bag: %v", err)
+		}
+		if !cb.ID.Equal(oidX509Certificate) {
+			return nil
+		}
+		cert, err := x509.ParseCertificate(cb.Data)
+		if err != nil {
+			return err
+		}
+		b.certs = append(b.certs, cert)
+	case bag.ID.Equal(oidKeyBag), bag.ID.Equal(oidShroudedKeyBag):
+		if b.key != nil {
+			return errors.New("PKCS#12 bundles with more than one private key are not supported")
+		}
+		der := bag.Value.Bytes
+		if bag.ID.Equal(oidShroudedKeyBag) {
+			var info encryptedPrivateKeyInfo
+			if _, err := asn1.Unmarshal(der, &info); err != nil {
+				return fmt.Errorf("invalid PKCS#12 key bag: %v", err)
+			}
+			var err error
+			if der, err = decryptPKCS12(info.Algorithm, info.EncryptedData, password); err != nil {
+				return err
+			}
+		}
+		key, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return errPKCS12Password
+		}
+		b.key = key
+	}
+	return nil
+}
+
+// loadPKCS12 reads pkcs12_file into a client certificate with its chain,
+// and returns the CA certificates in the bundle. Without pkcs12_password it
+// tries an empty password, then prompts.
+func loadPKCS12(cfg *Config) (tls.Certificate, []*x509.Certificate, error) {
+	der, err := ioutil.ReadFile(cfg.PKCS12File)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	bundle, err := decodePKCS12(der, cfg.PKCS12Password)
+	if errors.Is(err, errPKCS12Password) && cfg.PKCS12Password == "" {
+		pw, perr := promptPassword("Password for the PKCS#12 bundle: ")
+		if perr != nil {
+			return tls.Certificate{}, nil, fmt.Errorf("'%s' is password protected; set --pkcs12-password or $%s (%v)", cfg.PKCS12File, envPKCS12Password, perr)
+		}
+		cfg.PKCS12Password = string(pw)
+		bundle, err = decodePKCS12(der, cfg.PKCS12Password)
+	}
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	return bundle.certificate(cfg.PKCS12File)
+}
+
+// certificate returns the client certificate for the bundle's key with its
+// chain, and the CA certificates in the bundle; file names it in errors.
+func (b *pkcs12Bundle) certificate(file string) (tls.Certificate, []*x509.Certificate, error) {
+	if b.key == nil {
+		return tls.Certificate{}, nil, fmt.Errorf("no private key in '%s'", file)
+	}
+	signer, ok := b.key.(crypto.Signer)
+	if !ok {
+		return tls.Certificate{}, nil, fmt.Errorf("unsupported key type %T in '%s'; a client certificate needs a signing key", b.key, file)
+	}
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return tls.Certificate{}, nil, fmt.Errorf("unsupported key type %T in '%s'", b.key, file)
+	}
+
+	// The client certificate is the one for the key; the rest are its chain
+	var leaf *x509.Certificate
+	var others []*x509.Certificate
+	for _, c := range b.certs {
+		if leaf == nil && pub.Equal(c.PublicKey) {
+			leaf = c
+		} else {
+			others = append(others, c)
+		}
+	}
+	if leaf == nil {
+		return tls.Certificate{}, nil, fmt.Errorf("no certificate for the private key in '%s'", file)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{leaf.Raw}, PrivateKey: b.key, Leaf: leaf}
+	// Cross-signed intermediates can issue each other, so each certificate
+	// is added once and the chain ends at the first repeat
+	seen := map[*x509.Certificate]bool{leaf: true}
+	for c := leaf; ; {
+		next := pkcs12Issuer(c, others)
+		if next == nil || seen[next] || next.CheckSignatureFrom(next) == nil {
+			break
+		}
+		seen[next] = true
+		cert.Certificate = append(cert.Certificate, next.Raw)
+		c = next
+	}
+	var roots []*x509.Certificate
+	for _, c := range others {
+		if c.IsCA && c.CheckSignatureFrom(c) == nil {
+			roots = append(roots, c)
+		}
+	}
+	return cert, roots, nil
+}
+
+// pkcs12Issuer returns the certificate among certs that issued c.
+func pkcs12Issuer(c *x509.Certificate, certs []*x509.Certificate) *x509.Certificate {
+	for _, p := range certs {
+		if p != c && bytes.Equal(p.RawSubject, c.RawIssuer) && c.CheckSignatureFrom(p) == nil {
+			return p
+		}
+	}
+	return nil
+}
+
+// rc2Cipher is RC2 (RFC 2268), which older PKCS#12 tools still use to
+// encrypt the certificates in a bundle.
+type rc2Cipher struct {
+	k [64]uint16
+}
+
+// rc2PiTable is the permutation of 0-255 from the digits of pi that RC2's key
+// schedule uses.
+var rc2PiTable = [256]byte{
+	0xd9, 0x78, 0xf9, 0xc4, 0x19, 0xdd, 0xb5, 0xed, 0x28, 0xe9, 0xfd, 0x79, 0x4a, 0xa0, 0xd8, 0x9d,
+	0xc6, 0x7e, 0x37, 0x83, 0x2b, 0x76, 0x53, 0x8e, 0x62, 0x4c, 0x64, 0x88, 0x44, 0x8b, 0xfb, 0xa2,
+	0x17, 0x9a, 0x59, 0xf5, 0x87, 0xb3, 0x4f, 0x13, 0x61, 0x45, 0x6d, 0x8d, 0x09, 0x81, 0x7d, 0x32,
+	0xbd, 0x8f, 0x40, 0xeb, 0x86, 0xb7, 0x7b, 0x0b, 0xf0, 0x95, 0x21, 0x22, 0x5c, 0x6b, 0x4e, 0x82,
+	0x54, 0xd6, 0x65, 0x93, 0xce, 0x60, 0xb2, 0x1c, 0x73, 0x56, 0xc0, 0x14, 0xa7, 0x8c, 0xf1, 0xdc,
+	0x12, 0x75, 0xca, 0x1f, 0x3b, 0xbe, 0xe4, 0xd1, 0x42, 0x3d, 0xd4, 0x30, 0xa3, 0x3c, 0xb6, 0x26,
+	0x6f, 0xbf, 0x0e, 0xda, 0x46, 0x69, 0x07, 0x57, 0x27, 0xf2, 0x1d, 0x9b, 0xbc, 0x94, 0x43, 0x03,
+	0xf8, 0x11, 0xc7, 0xf6, 0x90, 0xef, 0x3e, 0xe7, 0x06, 0xc3, 0xd5, 0x2f, 0xc8, 0x66, 0x1e, 0xd7,
+	0x08, 0xe8, 0xea, 0xde, 0x80, 0x52, 0xee, 0xf7, 0x84, 0xaa, 0x72, 0xac, 0x35, 0x4d, 0x6a, 0x2a,
+	0x96, 0x1a, 0xd2, 0x71, 0x5a, 0x15, 0x49, 0x74, 0x4b, 0x9f, 0xd0, 0x5e, 0x04, 0x18, 0xa4, 0xec,
+	0xc2, 0xe0, 0x41, 0x6e, 0x0f, 0x51, 0xcb, 0xcc, 0x24, 0x91, 0xaf, 0x50, 0xa1, 0xf4, 0x70, 0x39,
+	0x99, 0x7c, 0x3a, 0x85, 0x23, 0xb8, 0xb4, 0x7a, 0xfc, 0x02, 0x36, 0x5b, 0x25, 0x55, 0x97, 0x31,
+	0x2d, 0x5d, 0xfa, 0x98, 0xe3, 0x8a, 0x92, 0xae, 0x05, 0xdf, 0x29, 0x10, 0x67, 0x6c, 0xba, 0xc9,
+	0xd3, 0x00, 0xe6, 0xcf, 0xe1, 0x9e, 0xa8, 0x2c, 0x63, 0x16, 0x01, 0x3f, 0x58, 0xe2, 0x89, 0xa9,
+	0x0d, 0x38, 0x34, 0x1b, 0xab, 0x33, 0xff, 0xb0, 0xbb, 0x48, 0x0c, 0x5f, 0xb9, 0xb1, 0xcd, 0x2e,
+	0xc5, 0xf3, 0xdb, 0x47, 0xe5, 0xa5, 0x9c, 0x77, 0x0a, 0xa6, 0x20, 0x68, 0xfe, 0x7f, 0xc1, 0xad,
+}
+
+// newRC2 expands key with the given effective key length in bits.
+func newRC2(key []byte, effectiveBits int) *rc2Cipher {
+	var l [128]byte
+	t := len(key)
+	copy(l[:], key)
+	for i := t; i < 128; i++ {
+		l[i] = rc2PiTable[l[i-1]+l[i-t]]
+	}
+	t8 := (effectiveBits + 7) / 8
+	tm := byte(255 >> uint(8*t8-effectiveBits))
+	l[128-t8] = rc2PiTable[l[128-t8]&tm]
+	for i := 127 - t8; i >= 0; i-- {
+		l[i] = rc2PiTable[l[i+1]^l[i+t8]]
+	}
+	c := &rc2Cipher{}
+	for i := range c.k {
+		c.k[i] = uint16(l[2*i]) | uint16(l[2*i+1])<<8
+	}
+	return c
+}
+
+func (c *rc2Cipher) BlockSize() int { return 8 }
+
+var rc2Shifts = [4]int{1, 2, 3, 5}
+
+func (c *rc2Cipher) Encrypt(dst, src []byte) {
+	var r [4]uint16
+	for i := range r {
+		r[i] = binary.LittleEndian.Uint16(src[2*i:])
+	}
+	j := 0
+	mix := func() {
+		for i := 0; i < 4; i++ {
+			r[i] += c.k[j] + (r[(i+3)%4] & r[(i+2)%4]) + (^r[(i+3)%4] & r[(i+1)%4])
+			r[i] = bits.RotateLeft16(r[i], rc2Shifts[i])
+			j++
+		}
+	}
+	mash := func() {
+		for i := 0; i < 4; i++ {
+			r[i] += c.k[r[(i+3)%4]&63]
+		}
+	}
+	for _, rounds := range []int{5, 6, 5} {
+		if j > 0 {
+			mash()
+		}
+		for n := 0; n < rounds; n++ {
+			mix()
+		}
+	}
+	for i := range r {
+		binary.LittleEndian.PutUint16(dst[2*i:], r[i])
+	}
+}
+
+func (c *rc2Cipher) Decrypt(dst, src []byte) {
+	var r [4]uint16
+	for i := range r {
+		r[i] = binary.LittleEndian.Uint16(src[2*i:])
+	}
+	j := 63
+	mix := func() {
+		for i := 3; i >= 0; i-- {
+			r[i] = bits.RotateLeft16(r[i], -rc2Shifts[i])
+			r[i] -= c.k[j] + (r[(i+3)%4] & r[(i+2)%4]) + (^r[(i+3)%4] & r[(i+1)%4])
+			j--
+		}
+	}
+	mash := func() {
+		for i := 3; i >= 0; i-- {
+			r[i] -= c.k[r[(i+3)%4]&63]
+		}
+	}
+	for _, rounds := range []int{5, 6, 5} {
+		if j < 63 {
+			mash()
+		}
+		for n := 0; n < rounds; n++ {
+			mix()
+		}
+	}
+	for i := range r {
+		binary.LittleEndian.PutUint16(dst[2*i:], r[i])
+	}
+}
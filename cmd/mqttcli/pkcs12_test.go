@@ -0,0 +1,251 @@
+// pkcs12_test.go
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The bundles in testdata hold testdata/client.pem and client.key, with the
+// password "secret":
+//
+//	openssl pkcs12 -export -inkey client.key -in client.pem -passout pass:secret -out pbes2.p12
+//	openssl pkcs12 -export -inkey client.key -in client.pem -passout pass:secret \
+//	        -keypbe PBE-SHA1-3DES -certpbe PBE-SHA1-3DES -macalg sha1 -out sha1-3des.p12
+//	openssl pkcs12 -export -legacy -inkey client.key -in client.pem -passout pass:secret \
+//	        -keypbe PBE-SHA1-RC2-40 -certpbe PBE-SHA1-RC2-40 -macalg sha1 -out sha1-rc2-40.p12
+var pkcs12Bundles = []string{"pbes2.p12", "sha1-3des.p12", "sha1-rc2-40.p12"}
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// The expected keys are from OpenSSL's PKCS12KDF, e.g.
+//
+//	openssl kdf -keylen 24 -kdfopt digest:SHA1 -kdfopt hexpass:0073006500730061006d00650000 \
+//	        -kdfopt hexsalt:ffffffffffffffff -kdfopt iter:2048 -kdfopt id:1 PKCS12KDF
+func TestPKCS12KDF(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		h          func() hash.Hash
+		id         byte
+		salt       string
+		iterations int
+		want       string
+	}{
+		{"sha1 key", sha1.New, 1, "ffffffffffffffff", 2048, "7cd9fd3e2b3be7691a44e3bef0f9ea0fb9b897d4e325d9d1"},
+		{"sha1 iv", sha1.New, 2, "ffffffffffffffff", 2048, "3f5a277f9c21ff82b0d22f41c70f72d36d6c1e365247094a"},
+		{"sha1 mac key", sha1.New, 3, "ffffffffffffffff", 2048, "91715bd27aa978513e3a40f55b8f7b567b5a9f3c4279edab"},
+		{"sha256 mac key", sha256.New, 3, "0102030405060708", 1000, "f3878e6635da52fc96aee1322eccb03cdc59a8b137b4ec66bc205f8fd090662f"},
+		{"longer than one hash", sha1.New, 1, "ffffffffffffffff", 1,
+			"ad2f5e19767c43a4c6b9638e9e219078" + "91046bfa1b416b81bccee1c6fdb9b8a9" + "5c4d6494e0f2db6506911264dad29a07" +
+				"194f3e7537fe3b3ace671c1524a6e1a5" + "3044bd1c96896f4462d92af8af2fc391" + "a243cc46fcadccfcb20001ecbf4c3f91" + "9dc9f035"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			want := unhex(t, tc.want)
+			got := pkcs12KDF(tc.h, tc.id, bmpPassword("sesame"), unhex(t, tc.salt), tc.iterations, len(want))
+			if !bytes.Equal(got, want) {
+				t.Errorf("got %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+func TestBMPPassword(t *testing.T) {
+	if got, want := bmpPassword("sesame"), unhex(t, "0073006500730061006d00650000"); !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+	if got, want := bmpPassword(""), []byte{0, 0}; !bytes.Equal(got, want) {
+		t.Errorf("empty password: got %x, want %x", got, want)
+	}
+}
+
+// The vectors are from RFC 2268, section 5.
+func TestRC2(t *testing.T) {
+	for _, tc := range []struct {
+		key        string
+		bits       int
+		plain, out string
+	}{
+		{"0000000000000000", 63, "0000000000000000", "ebb773f993278eff"},
+		{"ffffffffffffffff", 64, "ffffffffffffffff", "278b27e42e2f0d49"},
+		{"3000000000000000", 64, "1000000000000001", "30649edf9be7d2c2"},
+		{"88", 64, "0000000000000000", "61a8a244adacccf0"},
+		{"88bca90e90875a", 64, "0000000000000000", "6ccf4308974c267f"},
+		{"88bca90e90875a7f0f79c384627bafb2", 64, "0000000000000000", "1a807d272bbe5db1"},
+		{"88bca90e90875a7f0f79c384627bafb2", 128, "0000000000000000", "2269552ab0f85ca6"},
+	} {
+		c := newRC2(unhex(t, tc.key), tc.bits)
+		plain, want := unhex(t, tc.plain), unhex(t, tc.out)
+		got := make([]byte, 8)
+		c.Encrypt(got, plain)
+		if !bytes.Equal(got, want) {
+			t.Errorf("key %s/%d: encrypted to %x, want %x", tc.key, tc.bits, got, want)
+		}
+		c.Decrypt(got, want)
+		if !bytes.Equal(got, plain) {
+			t.Errorf("key %s/%d: decrypted to %x, want %x", tc.key, tc.bits, got, plain)
+		}
+	}
+}
+
+func TestDecodePKCS12(t *testing.T) {
+	want, err := tls.LoadX509KeyPair("testdata/client.pem", "testdata/client.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range pkcs12Bundles {
+		t.Run(name, func(t *testing.T) {
+			der, err := os.ReadFile("testdata/" + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bundle, err := decodePKCS12(der, "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(bundle.certs) != 1 || !bytes.Equal(bundle.certs[0].Raw, want.Certificate[0]) {
+				t.Errorf("got %d certificate(s), want testdata/client.pem", len(bundle.certs))
+			}
+			key, ok := bundle.key.(interface{ Equal(crypto.PrivateKey) bool })
+			if !ok || !key.Equal(want.PrivateKey) {
+				t.Errorf("got key %T, want the one in testdata/client.key", bundle.key)
+			}
+		})
+	}
+}
+
+func TestDecodePKCS12WrongPassword(t *testing.T) {
+	for _, name := range pkcs12Bundles {
+		der, err := os.ReadFile("testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pw := range []string{"", "Secret", "secret "} {
+			if _, err := decodePKCS12(der, pw); !errors.Is(err, errPKCS12Password) {
+				t.Errorf("%s with password %q: got %v, want errPKCS12Password", name, pw, err)
+			}
+		}
+	}
+}
+
+func TestLoadPKCS12(t *testing.T) {
+	cfg := &Config{PKCS12File: "testdata/pbes2.p12", PKCS12Password: "secret"}
+	cert, roots, err := loadPKCS12(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf == nil || cert.Leaf.Subject.CommonName != "mqttcli-test" {
+		t.Errorf("got leaf %v, want CN=mqttcli-test", cert.Leaf)
+	}
+	// A self-signed client certificate is its own chain, not a CA
+	if len(cert.Certificate) != 1 || len(roots) != 0 {
+		t.Errorf("got %d certificate(s) and %d root(s), want 1 and 0", len(cert.Certificate), len(roots))
+	}
+}
+
+// testCert issues a certificate for key's public half, signed by parent and
+// parentKey, or self-signed when parent is nil.
+func testCert(t *testing.T, cn string, key *ecdsa.PrivateKey, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) *x509.Certificate {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func testKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestPKCS12Chain(t *testing.T) {
+	rootKey, interKey, leafKey := testKey(t), testKey(t), testKey(t)
+	root := testCert(t, "root", rootKey, nil, nil)
+	inter := testCert(t, "intermediate", interKey, root, rootKey)
+	leaf := testCert(t, "leaf", leafKey, inter, interKey)
+
+	b := &pkcs12Bundle{key: leafKey, certs: []*x509.Certificate{root, leaf, inter}}
+	cert, roots, err := b.certificate("test.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.Certificate) != 2 || cert.Leaf != leaf || !bytes.Equal(cert.Certificate[1], inter.Raw) {
+		t.Errorf("got a chain of %d, want the leaf and its intermediate", len(cert.Certificate))
+	}
+	if len(roots) != 1 || roots[0] != root {
+		t.Errorf("got %d root(s), want the self-signed one", len(roots))
+	}
+}
+
+func TestPKCS12CrossSignedChain(t *testing.T) {
+	aKey, bKey, leafKey := testKey(t), testKey(t), testKey(t)
+	// A and B issue each other, so following issuers never reaches a root
+	aTmpl := testCert(t, "A", aKey, nil, nil)
+	b := testCert(t, "B", bKey, aTmpl, aKey)
+	a := testCert(t, "A", aKey, b, bKey)
+	leaf := testCert(t, "leaf", leafKey, a, aKey)
+
+	bundle := &pkcs12Bundle{key: leafKey, certs: []*x509.Certificate{leaf, a, b}}
+	cert, _, err := bundle.certificate("test.p12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.Certificate) != 3 {
+		t.Errorf("got a chain of %d, want the leaf, A, and B once each", len(cert.Certificate))
+	}
+}
+
+func TestPKCS12UnsupportedKey(t *testing.T) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &pkcs12Bundle{key: key}
+	if _, _, err := b.certificate("test.p12"); err == nil || !strings.Contains(err.Error(), "unsupported key type *ecdh.PrivateKey") {
+		t.Errorf("got %v, want an unsupported key type error", err)
+	}
+}
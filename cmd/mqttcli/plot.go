@@ -0,0 +1,157 @@
+// plot.go
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// sparkBlocks are the eight bar heights used to draw a sparkline.
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// plotRedrawInterval limits how often the chart is redrawn on busy topics.
+const plotRedrawInterval = 200 * time.Millisecond
+
+// plotter keeps a sliding window of samples per topic and redraws one
+// sparkline row per topic.
+type plotter struct {
+	field  string
+	window int
+	out    io.Writer
+
+	mu     sync.Mutex
+	series map[string][]float64
+	rows   int // rows drawn last time, so the cursor can move back over them
+	dirty  bool
+}
+
+func newPlotter(field string, window int, out io.Writer) *plotter {
+	return &plotter{field: field, window: window, out: out, series: map[string][]float64{}}
+}
+
+// handler extracts the field from each JSON payload and records it.
+func (p *plotter) handler(client mqtt.Client, msg mqtt.Message) {
+	v, ok := lookupJSONField(msg.Payload(), p.field)
+	if !ok {
+		return
+	}
+	f, ok := toFloat(v)
+	if !ok {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := append(p.series[msg.Topic()], f)
+	if len(s) > p.window {
+		s = s[len(s)-p.window:]
+	}
+	p.series[msg.Topic()] = s
+	p.dirty = true
+}
+
+// run redraws the chart whenever new samples arrived, until done is closed.
+func (p *plotter) run(done <-chan struct{}) {
+	ticker := time.NewTicker(plotRedrawInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			p.redraw()
+		}
+	}
+}
+
+func (p *plotter) redraw() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.dirty {
+		return
+	}
+	p.dirty = false
+
+	topics := make([]string, 0, len(p.series))
+	for t := range p.series {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+
+	var b strings.Builder
+	if p.rows > 0 {
+		fmt.Fprintf(&b, "\x1b[%dA", p.rows)
+	}
+	for _, t := range topics {
+		s := p.series[t]
+		lo, hi, sum := s[0], s[0], 0.0
+		for _, v := range s {
+			lo, hi, sum = min(lo, v), max(hi, v), sum+v
+		}
+		fmt.Fprintf(&b, "\r\x1b[2K%-32s %s last=%g min=%g max=%g avg=%.4g\n",
+			truncate(sanitizeForTerminal(t), 32), sparkline(s, lo, hi), s[len(s)-1], lo, hi, sum/float64(len(s)))
+	}
+	p.rows = len(topics)
+	io.WriteString(p.out, b.String())
+}
+
+// sparkline scales values between lo and hi onto the block characters,
+// clamping any value outside them to the lowest or highest block.
+func sparkline(values []float64, lo, hi float64) string {
+	out := make([]rune, len(values))
+	for i, v := range values {
+		idx := len(sparkBlocks) / 2
+		if hi > lo {
+			idx = int((v - lo) / (hi - lo) * float64(len(sparkBlocks)-1))
+		}
+		out[i] = sparkBlocks[max(0, min(idx, len(sparkBlocks)-1))]
+	}
+	return string(out)
+}
+
+// truncate shortens s to n runes, marking the cut with an ellipsis.
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
+
+// runPlot implements "mqttcli plot": a live sparkline of a numeric JSON field
+// for each matched topic over a sliding window of recent samples.
+func runPlot(args []string) {
+	fs := flag.NewFlagSet("plot", flag.ExitOnError)
+	flags := initCLIFlags(fs)
+	field := fs.String("field", "", "Dotted path of the numeric JSON field to chart, e.g. 'temperature' or 'env.temp'.")
+	window := fs.Int("window", 60, "Number of recent samples to chart per topic.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s plot [options] --field NAME\n\nOptions:\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *field == "" {
+		fatal("config_invalid", false, "Field is not set. Provide via --field.")
+	}
+	if *window <= 0 {
+		fatal("config_invalid", false, "--window must be positive.")
+	}
+
+	cfg := buildConfig(flags)
+	p := newPlotter(*field, *window, os.Stdout)
+	done := make(chan struct{})
+	go p.run(done)
+	runSubscription(context.Background(), &cfg, p.handler)
+	close(done)
+}
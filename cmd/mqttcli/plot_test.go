@@ -0,0 +1,27 @@
+// plot_test.go
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSparkline(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		values []float64
+		lo, hi float64
+		want   string
+	}{
+		{"scaled", []float64{0, 1, 2, 3, 4, 5, 6, 7}, 0, 7, "▁▂▃▄▅▆▇█"},
+		{"flat", []float64{3, 3, 3}, 3, 3, "▅▅▅"},
+		{"outside the range", []float64{-10, 20}, 0, 10, "▁█"},
+		{"range too wide for a float64", []float64{-math.MaxFloat64, math.MaxFloat64}, -math.MaxFloat64, math.MaxFloat64, "▁▁"},
+		{"NaN", []float64{math.NaN(), 1}, 0, 1, "▁█"},
+	} {
+		// None of these may index past the blocks
+		if got := sparkline(tc.values, tc.lo, tc.hi); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
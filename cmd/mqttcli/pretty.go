@@ -0,0 +1,94 @@
+// pretty.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// ANSI colors used by --pretty, close to jq's defaults.
+const (
+	colorKey    = "\x1b[34;1m"
+	colorString = "\x1b[32m"
+	colorNumber = "\x1b[36m"
+	colorBool   = "\x1b[33m"
+	colorNull   = "\x1b[90m"
+	colorReset  = "\x1b[0m"
+)
+
+// stdoutIsTerminal reports whether stdout is a terminal that may be colored;
+// setting NO_COLOR (https://no-color.org) turns colors off.
+func stdoutIsTerminal() bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// prettyPayload indents a JSON object or array payload, escaping it for the
+// terminal unless raw, and colors it when color is set. ok is false for
+// payloads that aren't JSON objects or arrays, which print as usual.
+func prettyPayload(payload []byte, raw, color bool) (string, bool) {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return "", false
+	}
+	var b bytes.Buffer
+	if err := json.Indent(&b, trimmed, "", "  "); err != nil {
+		return "", false
+	}
+	s := b.String()
+	if !raw {
+		s = sanitizeForTerminal(s)
+	}
+	if color {
+		s = colorizeJSON(s)
+	}
+	return s, true
+}
+
+// colorizeJSON colors the keys and values of valid, indented JSON text.
+func colorizeJSON(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '"':
+			end := i + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end++
+			color := colorString
+			if rest := strings.TrimLeft(s[end:], " "); strings.HasPrefix(rest, ":") {
+				color = colorKey
+			}
+			b.WriteString(color + s[i:end] + colorReset)
+			i = end
+		case c == '-' || (c >= '0' && c <= '9'):
+			end := i + strings.IndexAny(s[i:]+",", ",]}\n ")
+			b.WriteString(colorNumber + s[i:end] + colorReset)
+			i = end
+		case strings.HasPrefix(s[i:], "true"), strings.HasPrefix(s[i:], "false"):
+			n := 4
+			if c == 'f' {
+				n = 5
+			}
+			b.WriteString(colorBool + s[i:i+n] + colorReset)
+			i += n
+		case strings.HasPrefix(s[i:], "null"):
+			b.WriteString(colorNull + "null" + colorReset)
+			i += 4
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
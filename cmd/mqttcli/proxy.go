@@ -0,0 +1,608 @@
+// proxy.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	packets5 "github.com/eclipse/paho.golang/packets"
+	packets3 "github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// maxRemainingLength is the largest remaining length MQTT can encode.
+const maxRemainingLength = 268435455
+
+// proxyMaxPacketSize is the default for proxy --max-packet-size: the largest
+// packet read from either side, so a bogus length can't make the proxy
+// allocate up to maxRemainingLength.
+const proxyMaxPacketSize = 16 << 20
+
+// Directions of proxied packets.
+const (
+	toBroker = "client->broker"
+	toClient = "broker->client"
+)
+
+// mqttProxy implements "mqttcli proxy": it accepts MQTT connections, opens a
+// matching connection to the upstream broker for each, and logs every packet
+// passing in either direction. Packets are forwarded byte for byte.
+type mqttProxy struct {
+	cfg       *Config // upstream TLS and WebSocket settings, and output options
+	upstream  *url.URL
+	tls       *tls.Config // for ssl:// and wss:// upstreams
+	stamps    *stamper
+	up, down  shaping            // for client->broker and broker->client packets
+	protocol  uint               // protocol version to speak upstream; zero forwards the client's
+	creds     *credentialRewrite // replaces device credentials; nil forwards them
+	maxPacket int                // largest packet read, unless a MQTT v5 CONNECT or CONNACK allows less
+
+	mu    sync.Mutex // serializes packet lines
+	conns atomic.Int64
+}
+
+// readFrame reads one MQTT packet, fixed header included, without decoding it.
+// Packets over limit bytes are refused before they are read.
+func readFrame(r *bufio.Reader, limit int) ([]byte, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	frame := []byte{first}
+	length, shift := 0, 0
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		frame = append(frame, b)
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return nil, errors.New("malformed remaining length")
+		}
+		shift += 7
+	}
+	if length > maxRemainingLength {
+		return nil, fmt.Errorf("remaining length %d too large", length)
+	}
+	if size := len(frame) + length; size > limit {
+		return nil, fmt.Errorf("packet of %d bytes exceeds the maximum packet size of %d bytes", size, limit)
+	}
+	frame = append(frame, make([]byte, length)...)
+	if _, err := io.ReadFull(r, frame[len(frame)-length:]); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return frame, nil
+}
+
+// connectVersion returns the protocol level of a raw CONNECT packet: 3 for
+// MQTT 3.1, 4 for 3.1.1, 5 for MQTT 5, or 0 if it can't be read.
+func connectVersion(frame []byte) byte {
+	i := 1
+	for i < len(frame) && frame[i]&0x80 != 0 {
+		i++
+	}
+	i++ // last remaining length byte
+	if i+2 > len(frame) {
+		return 0
+	}
+	n := int(frame[i])<<8 | int(frame[i+1])
+	if i+2+n >= len(frame) {
+		return 0
+	}
+	return frame[i+2+n]
+}
+
+// packetField is one detail of a logged packet.
+type packetField struct {
+	name  string
+	value interface{}
+}
+
+// packetRecord is a proxied packet as printed with --output json.
+type packetRecord struct {
+	Time      string                 `json:"time"`
+	Conn      int64                  `json:"conn"`
+	Direction string                 `json:"direction"`
+	Type      string                 `json:"type"`
+	Size      int                    `json:"size"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+// describePacket decodes a raw packet for logging. v5 selects the MQTT 5
+// packet format; everything else is read as MQTT 3.1.1.
+func describePacket(frame []byte, v5 bool, payloadFormat string) (string, []packetField) {
+	var fields []packetField
+	add := func(name string, value interface{}) {
+		fields = append(fields, packetField{name, value})
+	}
+	password := func(set bool) {
+		if set {
+			add("password", "(redacted)")
+		}
+	}
+	payload := func(p []byte) {
+		add("payload", formatPayload(p, payloadFormat, false))
+	}
+	if v5 {
+		cp, err := packets5.ReadPacket(bytes.NewReader(frame))
+		if err != nil {
+			add("error", err.Error())
+			return packetTypeName(frame), fields
+		}
+		switch p := cp.Content.(type) {
+		case *packets5.Connect:
+			add("client_id", p.ClientID)
+			add("version", p.ProtocolVersion)
+			add("clean_start", p.CleanStart)
+			add("keepalive", p.KeepAlive)
+			if p.UsernameFlag {
+				add("username", p.Username)
+			}
+			password(p.PasswordFlag)
+			if p.WillFlag {
+				add("will_topic", p.WillTopic)
+				add("will_qos", p.WillQOS)
+			}
+		case *packets5.Connack:
+			add("reason", p.ReasonCode)
+			add("session_present", p.SessionPresent)
+		case *packets5.Publish:
+			add("topic", p.Topic)
+			if p.Properties != nil && p.Properties.TopicAlias != nil {
+				add("topic_alias", *p.Properties.TopicAlias)
+			}
+			add("qos", p.QoS)
+			if p.QoS > 0 {
+				add("id", p.PacketID)
+			}
+			add("retain", p.Retain)
+			if p.Duplicate {
+				add("dup", true)
+			}
+			payload(p.Payload)
+		case *packets5.Puback:
+			add("id", p.PacketID)
+			add("reason", p.ReasonCode)
+		case *packets5.Pubrec:
+			add("id", p.PacketID)
+			add("reason", p.ReasonCode)
+		case *packets5.Pubrel:
+			add("id", p.PacketID)
+			add("reason", p.ReasonCode)
+		case *packets5.Pubcomp:
+			add("id", p.PacketID)
+			add("reason", p.ReasonCode)
+		case *packets5.Subscribe:
+			add("id", p.PacketID)
+			var subs []string
+			for _, s := range p.Subscriptions {
+				sub := fmt.Sprintf("%s@%d", s.Topic, s.QoS)
+				if s.NoLocal {
+					sub += "+no_local"
+				}
+				if s.RetainAsPublished {
+					sub += "+retain_as_published"
+				}
+				if s.RetainHandling != 0 {
+					sub += fmt.Sprintf("+retain_handling=%d", s.RetainHandling)
+				}
+				subs = append(subs, sub)
+			}
+			add("filters", strings.Join(subs, ","))
+		case *packets5.Suback:
+			add("id", p.PacketID)
+			add("reasons", fmt.Sprint(p.Reasons))
+		case *packets5.Unsubscribe:
+			add("id", p.PacketID)
+			add("filters", strings.Join(p.Topics, ","))
+		case *packets5.Unsuback:
+			add("id", p.PacketID)
+			add("reasons", fmt.Sprint(p.Reasons))
+		case *packets5.Disconnect:
+			add("reason", p.ReasonCode)
+		case *packets5.Auth:
+			add("reason", p.ReasonCode)
+		}
+		return cp.PacketType(), fields
+	}
+
+	cp, err := packets3.ReadPacket(bytes.NewReader(frame))
+	if err != nil {
+		add("error", err.Error())
+		return packetTypeName(frame), fields
+	}
+	switch p := cp.(type) {
+	case *packets3.ConnectPacket:
+		add("client_id", p.ClientIdentifier)
+		add("version", p.ProtocolVersion)
+		add("clean_session", p.CleanSession)
+		add("keepalive", p.Keepalive)
+		if p.UsernameFlag {
+			add("username", p.Username)
+		}
+		password(p.PasswordFlag)
+		if p.WillFlag {
+			add("will_topic", p.WillTopic)
+			add("will_qos", p.WillQos)
+		}
+	case *packets3.ConnackPacket:
+		add("return_code", p.ReturnCode)
+		add("session_present", p.SessionPresent)
+	case *packets3.PublishPacket:
+		add("topic", p.TopicName)
+		add("qos", p.Qos)
+		if p.Qos > 0 {
+			add("id", p.MessageID)
+		}
+		add("retain", p.Retain)
+		if p.Dup {
+			add("dup", true)
+		}
+		payload(p.Payload)
+	case *packets3.PubackPacket:
+		add("id", p.MessageID)
+	case *packets3.PubrecPacket:
+		add("id", p.MessageID)
+	case *packets3.PubrelPacket:
+		add("id", p.MessageID)
+	case *packets3.PubcompPacket:
+		add("id", p.MessageID)
+	case *packets3.SubscribePacket:
+		add("id", p.MessageID)
+		var subs []string
+		for i, t := range p.Topics {
+			subs = append(subs, fmt.Sprintf("%s@%d", t, p.Qoss[i]))
+		}
+		add("filters", strings.Join(subs, ","))
+	case *packets3.SubackPacket:
+		add("id", p.MessageID)
+		add("return_codes", fmt.Sprint(p.ReturnCodes))
+	case *packets3.UnsubscribePacket:
+		add("id", p.MessageID)
+		add("filters", strings.Join(p.Topics, ","))
+	case *packets3.UnsubackPacket:
+		add("id", p.MessageID)
+	}
+	return packetTypeName(frame), fields
+}
+
+// packetTypeName names a raw packet by its fixed header.
+func packetTypeName(frame []byte) string {
+	if name, ok := packets3.PacketNames[frame[0]>>4]; ok {
+		return name
+	}
+	if frame[0]>>4 == packets5.AUTH {
+		return "AUTH"
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", frame[0]>>4)
+}
+
+// logPacket prints one proxied packet, as it arrived at the proxy.
+func (p *mqttProxy) logPacket(conn int64, dir string, frame []byte, v5, dropped bool) {
+	if p.cfg.Quiet {
+		return
+	}
+	name, fields := describePacket(frame, v5, p.cfg.PayloadFormat)
+	if dropped {
+		fields = append(fields, packetField{"dropped", true})
+	}
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cfg.Output == outputJSON {
+		rec := packetRecord{Time: now.UTC().Format(time.RFC3339Nano), Conn: conn, Direction: dir, Type: name, Size: len(frame)}
+		if len(fields) > 0 {
+			rec.Fields = make(map[string]interface{}, len(fields))
+			for _, f := range fields {
+				rec.Fields[f.name] = f.value
+			}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false) // keep "->" in directions readable
+		enc.Encode(rec)
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s[PACKET] conn=%d %s %s", p.stamps.stamp(now), conn, dir, name)
+	for _, f := range fields {
+		fmt.Fprintf(&b, " %s=%v", f.name, f.value)
+	}
+	fmt.Println(sanitizeForTerminal(b.String()))
+}
+
+// dialUpstream opens a connection to the upstream broker.
+func (p *mqttProxy) dialUpstream() (net.Conn, error) {
+	switch p.upstream.Scheme {
+	case "ssl", "tls", "mqtts":
+		return tls.DialWithDialer(egressDialer(time.Duration(p.cfg.ConnectTimeout)), "tcp", p.upstream.Host, p.tls)
+	case "ws", "wss":
+		return dialWebSocket(p.cfg, p.upstream.String(), p.tls, nil)
+	}
+	return egressDialer(time.Duration(p.cfg.ConnectTimeout)).Dial("tcp", p.upstream.Host)
+}
+
+// serve proxies one client connection until either side closes it.
+func (p *mqttProxy) serve(client net.Conn) {
+	id := p.conns.Add(1)
+	defer client.Close()
+	broker, err := p.dialUpstream()
+	if err != nil {
+		logError("proxy_upstream_failed", true, "Connection %d from %s: could not reach %s: %v", id, client.RemoteAddr(), p.upstream.Redacted(), err)
+		return
+	}
+	defer broker.Close()
+	logInfo("proxy_connected", "Connection %d from %s proxied to %s", id, client.RemoteAddr(), p.upstream.Redacted())
+
+	// Versions are set from the client's CONNECT, which always comes before
+	// anything the broker sends
+	t := newTranslator(id, p.protocol)
+	// The most each side accepts, lowered to what it advertises in a MQTT v5
+	// CONNECT or CONNACK
+	limits := map[string]*atomic.Int64{toBroker: new(atomic.Int64), toClient: new(atomic.Int64)}
+	limits[toBroker].Store(int64(p.maxPacket))
+	limits[toClient].Store(int64(p.maxPacket))
+	pipe := func(dir string, from, to net.Conn, w *shapedWriter) error {
+		defer w.close()
+		r := bufio.NewReader(from)
+		for {
+			frame, err := readFrame(r, int(limits[dir].Load()))
+			if err != nil {
+				return err
+			}
+			if dir == toBroker && frame[0]>>4 == packets3.Connect {
+				t.connect(frame)
+			}
+			if n := advertisedMaxPacket(frame, t.sourceV5(dir)); n > 0 && n < limits[reverseDirection(dir)].Load() {
+				limits[reverseDirection(dir)].Store(n)
+			}
+			dropped := w.dropped(frame)
+			p.logPacket(id, dir, frame, t.sourceV5(dir), dropped)
+			if dropped {
+				continue
+			}
+			if dir == toBroker && frame[0]>>4 == packets3.Connect && p.creds != nil {
+				var clientID string
+				if frame, clientID, err = p.creds.rewrite(frame); err != nil {
+					return fmt.Errorf("could not replace credentials of client '%s': %v", clientID, err)
+				}
+				logInfo("proxy_credentials", "Connection %d: replaced the credentials of client '%s'", id, clientID)
+			}
+			if frame, err = t.translate(dir, frame); err != nil {
+				return err
+			}
+			if frame == nil {
+				continue
+			}
+			if err := w.write(to, frame); err != nil {
+				return err
+			}
+		}
+	}
+
+	done := make(chan string, 2)
+	go func() {
+		err := pipe(toBroker, client, broker, newShapedWriter(p.up, broker))
+		done <- closeReason("client", err)
+	}()
+	go func() {
+		err := pipe(toClient, broker, client, newShapedWriter(p.down, client))
+		done <- closeReason("broker", err)
+	}()
+	reason := <-done
+	client.Close()
+	broker.Close()
+	<-done
+	logInfo("proxy_closed", "Connection %d closed: %s", id, reason)
+}
+
+// reverseDirection returns the direction packets answering those in dir take.
+func reverseDirection(dir string) string {
+	if dir == toBroker {
+		return toClient
+	}
+	return toBroker
+}
+
+// advertisedMaxPacket returns the Maximum Packet Size a MQTT v5 CONNECT or
+// CONNACK frame sets for packets sent to its sender, or zero.
+func advertisedMaxPacket(frame []byte, v5 bool) int64 {
+	if t := frame[0] >> 4; !v5 || (t != packets3.Connect && t != packets3.Connack) {
+		return 0
+	}
+	cp, err := packets5.ReadPacket(bytes.NewReader(frame))
+	if err != nil {
+		return 0
+	}
+	var p *packets5.Properties
+	switch c := cp.Content.(type) {
+	case *packets5.Connect:
+		p = c.Properties
+	case *packets5.Connack:
+		p = c.Properties
+	}
+	if p == nil || p.MaximumPacketSize == nil {
+		return 0
+	}
+	return int64(*p.MaximumPacketSize)
+}
+
+// closeReason describes why side stopped sending.
+func closeReason(side string, err error) string {
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return side + " closed the connection"
+	}
+	if errors.Is(err, errWillDisconnect) {
+		return err.Error()
+	}
+	return fmt.Sprintf("%s connection failed: %v", side, err)
+}
+
+// runProxy implements "mqttcli proxy".
+func runProxy(args []string) {
+	fs := flag.NewFlagSet("proxy", flag.ExitOnError)
+	var cfg Config
+	listen := fs.String("listen", ":1884", "Address to accept MQTT clients on.")
+	upstream := fs.String("upstream", "tcp://localhost:1883", "Broker to proxy to (tcp://, ssl://, ws://, or wss://).")
+	certFile := fs.String("tls-cert", "", "Accept clients over TLS with this certificate (PEM), terminating their TLS at the proxy.")
+	keyFile := fs.String("tls-key", "", "Private key for --tls-cert.")
+	fs.StringVar(&cfg.CAFile, "cafile", "", "CA certificate to verify an ssl:// or wss:// upstream with.")
+	fs.StringVar(&cfg.CertFile, "certfile", "", "Client certificate to present to the upstream.")
+	fs.StringVar(&cfg.KeyFile, "keyfile", "", "Private key for --certfile.")
+	fs.BoolVar(&cfg.Insecure, "insecure", false, "Skip verifying the upstream's certificate (NOT recommended).")
+	fs.StringVar(&cfg.PayloadFormat, "payload-format", "", "How to print payloads: string (default), raw, hex, or base64.")
+	fs.StringVar(&cfg.Timestamp, "timestamp", "", "Prefix packet lines with the time: none (default), unix, rfc3339, or relative.")
+	fs.BoolVar(&cfg.Quiet, "quiet", false, "Don't print packets, only connections.")
+	fs.BoolVar(&cfg.AirGapped, "air-gapped", false, "Only ever connect to the upstream's host and port; other connections are refused.")
+	stripCreds := fs.Bool("strip-credentials", false, "Remove the username and password clients send before forwarding their CONNECT.")
+	username := fs.String("username", "", "Send this username upstream in place of the client's.")
+	password := fs.String("password", os.Getenv("MQTTCLI_PROXY_PASSWORD"), "Send this password upstream in place of the client's (default $MQTTCLI_PROXY_PASSWORD).")
+	jwtKey := fs.String("jwt-key", "", "Send each client a freshly minted JWT as its password, signed with this PEM private key (RS256, ES256, ES384, EdDSA) or HMAC secret file (HS256).")
+	jwtAudience := fs.String("jwt-audience", "", "Audience (aud) claim for --jwt-key tokens.")
+	jwtTTL := fs.Duration("jwt-ttl", defaultJWTTTL, "How long --jwt-key tokens are valid.")
+	protocol := fs.String("upstream-protocol", "", "Speak this MQTT version to the broker, translating for clients using the other: 4 (3.1.1) or 5.")
+	delay := fs.String("delay", "", "Delay each packet by this long, e.g. '200ms', or 'CLIENT_TO_BROKER,BROKER_TO_CLIENT' such as '200ms,0'.")
+	jitter := fs.String("jitter", "", "Vary each packet's delay by up to this much either way (one value, or one per direction).")
+	bandwidth := fs.String("bandwidth", "", "Limit throughput to this many bytes per second, e.g. '16KB' or '1MiB' (one value, or one per direction).")
+	maxPacket := fs.String("max-packet-size", "", "Refuse packets bigger than this from either side, e.g. '256KB' (default 16MiB); a MQTT v5 client or broker that advertises less gets that.")
+	drop := fs.String("drop", "", "Drop this fraction of packets, e.g. '0.05' or '5%'; CONNECT and CONNACK always pass (one value, or one per direction).")
+	fs.StringVar(&cfg.Output, "output", "", "Output format: 'text' (default) or 'json' for one JSON object per packet on stdout and structured records on stderr.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s proxy [options]\n\n"+
+			"Sits between MQTT clients and a broker, printing every packet in both directions.\n"+
+			"Point a device at the proxy instead of the broker to see what its firmware sends.\n\nExample:\n"+
+			"  %s proxy --listen :1884 --upstream ssl://broker.example.com:8883 --cafile ca.pem\n\nOptions:\n",
+			filepath.Base(os.Args[0]), filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	jsonEvents = cfg.Output == outputJSON
+	// the proxy forwards whatever its clients send, publishes included
+	if readOnlyEnv() {
+		fatal("read_only", false, "proxy forwards client publishes and is refused while $%s is set.", envReadOnly)
+	}
+	if err := validPayloadFormat(cfg.PayloadFormat); err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+	if err := validTimestamp(cfg.Timestamp); err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+	if (*certFile == "") != (*keyFile == "") {
+		fatal("config_invalid", false, "--tls-cert and --tls-key must be given together.")
+	}
+	if *password != "" && *jwtKey != "" {
+		fatal("config_invalid", false, "--password and --jwt-key are mutually exclusive.")
+	}
+	if *jwtKey == "" && (*jwtAudience != "" || *jwtTTL != defaultJWTTTL) {
+		fatal("config_invalid", false, "--jwt-audience and --jwt-ttl require --jwt-key.")
+	}
+	if *jwtTTL <= 0 {
+		fatal("config_invalid", false, "--jwt-ttl must be positive.")
+	}
+	cfg.ConnectTimeout = Duration(defaultConnectTimeout)
+
+	u, err := url.Parse(*upstream)
+	if err != nil || u.Host == "" {
+		fatal("config_invalid", false, "Invalid --upstream '%s'.", *upstream)
+	}
+	if cfg.AirGapped {
+		cfg.BrokerURL = *upstream
+		if err := startAirGap(&cfg); err != nil {
+			fatal("config_invalid", false, "%v", err)
+		}
+	}
+	p := &mqttProxy{cfg: &cfg, upstream: u, stamps: newStamper(cfg.Timestamp), maxPacket: proxyMaxPacketSize}
+	if *maxPacket != "" {
+		n, err := parseByteSize(*maxPacket)
+		if err != nil || n < 2 || n > maxRemainingLength+5 {
+			fatal("config_invalid", false, "Invalid --max-packet-size '%s', expected a size such as 256KB.", *maxPacket)
+		}
+		p.maxPacket = int(n)
+	}
+	if p.up, p.down, err = parseShaping(*delay, *jitter, *bandwidth, *drop); err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+	if *protocol != "" {
+		if p.protocol, err = parseProtocolVersion(*protocol); err != nil || p.protocol == 3 {
+			fatal("config_invalid", false, "Unsupported --upstream-protocol '%s'; use 4 (MQTT 3.1.1) or 5.", *protocol)
+		}
+	}
+	if *stripCreds || *username != "" || *password != "" || *jwtKey != "" {
+		p.creds = &credentialRewrite{username: *username, password: *password}
+		if *jwtKey != "" {
+			if p.creds.jwt, err = loadJWTSigner(*jwtKey, *jwtAudience, *jwtTTL); err != nil {
+				fatal("config_invalid", false, "Failed to load --jwt-key: %v", err)
+			}
+		}
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt", "ws":
+	case "ssl", "tls", "mqtts", "wss":
+		if p.tls, err = NewTLSConfig(&cfg); err != nil {
+			fatal("tls_failed", false, "Failed to load upstream TLS settings: %v", err)
+		}
+		p.tls.ServerName = u.Hostname()
+	default:
+		fatal("config_invalid", false, "Unsupported --upstream scheme '%s'; use tcp://, ssl://, ws://, or wss://.", u.Scheme)
+	}
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fatal("proxy_failed", false, "%v", err)
+	}
+	if *certFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			fatal("tls_failed", false, "Failed to load --tls-cert: %v", err)
+		}
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	logInfo("proxy_listening", "Proxying %s to %s", ln.Addr(), u.Redacted())
+	if p.creds != nil {
+		logInfo("proxy_credentials", "Replacing client credentials with %s", p.creds.describe())
+	}
+	if p.up.active() {
+		logInfo("proxy_shaping", "Shaping client->broker packets: %s", p.up)
+	}
+	if p.down.active() {
+		logInfo("proxy_shaping", "Shaping broker->client packets: %s", p.down)
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				logInfo("exited", "Exiting.")
+				return
+			}
+			fatal("proxy_failed", false, "%v", err)
+		}
+		go p.serve(conn)
+	}
+}
@@ -0,0 +1,78 @@
+// proxy_test.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	packets5 "github.com/eclipse/paho.golang/packets"
+)
+
+func TestReadFrame(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		frame []byte
+		limit int
+		want  string // error, if any
+	}{
+		{"pingreq", []byte{0xc0, 0x00}, 16, ""},
+		{"at the limit", append([]byte{0x30, 0x0e}, make([]byte, 14)...), 16, ""},
+		{"over the limit", append([]byte{0x30, 0x0f}, make([]byte, 15)...), 16, "exceeds the maximum packet size of 16"},
+		{"huge length, no body", []byte{0x30, 0xff, 0xff, 0xff, 0x7f}, proxyMaxPacketSize, "exceeds the maximum packet size"},
+		{"five length bytes", []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}, proxyMaxPacketSize, "malformed remaining length"},
+		{"cut short", []byte{0x30, 0x05, 0x00}, 16, "unexpected EOF"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			frame, err := readFrame(bufio.NewReader(bytes.NewReader(tc.frame)), tc.limit)
+			if tc.want != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.want) {
+					t.Fatalf("got %v, want an error containing %q", err, tc.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(frame, tc.frame) {
+				t.Errorf("got %x, want %x", frame, tc.frame)
+			}
+		})
+	}
+}
+
+func TestAdvertisedMaxPacket(t *testing.T) {
+	size := uint32(4096)
+	encode := func(cp *packets5.ControlPacket) []byte {
+		var buf bytes.Buffer
+		if _, err := cp.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	connect := packets5.NewControlPacket(packets5.CONNECT)
+	connect.Content.(*packets5.Connect).Properties.MaximumPacketSize = &size
+	connack := packets5.NewControlPacket(packets5.CONNACK)
+	connack.Content.(*packets5.Connack).Properties.MaximumPacketSize = &size
+	plain := packets5.NewControlPacket(packets5.CONNACK)
+
+	for _, tc := range []struct {
+		name  string
+		frame []byte
+		v5    bool
+		want  int64
+	}{
+		{"CONNECT", encode(connect), true, 4096},
+		{"CONNACK", encode(connack), true, 4096},
+		{"CONNACK without one", encode(plain), true, 0},
+		{"MQTT 3", []byte{0x20, 0x02, 0x00, 0x00}, false, 0},
+		{"PINGREQ", []byte{0xc0, 0x00}, true, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := advertisedMaxPacket(tc.frame, tc.v5); got != tc.want {
+				t.Errorf("got %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+// proxycreds.go
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	packets5 "github.com/eclipse/paho.golang/packets"
+	packets3 "github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// defaultJWTTTL is how long minted JWTs are valid by default.
+const defaultJWTTTL = time.Hour
+
+// credentialRewrite replaces the username and password in proxied CONNECT
+// packets, so devices with credentials baked into their firmware can connect
+// to a broker that expects different ones.
+type credentialRewrite struct {
+	username string
+	password string
+	jwt      *jwtSigner // mints the password per device instead
+}
+
+// rewrite returns a CONNECT with the device's credentials replaced, in the
+// same protocol version, and the client ID it was for.
+func (c *credentialRewrite) rewrite(frame []byte) ([]byte, string, error) {
+	var password []byte
+	var b bytes.Buffer
+	if connectVersion(frame) == 5 {
+		cp, err := packets5.ReadPacket(bytes.NewReader(frame))
+		if err != nil {
+			return nil, "", err
+		}
+		p := cp.Content.(*packets5.Connect)
+		if password, err = c.passwordFor(p.ClientID); err != nil {
+			return nil, p.ClientID, err
+		}
+		p.Username, p.UsernameFlag = c.username, c.username != ""
+		p.Password, p.PasswordFlag = password, password != nil
+		_, err = cp.WriteTo(&b)
+		return b.Bytes(), p.ClientID, err
+	}
+	cp, err := packets3.ReadPacket(bytes.NewReader(frame))
+	if err != nil {
+		return nil, "", err
+	}
+	p := cp.(*packets3.ConnectPacket)
+	if password, err = c.passwordFor(p.ClientIdentifier); err != nil {
+		return nil, p.ClientIdentifier, err
+	}
+	p.Username, p.UsernameFlag = c.username, c.username != ""
+	p.Password, p.PasswordFlag = password, password != nil
+	// MQTT 3.1.1 doesn't allow a password without a username
+	if p.PasswordFlag {
+		p.UsernameFlag = true
+	}
+	err = p.Write(&b)
+	return b.Bytes(), p.ClientIdentifier, err
+}
+
+// passwordFor returns the password to send for clientID; nil sends none.
+func (c *credentialRewrite) passwordFor(clientID string) ([]byte, error) {
+	if c.jwt != nil {
+		token, err := c.jwt.mint(clientID, time.Now())
+		return []byte(token), err
+	}
+	if c.password != "" {
+		return []byte(c.password), nil
+	}
+	return nil, nil
+}
+
+// describe summarizes what is sent in place of the device's credentials.
+func (c *credentialRewrite) describe() string {
+	switch {
+	case c.jwt != nil:
+		return fmt.Sprintf("a JWT signed with %s and valid for %s", c.jwt.alg, c.jwt.ttl)
+	case c.username != "" || c.password != "":
+		return "the proxy's username and password"
+	}
+	return "no credentials"
+}
+
+// jwtSigner mints JWTs identifying each device by its client ID, for brokers
+// that authenticate clients with a token as the password.
+type jwtSigner struct {
+	alg      string // HS256, RS256, ES256, ES384, or EdDSA, from the key
+	secret   []byte // for HS256
+	key      crypto.Signer
+	ttl      time.Duration
+	audience string
+}
+
+// loadJWTSigner reads a signing key: a PEM private key (RSA, ECDSA P-256 or
+// P-384, or Ed25519), or else a shared secret for HMAC.
+func loadJWTSigner(path, audience string, ttl time.Duration) (*jwtSigner, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &jwtSigner{ttl: ttl, audience: audience}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		s.alg, s.secret = "HS256", bytes.TrimRight(data, "\r\n")
+		if len(s.secret) == 0 {
+			return nil, errors.New("the JWT secret is empty")
+		}
+		return s, nil
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the JWT key: %v", err)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		s.alg, s.key = "RS256", k
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			s.alg = "ES256"
+		case elliptic.P384():
+			s.alg = "ES384"
+		default:
+			return nil, fmt.Errorf("unsupported JWT key curve %s; use P-256 or P-384", k.Curve.Params().Name)
+		}
+		s.key = k
+	case ed25519.PrivateKey:
+		s.alg, s.key = "EdDSA", k
+	default:
+		return nil, fmt.Errorf("unsupported JWT key type %T", key)
+	}
+	return s, nil
+}
+
+// mint returns a token for subject, issued at now.
+func (s *jwtSigner) mint(subject string, now time.Time) (string, error) {
+	claims := map[string]interface{}{
+		"sub": subject,
+		"iat": now.Unix(),
+		"exp": now.Add(s.ttl).Unix(),
+	}
+	if s.audience != "" {
+		claims["aud"] = s.audience
+	}
+	header, _ := json.Marshal(map[string]string{"alg": s.alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	sig, err := s.sign([]byte(signed))
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
+
+func (s *jwtSigner) sign(data []byte) ([]byte, error) {
+	switch s.alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write(data)
+		return mac.Sum(nil), nil
+	case "RS256":
+		sum := sha256.Sum256(data)
+		return rsa.SignPKCS1v15(rand.Reader, s.key.(*rsa.PrivateKey), crypto.SHA256, sum[:])
+	case "ES256", "ES384":
+		var digest []byte
+		if s.alg == "ES256" {
+			sum := sha256.Sum256(data)
+			digest = sum[:]
+		} else {
+			sum := sha512.Sum384(data)
+			digest = sum[:]
+		}
+		k := s.key.(*ecdsa.PrivateKey)
+		r, ss, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			return nil, err
+		}
+		// JWS wants r and s as fixed-size big-endian halves, not ASN.1
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig := make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		ss.FillBytes(sig[size:])
+		return sig, nil
+	}
+	return ed25519.Sign(s.key.(ed25519.PrivateKey), data), nil
+}
@@ -0,0 +1,385 @@
+// proxytranslate.go
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	packets5 "github.com/eclipse/paho.golang/packets"
+	packets3 "github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// errWillDisconnect ends a proxied connection abruptly, so a 3.1.1 broker
+// sends the will message an MQTT 5 client asked for with DISCONNECT reason
+// 0x04.
+var errWillDisconnect = errors.New("client disconnected asking for its will message to be sent")
+
+// translator tracks the protocol spoken on each side of a proxied connection
+// and, with proxy --upstream-protocol, translates packets between MQTT 3.1.1
+// and 5 when the two differ. Features the other version can't express are
+// dropped and logged once per connection.
+type translator struct {
+	conn     int64
+	upstream uint // protocol to speak to the broker; zero uses the client's
+
+	mu       sync.Mutex
+	clientV5 bool
+	brokerV5 bool
+	unsubs   map[uint16]int  // UNSUBSCRIBE filter counts, to fill in v5 UNSUBACK reasons
+	lost     map[string]bool // already logged
+}
+
+func newTranslator(conn int64, upstream uint) *translator {
+	return &translator{conn: conn, upstream: upstream, unsubs: make(map[uint16]int), lost: make(map[string]bool)}
+}
+
+// connect records the protocol of the client's CONNECT.
+func (t *translator) connect(frame []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.clientV5 = connectVersion(frame) == 5
+	t.brokerV5 = t.clientV5
+	if t.upstream != 0 {
+		t.brokerV5 = t.upstream == 5
+	}
+}
+
+// sourceV5 reports whether packets travelling in dir are MQTT 5.
+func (t *translator) sourceV5(dir string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if dir == toBroker {
+		return t.clientV5
+	}
+	return t.brokerV5
+}
+
+// lose logs, once, that what couldn't be carried across.
+func (t *translator) lose(dir, what string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.lost[dir+what] {
+		return
+	}
+	t.lost[dir+what] = true
+	logWarn("proxy_translation_lost", "Connection %d %s: dropped %s, which the other protocol version can't carry", t.conn, dir, what)
+}
+
+// translate returns frame as the receiving side's protocol version expects
+// it; nil means there is nothing to forward.
+func (t *translator) translate(dir string, frame []byte) ([]byte, error) {
+	t.mu.Lock()
+	fromV5, toV5 := t.clientV5, t.brokerV5
+	t.mu.Unlock()
+	if dir == toClient {
+		fromV5, toV5 = toV5, fromV5
+	}
+	if fromV5 == toV5 {
+		return frame, nil
+	}
+	var b bytes.Buffer
+	if fromV5 {
+		cp, err := packets5.ReadPacket(bytes.NewReader(frame))
+		if err != nil {
+			return nil, err
+		}
+		out, err := t.toV3(dir, cp)
+		if out == nil || err != nil {
+			return nil, err
+		}
+		err = out.Write(&b)
+		return b.Bytes(), err
+	}
+	cp, err := packets3.ReadPacket(bytes.NewReader(frame))
+	if err != nil {
+		return nil, err
+	}
+	out, err := t.toV5(cp)
+	if out == nil || err != nil {
+		return nil, err
+	}
+	_, err = out.WriteTo(&b)
+	return b.Bytes(), err
+}
+
+// setProperties names the properties set in p, e.g. "MessageExpiry".
+func setProperties(p *packets5.Properties) []string {
+	if p == nil {
+		return nil
+	}
+	var names []string
+	v := reflect.ValueOf(p).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if !v.Field(i).IsZero() {
+			names = append(names, v.Type().Field(i).Name)
+		}
+	}
+	return names
+}
+
+// loseProperties logs the properties of an MQTT 5 packet that 3.1.1 drops.
+func (t *translator) loseProperties(dir, packet string, p *packets5.Properties) {
+	for _, name := range setProperties(p) {
+		t.lose(dir, packet+" property "+name)
+	}
+}
+
+// v3ConnectReturnCode maps an MQTT 5 CONNACK reason code to the closest 3.1.1
+// return code.
+func v3ConnectReturnCode(reason byte) byte {
+	switch reason {
+	case packets5.ConnackSuccess:
+		return packets3.Accepted
+	case packets5.ConnackUnsupportedProtocolVersion:
+		return packets3.ErrRefusedBadProtocolVersion
+	case packets5.ConnackInvalidClientID:
+		return packets3.ErrRefusedIDRejected
+	case packets5.ConnackBadUsernameOrPassword:
+		return packets3.ErrRefusedBadUsernameOrPassword
+	case packets5.ConnackNotAuthorized, packets5.ConnackBanned:
+		return packets3.ErrRefusedNotAuthorised
+	}
+	return packets3.ErrRefusedServerUnavailable
+}
+
+// v5ConnackReason maps a 3.1.1 CONNACK return code to its MQTT 5 reason code.
+func v5ConnackReason(code byte) byte {
+	switch code {
+	case packets3.Accepted:
+		return packets5.ConnackSuccess
+	case packets3.ErrRefusedBadProtocolVersion:
+		return packets5.ConnackUnsupportedProtocolVersion
+	case packets3.ErrRefusedIDRejected:
+		return packets5.ConnackInvalidClientID
+	case packets3.ErrRefusedServerUnavailable:
+		return packets5.ConnackServerUnavailable
+	case packets3.ErrRefusedBadUsernameOrPassword:
+		return packets5.ConnackBadUsernameOrPassword
+	case packets3.ErrRefusedNotAuthorised:
+		return packets5.ConnackNotAuthorized
+	}
+	return packets5.ConnackUnspecifiedError
+}
+
+// toV3 translates an MQTT 5 packet to 3.1.1.
+func (t *translator) toV3(dir string, cp *packets5.ControlPacket) (packets3.ControlPacket, error) {
+	failed := func(kind string, reason byte) {
+		if reason >= 0x80 {
+			t.lose(dir, fmt.Sprintf("%s reason code 0x%02X", kind, reason))
+		}
+	}
+	switch p := cp.Content.(type) {
+	case *packets5.Connect:
+		out := packets3.NewControlPacket(packets3.Connect).(*packets3.ConnectPacket)
+		out.ProtocolName, out.ProtocolVersion = "MQTT", 4
+		var expiry uint32
+		if p.Properties != nil && p.Properties.SessionExpiryInterval != nil {
+			expiry = *p.Properties.SessionExpiryInterval
+		}
+		// 3.1.1 sessions last until the next clean connect
+		out.CleanSession = expiry == 0
+		if p.CleanStart && expiry > 0 {
+			t.lose(dir, "CONNECT clean start (the broker resumes any existing session)")
+		}
+		if !p.CleanStart && expiry == 0 {
+			t.lose(dir, "CONNECT session resumption (a session that ends on disconnect starts clean)")
+		}
+		out.ClientIdentifier, out.Keepalive = p.ClientID, p.KeepAlive
+		out.UsernameFlag, out.Username = p.UsernameFlag, p.Username
+		out.PasswordFlag, out.Password = p.PasswordFlag, p.Password
+		out.WillFlag, out.WillTopic, out.WillMessage = p.WillFlag, p.WillTopic, p.WillMessage
+		out.WillQos, out.WillRetain = p.WillQOS, p.WillRetain
+		for _, name := range setProperties(p.Properties) {
+			if name != "SessionExpiryInterval" {
+				t.lose(dir, "CONNECT property "+name)
+			}
+		}
+		t.loseProperties(dir, "will", p.WillProperties)
+		return out, nil
+	case *packets5.Connack:
+		out := packets3.NewControlPacket(packets3.Connack).(*packets3.ConnackPacket)
+		out.ReturnCode, out.SessionPresent = v3ConnectReturnCode(p.ReasonCode), p.SessionPresent
+		failed("CONNACK", p.ReasonCode)
+		t.loseProperties(dir, "CONNACK", p.Properties)
+		return out, nil
+	case *packets5.Publish:
+		if p.Topic == "" {
+			return nil, errors.New("PUBLISH uses a topic alias, which can't be translated")
+		}
+		out := packets3.NewControlPacket(packets3.Publish).(*packets3.PublishPacket)
+		out.TopicName, out.MessageID, out.Payload = p.Topic, p.PacketID, p.Payload
+		out.Qos, out.Retain, out.Dup = p.QoS, p.Retain, p.Duplicate
+		t.loseProperties(dir, "PUBLISH", p.Properties)
+		return out, nil
+	case *packets5.Puback:
+		failed("PUBACK", p.ReasonCode)
+		out := packets3.NewControlPacket(packets3.Puback).(*packets3.PubackPacket)
+		out.MessageID = p.PacketID
+		return out, nil
+	case *packets5.Pubrec:
+		failed("PUBREC", p.ReasonCode)
+		out := packets3.NewControlPacket(packets3.Pubrec).(*packets3.PubrecPacket)
+		out.MessageID = p.PacketID
+		return out, nil
+	case *packets5.Pubrel:
+		failed("PUBREL", p.ReasonCode)
+		out := packets3.NewControlPacket(packets3.Pubrel).(*packets3.PubrelPacket)
+		out.MessageID = p.PacketID
+		return out, nil
+	case *packets5.Pubcomp:
+		failed("PUBCOMP", p.ReasonCode)
+		out := packets3.NewControlPacket(packets3.Pubcomp).(*packets3.PubcompPacket)
+		out.MessageID = p.PacketID
+		return out, nil
+	case *packets5.Subscribe:
+		out := packets3.NewControlPacket(packets3.Subscribe).(*packets3.SubscribePacket)
+		out.MessageID = p.PacketID
+		for _, s := range p.Subscriptions {
+			out.Topics = append(out.Topics, s.Topic)
+			out.Qoss = append(out.Qoss, s.QoS)
+			if s.NoLocal {
+				t.lose(dir, "SUBSCRIBE option no_local")
+			}
+			if s.RetainAsPublished {
+				t.lose(dir, "SUBSCRIBE option retain_as_published")
+			}
+			if s.RetainHandling != 0 {
+				t.lose(dir, "SUBSCRIBE option retain_handling")
+			}
+		}
+		t.loseProperties(dir, "SUBSCRIBE", p.Properties)
+		return out, nil
+	case *packets5.Suback:
+		out := packets3.NewControlPacket(packets3.Suback).(*packets3.SubackPacket)
+		out.MessageID = p.PacketID
+		for _, r := range p.Reasons {
+			if r > 2 {
+				failed("SUBACK", r)
+				r = 0x80
+			}
+			out.ReturnCodes = append(out.ReturnCodes, r)
+		}
+		return out, nil
+	case *packets5.Unsubscribe:
+		t.mu.Lock()
+		t.unsubs[p.PacketID] = len(p.Topics)
+		t.mu.Unlock()
+		out := packets3.NewControlPacket(packets3.Unsubscribe).(*packets3.UnsubscribePacket)
+		out.MessageID, out.Topics = p.PacketID, p.Topics
+		return out, nil
+	case *packets5.Unsuback:
+		for _, r := range p.Reasons {
+			failed("UNSUBACK", r)
+		}
+		out := packets3.NewControlPacket(packets3.Unsuback).(*packets3.UnsubackPacket)
+		out.MessageID = p.PacketID
+		return out, nil
+	case *packets5.Pingreq:
+		return packets3.NewControlPacket(packets3.Pingreq), nil
+	case *packets5.Pingresp:
+		return packets3.NewControlPacket(packets3.Pingresp), nil
+	case *packets5.Disconnect:
+		if dir == toClient {
+			// 3.1.1 brokers just close the connection, which the broker does next
+			t.lose(dir, fmt.Sprintf("DISCONNECT from the broker (reason code 0x%02X)", p.ReasonCode))
+			return nil, nil
+		}
+		if p.ReasonCode == 0x04 {
+			return nil, errWillDisconnect
+		}
+		return packets3.NewControlPacket(packets3.Disconnect), nil
+	case *packets5.Auth:
+		return nil, errors.New("AUTH (enhanced authentication) has no MQTT 3.1.1 equivalent")
+	}
+	return nil, fmt.Errorf("can't translate %s", cp.PacketType())
+}
+
+// toV5 translates a 3.1.1 packet to MQTT 5.
+func (t *translator) toV5(cp packets3.ControlPacket) (*packets5.ControlPacket, error) {
+	switch p := cp.(type) {
+	case *packets3.ConnectPacket:
+		out := packets5.NewControlPacket(packets5.CONNECT)
+		c := out.Content.(*packets5.Connect)
+		c.ClientID, c.KeepAlive, c.CleanStart = p.ClientIdentifier, p.Keepalive, p.CleanSession
+		c.UsernameFlag, c.Username = p.UsernameFlag, p.Username
+		c.PasswordFlag, c.Password = p.PasswordFlag, p.Password
+		c.WillFlag, c.WillTopic, c.WillMessage = p.WillFlag, p.WillTopic, p.WillMessage
+		c.WillQOS, c.WillRetain = p.WillQos, p.WillRetain
+		c.WillProperties = &packets5.Properties{}
+		if !p.CleanSession {
+			// 3.1.1 sessions last until the next clean connect
+			forever := uint32(0xFFFFFFFF)
+			c.Properties.SessionExpiryInterval = &forever
+		}
+		return out, nil
+	case *packets3.ConnackPacket:
+		out := packets5.NewControlPacket(packets5.CONNACK)
+		c := out.Content.(*packets5.Connack)
+		c.ReasonCode, c.SessionPresent = v5ConnackReason(p.ReturnCode), p.SessionPresent
+		return out, nil
+	case *packets3.PublishPacket:
+		out := packets5.NewControlPacket(packets5.PUBLISH)
+		c := out.Content.(*packets5.Publish)
+		c.Topic, c.PacketID, c.Payload = p.TopicName, p.MessageID, p.Payload
+		c.QoS, c.Retain, c.Duplicate = p.Qos, p.Retain, p.Dup
+		return out, nil
+	case *packets3.PubackPacket:
+		out := packets5.NewControlPacket(packets5.PUBACK)
+		out.Content.(*packets5.Puback).PacketID = p.MessageID
+		return out, nil
+	case *packets3.PubrecPacket:
+		out := packets5.NewControlPacket(packets5.PUBREC)
+		out.Content.(*packets5.Pubrec).PacketID = p.MessageID
+		return out, nil
+	case *packets3.PubrelPacket:
+		out := packets5.NewControlPacket(packets5.PUBREL)
+		out.Content.(*packets5.Pubrel).PacketID = p.MessageID
+		return out, nil
+	case *packets3.PubcompPacket:
+		out := packets5.NewControlPacket(packets5.PUBCOMP)
+		out.Content.(*packets5.Pubcomp).PacketID = p.MessageID
+		return out, nil
+	case *packets3.SubscribePacket:
+		out := packets5.NewControlPacket(packets5.SUBSCRIBE)
+		c := out.Content.(*packets5.Subscribe)
+		c.PacketID = p.MessageID
+		for i, topic := range p.Topics {
+			c.Subscriptions = append(c.Subscriptions, packets5.SubOptions{Topic: topic, QoS: p.Qoss[i]})
+		}
+		return out, nil
+	case *packets3.SubackPacket:
+		out := packets5.NewControlPacket(packets5.SUBACK)
+		c := out.Content.(*packets5.Suback)
+		c.PacketID, c.Reasons = p.MessageID, p.ReturnCodes
+		return out, nil
+	case *packets3.UnsubscribePacket:
+		out := packets5.NewControlPacket(packets5.UNSUBSCRIBE)
+		c := out.Content.(*packets5.Unsubscribe)
+		c.PacketID, c.Topics = p.MessageID, p.Topics
+		return out, nil
+	case *packets3.UnsubackPacket:
+		// MQTT 5 wants a reason per filter; 3.1.1 only acknowledges the request
+		t.mu.Lock()
+		n, ok := t.unsubs[p.MessageID]
+		delete(t.unsubs, p.MessageID)
+		t.mu.Unlock()
+		if !ok {
+			n = 1
+		}
+		out := packets5.NewControlPacket(packets5.UNSUBACK)
+		c := out.Content.(*packets5.Unsuback)
+		c.PacketID, c.Reasons = p.MessageID, make([]byte, n)
+		return out, nil
+	case *packets3.PingreqPacket:
+		return packets5.NewControlPacket(packets5.PINGREQ), nil
+	case *packets3.PingrespPacket:
+		return packets5.NewControlPacket(packets5.PINGRESP), nil
+	case *packets3.DisconnectPacket:
+		return packets5.NewControlPacket(packets5.DISCONNECT), nil
+	}
+	return nil, fmt.Errorf("can't translate %s", strings.SplitN(cp.String(), ":", 2)[0])
+}
@@ -0,0 +1,379 @@
+// proxytranslate_test.go
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	packets5 "github.com/eclipse/paho.golang/packets"
+	packets3 "github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func v5Frame(t *testing.T, cp *packets5.ControlPacket) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if _, err := cp.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func v3Frame(t *testing.T, cp packets3.ControlPacket) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := cp.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// translatorFor returns a translator for a client speaking clientV5 to a
+// broker speaking the other version.
+func translatorFor(t *testing.T, clientV5 bool) *translator {
+	t.Helper()
+	if clientV5 {
+		tr := newTranslator(1, 4)
+		tr.connect(v5Frame(t, packets5.NewControlPacket(packets5.CONNECT)))
+		return tr
+	}
+	connect := packets3.NewControlPacket(packets3.Connect).(*packets3.ConnectPacket)
+	connect.ProtocolName, connect.ProtocolVersion = "MQTT", 4
+	tr := newTranslator(1, 5)
+	tr.connect(v3Frame(t, connect))
+	return tr
+}
+
+// checkLost fails t unless tr logged something containing what as lost, or
+// nothing at all when what is empty.
+func checkLost(t *testing.T, tr *translator, what string) {
+	t.Helper()
+	var lost []string
+	for k := range tr.lost {
+		lost = append(lost, k)
+	}
+	if what == "" {
+		if len(lost) != 0 {
+			t.Errorf("got %q lost, want nothing", lost)
+		}
+		return
+	}
+	for _, k := range lost {
+		if strings.Contains(k, what) {
+			return
+		}
+	}
+	t.Errorf("got %q lost, want %q", lost, what)
+}
+
+func TestTranslateConnect(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		cleanStart bool
+		expiry     uint32
+		wantClean  bool
+		lost       string
+	}{
+		{"clean, ending on disconnect", true, 0, true, ""},
+		{"clean, persisting", true, 3600, false, "CONNECT clean start"},
+		{"resumed, persisting", false, 3600, false, ""},
+		{"resumed, ending on disconnect", false, 0, true, "CONNECT session resumption"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cp := packets5.NewControlPacket(packets5.CONNECT)
+			c := cp.Content.(*packets5.Connect)
+			c.ClientID, c.KeepAlive, c.CleanStart = "c1", 30, tc.cleanStart
+			c.UsernameFlag, c.Username = true, "user"
+			if tc.expiry != 0 {
+				c.Properties.SessionExpiryInterval = &tc.expiry
+			}
+			frame := v5Frame(t, cp)
+			tr := newTranslator(1, 4)
+			tr.connect(frame)
+			out, err := tr.translate(toBroker, frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := packets3.ReadPacket(bytes.NewReader(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			connect := got.(*packets3.ConnectPacket)
+			if connect.ProtocolVersion != 4 || connect.ClientIdentifier != "c1" || connect.Keepalive != 30 || connect.Username != "user" {
+				t.Errorf("got %v, want a 3.1.1 CONNECT for c1", connect)
+			}
+			if connect.CleanSession != tc.wantClean {
+				t.Errorf("got clean session %t, want %t", connect.CleanSession, tc.wantClean)
+			}
+			checkLost(t, tr, tc.lost)
+		})
+	}
+}
+
+func TestTranslateConnectToV5(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		clean  bool
+		expiry uint32
+	}{
+		{"clean", true, 0},
+		{"persistent", false, 0xFFFFFFFF},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cp := packets3.NewControlPacket(packets3.Connect).(*packets3.ConnectPacket)
+			cp.ProtocolName, cp.ProtocolVersion = "MQTT", 4
+			cp.ClientIdentifier, cp.CleanSession = "c1", tc.clean
+			frame := v3Frame(t, cp)
+			tr := newTranslator(1, 5)
+			tr.connect(frame)
+			out, err := tr.translate(toBroker, frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := packets5.ReadPacket(bytes.NewReader(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := got.Content.(*packets5.Connect)
+			if c.ProtocolVersion != 5 || c.ClientID != "c1" || c.CleanStart != tc.clean {
+				t.Errorf("got %v, want an MQTT 5 CONNECT for c1 with clean start %t", c, tc.clean)
+			}
+			var expiry uint32
+			if c.Properties.SessionExpiryInterval != nil {
+				expiry = *c.Properties.SessionExpiryInterval
+			}
+			if expiry != tc.expiry {
+				t.Errorf("got session expiry %d, want %d", expiry, tc.expiry)
+			}
+			checkLost(t, tr, "")
+		})
+	}
+}
+
+func TestTranslateSuback(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		fromV5  bool
+		reasons []byte
+		want    []byte
+		lost    string
+	}{
+		{"granted, to 3.1.1", true, []byte{0, 1, 2}, []byte{0, 1, 2}, ""},
+		{"refused, to 3.1.1", true, []byte{1, 0x87, 0x97}, []byte{1, 0x80, 0x80}, "SUBACK reason code 0x87"},
+		{"granted, to MQTT 5", false, []byte{2, 0}, []byte{2, 0}, ""},
+		{"refused, to MQTT 5", false, []byte{0x80, 1}, []byte{0x80, 1}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// The broker speaks fromV5, so the client speaks the other version
+			tr := translatorFor(t, !tc.fromV5)
+			var frame []byte
+			if tc.fromV5 {
+				cp := packets5.NewControlPacket(packets5.SUBACK)
+				s := cp.Content.(*packets5.Suback)
+				s.PacketID, s.Reasons = 9, tc.reasons
+				frame = v5Frame(t, cp)
+			} else {
+				cp := packets3.NewControlPacket(packets3.Suback).(*packets3.SubackPacket)
+				cp.MessageID, cp.ReturnCodes = 9, tc.reasons
+				frame = v3Frame(t, cp)
+			}
+			out, err := tr.translate(toClient, frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var id uint16
+			var got []byte
+			if tc.fromV5 {
+				cp, err := packets3.ReadPacket(bytes.NewReader(out))
+				if err != nil {
+					t.Fatal(err)
+				}
+				id, got = cp.(*packets3.SubackPacket).MessageID, cp.(*packets3.SubackPacket).ReturnCodes
+			} else {
+				cp, err := packets5.ReadPacket(bytes.NewReader(out))
+				if err != nil {
+					t.Fatal(err)
+				}
+				id, got = cp.Content.(*packets5.Suback).PacketID, cp.Content.(*packets5.Suback).Reasons
+			}
+			if id != 9 || !bytes.Equal(got, tc.want) {
+				t.Errorf("got SUBACK %d %v, want 9 %v", id, got, tc.want)
+			}
+			checkLost(t, tr, tc.lost)
+		})
+	}
+}
+
+func TestTranslatePublish(t *testing.T) {
+	type publish struct {
+		topic   string
+		id      uint16
+		qos     byte
+		retain  bool
+		dup     bool
+		payload string
+	}
+	contentType := &packets5.Properties{ContentType: "text/plain"}
+	alias := uint16(3)
+	for _, tc := range []struct {
+		name       string
+		fromV5     bool
+		in         publish
+		properties *packets5.Properties
+		err        string
+		lost       string
+	}{
+		{"QoS 0, to 3.1.1", true, publish{"a/b", 0, 0, false, false, "hello"}, nil, "", ""},
+		{"QoS 2 retained, to 3.1.1", true, publish{"a/b", 7, 2, true, true, "hello"}, nil, "", ""},
+		{"with properties, to 3.1.1", true, publish{"a/b", 7, 1, false, false, "{}"}, contentType, "", "PUBLISH property ContentType"},
+		{"topic alias", true, publish{"", 7, 1, false, false, "x"}, &packets5.Properties{TopicAlias: &alias}, "topic alias", ""},
+		{"QoS 0, to MQTT 5", false, publish{"a/b", 0, 0, false, false, "hello"}, nil, "", ""},
+		{"QoS 1 retained, to MQTT 5", false, publish{"a/b", 7, 1, true, false, ""}, nil, "", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := translatorFor(t, tc.fromV5)
+			var frame []byte
+			if tc.fromV5 {
+				cp := packets5.NewControlPacket(packets5.PUBLISH)
+				p := cp.Content.(*packets5.Publish)
+				p.Topic, p.PacketID, p.QoS, p.Retain, p.Duplicate = tc.in.topic, tc.in.id, tc.in.qos, tc.in.retain, tc.in.dup
+				p.Payload = []byte(tc.in.payload)
+				if tc.properties != nil {
+					p.Properties = tc.properties
+				}
+				frame = v5Frame(t, cp)
+			} else {
+				cp := packets3.NewControlPacket(packets3.Publish).(*packets3.PublishPacket)
+				cp.TopicName, cp.MessageID, cp.Qos, cp.Retain, cp.Dup = tc.in.topic, tc.in.id, tc.in.qos, tc.in.retain, tc.in.dup
+				cp.Payload = []byte(tc.in.payload)
+				frame = v3Frame(t, cp)
+			}
+			out, err := tr.translate(toBroker, frame)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got %v, want an error containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got publish
+			if tc.fromV5 {
+				cp, err := packets3.ReadPacket(bytes.NewReader(out))
+				if err != nil {
+					t.Fatal(err)
+				}
+				p := cp.(*packets3.PublishPacket)
+				got = publish{p.TopicName, p.MessageID, p.Qos, p.Retain, p.Dup, string(p.Payload)}
+			} else {
+				cp, err := packets5.ReadPacket(bytes.NewReader(out))
+				if err != nil {
+					t.Fatal(err)
+				}
+				p := cp.Content.(*packets5.Publish)
+				got = publish{p.Topic, p.PacketID, p.QoS, p.Retain, p.Duplicate, string(p.Payload)}
+			}
+			if !reflect.DeepEqual(got, tc.in) {
+				t.Errorf("got %+v, want %+v", got, tc.in)
+			}
+			checkLost(t, tr, tc.lost)
+		})
+	}
+}
+
+func TestConnackCodes(t *testing.T) {
+	for _, tc := range []struct {
+		v5, v3 byte
+		back   byte // v3 mapped back to MQTT 5
+	}{
+		{packets5.ConnackSuccess, packets3.Accepted, packets5.ConnackSuccess},
+		{packets5.ConnackUnsupportedProtocolVersion, packets3.ErrRefusedBadProtocolVersion, packets5.ConnackUnsupportedProtocolVersion},
+		{packets5.ConnackInvalidClientID, packets3.ErrRefusedIDRejected, packets5.ConnackInvalidClientID},
+		{packets5.ConnackBadUsernameOrPassword, packets3.ErrRefusedBadUsernameOrPassword, packets5.ConnackBadUsernameOrPassword},
+		{packets5.ConnackNotAuthorized, packets3.ErrRefusedNotAuthorised, packets5.ConnackNotAuthorized},
+		{packets5.ConnackBanned, packets3.ErrRefusedNotAuthorised, packets5.ConnackNotAuthorized},
+		{packets5.ConnackServerBusy, packets3.ErrRefusedServerUnavailable, packets5.ConnackServerUnavailable},
+		{packets5.ConnackQuotaExceeded, packets3.ErrRefusedServerUnavailable, packets5.ConnackServerUnavailable},
+	} {
+		if got := v3ConnectReturnCode(tc.v5); got != tc.v3 {
+			t.Errorf("v3ConnectReturnCode(0x%02X) = %d, want %d", tc.v5, got, tc.v3)
+		}
+		if got := v5ConnackReason(tc.v3); got != tc.back {
+			t.Errorf("v5ConnackReason(%d) = 0x%02X, want 0x%02X", tc.v3, got, tc.back)
+		}
+	}
+	if got := v5ConnackReason(0x42); got != packets5.ConnackUnspecifiedError {
+		t.Errorf("v5ConnackReason(0x42) = 0x%02X, want unspecified", got)
+	}
+}
+
+func TestTranslateUnsuback(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		filters []string // unsubscribed from first; none skips the UNSUBSCRIBE
+		reasons int
+	}{
+		{"one filter", []string{"a"}, 1},
+		{"three filters", []string{"a", "b/#", "c"}, 3},
+		{"no UNSUBSCRIBE seen", nil, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := translatorFor(t, true)
+			if tc.filters != nil {
+				cp := packets5.NewControlPacket(packets5.UNSUBSCRIBE)
+				u := cp.Content.(*packets5.Unsubscribe)
+				u.PacketID, u.Topics = 5, tc.filters
+				if _, err := tr.translate(toBroker, v5Frame(t, cp)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ack := packets3.NewControlPacket(packets3.Unsuback).(*packets3.UnsubackPacket)
+			ack.MessageID = 5
+			out, err := tr.translate(toClient, v3Frame(t, ack))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cp, err := packets5.ReadPacket(bytes.NewReader(out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			u := cp.Content.(*packets5.Unsuback)
+			if u.PacketID != 5 || !bytes.Equal(u.Reasons, make([]byte, tc.reasons)) {
+				t.Errorf("got UNSUBACK %d %v, want 5 with %d success reasons", u.PacketID, u.Reasons, tc.reasons)
+			}
+			if len(tr.unsubs) != 0 {
+				t.Errorf("%d UNSUBSCRIBE(s) left pending", len(tr.unsubs))
+			}
+		})
+	}
+}
+
+func TestTranslateDisconnect(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		dir    string
+		reason byte
+		out    bool
+		err    error
+	}{
+		{"normal", toBroker, 0x00, true, nil},
+		{"with will", toBroker, 0x04, false, errWillDisconnect},
+		{"from the broker", toClient, 0x8E, false, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// The side sending the DISCONNECT speaks MQTT 5
+			tr := translatorFor(t, tc.dir == toBroker)
+			cp := packets5.NewControlPacket(packets5.DISCONNECT)
+			cp.Content.(*packets5.Disconnect).ReasonCode = tc.reason
+			out, err := tr.translate(tc.dir, v5Frame(t, cp))
+			if err != tc.err {
+				t.Fatalf("got %v, want %v", err, tc.err)
+			}
+			if (out != nil) != tc.out {
+				t.Errorf("got %x forwarded, want a DISCONNECT: %t", out, tc.out)
+			}
+		})
+	}
+}
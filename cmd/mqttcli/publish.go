@@ -0,0 +1,298 @@
+// publish.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// defaultPublishTimeout bounds how long to wait for the broker to acknowledge a
+// QoS 1/2 publish.
+const defaultPublishTimeout = 10 * time.Second
+
+// maxPublishRate bounds --rate, in messages per second; far beyond what a
+// broker takes, and well short of ticking every nanosecond.
+const maxPublishRate = 1e6
+
+// readPublishPayload returns the message to publish: --message if given, else
+// the contents of --file, else everything on stdin.
+func readPublishPayload(message string, messageSet bool, file string) ([]byte, error) {
+	switch {
+	case messageSet && file != "":
+		return nil, fmt.Errorf("use only one of --message and --file")
+	case messageSet:
+		return []byte(message), nil
+	case file == "-":
+		return ioutil.ReadAll(os.Stdin)
+	case file != "":
+		return ioutil.ReadFile(file)
+	}
+	return ioutil.ReadAll(os.Stdin)
+}
+
+// openPublishLines returns the input of --lines: --file if given, else stdin.
+func openPublishLines(file string) (io.ReadCloser, error) {
+	if file == "" || file == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(file)
+}
+
+// readLines sends each non-empty line of r, without its line ending, until r
+// ends. Lines may be of any length.
+func readLines(r io.Reader, lines chan<- []byte, errs chan<- error) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if line = bytes.TrimRight(line, "\r\n"); len(line) > 0 {
+			lines <- line
+		}
+		if err != nil {
+			if err != io.EOF {
+				errs <- err
+			}
+			close(lines)
+			return
+		}
+	}
+}
+
+// publishLines publishes each line of input as its own message, at most rate
+// messages per second if rate is positive, until input ends or ctx is done.
+// With a topic template, each line's topic comes from its JSON fields; lines
+// it can't be resolved for are skipped with a warning.
+func publishLines(ctx context.Context, client mqtt.Client, cfg *Config, tt *topicTemplate, guard *publishGuard, chunks *chunker, retain bool, input io.Reader, rate float64, metrics *metricsRecorder) {
+	lines := make(chan []byte, 64)
+	errs := make(chan error, 1)
+	go readLines(input, lines, errs)
+
+	var tick <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	n, size, skipped := 0, 0, 0
+	defer func() {
+		logInfo("published", "Published %d line(s), %d bytes, to '%s' with QoS=%d retain=%t", n, size, cfg.Topic, cfg.QoS, retain)
+		if skipped > 0 {
+			logWarn("lines_skipped", "Skipped %d line(s) without a topic or over max_payload_size", skipped)
+		}
+	}()
+	for {
+		var line []byte
+		select {
+		case <-ctx.Done():
+			logInfo("shutting_down", "Shutting down...")
+			return
+		case err := <-errs:
+			fatal("publish_failed", false, "Could not read lines: %v", err)
+		case l, ok := <-lines:
+			if !ok {
+				return
+			}
+			line = l
+		}
+		if tick != nil && n > 0 {
+			select {
+			case <-ctx.Done():
+				logInfo("shutting_down", "Shutting down...")
+				return
+			case <-tick:
+			}
+		}
+		topic := cfg.Topic
+		if tt != nil {
+			var err error
+			if topic, err = tt.topic(line); err != nil {
+				logWarn("topic_template", "Skipping line %d: %v", n+skipped+1, err)
+				skipped++
+				continue
+			}
+		}
+		if err := guard.admit(ctx, topic, len(line)); err != nil {
+			if ctx.Err() != nil {
+				logInfo("shutting_down", "Shutting down...")
+				return
+			}
+			logWarn("payload_too_large", "Skipping line %d: %v", n+skipped+1, err)
+			skipped++
+			continue
+		}
+		start := time.Now()
+		if err := chunks.publish(ctx, client, cfg, topic, retain, line); err != nil {
+			client.Disconnect(0)
+			fatal(phaseErrorCode("publish", err), isRetryable(err), "Failed to publish line %d to '%s': %v", n+skipped+1, topic, err)
+		}
+		metrics.published(len(line), time.Since(start))
+		n++
+		size += len(line)
+	}
+}
+
+func runPublish(args []string) {
+	fs := flag.NewFlagSet("pub", flag.ExitOnError)
+	flags := initCLIFlags(fs)
+	var message, file string
+	var retain bool
+	fs.StringVar(&message, "message", "", "Message payload to publish.")
+	fs.StringVar(&message, "m", "", "Same as --message (mosquitto compatible).")
+	fs.StringVar(&file, "file", "", "Publish the contents of this file ('-' for stdin).")
+	fs.StringVar(&file, "f", "", "Same as --file (mosquitto compatible).")
+	fs.BoolVar(&retain, "retain", false, "Set the retain flag on published messages.")
+	fs.BoolVar(&retain, "r", false, "Same as --retain (mosquitto compatible).")
+	repeat := fs.Int("repeat", 1, "Number of times to publish the message (0 repeats until interrupted).")
+	interval := fs.Duration("interval", time.Second, "Delay between repeated publishes.")
+	var lines bool
+	fs.BoolVar(&lines, "lines", false, "Publish each line of stdin (or --file) as its own message, until the input ends. Empty lines are skipped.")
+	fs.BoolVar(&lines, "l", false, "Same as --lines (mosquitto compatible).")
+	fs.Float64Var(&flags.Rate, "rate", 0, "With --lines, publish at most this many messages per second.")
+	fs.StringVar(&flags.MaxPayloadSize, "max-payload-size", "", "Refuse to publish payloads bigger than this, e.g. 128KB for AWS IoT.")
+	fs.Var(&flags.TopicRateLimits, "topic-rate", "Publish at most RATE messages per second to the topics matching FILTER, as FILTER=RATE. Repeatable.")
+	fs.StringVar(&flags.MaxPacketSize, "max-packet-size", "", "The broker's maximum packet size, e.g. 128KB, for brokers that don't advertise one (MQTT 3, or v5 brokers that leave it out).")
+	fs.BoolVar(&flags.Delta, "delta", false, "With --retain, publish a delta against the document retained on the topic, to TOPIC/_delta, for 'sub --reconstruct' to apply.")
+	fs.BoolVar(&flags.Chunk, "chunk", false, "Publish payloads over the maximum packet size in chunks, for 'sub --reassemble' to put back together.")
+	fs.StringVar(&flags.GuardAction, "guard-action", "", "What to do with a publish over --max-payload-size or --topic-rate: 'block' (default) refuses or holds it back, 'warn' logs and sends it.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s pub [options] [--message TEXT | --file FILE | --lines]\n\n"+
+			"The payload is read from stdin when neither --message nor --file is given.\n\nExample:\n"+
+			"  tail -f sensor.log | %s pub --topic logs/sensor --lines\n\nOptions:\n", filepath.Base(os.Args[0]), filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	messageSet := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "message" || f.Name == "m" {
+			messageSet = true
+		}
+	})
+
+	cfg := buildConfig(flags)
+	refuseReadOnly(&cfg, "pub")
+	cfg.Reconstruct = false // for subscribing; it adds the delta topics
+	if cfg.ShareGroup != "" {
+		fatal("config_invalid", false, "pub can't use share_group; shared subscriptions only apply to subscribing.")
+	}
+	topics := cfg.subscriptions()
+	if len(topics) != 1 {
+		fatal("config_invalid", false, "pub needs exactly one topic, got %d.", len(topics))
+	}
+	for topic, qos := range topics {
+		cfg.Topic, cfg.QoS = topic, qos
+	}
+	tt, err := parseTopicTemplate(cfg.Topic)
+	if err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+	guard, err := newPublishGuard(&cfg)
+	if err != nil {
+		fatal("config_invalid", false, "%v.", err)
+	}
+	chunks, err := newChunker(&cfg)
+	if err != nil {
+		fatal("config_invalid", false, "%v.", err)
+	}
+	if cfg.Chunk && retain {
+		fatal("config_invalid", false, "--chunk can't be combined with --retain; each chunk would replace the one retained before it.")
+	}
+	if cfg.Delta && !retain {
+		fatal("config_invalid", false, "--delta needs --retain; a delta patches the document retained on the topic.")
+	}
+	if lines {
+		if cfg.Delta {
+			fatal("config_invalid", false, "--delta can't be combined with --lines.")
+		}
+		if messageSet || *repeat != 1 {
+			fatal("config_invalid", false, "--lines can't be combined with --message or --repeat.")
+		}
+		input, err := openPublishLines(file)
+		if err != nil {
+			fatal("config_invalid", false, "Could not read lines: %v", err)
+		}
+		defer input.Close()
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		metrics := newMetricsRecorder(&cfg)
+		defer metrics.write()
+		client, _, cancelSetup := connectWithBudget(ctx, &cfg)
+		cancelSetup()
+		defer client.Disconnect(250)
+		publishLines(ctx, client, &cfg, tt, guard, chunks, retain, input, cfg.Rate, metrics)
+		return
+	}
+	payload, err := readPublishPayload(message, messageSet, file)
+	if err != nil {
+		fatal("config_invalid", false, "Could not read message: %v", err)
+	}
+	if tt != nil {
+		if cfg.Topic, err = tt.topic(payload); err != nil {
+			fatal("config_invalid", false, "Could not resolve the topic: %v", err)
+		}
+	}
+
+	if err := guard.checkSize(cfg.Topic, len(payload)); err != nil {
+		fatal("payload_too_large", false, "Refusing to publish to '%s': %v", cfg.Topic, err)
+	}
+
+	// Handle Ctrl+C while connecting or between repeats
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	metrics := newMetricsRecorder(&cfg)
+	defer metrics.write()
+	client, _, cancelSetup := connectWithBudget(ctx, &cfg)
+	cancelSetup()
+	defer client.Disconnect(250)
+
+	publishes := []retainedPublish{{cfg.Topic, payload}}
+	if cfg.Delta {
+		base, err := fetchRetained(ctx, client, &cfg, cfg.Topic)
+		if err != nil {
+			client.Disconnect(0)
+			fatal(phaseErrorCode("subscribe", err), isRetryable(err), "Could not fetch the document retained on '%s': %v", cfg.Topic, err)
+		}
+		var delta *deltaEnvelope
+		if publishes, delta = deltaPublishes(cfg.Topic, base, payload); delta != nil {
+			logInfo("delta", "Publishing a %s delta to '%s' for the %d-byte document", delta.Delta.Format, publishes[0].topic, len(payload))
+		}
+	}
+
+	for i := 0; *repeat == 0 || i < *repeat; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				logInfo("shutting_down", "Shutting down...")
+				return
+			case <-time.After(*interval):
+			}
+		}
+		for _, p := range publishes {
+			// The size was checked before connecting, and a delta is
+			// smaller, so this only waits out topic rate limits
+			if err := guard.admit(ctx, p.topic, len(p.payload)); err != nil {
+				logInfo("shutting_down", "Shutting down...")
+				return
+			}
+			start := time.Now()
+			if err := chunks.publish(ctx, client, &cfg, p.topic, retain, p.payload); err != nil {
+				client.Disconnect(0)
+				fatal(phaseErrorCode("publish", err), isRetryable(err), "Failed to publish to '%s': %v", p.topic, err)
+			}
+			metrics.published(len(p.payload), time.Since(start))
+			logInfo("published", "Published %d bytes to '%s' with QoS=%d retain=%t", len(p.payload), p.topic, cfg.QoS, retain)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// publishguard.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values of guard_action.
+const (
+	guardBlock = "block"
+	guardWarn  = "warn"
+)
+
+// rateLimitFlag collects repeated --topic-rate FILTER=RATE flags.
+type rateLimitFlag map[string]float64
+
+func (m *rateLimitFlag) String() string {
+	return fmt.Sprint(map[string]float64(*m))
+}
+
+func (m *rateLimitFlag) Set(s string) error {
+	filter, value, ok := strings.Cut(s, "=")
+	if !ok || filter == "" {
+		return fmt.Errorf("invalid topic rate '%s', expected 'FILTER=MESSAGES_PER_SECOND'", s)
+	}
+	rate, err := strconv.ParseFloat(strings.TrimSuffix(value, "/s"), 64)
+	if err != nil {
+		return fmt.Errorf("invalid topic rate '%s', expected 'FILTER=MESSAGES_PER_SECOND'", s)
+	}
+	if *m == nil {
+		*m = rateLimitFlag{}
+	}
+	(*m)[filter] = rate
+	return nil
+}
+
+// topicRateLimit spaces out publishes to the topics matching filter.
+type topicRateLimit struct {
+	filter   string
+	rate     float64 // messages per second
+	interval time.Duration
+	next     time.Time // earliest the next publish may go
+}
+
+// publishGuard checks publishes against max_payload_size and
+// topic_rate_limits before they are sent, since brokers with strict limits
+// (128KB on AWS IoT) disconnect the client instead of saying what was wrong.
+type publishGuard struct {
+	maxPayload int64 // zero is unlimited
+	warn       bool  // log and send anyway instead of refusing or holding back
+
+	mu     sync.Mutex
+	limits []*topicRateLimit // by filter
+	warned map[string]bool
+}
+
+// newPublishGuard returns the guard for cfg, or nil if it sets no limits.
+func newPublishGuard(cfg *Config) (*publishGuard, error) {
+	g := &publishGuard{warned: map[string]bool{}}
+	switch cfg.GuardAction {
+	case "", guardBlock:
+	case guardWarn:
+		g.warn = true
+	default:
+		return nil, fmt.Errorf("guard_action must be '%s' or '%s', got '%s'", guardBlock, guardWarn, cfg.GuardAction)
+	}
+	if cfg.MaxPayloadSize != "" {
+		n, err := parseByteSize(cfg.MaxPayloadSize)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid max_payload_size '%s', expected a size such as 128KB", cfg.MaxPayloadSize)
+		}
+		g.maxPayload = n
+	}
+	for filter, rate := range cfg.TopicRateLimits {
+		if !(rate > 0) || math.IsInf(rate, 0) {
+			return nil, fmt.Errorf("topic_rate_limits for '%s' must be a positive number of messages per second, got %v", filter, rate)
+		}
+		g.limits = append(g.limits, &topicRateLimit{filter: filter, rate: rate, interval: time.Duration(float64(time.Second) / rate)})
+	}
+	sort.Slice(g.limits, func(i, j int) bool { return g.limits[i].filter < g.limits[j].filter })
+	if g.maxPayload == 0 && len(g.limits) == 0 {
+		return nil, nil
+	}
+	return g, nil
+}
+
+// payloadTooLargeError is a payload over max_payload_size.
+type payloadTooLargeError struct {
+	size, max int64
+}
+
+func (e *payloadTooLargeError) Error() string {
+	return fmt.Sprintf("payload of %d bytes exceeds max_payload_size of %d bytes", e.size, e.max)
+}
+
+// checkSize returns an error for a payload of size bytes over
+// max_payload_size, or with guard_action "warn" logs it instead.
+func (g *publishGuard) checkSize(topic string, size int) error {
+	if g == nil || g.maxPayload == 0 || int64(size) <= g.maxPayload {
+		return nil
+	}
+	err := &payloadTooLargeError{int64(size), g.maxPayload}
+	if !g.warn {
+		return err
+	}
+	if !g.warnedOnce("payload_too_large") {
+		logWarn("payload_too_large", "Publishing to '%s' anyway: %v", topic, err)
+	}
+	return nil
+}
+
+// warnedOnce reports whether key was seen before, and marks it seen.
+func (g *publishGuard) warnedOnce(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	seen := g.warned[key]
+	g.warned[key] = true
+	return seen
+}
+
+// admit returns once a publish of size bytes to topic is within the limits,
+// holding it back for as long as a topic rate limit needs. With guard_action
+// "warn" it logs what the publish exceeds and returns at once instead. A nil
+// guard admits everything.
+func (g *publishGuard) admit(ctx context.Context, topic string, size int) error {
+	if g == nil {
+		return nil
+	}
+	if err := g.checkSize(topic, size); err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	now := time.Now()
+	wait := time.Duration(0)
+	var matched []*topicRateLimit
+	for _, l := range g.limits {
+		if topicMatches(l.filter, topic) {
+			matched = append(matched, l)
+			wait = max(wait, l.next.Sub(now))
+		}
+	}
+	if wait > 0 && g.warn {
+		for _, l := range matched {
+			if l.next.After(now) && !g.warned["topic_rate "+l.filter] {
+				g.warned["topic_rate "+l.filter] = true
+				logWarn("rate_limit_exceeded", "Publishing to '%s' faster than the %g/s topic_rate_limits allows for '%s'", topic, l.rate, l.filter)
+			}
+		}
+		wait = 0
+	}
+	send := now.Add(wait)
+	for _, l := range matched {
+		l.next = send.Add(l.interval)
+	}
+	g.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
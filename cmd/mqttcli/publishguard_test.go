@@ -0,0 +1,141 @@
+// publishguard_test.go
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewPublishGuard(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cfg     Config
+		wantErr string
+		wantNil bool
+	}{
+		{"no limits", Config{}, "", true},
+		{"size", Config{MaxPayloadSize: "128KB"}, "", false},
+		{"rate", Config{TopicRateLimits: map[string]float64{"a/#": 2}}, "", false},
+		{"warn", Config{MaxPayloadSize: "1KiB", GuardAction: "warn"}, "", false},
+		{"bad size", Config{MaxPayloadSize: "lots"}, "invalid max_payload_size", false},
+		{"zero size", Config{MaxPayloadSize: "0"}, "invalid max_payload_size", false},
+		{"zero rate", Config{TopicRateLimits: map[string]float64{"a": 0}}, "must be a positive number", false},
+		{"negative rate", Config{TopicRateLimits: map[string]float64{"a": -1}}, "must be a positive number", false},
+		{"infinite rate", Config{TopicRateLimits: map[string]float64{"a": math.Inf(1)}}, "must be a positive number", false},
+		{"NaN rate", Config{TopicRateLimits: map[string]float64{"a": math.NaN()}}, "must be a positive number", false},
+		{"bad action", Config{MaxPayloadSize: "1KB", GuardAction: "drop"}, "guard_action must be", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g, err := newPublishGuard(&tc.cfg)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got %v, want an error containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (g == nil) != tc.wantNil {
+				t.Errorf("got guard %v, want nil=%t", g, tc.wantNil)
+			}
+		})
+	}
+}
+
+func TestPublishGuardSize(t *testing.T) {
+	g, err := newPublishGuard(&Config{MaxPayloadSize: "10B"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.admit(context.Background(), "a", 10); err != nil {
+		t.Errorf("10 bytes: %v", err)
+	}
+	var tooLarge *payloadTooLargeError
+	if err := g.admit(context.Background(), "a", 11); !errors.As(err, &tooLarge) || tooLarge.size != 11 || tooLarge.max != 10 {
+		t.Errorf("11 bytes: got %v, want payloadTooLargeError", err)
+	}
+
+	g.warn = true
+	if err := g.admit(context.Background(), "a", 11); err != nil {
+		t.Errorf("11 bytes with guard_action warn: %v", err)
+	}
+}
+
+func TestPublishGuardRate(t *testing.T) {
+	g, err := newPublishGuard(&Config{TopicRateLimits: map[string]float64{"a/+": 20}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := g.admit(ctx, "a/1", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first goes at once, the others 50ms apart
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("3 publishes at 20/s took %s, want at least 100ms", elapsed)
+	}
+
+	// Other topics aren't held back
+	start = time.Now()
+	for i := 0; i < 3; i++ {
+		g.admit(ctx, "b/1", 1)
+	}
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Errorf("unlimited topic took %s", elapsed)
+	}
+
+	// Nor with guard_action warn
+	g.warn = true
+	start = time.Now()
+	for i := 0; i < 3; i++ {
+		g.admit(ctx, "a/1", 1)
+	}
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Errorf("guard_action warn took %s, want no waiting", elapsed)
+	}
+}
+
+func TestPublishGuardRateCanceled(t *testing.T) {
+	g, err := newPublishGuard(&Config{TopicRateLimits: map[string]float64{"a": 0.1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	g.admit(ctx, "a", 1)
+	if err := g.admit(ctx, "a", 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the context's error", err)
+	}
+}
+
+func TestNilPublishGuard(t *testing.T) {
+	var g *publishGuard
+	if err := g.admit(context.Background(), "a", 1<<30); err != nil {
+		t.Errorf("nil guard: %v", err)
+	}
+}
+
+func TestRateLimitFlag(t *testing.T) {
+	var f rateLimitFlag
+	for _, s := range []string{"a/#=10", "b/+=0.5/s"} {
+		if err := f.Set(s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+	if f["a/#"] != 10 || f["b/+"] != 0.5 {
+		t.Errorf("got %v", f)
+	}
+	for _, s := range []string{"a/#", "=10", "a=fast"} {
+		if err := f.Set(s); err == nil {
+			t.Errorf("%s: want an error", s)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+// readonly.go
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// errReadOnly is the error of every publish attempted with --read-only.
+var errReadOnly = errors.New("publishing is disabled by --read-only")
+
+// refuseReadOnly exits before connecting when a command that publishes is run
+// with --read-only, so nothing reaches the broker at all.
+func refuseReadOnly(cfg *Config, what string) {
+	if cfg.ReadOnly {
+		fatal("read_only", false, "%s publishes messages and is refused by --read-only.", what)
+	}
+}
+
+// readOnlyEnv reports whether $MQTTCLI_READ_ONLY is set, for commands such as
+// relay that take no broker Config.
+func readOnlyEnv() bool {
+	return os.Getenv(envReadOnly) != ""
+}
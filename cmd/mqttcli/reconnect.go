@@ -0,0 +1,414 @@
+// reconnect.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// backoff yields reconnect delays that double from the initial delay up to the
+// maximum, each spread by ±jitter (a fraction) so a fleet of clients doesn't
+// reconnect in lockstep after a broker restart.
+type backoff struct {
+	next, max time.Duration
+	jitter    float64
+}
+
+func newBackoff(cfg *Config) *backoff {
+	return &backoff{
+		next:   time.Duration(cfg.ReconnectDelay),
+		max:    time.Duration(cfg.ReconnectMaxDelay),
+		jitter: cfg.ReconnectJitter,
+	}
+}
+
+func (b *backoff) delay() time.Duration {
+	d := b.next
+	b.next = min(b.next*2, b.max)
+	if b.jitter > 0 {
+		d = time.Duration(float64(d) * (1 + b.jitter*(2*rand.Float64()-1)))
+	}
+	return d
+}
+
+// reconnectSub is a subscription to restore after reconnecting.
+type reconnectSub struct {
+	qos     byte
+	handler mqtt.MessageHandler
+}
+
+// reconnectingClient is the client handed to every mode. When the connection
+// is lost it connects again with backoff, resubscribes to everything that was
+// subscribed, and carries on with the new connection; messages published while
+// it is down fail like they would on a disconnected client.
+type reconnectingClient struct {
+	cfg *Config
+
+	mu           sync.Mutex
+	client       mqtt.Client
+	generation   int // of client; losses reported by older connections are ignored
+	subs         map[string]reconnectSub
+	reconnecting bool
+	caps         brokerCaps      // cached and learned broker limits, see adaptPublish
+	granted      map[string]byte // filters granted a lower QoS than requested, see learnGranted
+	warned       map[string]bool // adaptations already logged
+	lost         []func()        // called when the connection drops, see onReconnect
+	restored     []func()        // called once reconnected and resubscribed
+	failed       []func(error)   // called instead of reconnecting with no_reconnect, see onFailure
+
+	ctx    context.Context // canceled by Disconnect
+	cancel context.CancelFunc
+}
+
+// connectReconnecting makes one connection attempt like connectMQTT, returning
+// a client that reconnects on its own unless cfg.NoReconnect is set.
+func connectReconnecting(ctx context.Context, cfg *Config) (mqtt.Client, error) {
+	r := &reconnectingClient{cfg: cfg, subs: map[string]reconnectSub{}, granted: map[string]byte{}, warned: map[string]bool{}}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	if !cfg.NoAdapt {
+		r.caps = loadBrokerCaps(cfg)
+	}
+	client, err := connectMQTT(ctx, cfg, r.lostHandler(0))
+	if err != nil {
+		r.cancel()
+		return nil, err
+	}
+	r.client = client
+	r.learn(client)
+	return r, nil
+}
+
+// brokerCaps returns the limits known for the broker, from the cache and from
+// every connection so far, or with no_adapt from the current connection.
+func (r *reconnectingClient) brokerCaps() brokerCaps {
+	if r.cfg.NoAdapt {
+		if cr, ok := r.current().(capsReporter); ok {
+			return cr.brokerCaps()
+		}
+		return brokerCaps{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.caps
+}
+
+func (r *reconnectingClient) current() mqtt.Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.client
+}
+
+// lostHandler returns the callback for the connection with the given
+// generation, called by the underlying client when its connection drops.
+func (r *reconnectingClient) lostHandler(generation int) func(error) {
+	return func(err error) {
+		if r.ctx.Err() != nil {
+			return
+		}
+		throttle.connectionLost(r.cfg, err)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.cfg.NoReconnect {
+			// Not fatal here: this is paho's goroutine, and exiting from it
+			// would skip the caller's cleanup
+			if len(r.failed) == 0 {
+				logError("connection_lost", true, "MQTT connection lost: %v", err)
+			}
+			for _, f := range r.failed {
+				f(err)
+			}
+			return
+		}
+		if r.reconnecting || generation != r.generation {
+			return
+		}
+		r.reconnecting = true
+		for _, f := range r.lost {
+			f()
+		}
+		go r.reconnect(r.generation+1, err)
+	}
+}
+
+func (r *reconnectingClient) reconnect(generation int, cause error) {
+	b := newBackoff(r.cfg)
+	for attempt := 1; ; attempt++ {
+		delay := b.delay()
+		if attempt == 1 {
+			logWarn("reconnecting", "MQTT connection lost: %v; reconnecting in %s", cause, delay.Round(time.Millisecond))
+		} else {
+			logWarn("reconnecting", "Reconnect attempt %d failed: %v; retrying in %s", attempt-1, cause, delay.Round(time.Millisecond))
+		}
+		select {
+		case <-time.After(delay):
+		case <-r.ctx.Done():
+			return
+		}
+
+		client, err := connectMQTT(r.ctx, r.cfg, r.lostHandler(generation))
+		if err != nil {
+			cause = err
+			continue
+		}
+		r.learn(client)
+		if err := r.resubscribe(client); err != nil {
+			client.Disconnect(0)
+			cause = err
+			continue
+		}
+
+		r.mu.Lock()
+		old := r.client
+		r.client, r.generation, r.reconnecting = client, generation, false
+		r.mu.Unlock()
+		old.Disconnect(0)
+		if r.ctx.Err() != nil {
+			client.Disconnect(250)
+			return
+		}
+		logInfo("reconnected", "Reconnected to %s after %d attempt(s)", r.cfg.BrokerURL, attempt)
+		r.mu.Lock()
+		restored := r.restored
+		r.mu.Unlock()
+		for _, f := range restored {
+			f()
+		}
+		return
+	}
+}
+
+// onReconnect registers callbacks for when the connection drops and for when
+// it has been restored, e.g. to tell queued session messages from live ones.
+func (r *reconnectingClient) onReconnect(lost, restored func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lost = append(r.lost, lost)
+	r.restored = append(r.restored, restored)
+}
+
+// onFailure registers a callback for when the connection drops and
+// no_reconnect keeps it from being restored.
+func (r *reconnectingClient) onFailure(f func(error)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failed = append(r.failed, f)
+}
+
+// resubscribe restores the recorded subscriptions on a new connection.
+func (r *reconnectingClient) resubscribe(client mqtt.Client) error {
+	r.mu.Lock()
+	subs := make(map[string]reconnectSub, len(r.subs))
+	for filter, s := range r.subs {
+		subs[filter] = s
+	}
+	r.mu.Unlock()
+
+	for filter, s := range subs {
+		// subscriptions were adapted when first made, so no need to repeat it
+		token := client.Subscribe(filter, s.qos, s.handler)
+		if err := waitToken(r.ctx, token, time.Duration(r.cfg.SubscribeTimeout), "subscribe"); err != nil {
+			return err
+		}
+	}
+	if len(subs) > 0 {
+		logInfo("resubscribed", "Resubscribed to %s", describeSubscriptions(qosOf(subs)))
+	}
+	return nil
+}
+
+func qosOf(subs map[string]reconnectSub) map[string]byte {
+	m := make(map[string]byte, len(subs))
+	for filter, s := range subs {
+		m[filter] = s.qos
+	}
+	return m
+}
+
+func (r *reconnectingClient) IsConnected() bool      { return r.current().IsConnected() }
+func (r *reconnectingClient) IsConnectionOpen() bool { return r.current().IsConnectionOpen() }
+func (r *reconnectingClient) Connect() mqtt.Token    { return r.current().Connect() }
+
+func (r *reconnectingClient) Disconnect(quiesce uint) {
+	r.cancel()
+	r.current().Disconnect(quiesce)
+	throttle.summarize()
+}
+
+func (r *reconnectingClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	// every command publishes through here, so this is the last line of --read-only
+	if r.cfg.ReadOnly {
+		return newV5Token(func() error { return errReadOnly })
+	}
+	qos, retained, err := r.adaptPublish(topic, qos, retained, payload)
+	if err != nil {
+		return newV5Token(func() error { return err })
+	}
+	switch p := payload.(type) {
+	case []byte:
+		throttle.publishing(len(p))
+	case string:
+		throttle.publishing(len(p))
+	}
+	return r.current().Publish(topic, qos, retained, payload)
+}
+
+func (r *reconnectingClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return r.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+func (r *reconnectingClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	filters, err := r.adaptSubscribe(filters)
+	if err != nil {
+		return newV5Token(func() error { return err })
+	}
+	r.mu.Lock()
+	for filter, qos := range filters {
+		r.subs[filter] = reconnectSub{qos, callback}
+	}
+	client := r.client
+	r.mu.Unlock()
+	token := client.SubscribeMultiple(filters, callback)
+	r.learnGranted(filters, token)
+	return token
+}
+
+func (r *reconnectingClient) Unsubscribe(topics ...string) mqtt.Token {
+	r.mu.Lock()
+	for _, t := range topics {
+		delete(r.subs, t)
+	}
+	client := r.client
+	r.mu.Unlock()
+	return client.Unsubscribe(topics...)
+}
+
+func (r *reconnectingClient) AddRoute(topic string, callback mqtt.MessageHandler) {
+	r.current().AddRoute(topic, callback)
+}
+
+func (r *reconnectingClient) OptionsReader() mqtt.ClientOptionsReader {
+	return r.current().OptionsReader()
+}
+
+// learn merges the capabilities client learned while connecting into r.caps,
+// caching them if they changed.
+func (r *reconnectingClient) learn(client mqtt.Client) {
+	cr, ok := client.(capsReporter)
+	if !ok || r.cfg.NoAdapt {
+		return
+	}
+	r.mu.Lock()
+	changed := r.caps.merge(cr.brokerCaps())
+	caps := r.caps
+	r.mu.Unlock()
+	if changed {
+		logInfo("broker_caps", "Broker %s advertises %s", r.cfg.BrokerURL, caps)
+		saveBrokerCaps(r.cfg, caps)
+	}
+}
+
+// learnGranted warns when a pre-v5 broker grants a filter a lower QoS than
+// requested, once the SUBACK arrives. That is a limit on the filter, such as
+// an ACL on its topics, so it isn't taken as the broker's maximum QoS.
+func (r *reconnectingClient) learnGranted(filters map[string]byte, token mqtt.Token) {
+	st, ok := token.(*mqtt.SubscribeToken)
+	if !ok || r.cfg.NoAdapt {
+		return
+	}
+	go func() {
+		if !st.Wait() || st.Error() != nil {
+			return
+		}
+		for filter, granted := range st.Result() {
+			if granted >= filters[filter] {
+				continue
+			}
+			r.mu.Lock()
+			known, seen := r.granted[filter]
+			r.granted[filter] = granted
+			r.mu.Unlock()
+			if !seen || known != granted {
+				logWarn("qos_downgraded", "Broker granted QoS %d for '%s' (requested %d); messages on it arrive with at most QoS %d",
+					granted, filter, filters[filter], granted)
+			}
+		}
+	}()
+}
+
+// warnOnce logs an adaptation the first time it happens.
+func (r *reconnectingClient) warnOnce(code, format string, args ...interface{}) {
+	r.mu.Lock()
+	seen := r.warned[code]
+	r.warned[code] = true
+	r.mu.Unlock()
+	if !seen {
+		logWarn(code, format, args...)
+	}
+}
+
+// adaptPublish fits a publish to the broker's known limits: QoS is lowered to
+// the maximum and the retain flag dropped where retain isn't available, with
+// a warning. Payloads over the maximum packet size can't be adapted and fail.
+func (r *reconnectingClient) adaptPublish(topic string, qos byte, retained bool, payload interface{}) (byte, bool, error) {
+	if r.cfg.NoAdapt {
+		return qos, retained, nil
+	}
+	r.mu.Lock()
+	caps := r.caps
+	r.mu.Unlock()
+	if caps.MaxQoS != nil && qos > *caps.MaxQoS {
+		r.warnOnce("qos_downgraded", "Broker supports QoS up to %d; publishing with QoS %d instead of %d", *caps.MaxQoS, *caps.MaxQoS, qos)
+		qos = *caps.MaxQoS
+	}
+	if retained && caps.RetainAvailable != nil && !*caps.RetainAvailable {
+		r.warnOnce("retain_disabled", "Broker doesn't support retained messages; publishing without retain")
+		retained = false
+	}
+	if caps.MaxPacketSize > 0 {
+		size := len(topic) + 16 // fixed header, topic length, packet ID, properties
+		switch p := payload.(type) {
+		case []byte:
+			size += len(p)
+		case string:
+			size += len(p)
+		}
+		if uint32(size) > caps.MaxPacketSize {
+			return qos, retained, fmt.Errorf("message of about %d bytes exceeds the broker's maximum packet size of %d bytes", size, caps.MaxPacketSize)
+		}
+	}
+	return qos, retained, nil
+}
+
+// adaptSubscribe fits subscriptions to the broker's known limits: QoS is
+// lowered to the maximum, and shared subscriptions become plain ones where
+// they aren't available, with a warning. Wildcards can't be adapted and fail.
+func (r *reconnectingClient) adaptSubscribe(filters map[string]byte) (map[string]byte, error) {
+	if r.cfg.NoAdapt {
+		return filters, nil
+	}
+	r.mu.Lock()
+	caps := r.caps
+	r.mu.Unlock()
+	adapted := make(map[string]byte, len(filters))
+	for filter, qos := range filters {
+		if caps.WildcardSubs != nil && !*caps.WildcardSubs && hasWildcard(filter) {
+			return nil, fmt.Errorf("broker doesn't support wildcard subscriptions like '%s'", filter)
+		}
+		if caps.SharedSubs != nil && !*caps.SharedSubs && isSharedSubscription(filter) {
+			plain := sharedSubscriptionFilter(filter)
+			r.warnOnce("shared_sub_unavailable", "Broker doesn't support shared subscriptions; subscribing to '%s' instead of '%s', so every instance gets every message", plain, filter)
+			filter = plain
+		}
+		if caps.MaxQoS != nil && qos > *caps.MaxQoS {
+			r.warnOnce("qos_downgraded", "Broker supports QoS up to %d; subscribing with QoS %d instead of %d", *caps.MaxQoS, *caps.MaxQoS, qos)
+			qos = *caps.MaxQoS
+		}
+		adapted[filter] = qos
+	}
+	return adapted, nil
+}
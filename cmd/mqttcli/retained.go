@@ -0,0 +1,85 @@
+// retained.go
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// retainedSettle is how long --retained-only waits after the last retained
+// message (or the SUBACK) before deciding the broker has sent them all.
+const retainedSettle = time.Second
+
+// retainedFilter implements --skip-retained and --retained-only.
+type retainedFilter struct {
+	skip, only bool
+
+	activity chan struct{} // a retained message was handled
+	live     chan struct{} // closed on the first message without the retain flag
+	liveOnce sync.Once
+}
+
+func newRetainedFilter(cfg *Config) *retainedFilter {
+	return &retainedFilter{
+		skip:     cfg.SkipRetained,
+		only:     cfg.RetainedOnly,
+		activity: make(chan struct{}, 1),
+		live:     make(chan struct{}),
+	}
+}
+
+func (f *retainedFilter) wrap(next mqtt.MessageHandler) mqtt.MessageHandler {
+	if !f.skip && !f.only {
+		return next
+	}
+	return func(client mqtt.Client, msg mqtt.Message) {
+		switch {
+		case f.skip && msg.Retained():
+			return
+		case f.only && !msg.Retained():
+			// Live traffic means the retained snapshot is complete
+			f.liveOnce.Do(func() { close(f.live) })
+			return
+		}
+		next(client, msg)
+		if f.only {
+			select {
+			case f.activity <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// watch returns ctx, or with --retained-only a child of ctx that is canceled
+// once the retained snapshot has been received. Call it once subscribed.
+func (f *retainedFilter) watch(ctx context.Context) context.Context {
+	if !f.only {
+		return ctx
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer cancel()
+		timer := time.NewTimer(retainedSettle)
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-f.live:
+				return
+			case <-timer.C:
+				return
+			case <-f.activity:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(retainedSettle)
+			}
+		}
+	}()
+	return ctx
+}
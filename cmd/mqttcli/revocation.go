@@ -0,0 +1,426 @@
+// revocation.go
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// OCSP modes for the ocsp option.
+const (
+	ocspStapled    = "stapled"     // check the broker's stapled response, if it sends one
+	ocspMustStaple = "must-staple" // fail if the broker doesn't staple a response
+	ocspCheck      = "check"       // ask the CA's responder when nothing is stapled
+)
+
+const (
+	// ocspTimeout bounds a query to an OCSP responder, made during the handshake.
+	ocspTimeout = 10 * time.Second
+	// revocationSkew is the clock skew allowed on CRL and OCSP validity times.
+	revocationSkew = 5 * time.Minute
+)
+
+// validOCSPMode checks the ocsp option.
+func validOCSPMode(mode string) error {
+	switch mode {
+	case "", "off", ocspStapled, ocspMustStaple, ocspCheck:
+		return nil
+	}
+	return fmt.Errorf("unknown ocsp mode '%s'; use %s, %s, or %s", mode, ocspStapled, ocspMustStaple, ocspCheck)
+}
+
+// loadCRLs reads the PEM or DER certificate revocation lists in path.
+func loadCRLs(path string) ([]*x509.RevocationList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ders [][]byte
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		for {
+			var block *pem.Block
+			if block, data = pem.Decode(data); block == nil {
+				break
+			}
+			if block.Type == "X509 CRL" {
+				ders = append(ders, block.Bytes)
+			}
+		}
+	} else {
+		ders = [][]byte{data}
+	}
+	if len(ders) == 0 {
+		return nil, fmt.Errorf("no CRLs found in crl_file '%s'", path)
+	}
+	crls := make([]*x509.RevocationList, 0, len(ders))
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return nil, fmt.Errorf("crl_file '%s': %v", path, err)
+		}
+		if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+			logWarn("crl_stale", "The CRL of '%s' in '%s' was due for an update on %s; revocations since then aren't known",
+				crl.Issuer.CommonName, path, crl.NextUpdate.UTC().Format(time.RFC3339))
+		}
+		crls = append(crls, crl)
+	}
+	return crls, nil
+}
+
+// brokerChain returns the broker's certificate chain, leaf first: the
+// verified one, or as presented when verification is skipped.
+func brokerChain(cs tls.ConnectionState) []*x509.Certificate {
+	if len(cs.VerifiedChains) > 0 {
+		return cs.VerifiedChains[0]
+	}
+	return cs.PeerCertificates
+}
+
+// verifyCRLs fails the handshake if a certificate in the broker's chain is
+// revoked by one of crls. The CRL of the broker certificate's issuer must
+// be among them, so a crl_file for the wrong CA doesn't pass silently.
+func verifyCRLs(crls []*x509.RevocationList) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		chain := brokerChain(cs)
+		if len(chain) < 2 {
+			return errors.New("crl_file: the broker's certificate issuer is unknown, so its revocation can't be checked")
+		}
+		covered := false
+		for i := 0; i+1 < len(chain); i++ {
+			cert, issuer := chain[i], chain[i+1]
+			for _, crl := range crls {
+				if !bytes.Equal(crl.RawIssuer, issuer.RawSubject) {
+					continue
+				}
+				if err := crl.CheckSignatureFrom(issuer); err != nil {
+					return fmt.Errorf("crl_file: the CRL of '%s' isn't signed by the broker's CA: %v", issuer.Subject.CommonName, err)
+				}
+				if i == 0 {
+					covered = true
+				}
+				for _, entry := range crl.RevokedCertificateEntries {
+					if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+						return fmt.Errorf("the broker's certificate '%s' (serial %X) was revoked on %s, according to the CRL of '%s'",
+							cert.Subject.CommonName, cert.SerialNumber, entry.RevocationTime.UTC().Format(time.RFC3339), issuer.Subject.CommonName)
+					}
+				}
+			}
+		}
+		if !covered {
+			return fmt.Errorf("crl_file has no CRL from '%s', which issued the broker's certificate", chain[1].Subject.CommonName)
+		}
+		return nil
+	}
+}
+
+// ASN.1 structures of OCSP (RFC 6960), as far as a client needs them.
+type ocspCertID struct {
+	HashAlgorithm  pkix.AlgorithmIdentifier
+	IssuerNameHash []byte
+	IssuerKeyHash  []byte
+	SerialNumber   *big.Int
+}
+
+type ocspRequest struct {
+	TBSRequest struct {
+		RequestList []struct {
+			CertID ocspCertID
+		}
+	}
+}
+
+type ocspResponse struct {
+	Status        asn1.Enumerated
+	ResponseBytes struct {
+		ResponseType asn1.ObjectIdentifier
+		Response     []byte
+	} `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData struct {
+		Raw         asn1.RawContent
+		Version     int `asn1:"optional,default:0,explicit,tag:0"`
+		ResponderID asn1.RawValue
+		ProducedAt  time.Time `asn1:"generalized"`
+		Responses   []ocspSingleResponse
+	}
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID  ocspCertID
+	Good    asn1.Flag `asn1:"tag:0,optional"`
+	Revoked struct {
+		RevocationTime time.Time       `asn1:"generalized"`
+		Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+	} `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag `asn1:"tag:2,optional"`
+	ThisUpdate time.Time `asn1:"generalized"`
+	NextUpdate time.Time `asn1:"generalized,explicit,tag:0,optional"`
+}
+
+var oidOCSPBasicResponse = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+// ocspSignatureAlgorithms maps the signature algorithms responders use.
+var ocspSignatureAlgorithms = map[string]x509.SignatureAlgorithm{
+	"1.2.840.113549.1.1.5":  x509.SHA1WithRSA,
+	"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+	"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+	"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+	"1.2.840.10045.4.1":     x509.ECDSAWithSHA1,
+	"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+	"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+	"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+	"1.3.101.112":           x509.PureEd25519,
+}
+
+// ocspStatus names the error statuses of an OCSP response.
+var ocspStatus = map[asn1.Enumerated]string{
+	1: "malformed request",
+	2: "internal error",
+	3: "try later",
+	5: "signature required",
+	6: "unauthorized",
+}
+
+// issuerHashes returns the hashes of issuer's name and public key that
+// identify it in a CertID.
+func issuerHashes(issuer *x509.Certificate, h func() hash.Hash) (name, key []byte, err error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, nil, err
+	}
+	nh, kh := h(), h()
+	nh.Write(issuer.RawSubject)
+	kh.Write(spki.PublicKey.RightAlign())
+	return nh.Sum(nil), kh.Sum(nil), nil
+}
+
+// ocspRequestFor builds the DER request for cert's status.
+func ocspRequestFor(cert, issuer *x509.Certificate) ([]byte, error) {
+	nameHash, keyHash, err := issuerHashes(issuer, sha1.New)
+	if err != nil {
+		return nil, err
+	}
+	var req ocspRequest
+	req.TBSRequest.RequestList = make([]struct{ CertID ocspCertID }, 1)
+	req.TBSRequest.RequestList[0].CertID = ocspCertID{
+		HashAlgorithm:  pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+		IssuerNameHash: nameHash,
+		IssuerKeyHash:  keyHash,
+		SerialNumber:   cert.SerialNumber,
+	}
+	return asn1.Marshal(req)
+}
+
+// certIDMatches reports whether id names cert as issued by issuer: the serial
+// and both issuer hashes must match, as RFC 6960 requires.
+func certIDMatches(id ocspCertID, cert, issuer *x509.Certificate) bool {
+	if id.SerialNumber == nil || id.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		return false
+	}
+	var h func() hash.Hash
+	switch alg := id.HashAlgorithm.Algorithm; {
+	case alg.Equal(oidSHA1):
+		h = sha1.New
+	case alg.Equal(oidSHA256):
+		h = sha256.New
+	case alg.Equal(oidSHA384):
+		h = sha512.New384
+	case alg.Equal(oidSHA512):
+		h = sha512.New
+	default:
+		return false
+	}
+	name, key, err := issuerHashes(issuer, h)
+	return err == nil && bytes.Equal(name, id.IssuerNameHash) && bytes.Equal(key, id.IssuerKeyHash)
+}
+
+// checkOCSPResponse checks a DER OCSP response about cert, returning when
+// it needs to be renewed, or an error if cert is revoked or the response
+// isn't a valid one from issuer or a responder it delegated to.
+func checkOCSPResponse(der []byte, cert, issuer *x509.Certificate) (time.Time, error) {
+	var resp ocspResponse
+	if rest, err := asn1.Unmarshal(der, &resp); err != nil || len(rest) > 0 {
+		return time.Time{}, errors.New("OCSP response is malformed")
+	}
+	if resp.Status != 0 {
+		return time.Time{}, fmt.Errorf("OCSP responder answered '%s'", ocspStatus[resp.Status])
+	}
+	if !resp.ResponseBytes.ResponseType.Equal(oidOCSPBasicResponse) {
+		return time.Time{}, errors.New("OCSP response is of an unsupported type")
+	}
+	var basic ocspBasicResponse
+	if _, err := asn1.Unmarshal(resp.ResponseBytes.Response, &basic); err != nil {
+		return time.Time{}, errors.New("OCSP response is malformed")
+	}
+	if err := checkOCSPSignature(&basic, issuer); err != nil {
+		return time.Time{}, err
+	}
+
+	now := time.Now()
+	for _, r := range basic.TBSResponseData.Responses {
+		if !certIDMatches(r.CertID, cert, issuer) {
+			continue
+		}
+		if r.ThisUpdate.After(now.Add(revocationSkew)) {
+			return time.Time{}, fmt.Errorf("OCSP response is dated %s, in the future", r.ThisUpdate.UTC().Format(time.RFC3339))
+		}
+		if !r.NextUpdate.IsZero() && r.NextUpdate.Before(now.Add(-revocationSkew)) {
+			return time.Time{}, fmt.Errorf("OCSP response expired on %s", r.NextUpdate.UTC().Format(time.RFC3339))
+		}
+		switch {
+		case bool(r.Good):
+			if r.NextUpdate.IsZero() {
+				return now.Add(time.Hour), nil
+			}
+			return r.NextUpdate, nil
+		case bool(r.Unknown):
+			return time.Time{}, fmt.Errorf("OCSP responder doesn't know the broker's certificate '%s'", cert.Subject.CommonName)
+		default:
+			return time.Time{}, fmt.Errorf("the broker's certificate '%s' (serial %X) was revoked on %s, according to OCSP",
+				cert.Subject.CommonName, cert.SerialNumber, r.Revoked.RevocationTime.UTC().Format(time.RFC3339))
+		}
+	}
+	return time.Time{}, fmt.Errorf("OCSP response doesn't cover the broker's certificate '%s'", cert.Subject.CommonName)
+}
+
+// checkOCSPSignature verifies that the response is signed by issuer, or by a
+// currently valid certificate issuer gave the OCSP signing usage.
+func checkOCSPSignature(basic *ocspBasicResponse, issuer *x509.Certificate) error {
+	algo, ok := ocspSignatureAlgorithms[basic.SignatureAlgorithm.Algorithm.String()]
+	if !ok {
+		return fmt.Errorf("OCSP response uses unsupported signature algorithm %s", basic.SignatureAlgorithm.Algorithm)
+	}
+	signed, sig := basic.TBSResponseData.Raw, basic.Signature.RightAlign()
+	if issuer.CheckSignature(algo, signed, sig) == nil {
+		return nil
+	}
+	now := time.Now()
+	for _, raw := range basic.Certificates {
+		responder, err := x509.ParseCertificate(raw.FullBytes)
+		if err != nil || responder.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		delegated := false
+		for _, usage := range responder.ExtKeyUsage {
+			delegated = delegated || usage == x509.ExtKeyUsageOCSPSigning
+		}
+		if !delegated || responder.CheckSignature(algo, signed, sig) != nil {
+			continue
+		}
+		if now.Before(responder.NotBefore) || now.After(responder.NotAfter) {
+			return fmt.Errorf("OCSP responder certificate '%s' is only valid from %s to %s", responder.Subject.CommonName,
+				responder.NotBefore.UTC().Format(time.RFC3339), responder.NotAfter.UTC().Format(time.RFC3339))
+		}
+		return nil
+	}
+	return fmt.Errorf("OCSP response isn't signed by '%s' or a responder it authorized", issuer.Subject.CommonName)
+}
+
+// ocspCache keeps good responses from responders by certificate serial
+// until they are due for renewal, so reconnects don't query each time.
+var ocspCache = struct {
+	sync.Mutex
+	until map[string]time.Time
+}{until: map[string]time.Time{}}
+
+// queryOCSP asks cert's OCSP responder for its status.
+func queryOCSP(cert, issuer *x509.Certificate) error {
+	key := string(issuer.RawSubject) + cert.SerialNumber.String()
+	ocspCache.Lock()
+	until := ocspCache.until[key]
+	ocspCache.Unlock()
+	if time.Now().Before(until) {
+		return nil
+	}
+	if len(cert.OCSPServer) == 0 {
+		return fmt.Errorf("the broker's certificate '%s' names no OCSP responder", cert.Subject.CommonName)
+	}
+	req, err := ocspRequestFor(cert, issuer)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: ocspTimeout}
+	resp, err := client.Post(cert.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return fmt.Errorf("OCSP query failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("OCSP query failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("OCSP query to %s failed: %s", cert.OCSPServer[0], resp.Status)
+	}
+	if until, err = checkOCSPResponse(body, cert, issuer); err != nil {
+		return err
+	}
+	ocspCache.Lock()
+	ocspCache.until[key] = until
+	ocspCache.Unlock()
+	return nil
+}
+
+// verifyOCSP fails the handshake if OCSP says the broker's certificate is
+// revoked, as stapled by the broker or, in check mode, from the responder.
+func verifyOCSP(mode string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		chain := brokerChain(cs)
+		if len(chain) < 2 {
+			return errors.New("ocsp: the broker's certificate issuer is unknown, so its revocation can't be checked")
+		}
+		cert, issuer := chain[0], chain[1]
+		if len(cs.OCSPResponse) > 0 {
+			_, err := checkOCSPResponse(cs.OCSPResponse, cert, issuer)
+			return err
+		}
+		switch mode {
+		case ocspMustStaple:
+			return errors.New("the broker stapled no OCSP response, which ocsp must-staple requires")
+		case ocspCheck:
+			return queryOCSP(cert, issuer)
+		}
+		return nil
+	}
+}
+
+// chainVerifiers runs each check in turn, as one VerifyConnection function.
+func chainVerifiers(checks []func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	switch len(checks) {
+	case 0:
+		return nil
+	case 1:
+		return checks[0]
+	}
+	return func(cs tls.ConnectionState) error {
+		for _, check := range checks {
+			if err := check(cs); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,63 @@
+// rewrite.go
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// TopicRewrite maps topics matching a regular expression to a new topic.
+// Replace may reference capture groups as $1 or ${name}.
+type TopicRewrite struct {
+	Match   string `json:"match"`   // e.g. "^iot/gnss/(.+)/data$"
+	Replace string `json:"replace"` // e.g. "fleet/${1}/position"
+}
+
+// parseTopicRewrite parses a rule written as "MATCH=>REPLACE".
+func parseTopicRewrite(s string) (TopicRewrite, error) {
+	match, replace, ok := strings.Cut(s, "=>")
+	if !ok || match == "" {
+		return TopicRewrite{}, fmt.Errorf("invalid rewrite rule '%s', expected 'MATCH=>REPLACE'", s)
+	}
+	return TopicRewrite{Match: match, Replace: replace}, nil
+}
+
+type compiledRewrite struct {
+	re      *regexp.Regexp
+	replace string
+}
+
+// topicRewriter applies the first matching rule to a topic.
+type topicRewriter struct {
+	rules []compiledRewrite
+}
+
+// newTopicRewriter compiles the rules in order. A nil rewriter leaves topics unchanged.
+func newTopicRewriter(rules []TopicRewrite) (*topicRewriter, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	rw := &topicRewriter{}
+	for _, r := range rules {
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite pattern '%s': %v", r.Match, err)
+		}
+		rw.rules = append(rw.rules, compiledRewrite{re: re, replace: r.Replace})
+	}
+	return rw, nil
+}
+
+// Rewrite returns topic rewritten by the first matching rule, or topic itself.
+func (rw *topicRewriter) Rewrite(topic string) string {
+	if rw == nil {
+		return topic
+	}
+	for _, r := range rw.rules {
+		if m := r.re.FindStringSubmatchIndex(topic); m != nil {
+			return string(r.re.ExpandString(nil, r.replace, topic, m))
+		}
+	}
+	return topic
+}
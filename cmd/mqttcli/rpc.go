@@ -0,0 +1,187 @@
+// rpc.go
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// defaultRPCTimeout is how long rpc waits for the response by default.
+const defaultRPCTimeout = 10 * time.Second
+
+// rpcRequest is one request sent by "mqttcli rpc" and how to recognize its
+// response.
+type rpcRequest struct {
+	topic            string
+	responseTopic    string
+	correlationID    string
+	correlationField string // JSON field holding the correlation ID (MQTT 3)
+	replyField       string // JSON field naming the response topic (MQTT 3); empty leaves the payload alone
+}
+
+// newCorrelationID returns a random ID for matching a response to its request.
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// embed adds the response topic and correlation ID to a JSON object payload,
+// for MQTT 3 responders, which have no properties to find them in.
+func (r *rpcRequest) embed(payload []byte) ([]byte, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return nil, fmt.Errorf("--reply-field needs a JSON object payload: %v", err)
+	}
+	doc[r.replyField] = r.responseTopic
+	doc[r.correlationField] = r.correlationID
+	return json.Marshal(doc)
+}
+
+// matches reports whether msg answers r. A response carrying correlation data
+// (MQTT 5) or a correlation field (MQTT 3) must carry r's ID; others are
+// accepted, since the response topic alone may identify the request.
+func (r *rpcRequest) matches(msg mqtt.Message) bool {
+	if p := messagePropertiesOf(msg); p != nil && p.CorrelationData != "" {
+		return p.CorrelationData == r.correlationID
+	}
+	if r.correlationField != "" {
+		if v, ok := lookupJSONField(msg.Payload(), r.correlationField); ok {
+			return fmt.Sprint(v) == r.correlationID
+		}
+	}
+	return true
+}
+
+// runRPC implements "mqttcli rpc": it publishes a request and waits for the
+// response. MQTT 5 requests carry the response topic and correlation data as
+// properties; with MQTT 3, --reply-field embeds them in the JSON payload.
+func runRPC(args []string) {
+	fs := flag.NewFlagSet("rpc", flag.ExitOnError)
+	flags := initCLIFlags(fs)
+	var message, file string
+	fs.StringVar(&message, "message", "", "Request payload.")
+	fs.StringVar(&message, "m", "", "Same as --message (mosquitto compatible).")
+	fs.StringVar(&file, "file", "", "Send the contents of this file as the request ('-' for stdin).")
+	fs.StringVar(&file, "f", "", "Same as --file (mosquitto compatible).")
+	responseTopic := fs.String("response-topic", "", "Topic to wait for the response on (default TOPIC/response).")
+	replyField := fs.String("reply-field", "", "MQTT 3: add the response topic to the JSON request under this field, e.g. 'reply_to'.")
+	correlationField := fs.String("correlation-field", "correlation_id", "MQTT 3: JSON field holding the correlation ID in requests (with --reply-field) and responses.")
+	fs.DurationVar(&flags.Timeout, "timeout", 0, "Exit with status 4 if no response arrives within this long (default 10s).")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s rpc [options] [--message TEXT | --file FILE]\n\n"+
+			"The request is read from stdin when neither --message nor --file is given.\n\nExample:\n"+
+			"  %s rpc --protocol 5 --topic devices/42/cmd -m '{\"cmd\":\"reboot\"}'\n\nOptions:\n",
+			filepath.Base(os.Args[0]), filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	messageSet := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "message" || f.Name == "m" {
+			messageSet = true
+		}
+	})
+
+	cfg := buildConfig(flags)
+	refuseReadOnly(&cfg, "rpc")
+	cfg.Reconstruct = false // for subscribing; it adds the delta topics
+	if cfg.ShareGroup != "" {
+		fatal("config_invalid", false, "rpc can't use share_group.")
+	}
+	topics := cfg.subscriptions()
+	if len(topics) != 1 {
+		fatal("config_invalid", false, "rpc needs exactly one topic, got %d.", len(topics))
+	}
+	for topic, qos := range topics {
+		cfg.Topic, cfg.Topics, cfg.QoS = topic, nil, qos
+	}
+	if hasWildcard(cfg.Topic) {
+		fatal("config_invalid", false, "Can't send a request to '%s', which contains a wildcard.", cfg.Topic)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = Duration(defaultRPCTimeout)
+	}
+
+	req := &rpcRequest{
+		topic:            cfg.Topic,
+		responseTopic:    *responseTopic,
+		correlationID:    cfg.CorrelationData,
+		correlationField: *correlationField,
+		replyField:       *replyField,
+	}
+	if req.responseTopic == "" {
+		req.responseTopic = cfg.Topic + "/response"
+	}
+	if req.correlationID == "" {
+		req.correlationID = newCorrelationID()
+	}
+	payload, err := readPublishPayload(message, messageSet, file)
+	if err != nil {
+		fatal("config_invalid", false, "Could not read request: %v", err)
+	}
+	if cfg.Protocol == 5 {
+		cfg.ResponseTopic, cfg.CorrelationData = req.responseTopic, req.correlationID
+	} else if req.replyField != "" {
+		if payload, err = req.embed(payload); err != nil {
+			fatal("config_invalid", false, "%v", err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	client, setupCtx, cancelSetup := connectWithBudget(ctx, &cfg)
+	defer cancelSetup()
+	defer client.Disconnect(250)
+
+	// Subscribe before sending, so a quick response isn't missed
+	responses := make(chan mqtt.Message, 16)
+	respCfg := cfg
+	respCfg.Topic = req.responseTopic
+	err = subscribeToTopic(setupCtx, client, &respCfg, func(c mqtt.Client, msg mqtt.Message) {
+		if req.matches(msg) {
+			select {
+			case responses <- msg:
+			default:
+			}
+		}
+	})
+	if err != nil {
+		client.Disconnect(0)
+		exitSetupFailure(ctx, setupCtx, &respCfg, "subscribe", err, "Failed to subscribe to response topic '%s': %v", req.responseTopic, err)
+	}
+	cancelSetup()
+
+	sent := time.Now()
+	token := client.Publish(req.topic, cfg.QoS, false, payload)
+	if err := waitToken(ctx, token, defaultPublishTimeout, "publish"); err != nil {
+		client.Disconnect(0)
+		fatal(phaseErrorCode("publish", err), isRetryable(err), "Failed to send request to '%s': %v", req.topic, err)
+	}
+	logInfo("rpc_sent", "Sent request %s to '%s'; waiting for the response on '%s'", req.correlationID, req.topic, req.responseTopic)
+
+	select {
+	case msg := <-responses:
+		logInfo("rpc_response", "Response after %s", time.Since(sent).Round(time.Millisecond))
+		messageHandler(&cfg, nil, nil, nil)(client, msg)
+	case <-time.After(time.Duration(cfg.Timeout)):
+		client.Disconnect(0)
+		fatalStatus(exitNoMessages, "rpc_timeout", true, "No response to request %s on '%s' within %s.",
+			req.correlationID, req.responseTopic, time.Duration(cfg.Timeout))
+	case <-ctx.Done():
+		client.Disconnect(0)
+		fatalStatus(exitNoMessages, "rpc_interrupted", false, "Interrupted before a response to request %s arrived.", req.correlationID)
+	}
+}
@@ -0,0 +1,53 @@
+// sanitize.go
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// sanitizeForTerminal makes untrusted text safe to print: control characters
+// (including ESC, so ANSI sequences can't recolor or rewrite the terminal),
+// bidirectional overrides, and invalid UTF-8 are shown as visible escapes.
+// Newlines and tabs are kept.
+func sanitizeForTerminal(s string) string {
+	if isTerminalSafe(s) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&b, `\x%02x`, s[i])
+		case r == '\n' || r == '\t':
+			b.WriteRune(r)
+		case r < 0x80 && unicode.IsControl(r):
+			fmt.Fprintf(&b, `\x%02x`, r)
+		case unicode.IsControl(r) || isBidiControl(r):
+			fmt.Fprintf(&b, `\u%04x`, r)
+		default:
+			b.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// isTerminalSafe is the fast path for the common case of clean text.
+func isTerminalSafe(s string) bool {
+	for _, r := range s {
+		if r == utf8.RuneError || (unicode.IsControl(r) && r != '\n' && r != '\t') || isBidiControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// isBidiControl reports Unicode bidirectional embedding, override, and isolate
+// characters, which can make printed text read differently from its bytes.
+func isBidiControl(r rune) bool {
+	return (r >= 0x202A && r <= 0x202E) || (r >= 0x2066 && r <= 0x2069)
+}
@@ -0,0 +1,756 @@
+// selftest.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	packets5 "github.com/eclipse/paho.golang/packets"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/gorilla/websocket"
+)
+
+// selfTestTimeout bounds each self-test check.
+const selfTestTimeout = 10 * time.Second
+
+// selfTestBroker is a minimal in-process MQTT 3.1.1 and 5 broker for
+// "mqttcli selftest": clean and persistent sessions, QoS 0 to 2, and retained
+// messages, without authentication. Persistent sessions last until the broker
+// stops, and messages left unacknowledged when a client goes away are not sent
+// again. It is just enough to exercise mqttcli's own client paths.
+type selfTestBroker struct {
+	mu       sync.Mutex
+	sessions map[string]*selfTestSession // by client ID
+	retained map[string]selfTestMessage
+	lastID   int // for clients that leave the client ID to the broker
+}
+
+// selfTestMessage is a message routed by a selfTestBroker.
+type selfTestMessage struct {
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+}
+
+// selfTestSession is what the broker keeps for one client ID; b.mu guards it.
+type selfTestSession struct {
+	id      string
+	subs    map[string]byte
+	persist bool          // outlives the connection: CleanSession=false, or a v5 session expiry
+	conn    *selfTestConn // nil while the client is away
+	queued  []selfTestMessage
+}
+
+// selfTestConn is one client connection to a selfTestBroker.
+type selfTestConn struct {
+	conn    net.Conn
+	version byte // protocol level from the CONNECT
+	session *selfTestSession
+	wmu     sync.Mutex
+
+	mu     sync.Mutex
+	nextID uint16
+}
+
+func newSelfTestBroker() *selfTestBroker {
+	return &selfTestBroker{sessions: map[string]*selfTestSession{}, retained: map[string]selfTestMessage{}}
+}
+
+func (c *selfTestConn) write(p packets.ControlPacket) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return p.Write(c.conn)
+}
+
+func (c *selfTestConn) write5(p io.WriterTo) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := p.WriteTo(c.conn)
+	return err
+}
+
+func (b *selfTestBroker) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+// handle serves one connection in the protocol version of its CONNECT.
+func (b *selfTestBroker) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	frame, err := readFrame(r, proxyMaxPacketSize)
+	if err != nil {
+		return
+	}
+	c := &selfTestConn{conn: conn, version: connectVersion(frame)}
+	if c.version == 5 {
+		b.handleV5(c, r, frame)
+	} else {
+		b.handleV3(c, r, frame)
+	}
+}
+
+// openSession finds or starts the session for clientID, taking it over from
+// any connection still holding it, and reports whether it existed already.
+// An empty clientID gets one assigned.
+func (b *selfTestBroker) openSession(c *selfTestConn, clientID string, clean, persist bool) (*selfTestSession, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if clientID == "" {
+		b.lastID++
+		clientID = fmt.Sprintf("selftest-assigned-%d", b.lastID)
+	}
+	s, present := b.sessions[clientID]
+	if present && s.conn != nil {
+		s.conn.conn.Close()
+		s.conn = nil
+	}
+	if !present || clean {
+		s, present = &selfTestSession{id: clientID, subs: map[string]byte{}}, false
+		b.sessions[clientID] = s
+	}
+	s.persist = persist
+	c.session = s
+	return s, present
+}
+
+// attach makes c the connection of its session once the CONNACK is out, and
+// sends it the messages queued while the client was away.
+func (b *selfTestBroker) attach(c *selfTestConn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := c.session
+	s.conn = c
+	for _, m := range s.queued {
+		c.send(m, m.qos, false)
+	}
+	s.queued = nil
+}
+
+// detach ends c's hold on its session, dropping the session unless it
+// persists.
+func (b *selfTestBroker) detach(c *selfTestConn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := c.session
+	if s.conn != c {
+		return // taken over
+	}
+	s.conn = nil
+	if !s.persist && b.sessions[s.id] == s {
+		delete(b.sessions, s.id)
+	}
+}
+
+// waitAway waits until the session of clientID has no connection, so
+// messages published from then on are queued for it.
+func (b *selfTestBroker) waitAway(ctx context.Context, clientID string) error {
+	for {
+		b.mu.Lock()
+		s := b.sessions[clientID]
+		away := s != nil && s.conn == nil
+		b.mu.Unlock()
+		if away {
+			return nil
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			return fmt.Errorf("the broker still sees '%s' connected", clientID)
+		}
+	}
+}
+
+func (b *selfTestBroker) subscribe(c *selfTestConn, filters []string, qoss []byte) {
+	b.mu.Lock()
+	for i, filter := range filters {
+		c.session.subs[filter] = qoss[i]
+	}
+	b.mu.Unlock()
+	b.sendRetained(c, filters, qoss)
+}
+
+func (b *selfTestBroker) unsubscribe(c *selfTestConn, filters []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, filter := range filters {
+		delete(c.session.subs, filter)
+	}
+}
+
+func (b *selfTestBroker) handleV3(c *selfTestConn, r io.Reader, frame []byte) {
+	cp, err := packets.ReadPacket(bytes.NewReader(frame))
+	if err != nil {
+		return
+	}
+	connect, ok := cp.(*packets.ConnectPacket)
+	if !ok {
+		return
+	}
+	ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	if ack.ReturnCode = connect.Validate(); ack.ReturnCode != packets.Accepted {
+		c.write(ack)
+		return
+	}
+	_, ack.SessionPresent = b.openSession(c, connect.ClientIdentifier, connect.CleanSession, !connect.CleanSession)
+	defer b.detach(c)
+	if err := c.write(ack); err != nil {
+		return
+	}
+	b.attach(c)
+
+	for {
+		cp, err := packets.ReadPacket(r)
+		if err != nil {
+			return
+		}
+		switch p := cp.(type) {
+		case *packets.SubscribePacket:
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID, ack.ReturnCodes = p.MessageID, p.Qoss
+			c.write(ack)
+			b.subscribe(c, p.Topics, p.Qoss)
+		case *packets.UnsubscribePacket:
+			b.unsubscribe(c, p.Topics)
+			ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ack.MessageID = p.MessageID
+			c.write(ack)
+		case *packets.PublishPacket:
+			switch p.Qos {
+			case 1:
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				c.write(ack)
+			case 2:
+				rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				rec.MessageID = p.MessageID
+				c.write(rec)
+			}
+			b.route(selfTestMessage{p.TopicName, p.Payload, p.Qos, p.Retain})
+		case *packets.PubrelPacket:
+			comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			comp.MessageID = p.MessageID
+			c.write(comp)
+		case *packets.PubrecPacket:
+			rel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+			rel.MessageID = p.MessageID
+			c.write(rel)
+		case *packets.PingreqPacket:
+			c.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func (b *selfTestBroker) handleV5(c *selfTestConn, r io.Reader, frame []byte) {
+	cp, err := packets5.ReadPacket(bytes.NewReader(frame))
+	if err != nil {
+		return
+	}
+	connect, ok := cp.Content.(*packets5.Connect)
+	if !ok {
+		return
+	}
+	persist := connect.Properties != nil && connect.Properties.SessionExpiryInterval != nil && *connect.Properties.SessionExpiryInterval > 0
+	ackPacket := packets5.NewControlPacket(packets5.CONNACK)
+	ack := ackPacket.Content.(*packets5.Connack)
+	var s *selfTestSession
+	s, ack.SessionPresent = b.openSession(c, connect.ClientID, connect.CleanStart, persist)
+	defer b.detach(c)
+	if connect.ClientID == "" {
+		ack.Properties.AssignedClientID = s.id
+	}
+	if err := c.write5(ackPacket); err != nil {
+		return
+	}
+	b.attach(c)
+
+	for {
+		cp, err := packets5.ReadPacket(r)
+		if err != nil {
+			return
+		}
+		reply := func(t byte, fill func(*packets5.ControlPacket)) {
+			out := packets5.NewControlPacket(t)
+			fill(out)
+			c.write5(out)
+		}
+		switch p := cp.Content.(type) {
+		case *packets5.Subscribe:
+			var filters []string
+			var qoss []byte
+			for _, o := range p.Subscriptions {
+				filters, qoss = append(filters, o.Topic), append(qoss, o.QoS)
+			}
+			reply(packets5.SUBACK, func(out *packets5.ControlPacket) {
+				ack := out.Content.(*packets5.Suback)
+				ack.PacketID, ack.Reasons = p.PacketID, qoss
+			})
+			b.subscribe(c, filters, qoss)
+		case *packets5.Unsubscribe:
+			b.unsubscribe(c, p.Topics)
+			reply(packets5.UNSUBACK, func(out *packets5.ControlPacket) {
+				ack := out.Content.(*packets5.Unsuback)
+				ack.PacketID, ack.Reasons = p.PacketID, make([]byte, len(p.Topics))
+			})
+		case *packets5.Publish:
+			switch p.QoS {
+			case 1:
+				reply(packets5.PUBACK, func(out *packets5.ControlPacket) { out.Content.(*packets5.Puback).PacketID = p.PacketID })
+			case 2:
+				reply(packets5.PUBREC, func(out *packets5.ControlPacket) { out.Content.(*packets5.Pubrec).PacketID = p.PacketID })
+			}
+			b.route(selfTestMessage{p.Topic, p.Payload, p.QoS, p.Retain})
+		case *packets5.Pubrel:
+			reply(packets5.PUBCOMP, func(out *packets5.ControlPacket) { out.Content.(*packets5.Pubcomp).PacketID = p.PacketID })
+		case *packets5.Pubrec:
+			reply(packets5.PUBREL, func(out *packets5.ControlPacket) { out.Content.(*packets5.Pubrel).PacketID = p.PacketID })
+		case *packets5.Pingreq:
+			reply(packets5.PINGRESP, func(*packets5.ControlPacket) {})
+		case *packets5.Disconnect:
+			return
+		}
+	}
+}
+
+// send delivers m to c with the given QoS and retain flag.
+func (c *selfTestConn) send(m selfTestMessage, qos byte, retain bool) {
+	var id uint16
+	if qos > 0 {
+		c.mu.Lock()
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		id = c.nextID
+		c.mu.Unlock()
+	}
+	if c.version == 5 {
+		c.write5(&packets5.Publish{Topic: m.topic, Payload: m.payload, QoS: qos, Retain: retain, PacketID: id, Properties: &packets5.Properties{}})
+		return
+	}
+	out := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	out.TopicName, out.Payload, out.Qos, out.Retain, out.MessageID = m.topic, m.payload, qos, retain, id
+	c.write(out)
+}
+
+// route stores retained messages and hands m to every matching session at
+// the lower of the publish and subscription QoS, queueing QoS 1 and 2 for
+// persistent sessions whose client is away.
+func (b *selfTestBroker) route(m selfTestMessage) {
+	type delivery struct {
+		c   *selfTestConn
+		qos byte
+	}
+	var deliveries []delivery
+	b.mu.Lock()
+	if m.retain {
+		if len(m.payload) == 0 {
+			delete(b.retained, m.topic)
+		} else {
+			b.retained[m.topic] = m
+		}
+	}
+	for _, s := range b.sessions {
+		matched, best := false, byte(0)
+		for filter, qos := range s.subs {
+			if topicMatches(filter, m.topic) {
+				matched, best = true, max(best, qos)
+			}
+		}
+		switch qos := min(best, m.qos); {
+		case !matched:
+		case s.conn != nil:
+			deliveries = append(deliveries, delivery{s.conn, qos})
+		case s.persist && qos > 0:
+			s.queued = append(s.queued, selfTestMessage{m.topic, m.payload, qos, false})
+		}
+	}
+	b.mu.Unlock()
+
+	for _, d := range deliveries {
+		d.c.send(m, d.qos, false)
+	}
+}
+
+func (b *selfTestBroker) sendRetained(c *selfTestConn, filters []string, qoss []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for topic, m := range b.retained {
+		for i, filter := range filters {
+			if topicMatches(filter, topic) {
+				c.send(m, min(qoss[i], m.qos), true)
+				break
+			}
+		}
+	}
+}
+
+// dropAll closes every client connection, as a broker restart would.
+func (b *selfTestBroker) dropAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range b.sessions {
+		if s.conn != nil {
+			s.conn.conn.Close()
+		}
+	}
+}
+
+// serveWebSocket accepts MQTT over WebSocket on path and hands the connections
+// to the broker.
+func (b *selfTestBroker) serveWebSocket(ln net.Listener, path string) {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"mqtt"}}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+		ws, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		b.handle(&wsConn{Conn: ws})
+	})
+	(&http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}).Serve(ln)
+}
+
+// selfTestCertificate returns a fresh self-signed certificate for 127.0.0.1
+// and localhost, and its PEM to trust as the CA.
+func selfTestCertificate() (tls.Certificate, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "mqttcli selftest"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().AddDate(1, 0, 0), // well past the expiry warning window
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	cert, err := tls.X509KeyPair(certPEM, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	return cert, string(certPEM), err
+}
+
+// selfTestConfig returns the client config for one check against broker.
+func selfTestConfig(broker, clientID string) Config {
+	return Config{
+		BrokerURL:         broker,
+		ClientID:          clientID,
+		ConnectTimeout:    Duration(5 * time.Second),
+		SubscribeTimeout:  Duration(5 * time.Second),
+		ConnectAttempts:   1,
+		ReconnectDelay:    Duration(200 * time.Millisecond),
+		ReconnectMaxDelay: Duration(time.Second),
+		NoAdapt:           true, // don't cache the limits of a broker that is gone after the test
+	}
+}
+
+// selfTestRoundTrip connects with cfg, subscribes to topic, publishes payload,
+// and checks it comes back intact with the expected QoS.
+func selfTestRoundTrip(ctx context.Context, cfg Config, topic string, qos byte, payload []byte) error {
+	client, err := connectReconnecting(ctx, &cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(0)
+	got := make(chan mqtt.Message, 1)
+	cfg.Topic, cfg.QoS = topic, qos
+	if err := subscribeToTopic(ctx, client, &cfg, func(c mqtt.Client, msg mqtt.Message) {
+		select {
+		case got <- msg:
+		default:
+		}
+	}); err != nil {
+		return err
+	}
+	if err := waitToken(ctx, client.Publish(topic, qos, false, payload), defaultPublishTimeout, "publish"); err != nil {
+		return err
+	}
+	select {
+	case msg := <-got:
+		switch {
+		case !bytes.Equal(msg.Payload(), payload):
+			return fmt.Errorf("payload changed in transit (%d bytes sent, %d received)", len(payload), len(msg.Payload()))
+		case msg.Qos() != qos:
+			return fmt.Errorf("received with QoS %d, published with QoS %d", msg.Qos(), qos)
+		}
+		return nil
+	case <-ctx.Done():
+		return errors.New("published message never arrived")
+	}
+}
+
+// selfTestCheck is one end-to-end check.
+type selfTestCheck struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// selfTestChecks returns the checks to run against the embedded broker's
+// listeners.
+func selfTestChecks(b *selfTestBroker, tcpURL, tlsURL, wsURL, tunnelURL, caPEM string) []selfTestCheck {
+	text := []byte("hello from mqttcli selftest")
+	binary := make([]byte, 256<<10)
+	rand.Read(binary)
+	return []selfTestCheck{
+		{"TCP connect, QoS 0 publish and subscribe", func(ctx context.Context) error {
+			return selfTestRoundTrip(ctx, selfTestConfig(tcpURL, "selftest-qos0"), "selftest/qos0", 0, text)
+		}},
+		{"QoS 1 publish and subscribe", func(ctx context.Context) error {
+			return selfTestRoundTrip(ctx, selfTestConfig(tcpURL, "selftest-qos1"), "selftest/qos1", 1, text)
+		}},
+		{"QoS 2 publish and subscribe", func(ctx context.Context) error {
+			return selfTestRoundTrip(ctx, selfTestConfig(tcpURL, "selftest-qos2"), "selftest/qos2", 2, text)
+		}},
+		{"256 KiB binary payload", func(ctx context.Context) error {
+			return selfTestRoundTrip(ctx, selfTestConfig(tcpURL, "selftest-binary"), "selftest/binary", 1, binary)
+		}},
+		{"Retained message on subscribe", func(ctx context.Context) error {
+			cfg := selfTestConfig(tcpURL, "selftest-retain-pub")
+			pub, err := connectReconnecting(ctx, &cfg)
+			if err != nil {
+				return err
+			}
+			err = waitToken(ctx, pub.Publish("selftest/retained", 1, true, text), defaultPublishTimeout, "publish")
+			pub.Disconnect(0)
+			if err != nil {
+				return err
+			}
+			cfg = selfTestConfig(tcpURL, "selftest-retain-sub")
+			cfg.Topic = "selftest/#"
+			sub, err := connectReconnecting(ctx, &cfg)
+			if err != nil {
+				return err
+			}
+			defer sub.Disconnect(0)
+			got := make(chan mqtt.Message, 1)
+			if err := subscribeToTopic(ctx, sub, &cfg, func(c mqtt.Client, msg mqtt.Message) {
+				select {
+				case got <- msg:
+				default:
+				}
+			}); err != nil {
+				return err
+			}
+			select {
+			case msg := <-got:
+				if !msg.Retained() || !bytes.Equal(msg.Payload(), text) {
+					return fmt.Errorf("got '%s' with retain=%t instead of the retained message", msg.Payload(), msg.Retained())
+				}
+				return nil
+			case <-ctx.Done():
+				return errors.New("retained message never arrived")
+			}
+		}},
+		{"MQTT v5 publish and subscribe", func(ctx context.Context) error {
+			cfg := selfTestConfig(tcpURL, "selftest-v5")
+			cfg.Protocol = 5
+			return selfTestRoundTrip(ctx, cfg, "selftest/v5", 1, text)
+		}},
+		{"Persistent session delivers a QoS 1 message queued while offline", func(ctx context.Context) error {
+			cfg := selfTestConfig(tcpURL, "selftest-session")
+			cfg.Protocol, cfg.SessionExpiry = 5, Duration(time.Minute)
+			cfg.Topic, cfg.QoS = "selftest/session", 1
+			client, err := connectReconnecting(ctx, &cfg)
+			if err != nil {
+				return err
+			}
+			err = subscribeToTopic(ctx, client, &cfg, func(mqtt.Client, mqtt.Message) {})
+			client.Disconnect(0)
+			if err != nil {
+				return err
+			}
+			if err := b.waitAway(ctx, cfg.ClientID); err != nil {
+				return err
+			}
+			pubCfg := selfTestConfig(tcpURL, "selftest-session-pub")
+			pub, err := connectReconnecting(ctx, &pubCfg)
+			if err != nil {
+				return err
+			}
+			err = waitToken(ctx, pub.Publish(cfg.Topic, 1, false, text), defaultPublishTimeout, "publish")
+			pub.Disconnect(0)
+			if err != nil {
+				return err
+			}
+
+			// The broker sends the queued message right after the CONNACK; give
+			// it time to arrive before the subscription is made again, as it
+			// would over a slower link
+			client, err = connectReconnecting(ctx, &cfg)
+			if err != nil {
+				return err
+			}
+			defer client.Disconnect(0)
+			time.Sleep(100 * time.Millisecond)
+			got := make(chan mqtt.Message, 1)
+			if err := subscribeToTopic(ctx, client, &cfg, func(c mqtt.Client, msg mqtt.Message) {
+				select {
+				case got <- msg:
+				default:
+				}
+			}); err != nil {
+				return err
+			}
+			select {
+			case msg := <-got:
+				if !bytes.Equal(msg.Payload(), text) || msg.Qos() != 1 {
+					return fmt.Errorf("got '%s' with QoS %d instead of the queued message", msg.Payload(), msg.Qos())
+				}
+				return nil
+			case <-ctx.Done():
+				return errors.New("queued message never arrived")
+			}
+		}},
+		{"TLS (ssl://) with certificate verification", func(ctx context.Context) error {
+			cfg := selfTestConfig(tlsURL, "selftest-tls")
+			cfg.CAPEM = caPEM
+			return selfTestRoundTrip(ctx, cfg, "selftest/tls", 1, text)
+		}},
+		{"WebSocket (ws://)", func(ctx context.Context) error {
+			return selfTestRoundTrip(ctx, selfTestConfig(wsURL, "selftest-ws"), "selftest/ws", 1, text)
+		}},
+		{"HTTP tunnel (http://) through the relay", func(ctx context.Context) error {
+			return selfTestRoundTrip(ctx, selfTestConfig(tunnelURL, "selftest-tunnel"), "selftest/tunnel", 1, text)
+		}},
+		{"Reconnect and resubscribe after the broker drops the connection", func(ctx context.Context) error {
+			cfg := selfTestConfig(tcpURL, "selftest-reconnect")
+			cfg.Topic, cfg.QoS = "selftest/reconnect", 1
+			client, err := connectReconnecting(ctx, &cfg)
+			if err != nil {
+				return err
+			}
+			defer client.Disconnect(0)
+			got := make(chan struct{}, 1)
+			if err := subscribeToTopic(ctx, client, &cfg, func(c mqtt.Client, msg mqtt.Message) {
+				select {
+				case got <- struct{}{}:
+				default:
+				}
+			}); err != nil {
+				return err
+			}
+			b.dropAll()
+			pubCfg := selfTestConfig(tcpURL, "selftest-reconnect-pub")
+			pub, err := connectReconnecting(ctx, &pubCfg)
+			if err != nil {
+				return err
+			}
+			defer pub.Disconnect(0)
+			// Keep publishing until the resubscribed client gets one
+			tick := time.NewTicker(200 * time.Millisecond)
+			defer tick.Stop()
+			for {
+				select {
+				case <-got:
+					return nil
+				case <-tick.C:
+					pub.Publish(cfg.Topic, 1, false, text)
+				case <-ctx.Done():
+					return errors.New("no message arrived after reconnecting")
+				}
+			}
+		}},
+	}
+}
+
+// runSelfTest implements "mqttcli selftest": it starts an embedded broker on
+// loopback listeners and runs mqttcli's client paths against it end to end.
+func runSelfTest(args []string) {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	output := fs.String("output", "", "Output format: 'text' (default) or 'json' for structured records on stderr.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s selftest [options]\n\n"+
+			"Runs an embedded MQTT 3.1.1 and 5 broker on 127.0.0.1 and checks connecting, QoS 0-2,\n"+
+			"retained messages, MQTT v5, persistent sessions, TLS, WebSocket, the HTTP tunnel,\n"+
+			"and reconnecting against it.\n"+
+			"Exits with status 1 if any check fails.\n\nOptions:\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	jsonEvents = *output == outputJSON
+
+	b := newSelfTestBroker()
+	listen := func() net.Listener {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			fatal("selftest_failed", false, "Could not start the embedded broker: %v", err)
+		}
+		return ln
+	}
+	cert, caPEM, err := selfTestCertificate()
+	if err != nil {
+		fatal("selftest_failed", false, "Could not create a test certificate: %v", err)
+	}
+	tcpLn, tlsLn, wsLn, tunnelLn := listen(), listen(), listen(), listen()
+	defer tcpLn.Close()
+	defer tlsLn.Close()
+	defer wsLn.Close()
+	defer tunnelLn.Close()
+	go b.serve(tcpLn)
+	go b.serve(tls.NewListener(tlsLn, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}))
+	go b.serveWebSocket(wsLn, "/mqtt")
+	relay := &tunnelRelay{broker: tcpLn.Addr().String(), sessions: make(map[string]*tunnelSession)}
+	go (&http.Server{Handler: relay, ReadHeaderTimeout: 10 * time.Second}).Serve(tunnelLn)
+
+	checks := selfTestChecks(b,
+		"tcp://"+tcpLn.Addr().String(), "ssl://"+tlsLn.Addr().String(),
+		"ws://"+wsLn.Addr().String()+"/mqtt", "http://"+tunnelLn.Addr().String()+"/mqtt", caPEM)
+	failed := 0
+	for _, check := range checks {
+		ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+		start := time.Now()
+		err := check.run(ctx)
+		cancel()
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL  %s: %v\n", check.name, err)
+			continue
+		}
+		fmt.Printf("ok    %s (%s)\n", check.name, time.Since(start).Round(time.Microsecond))
+	}
+	fmt.Printf("\n%d of %d checks passed (mqttcli %s)\n", len(checks)-failed, len(checks), version)
+	if failed > 0 {
+		os.Exit(exitFailure)
+	}
+}
@@ -0,0 +1,250 @@
+// session.go
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// sessionVersion is the format version written to recording headers.
+const sessionVersion = 1
+
+// secretFlags are redacted from the command line saved in recordings. Flags
+// are added by secretFlag where they're defined, so a new spelling of a
+// secret can't be missed here.
+var secretFlags = map[string]bool{}
+
+// secretFlag marks the flag name as holding a secret, and returns it.
+func secretFlag(name string) string {
+	secretFlags[name] = true
+	return name
+}
+
+// sessionHeader is the first line of a recording.
+type sessionHeader struct {
+	Type    string   `json:"type"` // "session"
+	Version int      `json:"version"`
+	Started string   `json:"started"`
+	Tool    string   `json:"tool"` // mqttcli version that recorded it
+	Broker  string   `json:"broker"`
+	Command []string `json:"command"` // arguments, with secrets redacted
+}
+
+// sessionEntry is one message of a recording, at its offset from the start.
+type sessionEntry struct {
+	Type     string `json:"type"` // "message"
+	OffsetMS int64  `json:"offset_ms"`
+	messageRecord
+}
+
+// sessionRecorder writes the command line and every handled message of a
+// subscription to a JSON Lines file, for "mqttcli play" to show again later.
+type sessionRecorder struct {
+	mu      sync.Mutex
+	f       *os.File
+	started time.Time
+	tp      *topicPattern
+}
+
+// newSessionRecorder starts recording to cfg.Record; it returns nil when not
+// recording.
+func newSessionRecorder(cfg *Config) (*sessionRecorder, error) {
+	if cfg.Record == "" {
+		return nil, nil
+	}
+	tp, err := parseTopicPattern(cfg.TopicPattern)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(cfg.Record)
+	if err != nil {
+		return nil, fmt.Errorf("could not create recording: %v", err)
+	}
+	r := &sessionRecorder{f: f, started: time.Now(), tp: tp}
+	header, _ := json.Marshal(sessionHeader{
+		Type:    "session",
+		Version: sessionVersion,
+		Started: r.started.UTC().Format(time.RFC3339Nano),
+		Tool:    version,
+		Broker:  cfg.BrokerURL,
+		Command: redactArgs(os.Args[1:]),
+	})
+	if _, err := fmt.Fprintf(f, "%s\n", header); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not write recording: %v", err)
+	}
+	return r, nil
+}
+
+// redactArgs replaces the values of secretFlags, given as "--flag value" or
+// "--flag=value".
+func redactArgs(args []string) []string {
+	out := make([]string, len(args))
+	copy(out, args)
+	for i := 0; i < len(out); i++ {
+		name := strings.TrimLeft(out[i], "-")
+		if name == out[i] {
+			continue
+		}
+		if n, _, ok := strings.Cut(name, "="); ok {
+			if secretFlags[n] {
+				out[i] = out[i][:len(out[i])-len(name)] + n + "=***"
+			}
+			continue
+		}
+		if secretFlags[name] && i+1 < len(out) {
+			out[i+1] = "***"
+			i++
+		}
+	}
+	return out
+}
+
+// wrap records each message before calling h.
+func (r *sessionRecorder) wrap(h mqtt.MessageHandler) mqtt.MessageHandler {
+	if r == nil {
+		return h
+	}
+	return func(client mqtt.Client, msg mqtt.Message) {
+		r.write(msg)
+		h(client, msg)
+	}
+}
+
+func (r *sessionRecorder) write(msg mqtt.Message) {
+	line, _ := json.Marshal(sessionEntry{
+		Type:          "message",
+		OffsetMS:      time.Since(r.started).Milliseconds(),
+		messageRecord: newMessageRecord(msg, r.tp),
+	})
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := fmt.Fprintf(r.f, "%s\n", line); err != nil {
+		logWarn("record_failed", "Could not write to recording: %v", err)
+	}
+}
+
+func (r *sessionRecorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// recordedMessage is a message read back from a recording.
+type recordedMessage struct {
+	rec     messageRecord
+	payload []byte
+}
+
+func (m *recordedMessage) Duplicate() bool   { return false }
+func (m *recordedMessage) Qos() byte         { return m.rec.QoS }
+func (m *recordedMessage) Retained() bool    { return m.rec.Retained }
+func (m *recordedMessage) Topic() string     { return m.rec.Topic }
+func (m *recordedMessage) MessageID() uint16 { return 0 }
+func (m *recordedMessage) Payload() []byte   { return m.payload }
+func (m *recordedMessage) Ack()              {}
+
+// runPlay implements "mqttcli play", which prints the messages of a recording
+// with their original timing.
+func runPlay(args []string) {
+	fs := flag.NewFlagSet("play", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "Playback speed, e.g. 2 for twice as fast.")
+	noWait := fs.Bool("no-wait", false, "Print all messages at once instead of with their original timing.")
+	var cfg Config
+	fs.BoolVar(&cfg.Raw, "raw", false, "Print payloads as recorded, without escaping control characters.")
+	fs.StringVar(&cfg.PayloadFormat, "payload-format", "", "How to print payloads: string (default), raw, hex, or base64.")
+	fs.BoolVar(&cfg.Pretty, "pretty", false, "Indent JSON object and array payloads.")
+	fs.StringVar(&cfg.Format, "format", "", "Text message lines: short (default), full, or payload-only.")
+	fs.StringVar(&cfg.Timestamp, "timestamp", "", "Prefix text message lines with the time: none (default), unix, rfc3339, or relative.")
+	fs.StringVar(&cfg.Template, "template", "", "Print each message with this Go template instead, e.g. '{{.Topic}} {{.Payload}}'.")
+	fs.StringVar(&cfg.Output, "output", "", "Output format: 'text' (default) or 'json'.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s play [options] FILE\n\n"+
+			"Shows a session recorded with --record: the command that was run, then its\n"+
+			"messages as they arrived.\n\nOptions:\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	jsonEvents = cfg.Output == outputJSON
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *speed <= 0 {
+		fatal("config_invalid", false, "--speed must be positive.")
+	}
+	if err := validPayloadFormat(cfg.PayloadFormat); err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+	if err := validTextFormat(cfg.Format); err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+	if err := validTimestamp(cfg.Timestamp); err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+	if _, err := parseMessageTemplate(cfg.Template); err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fatal("play_failed", false, "could not open recording: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	var header sessionHeader
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &header) != nil || header.Type != "session" {
+		fatal("play_failed", false, "'%s' is not an mqttcli recording", fs.Arg(0))
+	}
+	if header.Version > sessionVersion {
+		fatal("play_failed", false, "recording format %d needs a newer mqttcli", header.Version)
+	}
+	logInfo("playing", "Session recorded %s against %s: mqttcli %s",
+		header.Started, header.Broker, strings.Join(header.Command, " "))
+
+	handler := messageHandler(&cfg, nil, nil, nil)
+	start := time.Now()
+	n := 0
+	for scanner.Scan() {
+		var entry sessionEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Type != "message" {
+			continue
+		}
+		payload := []byte(entry.Payload)
+		if entry.PayloadEncoding == "base64" {
+			payload, _ = base64.StdEncoding.DecodeString(entry.Payload)
+		}
+		if !*noWait {
+			at := time.Duration(float64(entry.OffsetMS) * float64(time.Millisecond) / *speed)
+			time.Sleep(time.Until(start.Add(at)))
+		}
+		if cfg.Output == outputJSON {
+			// keep the recorded timestamps
+			encodeRecordPayload(&entry.messageRecord, payload, cfg.PayloadFormat)
+			line, _ := json.Marshal(entry.messageRecord)
+			fmt.Printf("%s\n", line)
+		} else {
+			handler(nil, &recordedMessage{rec: entry.messageRecord, payload: payload})
+		}
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		fatal("play_failed", false, "could not read recording: %v", err)
+	}
+	logInfo("played", "Played %d message(s).", n)
+}
@@ -0,0 +1,60 @@
+// session_test.go
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestRedactArgs(t *testing.T) {
+	initCLIFlags(flag.NewFlagSet("sub", flag.ContinueOnError))
+	for _, tc := range []struct {
+		args, want []string
+	}{
+		{[]string{"sub", "--password", "hunter2", "-t", "a/#"}, []string{"sub", "--password", "***", "-t", "a/#"}},
+		{[]string{"sub", "-P", "hunter2", "--record", "r.jsonl"}, []string{"sub", "-P", "***", "--record", "r.jsonl"}},
+		{[]string{"sub", "-P=hunter2"}, []string{"sub", "-P=***"}},
+		{[]string{"sub", "--key-password=x", "--pkcs12-password", "y", "--pkcs11-pin", "1234"},
+			[]string{"sub", "--key-password=***", "--pkcs12-password", "***", "--pkcs11-pin", "***"}},
+		{[]string{"sub", "--ws-header", "Authorization: Bearer t", "--tunnel-token=s"},
+			[]string{"sub", "--ws-header", "***", "--tunnel-token=***"}},
+		// A topic named like a flag is a value, not a flag
+		{[]string{"pub", "-t", "password", "-m", "x"}, []string{"pub", "-t", "password", "-m", "x"}},
+		{[]string{"sub", "--password"}, []string{"sub", "--password"}},
+	} {
+		if got := redactArgs(tc.args); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("redactArgs(%q) = %q, want %q", tc.args, got, tc.want)
+		}
+	}
+}
+
+// Every flag that sets one of the secrets, in any spelling, must be redacted.
+func TestSecretFlagsCoverSecrets(t *testing.T) {
+	fs := flag.NewFlagSet("sub", flag.ContinueOnError)
+	f := initCLIFlags(fs)
+	secrets := map[uintptr]string{
+		reflect.ValueOf(&f.Password).Pointer():       "password",
+		reflect.ValueOf(&f.KeyPassword).Pointer():    "key password",
+		reflect.ValueOf(&f.PKCS12Password).Pointer(): "PKCS#12 password",
+		reflect.ValueOf(&f.PKCS11PIN).Pointer():      "PKCS#11 PIN",
+		reflect.ValueOf(&f.TunnelToken).Pointer():    "tunnel token",
+		reflect.ValueOf(&f.WSHeaders).Pointer():      "WebSocket headers",
+	}
+	found := 0
+	fs.VisitAll(func(fl *flag.Flag) {
+		v := reflect.ValueOf(fl.Value)
+		if v.Kind() != reflect.Ptr {
+			return
+		}
+		if secret, ok := secrets[v.Pointer()]; ok {
+			found++
+			if !secretFlags[fl.Name] {
+				t.Errorf("-%s sets the %s but isn't redacted from recordings", fl.Name, secret)
+			}
+		}
+	})
+	if found < len(secrets) {
+		t.Errorf("found %d flags setting secrets, want at least %d", found, len(secrets))
+	}
+}
@@ -0,0 +1,233 @@
+// shaping.go
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shapedQueue is how many delayed packets wait per direction before reading
+// from the sender pauses.
+const shapedQueue = 1024
+
+// shaping degrades one direction of a proxied connection, for testing clients
+// against slow or lossy networks.
+type shaping struct {
+	delay  time.Duration
+	jitter time.Duration // each packet's delay varies by up to this much either way
+	rate   int64         // bytes per second; zero is unlimited
+	drop   float64       // probability of dropping a packet, 0 to 1
+}
+
+func (s shaping) active() bool {
+	return s.delay > 0 || s.jitter > 0 || s.rate > 0 || s.drop > 0
+}
+
+func (s shaping) String() string {
+	var parts []string
+	if s.jitter > 0 {
+		parts = append(parts, fmt.Sprintf("delay %s±%s", s.delay, s.jitter))
+	} else if s.delay > 0 {
+		parts = append(parts, "delay "+s.delay.String())
+	}
+	if s.rate > 0 {
+		parts = append(parts, fmt.Sprintf("%d bytes/s", s.rate))
+	}
+	if s.drop > 0 {
+		parts = append(parts, fmt.Sprintf("%g%% dropped", s.drop*100))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// splitDirections splits a shaping flag value into its client->broker and
+// broker->client parts: "V" applies to both, "UP,DOWN" to each.
+func splitDirections(name, value string) (up, down string, err error) {
+	parts := strings.Split(value, ",")
+	switch len(parts) {
+	case 1:
+		return parts[0], parts[0], nil
+	case 2:
+		return parts[0], parts[1], nil
+	}
+	return "", "", fmt.Errorf("invalid --%s '%s', expected VALUE or CLIENT_TO_BROKER,BROKER_TO_CLIENT", name, value)
+}
+
+// parseByteRate parses a bandwidth such as "4000", "16KB", or "1MiB", in bytes
+// per second; a trailing "/s" is allowed.
+func parseByteRate(s string) (int64, error) {
+	n, err := parseByteSize(strings.TrimSuffix(strings.TrimSpace(s), "/s"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid bandwidth '%s', expected bytes per second such as 16KB or 1MiB", s)
+	}
+	return n, nil
+}
+
+// parseByteSize parses a size such as "4000", "16KB", or "64MiB".
+func parseByteSize(s string) (int64, error) {
+	num := strings.TrimSpace(s)
+	mult := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"KB", 1000}, {"MB", 1000 * 1000}, {"B", 1}} {
+		if strings.HasSuffix(num, u.suffix) {
+			num, mult = strings.TrimSuffix(num, u.suffix), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// parseShaping builds the shaping for both directions from the proxy flags;
+// empty values leave that aspect alone.
+func parseShaping(delay, jitter, bandwidth, drop string) (up, down shaping, err error) {
+	set := func(name, value string, parse func(v string, s *shaping) error) {
+		if value == "" || err != nil {
+			return
+		}
+		var u, d string
+		if u, d, err = splitDirections(name, value); err != nil {
+			return
+		}
+		if err = parse(u, &up); err == nil {
+			err = parse(d, &down)
+		}
+	}
+	duration := func(name string, field func(*shaping) *time.Duration) func(string, *shaping) error {
+		return func(v string, s *shaping) error {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return fmt.Errorf("invalid --%s '%s', expected a duration such as 200ms", name, v)
+			}
+			*field(s) = d
+			return nil
+		}
+	}
+	set("delay", delay, duration("delay", func(s *shaping) *time.Duration { return &s.delay }))
+	set("jitter", jitter, duration("jitter", func(s *shaping) *time.Duration { return &s.jitter }))
+	set("bandwidth", bandwidth, func(v string, s *shaping) error {
+		var err error
+		s.rate, err = parseByteRate(v)
+		return err
+	})
+	set("drop", drop, func(v string, s *shaping) error {
+		p, err := strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64)
+		if strings.HasSuffix(v, "%") {
+			p /= 100
+		}
+		if err != nil || p < 0 || p > 1 {
+			return fmt.Errorf("invalid --drop '%s', expected a probability such as 0.05 or 5%%", v)
+		}
+		s.drop = p
+		return nil
+	})
+	return up, down, err
+}
+
+// shapedFrame is a packet waiting for its release time.
+type shapedFrame struct {
+	frame   []byte
+	release time.Time
+}
+
+// shapedWriter delivers packets to one side of a proxied connection after the
+// delay and transmission time its shaping calls for, in order, like a slow
+// link would.
+type shapedWriter struct {
+	s     shaping
+	to    net.Conn
+	queue chan shapedFrame
+
+	mu   sync.Mutex
+	rand *rand.Rand
+	last time.Time // release time of the previous packet
+	free time.Time // when the simulated link finishes sending it
+	err  error     // from writing to to
+}
+
+// newShapedWriter starts a writer to to; without shaping it returns nil, and
+// packets are written directly.
+func newShapedWriter(s shaping, to net.Conn) *shapedWriter {
+	if !s.active() {
+		return nil
+	}
+	w := &shapedWriter{s: s, to: to, queue: make(chan shapedFrame, shapedQueue),
+		rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	go w.run()
+	return w
+}
+
+// dropped decides whether to drop the next packet. CONNECT and CONNACK always
+// pass, so connections can be established.
+func (w *shapedWriter) dropped(frame []byte) bool {
+	if w == nil || w.s.drop == 0 {
+		return false
+	}
+	if t := frame[0] >> 4; t == 1 || t == 2 {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.rand.Float64() < w.s.drop
+}
+
+// write queues frame for delivery, or writes it at once without shaping.
+func (w *shapedWriter) write(to net.Conn, frame []byte) error {
+	if w == nil {
+		_, err := to.Write(frame)
+		return err
+	}
+	w.mu.Lock()
+	if w.err != nil {
+		w.mu.Unlock()
+		return w.err
+	}
+	// The packet is sent once the link is free, then takes the delay to arrive
+	sent := time.Now()
+	if w.s.rate > 0 {
+		if w.free.After(sent) {
+			sent = w.free
+		}
+		sent = sent.Add(time.Duration(int64(len(frame)) * int64(time.Second) / w.s.rate))
+		w.free = sent
+	}
+	release := sent.Add(w.s.delay)
+	if w.s.jitter > 0 {
+		release = release.Add(time.Duration(w.rand.Int63n(int64(2*w.s.jitter))) - w.s.jitter)
+	}
+	if release.Before(w.last) {
+		release = w.last // a stream can't reorder
+	}
+	w.last = release
+	w.mu.Unlock()
+	w.queue <- shapedFrame{frame, release}
+	return nil
+}
+
+func (w *shapedWriter) run() {
+	for f := range w.queue {
+		time.Sleep(time.Until(f.release))
+		if _, err := w.to.Write(f.frame); err != nil {
+			w.mu.Lock()
+			w.err = err
+			w.mu.Unlock()
+			w.to.Close()
+		}
+	}
+}
+
+// close stops the writer once queued packets are delivered.
+func (w *shapedWriter) close() {
+	if w != nil {
+		close(w.queue)
+	}
+}
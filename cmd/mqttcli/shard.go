@@ -0,0 +1,56 @@
+// shard.go
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// topicShard selects a deterministic subset of topics, so that N instances with
+// the same wildcard subscription can each process 1/N of the topic space.
+type topicShard struct {
+	index int // 1-based
+	count int
+}
+
+// parseShard parses "I/N", e.g. "2/5" for the second of five shards. An empty
+// string disables sharding.
+func parseShard(s string) (*topicShard, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var sh topicShard
+	var rest string
+	if n, _ := fmt.Sscanf(s, "%d/%d%s", &sh.index, &sh.count, &rest); n != 2 {
+		return nil, fmt.Errorf("invalid shard '%s', expected 'I/N' such as '2/5'", s)
+	}
+	if sh.count < 1 || sh.index < 1 || sh.index > sh.count {
+		return nil, fmt.Errorf("invalid shard '%s': need 1 <= I <= N", s)
+	}
+	return &sh, nil
+}
+
+// owns reports whether topic belongs to this shard. The FNV-1a hash keeps the
+// assignment stable across runs, hosts, and versions.
+func (sh *topicShard) owns(topic string) bool {
+	if sh == nil {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(topic))
+	return int(h.Sum32()%uint32(sh.count)) == sh.index-1
+}
+
+// wrap returns a handler that only passes on messages for topics in this shard.
+func (sh *topicShard) wrap(h mqtt.MessageHandler) mqtt.MessageHandler {
+	if sh == nil {
+		return h
+	}
+	return func(client mqtt.Client, msg mqtt.Message) {
+		if sh.owns(msg.Topic()) {
+			h(client, msg)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// share.go
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// shareFilter returns filter as a member of the shared subscription group,
+// "$share/GROUP/filter". Filters that are already shared are kept as they are.
+func shareFilter(filter, group string) string {
+	if group == "" || isSharedSubscription(filter) {
+		return filter
+	}
+	return "$share/" + group + "/" + filter
+}
+
+// validShareGroup checks a shared subscription group name, which may not
+// contain wildcards or topic separators.
+func validShareGroup(group string) error {
+	if group == "" || strings.ContainsAny(group, "/+#") {
+		return fmt.Errorf("invalid share group '%s': it must be non-empty without '/', '+', or '#'", group)
+	}
+	return nil
+}
+
+// validSharedFilter checks a "$share/GROUP/filter" subscription.
+func validSharedFilter(filter string) error {
+	group, rest, ok := strings.Cut(strings.TrimPrefix(filter, "$share/"), "/")
+	if !ok || rest == "" {
+		return fmt.Errorf("invalid shared subscription '%s', expected '$share/GROUP/FILTER'", filter)
+	}
+	return validShareGroup(group)
+}
+
+// shareCounter counts the messages given to each member of a demo group.
+type shareCounter struct {
+	mu     sync.Mutex
+	counts []int
+	total  int
+	done   chan struct{} // closed once want messages have arrived
+	want   int
+}
+
+func (c *shareCounter) handler(member int, quiet bool) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		c.mu.Lock()
+		c.counts[member]++
+		c.total++
+		if c.want > 0 && c.total == c.want {
+			close(c.done)
+		}
+		c.mu.Unlock()
+		if !quiet {
+			fmt.Println(sanitizeForTerminal(fmt.Sprintf("[SUBSCRIBER %d] Topic=%s QoS=%d Payload=%s",
+				member+1, msg.Topic(), msg.Qos(), formatPayload(msg.Payload(), payloadString, false))))
+		}
+	}
+}
+
+// report prints how the messages were spread across the group's members.
+func (c *shareCounter) report(w io.Writer, clientIDs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SUBSCRIBER\tCLIENT ID\tMESSAGES\tSHARE")
+	for i, n := range c.counts {
+		share := 0.0
+		if c.total > 0 {
+			share = 100 * float64(n) / float64(c.total)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%.1f%%\n", i+1, clientIDs[i], n, share)
+	}
+	fmt.Fprintf(tw, "total\t\t%d\n", c.total)
+	tw.Flush()
+}
+
+// runShareDemo implements "mqttcli share-demo": it connects several
+// subscribers to one shared subscription group and shows how the broker
+// spreads messages across them, optionally publishing test messages itself.
+func runShareDemo(args []string) {
+	fs := flag.NewFlagSet("share-demo", flag.ExitOnError)
+	flags := initCLIFlags(fs)
+	subscribers := fs.Int("subscribers", 3, "Number of subscribers in the group.")
+	publish := fs.Int("publish", 0, "Publish this many test messages to the topic, then report (0 observes existing traffic).")
+	duration := fs.Duration("duration", 0, "Report after this long (0 waits for Ctrl+C, or with --publish for the test messages).")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s share-demo [options]\n\n"+
+			"Subscribers use client IDs CLIENTID-1 to CLIENTID-N and the --share-group group\n"+
+			"(default 'mqttcli-demo').\n\nExample:\n"+
+			"  %s share-demo --clientid demo --topic demo/jobs --subscribers 4 --publish 100\n\nOptions:\n",
+			filepath.Base(os.Args[0]), filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if flags.ShareGroup == "" {
+		flags.ShareGroup = "mqttcli-demo"
+	}
+	cfg := buildConfig(flags)
+	if *subscribers < 1 {
+		fatal("config_invalid", false, "--subscribers must be at least 1.")
+	}
+	var topic string
+	var qos byte
+	if *publish > 0 {
+		plain := cfg
+		plain.ShareGroup = ""
+		subs := plain.subscriptions()
+		for filter, q := range subs {
+			topic, qos = filter, q
+		}
+		if len(subs) != 1 || hasWildcard(topic) || isSharedSubscription(topic) {
+			fatal("config_invalid", false, "--publish needs exactly one --topic without wildcards or '$share/'.")
+		}
+		refuseReadOnly(&cfg, "share-demo --publish")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	counter := &shareCounter{counts: make([]int, *subscribers), done: make(chan struct{}), want: *publish}
+	clientIDs := make([]string, *subscribers)
+	for i := range clientIDs {
+		member := cfg
+		member.ClientID = fmt.Sprintf("%s-%d", cfg.ClientID, i+1)
+		clientIDs[i] = member.ClientID
+		client, setupCtx, cancelSetup := connectWithBudget(ctx, &member)
+		defer client.Disconnect(250)
+		if err := subscribeToTopic(setupCtx, client, &member, counter.handler(i, cfg.Quiet)); err != nil {
+			client.Disconnect(0)
+			exitSetupFailure(ctx, setupCtx, &member, "subscribe", err, "Subscriber %d failed to subscribe to %s: %v", i+1, describeSubscriptions(member.subscriptions()), err)
+		}
+		cancelSetup()
+	}
+	logInfo("share_demo_ready", "%d subscriber(s) joined %s", *subscribers, describeSubscriptions(cfg.subscriptions()))
+
+	if *publish > 0 {
+		pub := cfg
+		pub.ClientID = cfg.ClientID + "-pub"
+		client, _, cancelSetup := connectWithBudget(ctx, &pub)
+		cancelSetup()
+		defer client.Disconnect(250)
+		for i := 1; i <= *publish && ctx.Err() == nil; i++ {
+			token := client.Publish(topic, qos, false, fmt.Sprintf(`{"seq":%d}`, i))
+			if err := waitToken(ctx, token, defaultPublishTimeout, "publish"); err != nil {
+				fatal(phaseErrorCode("publish", err), isRetryable(err), "Failed to publish test message %d to '%s': %v", i, topic, err)
+			}
+		}
+		logInfo("share_demo_published", "Published %d test message(s) to '%s' with QoS=%d", *publish, topic, qos)
+		select {
+		case <-counter.done:
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+			logWarn("share_demo_incomplete", "Not every test message arrived within 5s; QoS 0 messages may be dropped")
+		}
+	} else {
+		<-ctx.Done()
+	}
+	counter.report(os.Stdout, clientIDs)
+}
@@ -0,0 +1,287 @@
+// sink.go
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Sink receives every handled message as the same JSON envelope printed by
+// --output json. Write is called from the message handler; a slow sink slows
+// down message handling rather than dropping messages.
+type Sink interface {
+	Write(rec messageRecord) error
+	Close() error
+}
+
+// newMessageRecord builds the JSON envelope of msg, with any fields matched by tp.
+func newMessageRecord(msg mqtt.Message, tp *topicPattern) messageRecord {
+	rec := messageRecord{
+		Topic:     msg.Topic(),
+		QoS:       msg.Qos(),
+		Retained:  msg.Retained(),
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Payload:   string(msg.Payload()),
+	}
+	if !utf8.Valid(msg.Payload()) {
+		rec.Payload = base64.StdEncoding.EncodeToString(msg.Payload())
+		rec.PayloadEncoding = "base64"
+	}
+	if m, ok := tp.Match(msg.Topic()); ok && len(m) > 0 {
+		rec.Fields = m
+	}
+	rec.Properties = messagePropertiesOf(msg)
+	return rec
+}
+
+// sinkSet is the configured sinks of a subscription.
+type sinkSet []Sink
+
+// newSinks starts the sinks configured in cfg, each timed as a pipeline
+// stage named after its option.
+func newSinks(cfg *Config) (sinkSet, error) {
+	var sinks sinkSet
+	for i, command := range cfg.ExecSinks {
+		s, err := newExecSink(command)
+		if err != nil {
+			sinks.Close()
+			return nil, err
+		}
+		stage := "sink_exec"
+		if len(cfg.ExecSinks) > 1 {
+			stage = fmt.Sprintf("sink_exec[%d]", i+1)
+		}
+		sinks = append(sinks, timedSink{s, stage})
+	}
+	if cfg.Exec != "" {
+		limit := cfg.ExecConcurrency
+		if limit == 0 {
+			limit = 1
+		}
+		if err := validExecPartition(cfg); err != nil {
+			sinks.Close()
+			return nil, err
+		}
+		h := newExecHook(cfg.Exec, limit, time.Duration(cfg.ExecTimeout), cfg.ExecPartition)
+		h.wait = cfg.AtLeastOnce
+		sinks = append(sinks, timedSink{h, "exec"})
+	}
+	if cfg.OutFIFO != "" {
+		s, err := newFIFOSink(cfg.OutFIFO, cfg.OutFIFOBlock)
+		if err != nil {
+			sinks.Close()
+			return nil, err
+		}
+		sinks = append(sinks, timedSink{s, "out_fifo"})
+	}
+	if cfg.DBusSignal != "" {
+		s, err := newDBusSink(cfg.DBusSignal)
+		if err != nil {
+			sinks.Close()
+			return nil, err
+		}
+		sinks = append(sinks, timedSink{s, "dbus_signal"})
+	}
+	if cfg.OutDir != "" {
+		s, err := newDirSink(cfg.OutDir, cfg.OutName, cfg.TopicPattern)
+		if err != nil {
+			sinks.Close()
+			return nil, err
+		}
+		s.sync = cfg.AtLeastOnce
+		sinks = append(sinks, timedSink{s, "out_dir"})
+	}
+	return sinks, nil
+}
+
+// wrap passes each message to every sink before calling next. With
+// at_least_once, a failed write ends there, and the message is left
+// unacknowledged for the broker to send again.
+func (ss sinkSet) wrap(next mqtt.MessageHandler, tp *topicPattern) mqtt.MessageHandler {
+	if len(ss) == 0 {
+		return next
+	}
+	return func(client mqtt.Client, msg mqtt.Message) {
+		rec := newMessageRecord(msg, tp)
+		for _, s := range ss {
+			if err := s.Write(rec); err != nil && deliveryFailed(client, msg, err) {
+				return
+			}
+		}
+		next(client, msg)
+	}
+}
+
+func (ss sinkSet) Close() error {
+	for _, s := range ss {
+		s.Close()
+	}
+	return nil
+}
+
+// Delays before restarting a crashed exec sink double from execSinkRestartDelay
+// up to execSinkMaxRestartDelay.
+const (
+	execSinkRestartDelay    = time.Second
+	execSinkMaxRestartDelay = 30 * time.Second
+)
+
+// execSink streams messages as JSON lines to the stdin of a long-lived child
+// process, so sinks can be written in any language. The child is restarted
+// with a growing delay if it exits; messages arriving while it is down are
+// dropped and counted.
+type execSink struct {
+	command string
+
+	mu      sync.Mutex
+	child   *execChild // nil while down
+	delay   time.Duration
+	restart time.Time
+	dropped int
+	closed  bool
+}
+
+// execChild is one run of an exec sink's process.
+type execChild struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	exited chan struct{}
+	err    error // from Wait, valid once exited is closed
+}
+
+func newExecSink(command string) (*execSink, error) {
+	s := &execSink{command: command, delay: execSinkRestartDelay}
+	child, err := startExecChild(command)
+	if err != nil {
+		return nil, fmt.Errorf("could not start sink '%s': %v", command, err)
+	}
+	s.child = child
+	logInfo("sink_started", "Started sink '%s'", command)
+	return s, nil
+}
+
+// shellCommand runs command through the platform shell.
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
+
+func startExecChild(command string) (*execChild, error) {
+	cmd := shellCommand(command)
+	// Keep the child's output away from the messages on stdout
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	c := &execChild{cmd: cmd, stdin: stdin, exited: make(chan struct{})}
+	go func() {
+		c.err = cmd.Wait()
+		close(c.exited)
+	}()
+	return c, nil
+}
+
+func (c *execChild) running() bool {
+	select {
+	case <-c.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// down records that the child died and schedules the restart; s.mu must be held.
+func (s *execSink) down(reason error) {
+	if s.child != nil {
+		s.child.stdin.Close()
+		s.child = nil
+	}
+	s.restart = time.Now().Add(s.delay)
+	logWarn("sink_exited", "Sink '%s' stopped (%v), restarting in %s", s.command, reason, s.delay)
+	s.delay *= 2
+	if s.delay > execSinkMaxRestartDelay {
+		s.delay = execSinkMaxRestartDelay
+	}
+}
+
+func (s *execSink) Write(rec messageRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return os.ErrClosed
+	}
+
+	if s.child != nil && !s.child.running() {
+		reason := s.child.err
+		if reason == nil {
+			reason = errors.New("exited")
+		}
+		s.down(reason)
+	}
+	if s.child == nil {
+		if time.Now().Before(s.restart) {
+			s.dropped++
+			return fmt.Errorf("sink '%s' is restarting", s.command)
+		}
+		child, err := startExecChild(s.command)
+		if err != nil {
+			s.down(err)
+			s.dropped++
+			return err
+		}
+		s.child = child
+		logInfo("sink_restarted", "Restarted sink '%s' (%d message(s) dropped while it was down)", s.command, s.dropped)
+		s.dropped = 0
+	}
+
+	if _, err := s.child.stdin.Write(append(line, '\n')); err != nil {
+		s.down(err)
+		s.dropped++
+		return err
+	}
+	// Reset the restart delay once the child is taking messages again
+	s.delay = execSinkRestartDelay
+	return nil
+}
+
+// Close closes the child's stdin and gives it a few seconds to finish before
+// killing it.
+func (s *execSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.child == nil {
+		s.closed = true
+		return nil
+	}
+	s.closed = true
+	s.child.stdin.Close()
+	select {
+	case <-s.child.exited:
+	case <-time.After(5 * time.Second):
+		logWarn("sink_killed", "Sink '%s' did not exit after its input closed, killing it", s.command)
+		s.child.cmd.Process.Kill()
+	}
+	return nil
+}
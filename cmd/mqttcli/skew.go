@@ -0,0 +1,119 @@
+// skew.go
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// skewMeter records, per device, the difference between receive time and the
+// timestamp embedded in each payload.
+type skewMeter struct {
+	field   string
+	pattern *topicPattern
+
+	mu      sync.Mutex
+	samples map[string][]time.Duration
+	missing int
+}
+
+func newSkewMeter(field string, pattern *topicPattern) *skewMeter {
+	return &skewMeter{field: field, pattern: pattern, samples: map[string][]time.Duration{}}
+}
+
+func (m *skewMeter) handler(client mqtt.Client, msg mqtt.Message) {
+	received := time.Now()
+	v, ok := lookupJSONField(msg.Payload(), m.field)
+	var sent time.Time
+	if ok {
+		sent, ok = parseTimestamp(v)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !ok {
+		m.missing++
+		return
+	}
+	device := msg.Topic()
+	if fields, matched := m.pattern.Match(device); matched && fields["device"] != "" {
+		device = fields["device"]
+	}
+	m.samples[device] = append(m.samples[device], received.Sub(sent))
+}
+
+// percentile returns the p-th percentile (0-100) of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p / 100 * float64(len(sorted)-1))
+	return sorted[i]
+}
+
+// report prints the skew distribution per device. Positive skew means the
+// payload timestamp is behind receive time (device clock slow, or latency);
+// negative skew means the device clock is ahead.
+func (m *skewMeter) report(out io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	devices := make([]string, 0, len(m.samples))
+	for d := range m.samples {
+		devices = append(devices, d)
+	}
+	sort.Strings(devices)
+
+	fmt.Fprintf(out, "%-40s %6s %12s %12s %12s %12s\n", "DEVICE", "COUNT", "MIN", "P50", "P90", "MAX")
+	for _, d := range devices {
+		s := m.samples[d]
+		sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+		fmt.Fprintf(out, "%-40s %6d %12s %12s %12s %12s\n", truncate(sanitizeForTerminal(d), 40), len(s),
+			s[0].Round(time.Millisecond), percentile(s, 50).Round(time.Millisecond),
+			percentile(s, 90).Round(time.Millisecond), s[len(s)-1].Round(time.Millisecond))
+	}
+	if m.missing > 0 {
+		fmt.Fprintf(out, "%d message(s) had no parsable '%s' timestamp\n", m.missing, m.field)
+	}
+}
+
+// runClockSkew implements "mqttcli clock-skew": it compares timestamps embedded
+// in payloads against receive time and reports per-device skew distributions.
+func runClockSkew(args []string) {
+	fs := flag.NewFlagSet("clock-skew", flag.ExitOnError)
+	flags := initCLIFlags(fs)
+	field := fs.String("field", "timestamp", "Dotted path of the JSON timestamp field (Unix s/ms/us/ns or RFC 3339).")
+	duration := fs.Duration("duration", time.Minute, "How long to sample before reporting (0 waits for Ctrl+C).")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s clock-skew [options]\n\n"+
+			"Skew is receive time minus payload time; devices are grouped by the 'device'\n"+
+			"field of --topic-pattern when set, otherwise by topic.\n\nOptions:\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cfg := buildConfig(flags)
+	pattern, err := parseTopicPattern(cfg.TopicPattern)
+	if err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+
+	ctx := context.Background()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	m := newSkewMeter(*field, pattern)
+	runSubscription(ctx, &cfg, m.handler)
+	m.report(os.Stdout)
+}
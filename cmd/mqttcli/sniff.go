@@ -0,0 +1,212 @@
+// sniff.go
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// sniffedTopicsMax bounds the topics whose last detected format is kept, so
+// a wide wildcard doesn't grow the table forever.
+const sniffedTopicsMax = 10000
+
+// sniffer recognizes one payload format and renders it readably.
+type sniffer struct {
+	name   string
+	match  func([]byte) bool
+	decode decodeFunc // nil passes the payload through
+}
+
+// sniffers are tried in order, so cheap, distinctive checks come first:
+// binary formats only after text has been ruled out, and protobuf, which
+// much binary parses as, last.
+var sniffers = []sniffer{
+	{name: "gzip", match: func(b []byte) bool { return len(b) > 2 && b[0] == 0x1f && b[1] == 0x8b }},
+	{name: "json", match: isJSONPayload},
+	{name: "nmea", match: isNMEA, decode: decodeNMEA},
+	{name: "text", match: isText},
+	{name: "cbor", match: func(b []byte) bool { return len(b) > 0 && b[0] >= 0x80 && b[0] <= 0xdb && isCBOR(b) }, decode: decodeCBOR},
+	{name: "protobuf", match: isProtobuf, decode: decodeRawProtobuf},
+}
+
+// payloadSniffer is the "sniff" decoder: it picks a decoder for each message
+// from the payload itself, so topics mixing formats still render sensibly.
+type payloadSniffer struct {
+	set []sniffer
+
+	mu   sync.Mutex
+	seen map[string]string // topic -> last detected format
+}
+
+// newPayloadSniffer tries every sniffer for "sniff", or only the ones listed
+// as "sniff:json+cbor".
+func newPayloadSniffer(spec string) (*payloadSniffer, error) {
+	s := &payloadSniffer{seen: make(map[string]string)}
+	_, arg, _ := strings.Cut(spec, ":")
+	if arg == "" {
+		s.set = sniffers
+		return s, nil
+	}
+	for _, name := range strings.Split(arg, "+") {
+		found := false
+		for _, f := range sniffers {
+			if f.name == name {
+				s.set, found = append(s.set, f), true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown sniffer '%s'", name)
+		}
+	}
+	return s, nil
+}
+
+// detect returns the format of b and its rendering. Gzip is unpacked and the
+// content sniffed in turn, giving formats such as "gzip+json"; unpacked is set
+// for that content, so only one layer is unpacked and a gzip quine can't
+// recurse forever.
+func (s *payloadSniffer) detect(b []byte, unpacked bool) (string, []byte, error) {
+	for _, f := range s.set {
+		if (f.name == "gzip" && unpacked) || !f.match(b) {
+			continue
+		}
+		if f.name == "gzip" {
+			inner, err := decompress(gzip.NewReader(bytes.NewReader(b)))
+			if err != nil {
+				return "gzip", nil, err
+			}
+			format, out, err := s.detect(inner, true)
+			return "gzip+" + format, out, err
+		}
+		if f.decode == nil {
+			return f.name, b, nil
+		}
+		out, err := f.decode(b)
+		return f.name, out, err
+	}
+	return "binary", b, nil
+}
+
+// decode sniffs a payload, logging the format the first time a topic is seen
+// and whenever it changes.
+func (s *payloadSniffer) decode(topic string, b []byte) ([]byte, error) {
+	format, out, err := s.detect(b, false)
+	s.mu.Lock()
+	prev, ok := s.seen[topic]
+	if prev != format {
+		if len(s.seen) >= sniffedTopicsMax {
+			s.seen = make(map[string]string)
+		}
+		s.seen[topic] = format
+	}
+	s.mu.Unlock()
+	switch {
+	case !ok:
+		logInfo("payload_sniffed", "Payloads on '%s' look like %s", topic, format)
+	case prev != format:
+		logInfo("payload_sniffed", "Payloads on '%s' changed from %s to %s", topic, prev, format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sniffed %s: %v", format, err)
+	}
+	return out, nil
+}
+
+func isJSONPayload(b []byte) bool {
+	t := bytes.TrimSpace(b)
+	return len(t) > 0 && (t[0] == '{' || t[0] == '[' || t[0] == '"') && json.Valid(t)
+}
+
+// isText reports whether b is UTF-8 made of printable characters and
+// whitespace.
+func isText(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// isProtobuf reports whether b parses as protobuf wire data with plausible
+// field numbers; random bytes rarely manage both for long.
+func isProtobuf(b []byte) bool {
+	fields, err := parseProtoFields(b)
+	if err != nil || len(fields) == 0 {
+		return false
+	}
+	for k := range fields {
+		if n, _ := strconv.Atoi(k); n > 10000 {
+			return false
+		}
+	}
+	return true
+}
+
+// nmeaSentences splits a payload into NMEA 0183 sentences: "$" (or "!" for
+// AIS) and an address such as GPGGA, then comma-separated fields.
+func nmeaSentences(b []byte) []string {
+	var out []string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if len(line) < 6 || (line[0] != '$' && line[0] != '!') {
+			return nil
+		}
+		addr, _, _ := strings.Cut(line[1:], ",")
+		addr, _, _ = strings.Cut(addr, "*")
+		if len(addr) < 3 || strings.IndexFunc(addr, func(r rune) bool { return r < '0' || (r > '9' && r < 'A') || r > 'Z' }) >= 0 {
+			return nil
+		}
+		out = append(out, line)
+	}
+	return out
+}
+
+func isNMEA(b []byte) bool { return len(nmeaSentences(b)) > 0 }
+
+// decodeNMEA renders NMEA 0183 sentences as JSON, one object per sentence
+// with its talker, type, fields, and whether the checksum holds.
+func decodeNMEA(b []byte) ([]byte, error) {
+	lines := nmeaSentences(b)
+	if lines == nil {
+		return nil, fmt.Errorf("not NMEA 0183 sentences")
+	}
+	var list []map[string]interface{}
+	for _, line := range lines {
+		body, sum, hasSum := strings.Cut(line[1:], "*")
+		fields := strings.Split(body, ",")
+		addr := fields[0]
+		s := map[string]interface{}{"sentence": addr, "fields": fields[1:]}
+		if addr[0] == 'P' {
+			s["talker"], s["type"] = "P", addr[1:] // proprietary
+		} else {
+			s["talker"], s["type"] = addr[:2], addr[2:]
+		}
+		if hasSum {
+			var x byte
+			for i := 0; i < len(body); i++ {
+				x ^= body[i]
+			}
+			want, err := strconv.ParseUint(strings.TrimSpace(sum), 16, 8)
+			s["checksum_valid"] = err == nil && byte(want) == x
+		}
+		list = append(list, s)
+	}
+	if len(list) == 1 {
+		return json.Marshal(list[0])
+	}
+	return json.Marshal(list)
+}
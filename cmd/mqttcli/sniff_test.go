@@ -0,0 +1,81 @@
+// sniff_test.go
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, b []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSniff(t *testing.T) {
+	s, err := newPayloadSniffer("sniff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		payload []byte
+		format  string
+		out     string
+	}{
+		{"json", []byte(` {"temp": 21.5}`), "json", ` {"temp": 21.5}`},
+		{"text", []byte("hello\n"), "text", "hello\n"},
+		{"nmea", []byte("$GPGLL,4916.45,N,12311.12,W*31"), "nmea",
+			`{"checksum_valid":false,"fields":["4916.45","N","12311.12","W"],"sentence":"GPGLL","talker":"GP","type":"GLL"}`},
+		{"cbor", []byte{0xa1, 0x61, 'a', 0x01}, "cbor", `{"a":1}`},
+		{"protobuf", []byte{0x08, 0x96, 0x01}, "protobuf", `{"1":150}`},
+		{"gzip json", gzipped(t, []byte(`{"a":1}`)), "gzip+json", `{"a":1}`},
+		{"binary", []byte{0xff, 0xfe, 0x00}, "binary", "\xff\xfe\x00"},
+	} {
+		format, out, err := s.detect(tc.payload, false)
+		if err != nil || format != tc.format || string(out) != tc.out {
+			t.Errorf("%s: got %s %q (%v), want %s %q", tc.name, format, out, err, tc.format, tc.out)
+		}
+	}
+}
+
+func TestSniffOneGzipLayer(t *testing.T) {
+	s, _ := newPayloadSniffer("sniff")
+	format, _, err := s.detect(gzipped(t, gzipped(t, []byte(`{"a":1}`))), false)
+	if err != nil || !strings.HasPrefix(format, "gzip+") || strings.HasPrefix(format, "gzip+gzip") {
+		t.Errorf("got %s (%v), want gzip around a payload that isn't unpacked again", format, err)
+	}
+}
+
+func TestSniffGzipBomb(t *testing.T) {
+	s, _ := newPayloadSniffer("sniff")
+	bomb := gzipped(t, make([]byte, decompressedMax+1))
+	if _, _, err := s.detect(bomb, false); err == nil {
+		t.Errorf("unpacked %d bytes of gzip to more than %d", len(bomb), decompressedMax)
+	}
+	if _, _, err := s.detect(gzipped(t, make([]byte, decompressedMax)), false); err != nil {
+		t.Errorf("payload of exactly %d bytes: %v", decompressedMax, err)
+	}
+}
+
+func TestNewPayloadSniffer(t *testing.T) {
+	s, err := newPayloadSniffer("sniff:json+cbor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format, _, _ := s.detect([]byte("hello"), false); format != "binary" {
+		t.Errorf("sniff:json+cbor detected %s in plain text", format)
+	}
+	if _, err := newPayloadSniffer("sniff:json+yaml"); err == nil {
+		t.Error("accepted the unknown sniffer yaml")
+	}
+}
@@ -0,0 +1,180 @@
+// sub.go
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+// subUsage prints help for the sub command.
+func subUsage(fs *flag.FlagSet) {
+	fmt.Fprintf(fs.Output(),
+		`Usage: %[1]s sub [options]
+       %[1]s [options]
+
+Subscribes to an MQTT topic using Eclipse Paho and prints incoming messages, supporting
+optional TLS for AWS IoT Core or other brokers. Configuration can come from both a JSON
+file and CLI flags. CLI flags override JSON values. Run '%[1]s help' for other commands.
+
+Options:
+`, filepath.Base(os.Args[0]))
+	fs.PrintDefaults()
+
+	fmt.Fprint(fs.Output(), `
+Examples:
+
+  # Basic local broker usage:
+  mqttcli --broker "tcp://localhost:1883" --clientid "testClient" \
+          --topic "my/test/topic" --qos 1
+
+  # Using AWS IoT Core with mutual TLS:
+  mqttcli --broker "ssl://<endpoint>.amazonaws.com:8883" \
+          --clientid "myThing" \
+          --cafile "AmazonRootCA1.pem" \
+          --certfile "deviceCert.crt" \
+          --keyfile "deviceKey.key" \
+          --topic "iot/gnss/myThing/data" --qos 1
+
+  # Publish a retained message:
+  mqttcli pub --broker "tcp://localhost:1883" --clientid "publisher" \
+          --topic "my/test/topic" --message "hello" --retain
+
+  # Health check: wait up to 10s for one message, exit 0 if it arrives:
+  mqttcli --broker "tcp://localhost:1883" --clientid "probe" \
+          --topic "my/test/topic" --count 1 --timeout 10s
+
+  # JSON config usage:
+  mqttcli --config /path/to/config.json
+
+  # Live chart of a JSON field:
+  mqttcli plot --broker "tcp://localhost:1883" --clientid "plotter" \
+          --topic "sensors/+/env" --field temperature
+`)
+}
+
+// runSubscribe is the sub command, and what runs when no command is given.
+func runSubscribe(args []string) {
+	// 1. Parse CLI flags
+	fs := flag.NewFlagSet("sub", flag.ExitOnError)
+	flags := initCLIFlags(fs)
+	leader := initLeaderFlags(fs)
+	watchConfig := fs.Bool("watch-config", false, "Reconnect with the new settings whenever the --config file changes (e.g. a mounted ConfigMap).")
+	watchCerts := fs.Bool("watch-certs", false, "Reconnect with the renewed client certificate whenever the TLS files change, or on SIGHUP.")
+	fs.IntVar(&flags.Count, "count", 0, "Exit successfully after receiving this many messages.")
+	fs.BoolVar(&flags.SkipRetained, "skip-retained", false, "Ignore retained messages, such as the burst the broker sends on subscribing.")
+	fs.BoolVar(&flags.RetainedOnly, "retained-only", false, "Print the retained messages for the topics and exit.")
+	fs.BoolVar(&flags.UnsubscribeOnExit, "unsubscribe-on-exit", false, "Unsubscribe before disconnecting, so a persistent session stops queuing messages.")
+	fs.DurationVar(&flags.DrainTimeout, "drain-timeout", 0, "On exit, wait up to this long to unsubscribe and finish in-flight QoS 1/2 publishes (default 1s).")
+	fs.BoolVar(&flags.Reassemble, "reassemble", false, "Put payloads published with 'pub --chunk' back together, handling each once all its chunks arrived.")
+	fs.BoolVar(&flags.Reconstruct, "reconstruct", false, "Also subscribe to the delta topics of 'pub --delta' and handle each delta as the document it produces.")
+	fs.DurationVar(&flags.MaxAge, "max-age", 0, "Drop messages whose JSON timestamp is older than this.")
+	fs.StringVar(&flags.SkipBacklog, "skip-backlog", "", "After reconnecting, skip up to this many queued messages (e.g. 500), or those older than this (e.g. 10m).")
+	fs.DurationVar(&flags.LatencyBudget, "latency-budget", 0, "Warn when handling a message takes longer than this (e.g. 50ms), naming the slow stages of the pipeline.")
+	fs.StringVar(&flags.TimestampField, "timestamp-field", "", "Dotted path of the JSON timestamp used by --max-age (Unix s/ms/us/ns or RFC 3339; default 'timestamp').")
+	fs.Var(&flags.ExecSinks, "sink-exec", "Stream each message as a JSON line to the stdin of this long-running command (restarted if it exits). Repeatable.")
+	fs.StringVar(&flags.Exec, "exec", "", "Run this command for each message, with the payload on stdin and MQTT_TOPIC, MQTT_QOS, MQTT_RETAINED, and MQTT_TIMESTAMP set.")
+	fs.IntVar(&flags.ExecConcurrency, "exec-concurrency", 0, "Most --exec commands running at once; more messages wait (default 1).")
+	fs.DurationVar(&flags.ExecTimeout, "exec-timeout", 0, "Kill an --exec command that runs longer than this.")
+	fs.StringVar(&flags.ExecPartition, "exec-partition", "", "Keep --exec commands in order per 'topic' or per --topic-pattern field, running different ones in parallel.")
+	fs.StringVar(&flags.OutFIFO, "out-fifo", "", "Also write each message as a JSON line to this named pipe (created if missing).")
+	fs.BoolVar(&flags.OutFIFOBlock, "out-fifo-block", false, "Wait for a slow --out-fifo reader instead of dropping messages.")
+	fs.StringVar(&flags.DBusSignal, "dbus-signal", "", "Emit a D-Bus signal per message on the 'session' or 'system' bus (Linux).")
+	fs.StringVar(&flags.OutDir, "out-dir", "", "Write each payload, as received, to its own file in this directory.")
+	fs.StringVar(&flags.OutName, "out-name", "", "File name template for --out-dir: {topic}, {timestamp}, {seq}, {qos}, and --topic-pattern fields (default \"{topic}_{timestamp}\").")
+	fs.BoolVar(&flags.AtLeastOnce, "at-least-once", false, "MQTT v5: acknowledge each message only once --exec succeeded or --out-dir wrote it to disk; the broker sends it again otherwise.")
+	fs.StringVar(&flags.HistoryListen, "history-listen", "", "Keep the last messages of each topic and serve them over HTTP on this address (e.g. 127.0.0.1:8787) for 'mqttcli history'.")
+	fs.IntVar(&flags.HistorySize, "history-size", 0, "Messages kept per topic for --history-listen (default 100).")
+	fs.StringVar(&flags.HistoryMaxBytes, "history-max-bytes", "", "Cap on the memory of all --history-listen buffers, e.g. 16MiB (default 64MiB); the oldest messages go first.")
+	fs.DurationVar(&flags.Timeout, "timeout", 0, "Exit with status 4 if --count messages (default 1) don't arrive within this long of subscribing.")
+	fs.Usage = func() { subUsage(fs) }
+	fs.Parse(args)
+
+	// 2. Load config, apply overrides, and validate
+	cfg := buildConfig(flags)
+	if *watchConfig && flags.ConfigPath == "" {
+		fatal("config_invalid", false, "--watch-config needs --config.")
+	}
+	if *watchCerts && len(certFilePaths(&cfg)) == 0 {
+		fatal("config_invalid", false, "--watch-certs needs TLS files to watch (--cafile, --certfile, --keyfile, --chainfile, or --pkcs12).")
+	}
+	if (*watchConfig || *watchCerts) && (cfg.Count > 0 || cfg.Timeout > 0 || cfg.RetainedOnly) {
+		fatal("config_invalid", false, "--count, --timeout, and --retained-only can't be combined with --watch-config or --watch-certs.")
+	}
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx := sigCtx
+
+	// SIGHUP reloads the certificate instead of ending the process
+	var reload chan os.Signal
+	if *watchCerts {
+		reload = make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		defer signal.Stop(reload)
+	}
+
+	// Only one replica subscribes at a time when leader election is enabled
+	if leader.Lease != "" {
+		if cfg.AirGapped {
+			fatal("config_invalid", false, "air_gapped rules out leader election, which talks to the Kubernetes API.")
+		}
+		elector, err := newLeaderElector(leader)
+		if err != nil {
+			fatal("config_invalid", false, "Leader election: %v", err)
+		}
+		if ctx, err = elector.acquire(sigCtx); err != nil {
+			return
+		}
+		defer elector.release()
+	}
+
+	// The history outlives reconnects, so it keeps the settings it started with
+	history, err := newMessageHistory(&cfg)
+	if err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+	if err := history.serve(ctx, cfg.HistoryListen); err != nil {
+		fatal("history_failed", false, "Could not serve the message history: %v", err)
+	}
+
+	for {
+		pattern, err := parseTopicPattern(cfg.TopicPattern)
+		if err != nil {
+			fatal("config_invalid", false, "%v", err)
+		}
+		rewriter, err := newTopicRewriter(cfg.TopicRewrites)
+		if err != nil {
+			fatal("config_invalid", false, "%v", err)
+		}
+		abbrev := newTopicAbbreviator(cfg.TopicAliases, cfg.TopicAbbrev, os.Stdout)
+
+		// 3. Connect, subscribe, and print messages until shutdown (or a config change)
+		runCtx := ctx
+		if *watchConfig {
+			runCtx = watchConfigFile(ctx, flags.ConfigPath)
+		}
+		if *watchCerts {
+			runCtx = watchCertFiles(runCtx, &cfg, reload)
+		}
+		sinks, err := newSinks(&cfg)
+		if err != nil {
+			fatal("config_invalid", false, "%v", err)
+		}
+		runSubscription(runCtx, &cfg, pipeline.stage("history", history.wrap(pipeline.stage("sinks", sinks.wrap(pipeline.stage("print", messageHandler(&cfg, pattern, rewriter, abbrev)), pattern)), pattern)))
+		sinks.Close()
+		if ctx.Err() != nil || !(*watchConfig || *watchCerts) {
+			break
+		}
+		cfg = buildConfig(flags)
+	}
+
+	// Exit non-zero on a lost lease so the pod is restarted and rejoins the election
+	if ctx.Err() != nil && sigCtx.Err() == nil {
+		fatal("leader_lost", true, "Lost lease '%s', exiting.", leader.Lease)
+	}
+}
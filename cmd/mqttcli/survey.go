@@ -0,0 +1,461 @@
+// survey.go
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	packets3 "github.com/eclipse/paho.mqtt.golang/packets"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultSurveyTopic is subscribed to when --topic isn't given; nothing
+// should publish there, so pings aren't held up by messages.
+const defaultSurveyTopic = "mqttcli/survey"
+
+// surveyBroker is one endpoint in a --brokers file.
+type surveyBroker struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+}
+
+// UnmarshalYAML accepts either a bare URL or a mapping with name and url.
+func (b *surveyBroker) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		b.URL = n.Value
+		return nil
+	}
+	type plain surveyBroker
+	return n.Decode((*plain)(b))
+}
+
+// loadSurveyBrokers reads a --brokers file: a YAML list of brokers, or a
+// mapping with the list under "brokers".
+func loadSurveyBrokers(path string) ([]surveyBroker, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid broker list '%s': %v", path, err)
+	}
+	var brokers []surveyBroker
+	if len(doc.Content) > 0 {
+		if root := doc.Content[0]; root.Kind == yaml.SequenceNode {
+			err = root.Decode(&brokers)
+		} else {
+			var wrapped struct {
+				Brokers []surveyBroker `yaml:"brokers"`
+			}
+			err = root.Decode(&wrapped)
+			brokers = wrapped.Brokers
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid broker list '%s': %v", path, err)
+		}
+	}
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("no brokers listed in '%s'", path)
+	}
+	for i := range brokers {
+		if brokers[i].URL == "" {
+			return nil, fmt.Errorf("broker %d in '%s' has no url", i+1, path)
+		}
+		if brokers[i].Name == "" {
+			brokers[i].Name = redactedBroker(brokers[i].URL)
+		}
+	}
+	return brokers, nil
+}
+
+// surveyTimings is how long each step of one connection took. tls is -1
+// without TLS, or when it's part of a WebSocket dial.
+type surveyTimings struct {
+	dns, dial, tls, connect, subscribe, ping time.Duration
+}
+
+func (t surveyTimings) total() time.Duration {
+	return t.dns + t.dial + max(t.tls, 0) + t.connect + t.subscribe + t.ping
+}
+
+// surveyConn connects to broker once over MQTT 3.1.1, timing DNS, the TCP
+// dial, the TLS handshake, CONNECT, SUBSCRIBE, and the median of pings
+// PINGREQ round trips, then disconnects. For ws:// and wss:// the WebSocket
+// dial, including any TLS, counts as the dial. tlsConfig is shared by every
+// connection and is cloned before use.
+func surveyConn(ctx context.Context, cfg *Config, tlsConfig *tls.Config, broker string, pings int) (surveyTimings, error) {
+	var t surveyTimings
+	u, err := url.Parse(broker)
+	if err != nil {
+		return t, fmt.Errorf("invalid broker URL: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cfg.ConnectTimeout))
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	start := time.Now()
+	if _, err := net.DefaultResolver.LookupHost(ctx, u.Hostname()); err != nil {
+		return t, err
+	}
+	t.dns = time.Since(start)
+
+	var conn net.Conn
+	start = time.Now()
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts", "tcps":
+		useTLS := u.Scheme != "tcp" && u.Scheme != "mqtt"
+		port := u.Port()
+		if port == "" {
+			port = map[bool]string{false: "1883", true: "8883"}[useTLS]
+		}
+		if conn, err = egressDialer(0).DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port)); err != nil {
+			return t, err
+		}
+		t.dial, t.tls = time.Since(start), -1
+		if useTLS {
+			c := tlsConfig.Clone()
+			if c.ServerName == "" {
+				c.ServerName = u.Hostname()
+			}
+			start = time.Now()
+			tc := tls.Client(conn, c)
+			if err := tc.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return t, err
+			}
+			t.tls, conn = time.Since(start), tc
+		}
+	case "ws", "wss":
+		var wsTLS *tls.Config
+		if u.Scheme == "wss" || hasTLSMaterial(cfg) {
+			wsTLS = tlsConfig.Clone()
+		}
+		header, err := wsHeader(cfg)
+		if err != nil {
+			return t, err
+		}
+		if conn, err = dialWebSocket(cfg, broker, wsTLS, header); err != nil {
+			return t, err
+		}
+		t.dial, t.tls = time.Since(start), -1
+	default:
+		return t, fmt.Errorf("broker scheme '%s' is not supported by survey", u.Scheme)
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	cp := packets3.NewControlPacket(packets3.Connect).(*packets3.ConnectPacket)
+	cp.ProtocolName, cp.ProtocolVersion = "MQTT", 4
+	cp.CleanSession, cp.Keepalive = true, 30
+	cp.ClientIdentifier = cfg.ClientID
+	if cfg.Username != "" {
+		cp.Username, cp.UsernameFlag = cfg.Username, true
+	}
+	if cfg.Password != "" {
+		cp.Password, cp.PasswordFlag = []byte(cfg.Password), true
+	}
+	start = time.Now()
+	if err := cp.Write(conn); err != nil {
+		return t, err
+	}
+	p, err := surveyAwait(conn, packets3.Connack)
+	if err != nil {
+		return t, err
+	}
+	if rc := p.(*packets3.ConnackPacket).ReturnCode; rc != packets3.Accepted {
+		return t, packets3.ConnErrors[rc]
+	}
+	t.connect = time.Since(start)
+
+	sp := packets3.NewControlPacket(packets3.Subscribe).(*packets3.SubscribePacket)
+	sp.MessageID = 1
+	sp.Topics = []string{cfg.Topics[0].Topic}
+	sp.Qoss = []byte{0}
+	start = time.Now()
+	if err := sp.Write(conn); err != nil {
+		return t, err
+	}
+	if p, err = surveyAwait(conn, packets3.Suback); err != nil {
+		return t, err
+	}
+	if rc := p.(*packets3.SubackPacket).ReturnCodes; len(rc) == 0 || rc[0] == 0x80 {
+		return t, fmt.Errorf("subscription to '%s' refused", sp.Topics[0])
+	}
+	t.subscribe = time.Since(start)
+
+	rtts := make([]time.Duration, 0, pings)
+	for i := 0; i < pings; i++ {
+		start = time.Now()
+		if err := packets3.NewControlPacket(packets3.Pingreq).Write(conn); err != nil {
+			return t, err
+		}
+		if _, err := surveyAwait(conn, packets3.Pingresp); err != nil {
+			return t, err
+		}
+		rtts = append(rtts, time.Since(start))
+	}
+	t.ping = medianDuration(rtts)
+
+	packets3.NewControlPacket(packets3.Disconnect).Write(conn)
+	return t, nil
+}
+
+// surveyAwait reads packets until one of type want, skipping messages
+// delivered on the subscription.
+func surveyAwait(r io.Reader, want byte) (packets3.ControlPacket, error) {
+	for {
+		p, err := packets3.ReadPacket(r)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return nil, fmt.Errorf("timed out waiting for %s", packets3.PacketNames[want])
+			}
+			return nil, err
+		}
+		var got byte
+		switch p.(type) {
+		case *packets3.PublishPacket:
+			continue
+		case *packets3.ConnackPacket:
+			got = packets3.Connack
+		case *packets3.SubackPacket:
+			got = packets3.Suback
+		case *packets3.PingrespPacket:
+			got = packets3.Pingresp
+		}
+		if got != want {
+			return nil, fmt.Errorf("expected %s, got %s", packets3.PacketNames[want], p)
+		}
+		return p, nil
+	}
+}
+
+func medianDuration(d []time.Duration) time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+	s := append([]time.Duration(nil), d...)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	return s[len(s)/2]
+}
+
+// surveyResult is one broker's medians over the rounds that succeeded.
+type surveyResult struct {
+	broker   surveyBroker
+	rounds   int
+	failures int
+	err      error // from the last failed round
+	median   surveyTimings
+}
+
+// surveyBrokerRounds connects to b rounds times, one after another.
+func surveyBrokerRounds(ctx context.Context, cfg *Config, tlsConfig *tls.Config, b surveyBroker, rounds, pings int) surveyResult {
+	res := surveyResult{broker: b, rounds: rounds}
+	var got []surveyTimings
+	for i := 0; i < rounds && ctx.Err() == nil; i++ {
+		t, err := surveyConn(ctx, cfg, tlsConfig, b.URL, pings)
+		if err != nil {
+			res.failures++
+			res.err = err
+			continue
+		}
+		got = append(got, t)
+	}
+	if len(got) == 0 {
+		if res.err == nil {
+			res.err = ctx.Err()
+		}
+		return res
+	}
+	pick := func(f func(t surveyTimings) time.Duration) time.Duration {
+		var d []time.Duration
+		for _, t := range got {
+			d = append(d, f(t))
+		}
+		return medianDuration(d)
+	}
+	res.median = surveyTimings{
+		dns:       pick(func(t surveyTimings) time.Duration { return t.dns }),
+		dial:      pick(func(t surveyTimings) time.Duration { return t.dial }),
+		tls:       pick(func(t surveyTimings) time.Duration { return t.tls }),
+		connect:   pick(func(t surveyTimings) time.Duration { return t.connect }),
+		subscribe: pick(func(t surveyTimings) time.Duration { return t.subscribe }),
+		ping:      pick(func(t surveyTimings) time.Duration { return t.ping }),
+	}
+	return res
+}
+
+// rankSurvey orders results best first by the chosen measure; brokers that
+// never connected come last.
+func rankSurvey(results []surveyResult, by string) {
+	measure := func(r surveyResult) time.Duration {
+		switch by {
+		case "connect":
+			return r.median.dns + r.median.dial + max(r.median.tls, 0) + r.median.connect
+		case "total":
+			return r.median.total()
+		}
+		return r.median.ping
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if okA, okB := a.failures < a.rounds, b.failures < b.rounds; okA != okB {
+			return okA
+		}
+		if a.failures != b.failures {
+			return a.failures < b.failures
+		}
+		if ma, mb := measure(a), measure(b); ma != mb {
+			return ma < mb
+		}
+		return a.median.total() < b.median.total()
+	})
+}
+
+func surveyMillis(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Microsecond)) / 1000
+}
+
+// printSurvey writes the ranked comparison as a table.
+func printSurvey(out io.Writer, results []surveyResult) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "RANK\tBROKER\tDNS\tDIAL\tTLS\tCONNECT\tSUBSCRIBE\tPING\tTOTAL\tFAILED\t\n")
+	ms := func(d time.Duration) string {
+		if d < 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.1fms", surveyMillis(d))
+	}
+	for i, r := range results {
+		failed := fmt.Sprintf("%d/%d", r.failures, r.rounds)
+		if r.failures == r.rounds {
+			fmt.Fprintf(w, "-\t%s\t\t\t\t\t\t\t\t%s\t%v\n", r.broker.Name, failed, r.err)
+			continue
+		}
+		t := r.median
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n", i+1, r.broker.Name,
+			ms(t.dns), ms(t.dial), ms(t.tls), ms(t.connect), ms(t.subscribe), ms(t.ping), ms(t.total()), failed)
+	}
+	w.Flush()
+}
+
+// surveyJSON is one broker in --output json.
+type surveyJSON struct {
+	Rank        int      `json:"rank,omitempty"`
+	Name        string   `json:"name"`
+	URL         string   `json:"url"`
+	Rounds      int      `json:"rounds"`
+	Failures    int      `json:"failures"`
+	Error       string   `json:"error,omitempty"`
+	DNSMs       *float64 `json:"dns_ms,omitempty"`
+	DialMs      *float64 `json:"dial_ms,omitempty"`
+	TLSMs       *float64 `json:"tls_ms,omitempty"`
+	ConnectMs   *float64 `json:"connect_ms,omitempty"`
+	SubscribeMs *float64 `json:"subscribe_ms,omitempty"`
+	PingMs      *float64 `json:"ping_ms,omitempty"`
+	TotalMs     *float64 `json:"total_ms,omitempty"`
+}
+
+func printSurveyJSON(out io.Writer, results []surveyResult) {
+	enc := json.NewEncoder(out)
+	for i, r := range results {
+		j := surveyJSON{Name: r.broker.Name, URL: redactedBroker(r.broker.URL), Rounds: r.rounds, Failures: r.failures}
+		if r.err != nil {
+			j.Error = r.err.Error()
+		}
+		if r.failures < r.rounds {
+			ms := func(d time.Duration) *float64 {
+				v := surveyMillis(d)
+				return &v
+			}
+			t := r.median
+			j.Rank = i + 1
+			j.DNSMs, j.DialMs = ms(t.dns), ms(t.dial)
+			if t.tls > 0 {
+				j.TLSMs = ms(t.tls)
+			}
+			j.ConnectMs, j.SubscribeMs, j.PingMs, j.TotalMs = ms(t.connect), ms(t.subscribe), ms(t.ping), ms(t.total())
+		}
+		enc.Encode(j)
+	}
+}
+
+// runSurvey implements "mqttcli survey": it connects to each broker in a
+// list and ranks them by latency, to pick the closest regional endpoint.
+func runSurvey(args []string) {
+	fs := flag.NewFlagSet("survey", flag.ExitOnError)
+	flags := initCLIFlags(fs)
+	brokersPath := fs.String("brokers", "", "YAML file listing the brokers to compare (required).")
+	rounds := fs.Int("rounds", 3, "Connections to make to each broker; the table shows medians.")
+	pings := fs.Int("pings", 5, "PINGREQ round trips to time on each connection.")
+	rankBy := fs.String("rank-by", "ping", "What to rank by: ping, connect (until CONNACK), or total.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s survey --brokers list.yaml [options]\n\n"+
+			"The list is YAML: URLs, or mappings with name and url, optionally under 'brokers:'.\n"+
+			"Connection flags such as --clientid, --cafile, and --cert apply to every broker.\n"+
+			"--topic defaults to '%s'. --output json prints one object per broker, best first.\n\nOptions:\n", filepath.Base(os.Args[0]), defaultSurveyTopic)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *brokersPath == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	switch {
+	case *rounds < 1:
+		fatal("config_invalid", false, "--rounds must be at least 1")
+	case *pings < 1:
+		fatal("config_invalid", false, "--pings must be at least 1")
+	case *rankBy != "ping" && *rankBy != "connect" && *rankBy != "total":
+		fatal("config_invalid", false, "--rank-by must be ping, connect, or total, not '%s'", *rankBy)
+	}
+	brokers, err := loadSurveyBrokers(*brokersPath)
+	if err != nil {
+		fatal("config_invalid", false, "%v", err)
+	}
+	if flags.BrokerURL == "" {
+		flags.BrokerURL = brokers[0].URL
+	}
+	if len(flags.Topics) == 0 {
+		flags.Topics = topicFlag{{Topic: defaultSurveyTopic}}
+	}
+	cfg := buildConfig(flags)
+	tlsConfig, err := NewTLSConfig(&cfg)
+	if err != nil {
+		fatal("tls_failed", false, "Failed to load TLS settings: %v", err)
+	}
+
+	ctx := context.Background()
+	var results []surveyResult
+	reachable := false
+	for _, b := range brokers {
+		logInfo("survey_broker", "Surveying %s", b.Name)
+		r := surveyBrokerRounds(ctx, &cfg, tlsConfig, b, *rounds, *pings)
+		reachable = reachable || r.failures < r.rounds
+		results = append(results, r)
+	}
+	rankSurvey(results, *rankBy)
+	if cfg.Output == "json" {
+		printSurveyJSON(os.Stdout, results)
+	} else {
+		printSurvey(os.Stdout, results)
+	}
+	if !reachable {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,78 @@
+// textformat.go
+package main
+
+import (
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Message line layouts selected with --format.
+const (
+	formatShort       = "short"        // topic, QoS, topic fields, and properties (default)
+	formatFull        = "full"         // short, plus retained flag, message ID, and size
+	formatPayloadOnly = "payload-only" // just the payload, for piping
+)
+
+// Message timestamps selected with --timestamp.
+const (
+	timestampNone     = "none" // default
+	timestampUnix     = "unix"
+	timestampRFC3339  = "rfc3339"
+	timestampRelative = "relative" // since mqttcli started handling messages
+)
+
+func validTextFormat(format string) error {
+	switch format {
+	case "", formatShort, formatFull, formatPayloadOnly:
+		return nil
+	}
+	return fmt.Errorf("unknown format '%s'; use short, full, or payload-only", format)
+}
+
+func validTimestamp(mode string) error {
+	switch mode {
+	case "", timestampNone, timestampUnix, timestampRFC3339, timestampRelative:
+		return nil
+	}
+	return fmt.Errorf("unknown timestamp '%s'; use none, unix, rfc3339, or relative", mode)
+}
+
+// stamper prefixes text output lines with the time each message arrived.
+type stamper struct {
+	mode  string
+	start time.Time
+}
+
+func newStamper(mode string) *stamper {
+	return &stamper{mode: mode, start: time.Now()}
+}
+
+// stamp returns the prefix for a line printed at now, with a trailing space,
+// or "" without --timestamp.
+func (s *stamper) stamp(now time.Time) string {
+	switch s.mode {
+	case timestampUnix:
+		return fmt.Sprintf("%d.%03d ", now.Unix(), now.Nanosecond()/int(time.Millisecond))
+	case timestampRFC3339:
+		return now.UTC().Format("2006-01-02T15:04:05.000Z07:00") + " "
+	case timestampRelative:
+		return fmt.Sprintf("+%.3fs ", now.Sub(s.start).Seconds())
+	}
+	return ""
+}
+
+// metadata returns the "[MSG RECEIVED] ... Payload=" part of a text line in
+// the given layout; fields are the topic fields and properties, each followed
+// by a space.
+func metadata(format, topic string, msg mqtt.Message, fields string) string {
+	switch format {
+	case formatPayloadOnly:
+		return ""
+	case formatFull:
+		return fmt.Sprintf("[MSG RECEIVED] Topic=%s QoS=%d Retained=%t MessageID=%d Size=%d %sPayload=",
+			topic, msg.Qos(), msg.Retained(), msg.MessageID(), len(msg.Payload()), fields)
+	}
+	return fmt.Sprintf("[MSG RECEIVED] Topic=%s QoS=%d %sPayload=", topic, msg.Qos(), fields)
+}
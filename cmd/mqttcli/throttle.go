@@ -0,0 +1,194 @@
+// throttle.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// throttleWarnEvery limits how often each kind of signal is logged.
+	throttleWarnEvery = 30 * time.Second
+	// slowAckWarmup acknowledgements set the baseline before any counts as slow.
+	slowAckWarmup = 20
+	// An acknowledgement is slow past slowAckFactor times the usual latency
+	// (and at least slowAckFloor), or past slowAckCeiling regardless.
+	slowAckFactor  = 10
+	slowAckFloor   = 500 * time.Millisecond
+	slowAckCeiling = 5 * time.Second
+	// awsPublishRate and awsPublishBytes are AWS IoT Core's per-connection
+	// limits; a connection going over them is throttled and may be closed.
+	awsPublishRate  = 100
+	awsPublishBytes = 512 << 10
+)
+
+// throttleAdvice says what each throttling signal means and what to do about it.
+var throttleAdvice = map[string]string{
+	"quota_exceeded":           "the broker's quota for this client or account is used up; publish less often or in batches, or ask the broker operator to raise the quota",
+	"message_rate_too_high":    "the broker limits how fast this client may publish; slow down, e.g. with pub --rate or a longer --interval",
+	"server_busy":              "the broker is overloaded; mqttcli backs off before retrying, and --reconnect-delay spaces the attempts further",
+	"connection_rate_exceeded": "the broker limits how often a client may connect; raise --reconnect-delay, and don't run several instances with one --clientid",
+	"aws_throttled":            fmt.Sprintf("AWS IoT Core closes connections publishing over %d messages or %d KiB a second; slow down with pub --rate, or spread the load over several client IDs", awsPublishRate, awsPublishBytes>>10),
+	"slow_ack":                 "the broker takes much longer than usual to acknowledge QoS 1/2 publishes, which is how many brokers throttle; lower the publish rate or use QoS 0 where losing a message is acceptable",
+}
+
+// throttleReasons are the MQTT v5 reason codes brokers use to throttle.
+var throttleReasons = map[byte]string{
+	0x89: "server_busy",
+	0x96: "message_rate_too_high",
+	0x97: "quota_exceeded",
+	0x9F: "connection_rate_exceeded",
+}
+
+// throttleMonitor counts the signs that the broker is throttling this client,
+// warning with advice as they appear and summing them up on disconnect.
+type throttleMonitor struct {
+	mu       sync.Mutex
+	counts   map[string]int64
+	warned   map[string]time.Time
+	reported bool
+
+	// publishes in the current and previous second, for AWS IoT's limits
+	second                int64
+	published, prevPubs   int
+	publishedB, prevBytes int
+
+	// usual acknowledgement latency, an exponential moving average
+	acks    int
+	ackAvg  time.Duration
+	slowest time.Duration
+}
+
+// throttle monitors the connections of this run.
+var throttle = &throttleMonitor{counts: map[string]int64{}, warned: map[string]time.Time{}}
+
+// signal counts one throttling signal, logging it with advice unless the
+// same kind was logged within throttleWarnEvery.
+func (t *throttleMonitor) signal(kind, detail string) {
+	t.mu.Lock()
+	t.counts[kind]++
+	n := t.counts[kind]
+	last, seen := t.warned[kind]
+	now := time.Now()
+	if seen && now.Sub(last) < throttleWarnEvery {
+		t.mu.Unlock()
+		return
+	}
+	t.warned[kind] = now
+	t.mu.Unlock()
+	logWarn("broker_throttling", "Broker throttling (%s, %d so far): %s; %s", kind, n, detail, throttleAdvice[kind])
+}
+
+// reasonCode counts a v5 reason code that throttles, from the given packet.
+func (t *throttleMonitor) reasonCode(rc *reasonCodeError) {
+	if kind, ok := throttleReasons[rc.code]; ok {
+		t.signal(kind, rc.Error())
+	}
+}
+
+// publishing counts an outgoing publish of size bytes.
+func (t *throttleMonitor) publishing(size int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.roll(time.Now().Unix())
+	t.published++
+	t.publishedB += size
+}
+
+// roll starts a new second of publish counts.
+func (t *throttleMonitor) roll(sec int64) {
+	if sec == t.second {
+		return
+	}
+	if sec == t.second+1 {
+		t.prevPubs, t.prevBytes = t.published, t.publishedB
+	} else {
+		t.prevPubs, t.prevBytes = 0, 0
+	}
+	t.second, t.published, t.publishedB = sec, 0, 0
+}
+
+// acked records how long the broker took to acknowledge a publish.
+func (t *throttleMonitor) acked(d time.Duration) {
+	t.mu.Lock()
+	slow := d > slowAckCeiling || (t.acks >= slowAckWarmup && d > slowAckFloor && d > slowAckFactor*t.ackAvg)
+	if slow {
+		t.slowest = max(t.slowest, d)
+	} else if t.acks++; t.acks == 1 {
+		t.ackAvg = d
+	} else {
+		t.ackAvg += (d - t.ackAvg) / 20
+	}
+	avg := t.ackAvg
+	t.mu.Unlock()
+	if slow {
+		t.signal("slow_ack", fmt.Sprintf("a publish took %s to be acknowledged, against %s usually", d.Round(time.Millisecond), avg.Round(time.Microsecond)))
+	}
+}
+
+// connectionLost checks whether a dropped connection looks like throttling:
+// AWS IoT Core closes MQTT 3 connections that go over its rate limits
+// without saying why, so a close right after such a burst counts.
+func (t *throttleMonitor) connectionLost(cfg *Config, err error) {
+	var rc *reasonCodeError
+	if errors.As(err, &rc) || !isAWSIoTEndpoint(cfg.BrokerURL) {
+		return
+	}
+	if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, syscall.ECONNRESET) &&
+		!strings.Contains(err.Error(), "connection reset") {
+		return
+	}
+	t.mu.Lock()
+	t.roll(time.Now().Unix())
+	pubs, bytes := max(t.published, t.prevPubs), max(t.publishedB, t.prevBytes)
+	t.mu.Unlock()
+	if pubs > awsPublishRate || bytes > awsPublishBytes {
+		t.signal("aws_throttled", fmt.Sprintf("AWS IoT closed the connection (%v) after %d publishes (%d KiB) in a second", err, pubs, bytes>>10))
+	}
+}
+
+// snapshot returns the signals counted so far, or nil if there were none.
+func (t *throttleMonitor) snapshot() map[string]int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.counts) == 0 {
+		return nil
+	}
+	counts := make(map[string]int64, len(t.counts))
+	for k, n := range t.counts {
+		counts[k] = n
+	}
+	return counts
+}
+
+// summarize logs the signals of the run, once, if there were any.
+func (t *throttleMonitor) summarize() {
+	t.mu.Lock()
+	done := t.reported
+	t.reported = true
+	slowest := t.slowest
+	t.mu.Unlock()
+	counts := t.snapshot()
+	if done || counts == nil {
+		return
+	}
+	kinds := make([]string, 0, len(counts))
+	for k := range counts {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	parts := make([]string, len(kinds))
+	for i, k := range kinds {
+		parts[i] = fmt.Sprintf("%s %d", k, counts[k])
+		if k == "slow_ack" {
+			parts[i] += fmt.Sprintf(" (slowest %s)", slowest.Round(time.Millisecond))
+		}
+	}
+	logWarn("throttling_summary", "The broker throttled this client: %s", strings.Join(parts, ", "))
+}
@@ -0,0 +1,136 @@
+// throttle_test.go
+package main
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newThrottleMonitor() *throttleMonitor {
+	return &throttleMonitor{counts: map[string]int64{}, warned: map[string]time.Time{}}
+}
+
+// repeat returns n acknowledgement latencies of d.
+func repeat(n int, d time.Duration) []time.Duration {
+	l := make([]time.Duration, n)
+	for i := range l {
+		l[i] = d
+	}
+	return l
+}
+
+func TestThrottleSlowAck(t *testing.T) {
+	ms := time.Millisecond
+	for _, tc := range []struct {
+		name    string
+		acks    []time.Duration
+		slow    int64
+		slowest time.Duration
+	}{
+		{"steady", repeat(30, 10*ms), 0, 0},
+		{"spike while warming up", append(repeat(5, 10*ms), time.Second), 0, 0},
+		{"spike", append(repeat(slowAckWarmup, 10*ms), time.Second), 1, time.Second},
+		{"spike under the floor", append(repeat(slowAckWarmup, 10*ms), 400*ms), 0, 0},
+		{"over the ceiling while warming up", []time.Duration{6 * time.Second}, 1, 6 * time.Second},
+		{"slow as usual", append(repeat(slowAckWarmup, 200*ms), time.Second), 0, 0},
+		{"spikes don't move the baseline", append(repeat(slowAckWarmup, 10*ms), time.Second, 2*time.Second, time.Second), 3, 2 * time.Second},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newThrottleMonitor()
+			for _, d := range tc.acks {
+				m.acked(d)
+			}
+			if got := m.snapshot()["slow_ack"]; got != tc.slow {
+				t.Errorf("got %d slow acknowledgements, want %d", got, tc.slow)
+			}
+			if m.slowest != tc.slowest {
+				t.Errorf("got slowest %s, want %s", m.slowest, tc.slowest)
+			}
+		})
+	}
+}
+
+func TestThrottleReasonCode(t *testing.T) {
+	for _, tc := range []struct {
+		code byte
+		want map[string]int64
+	}{
+		{0x89, map[string]int64{"server_busy": 1}},
+		{0x96, map[string]int64{"message_rate_too_high": 1}},
+		{0x97, map[string]int64{"quota_exceeded": 1}},
+		{0x9F, map[string]int64{"connection_rate_exceeded": 1}},
+		{0x87, nil}, // not authorized
+	} {
+		m := newThrottleMonitor()
+		m.reasonCode(&reasonCodeError{packet: "PUBACK", code: tc.code, name: "test"})
+		if got := m.snapshot(); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("reason code 0x%02X: got %v, want %v", tc.code, got, tc.want)
+		}
+	}
+}
+
+func TestThrottleConnectionLost(t *testing.T) {
+	aws := "ssl://abc123-ats.iot.eu-west-1.amazonaws.com:8883"
+	for _, tc := range []struct {
+		name      string
+		broker    string
+		err       error
+		publishes int
+		size      int
+		throttled bool
+	}{
+		{"over the rate", aws, io.EOF, awsPublishRate + 1, 10, true},
+		{"over the bytes", aws, syscall.ECONNRESET, 2, awsPublishBytes, true},
+		{"reset by peer", aws, errors.New("read tcp: connection reset by peer"), awsPublishRate + 1, 10, true},
+		{"under the limits", aws, io.EOF, awsPublishRate, 10, false},
+		{"another broker", "tcp://localhost:1883", io.EOF, awsPublishRate + 1, 10, false},
+		{"with a reason code", aws, &reasonCodeError{packet: "DISCONNECT", code: 0x8E, name: "Session taken over"}, awsPublishRate + 1, 10, false},
+		{"another error", aws, errors.New("pingresp not received"), awsPublishRate + 1, 10, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newThrottleMonitor()
+			for i := 0; i < tc.publishes; i++ {
+				m.publishing(tc.size)
+			}
+			m.connectionLost(&Config{BrokerURL: tc.broker}, tc.err)
+			if got := m.snapshot()["aws_throttled"] > 0; got != tc.throttled {
+				t.Errorf("got throttled %t, want %t", got, tc.throttled)
+			}
+		})
+	}
+}
+
+func TestThrottleRoll(t *testing.T) {
+	m := newThrottleMonitor()
+	m.second, m.published, m.publishedB = 100, 5, 50
+	m.roll(100)
+	if m.published != 5 {
+		t.Errorf("the same second reset the count to %d", m.published)
+	}
+	m.roll(101)
+	if m.published != 0 || m.prevPubs != 5 || m.prevBytes != 50 {
+		t.Errorf("next second: got %d now, %d (%d bytes) before; want 0, 5 (50 bytes)", m.published, m.prevPubs, m.prevBytes)
+	}
+	m.published = 3
+	m.roll(103)
+	if m.published != 0 || m.prevPubs != 0 || m.prevBytes != 0 {
+		t.Errorf("after a quiet second: got %d now, %d (%d bytes) before; want nothing", m.published, m.prevPubs, m.prevBytes)
+	}
+}
+
+func TestThrottleSignalCounts(t *testing.T) {
+	m := newThrottleMonitor()
+	for i := 0; i < 3; i++ {
+		m.signal("server_busy", "test")
+	}
+	if got := m.snapshot(); !reflect.DeepEqual(got, map[string]int64{"server_busy": 3}) {
+		t.Errorf("got %v, want server_busy counted 3 times", got)
+	}
+	if len(m.warned) != 1 {
+		t.Errorf("got %d kinds warned about, want 1", len(m.warned))
+	}
+}
@@ -0,0 +1,44 @@
+// timestamp.go
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseTimestamp interprets a JSON value as a point in time. Numbers (or numeric
+// strings) are Unix time, with the unit inferred from magnitude: seconds,
+// milliseconds, microseconds, or nanoseconds. Other strings are parsed as RFC 3339.
+func parseTimestamp(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case float64:
+		return unixFromNumber(t), true
+	case string:
+		s := strings.TrimSpace(t)
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return unixFromNumber(f), true
+		}
+		if ts, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return ts, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// unixFromNumber converts a Unix timestamp whose unit is inferred from its magnitude.
+func unixFromNumber(f float64) time.Time {
+	abs := math.Abs(f)
+	switch {
+	case abs >= 1e17:
+		return time.Unix(0, int64(f))
+	case abs >= 1e14:
+		return time.UnixMicro(int64(f))
+	case abs >= 1e11:
+		return time.UnixMilli(int64(f))
+	default:
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9))
+	}
+}
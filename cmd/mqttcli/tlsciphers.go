@@ -0,0 +1,119 @@
+// tlsciphers.go
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// tlsVersionNames maps tls_min_version and tls_max_version values to versions.
+var tlsVersionNames = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion returns the version named by s, or def if s is empty.
+func parseTLSVersion(s string, def uint16) (uint16, error) {
+	if s == "" {
+		return def, nil
+	}
+	v, ok := tlsVersionNames[strings.TrimPrefix(strings.ToLower(s), "tls")]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version '%s'; use 1.0, 1.1, 1.2, or 1.3", s)
+	}
+	return v, nil
+}
+
+// tlsVersions returns the TLS versions cfg allows, TLS 1.2 to 1.3 by default.
+func tlsVersions(cfg *Config) (min, max uint16, err error) {
+	if min, err = parseTLSVersion(cfg.TLSMinVersion, tls.VersionTLS12); err != nil {
+		return 0, 0, err
+	}
+	if max, err = parseTLSVersion(cfg.TLSMaxVersion, tls.VersionTLS13); err != nil {
+		return 0, 0, err
+	}
+	if min > max {
+		return 0, 0, fmt.Errorf("tls_min_version %s is above tls_max_version %s", tls.VersionName(min), tls.VersionName(max))
+	}
+	return min, max, nil
+}
+
+// cipherSuites returns the suites named in ciphers (IANA names such as
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, comma-separated or one per value),
+// or nil for Go's defaults. The second result names those Go considers
+// insecure, which are only used when asked for by name. TLS 1.3 suites
+// can't be chosen: Go always offers all three, which are all secure.
+func cipherSuites(ciphers []string) ([]uint16, []string, error) {
+	known := map[string]*tls.CipherSuite{}
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = s
+	}
+	for _, s := range tls.InsecureCipherSuites() {
+		known[s.Name] = s
+	}
+	var ids []uint16
+	var insecure []string
+	for _, v := range ciphers {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.ToUpper(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			s, ok := known[name]
+			if !ok {
+				return nil, nil, fmt.Errorf("unknown cipher suite '%s'; TLS 1.2 suites are %s", name, strings.Join(tls12Suites(), ", "))
+			}
+			if len(s.SupportedVersions) == 1 && s.SupportedVersions[0] == tls.VersionTLS13 {
+				return nil, nil, fmt.Errorf("cipher suite '%s' is TLS 1.3, whose suites can't be restricted; list TLS 1.2 suites, or set tls_min_version 1.3", name)
+			}
+			if s.Insecure {
+				insecure = append(insecure, s.Name)
+			}
+			ids = append(ids, s.ID)
+		}
+	}
+	return ids, insecure, nil
+}
+
+// tls12Suites names the secure suites that can be chosen, for error messages.
+func tls12Suites() []string {
+	var names []string
+	for _, s := range tls.CipherSuites() {
+		for _, v := range s.SupportedVersions {
+			if v == tls.VersionTLS12 {
+				names = append(names, s.Name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// checkTLSVersions validates the TLS versions and cipher suites of cfg,
+// warning about the insecure ones it allows.
+func checkTLSVersions(cfg *Config) error {
+	min, max, err := tlsVersions(cfg)
+	if err != nil {
+		return err
+	}
+	suites, insecure, err := cipherSuites(cfg.Ciphers)
+	if err != nil {
+		return err
+	}
+	if len(suites) > 0 && min == tls.VersionTLS13 {
+		return fmt.Errorf("ciphers only apply to TLS 1.2 and older, but tls_min_version is 1.3")
+	}
+	if min < tls.VersionTLS12 {
+		logWarn("tls_legacy_version", "Accepting %s, which is deprecated; only use it to reach brokers that can't do TLS 1.2", tls.VersionName(min))
+	}
+	if len(insecure) > 0 {
+		logWarn("tls_insecure_cipher", "Offering insecure cipher suite(s) %s; only use them to reach brokers that support nothing better", strings.Join(insecure, ", "))
+	}
+	if len(suites) > 0 && max == tls.VersionTLS13 {
+		logInfo("tls_ciphers", "Cipher suites apply to TLS 1.2 and older; a TLS 1.3 handshake still uses Go's TLS 1.3 suites (set tls_max_version 1.2 to enforce the list)")
+	}
+	return nil
+}
@@ -5,38 +5,253 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"net/url"
+	"strings"
 )
 
-// NewTLSConfig loads CA, client cert, and key files into a tls.Config.
-// If insecure is true, it won't verify the server's certificate.
-func NewTLSConfig(caFile, certFile, keyFile string, insecure bool) (*tls.Config, error) {
+// embeddedRoots counts the certificates of the CA bundle built in with the
+// cabundle tag, which verify brokers on systems without their own roots.
+var embeddedRoots int
+
+// NewTLSConfig loads the CA, client cert, and key named in cfg into a tls.Config.
+// Inline PEM fields take precedence over the corresponding files, and a PKCS#12
+// bundle supplies the client cert, key, and any CA not given separately.
+// If cfg.Insecure is true, it won't verify the server's certificate.
+func NewTLSConfig(cfg *Config) (*tls.Config, error) {
+	minVersion, maxVersion, err := tlsVersions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	suites, _, err := cipherSuites(cfg.Ciphers)
+	if err != nil {
+		return nil, err
+	}
 	tlsConfig := &tls.Config{
-		InsecureSkipVerify: insecure,
-		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.Insecure,
+		ServerName:         cfg.TLSServerName,
+		MinVersion:         minVersion,
+		MaxVersion:         maxVersion,
+		CipherSuites:       suites,
+		NextProtos:         alpnProtocols(cfg),
 	}
-
-	// If CA file is provided, load it so the client trusts that root CA
-	if caFile != "" {
-		certs := x509.NewCertPool()
-		ca, err := ioutil.ReadFile(caFile)
+	var checks []func(tls.ConnectionState) error
+	if len(cfg.PinSHA256) > 0 {
+		pins, err := parsePins(cfg.PinSHA256)
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, verifyPins(pins))
+	}
+	if cfg.CRLFile != "" {
+		crls, err := loadCRLs(cfg.CRLFile)
 		if err != nil {
 			return nil, err
 		}
+		checks = append(checks, verifyCRLs(crls))
+	}
+	if cfg.OCSP != "" && cfg.OCSP != "off" {
+		checks = append(checks, verifyOCSP(cfg.OCSP))
+	}
+	tlsConfig.VerifyConnection = chainVerifiers(checks)
+	if cfg.TLSKeyLog != "" {
+		if tlsConfig.KeyLogWriter, err = openKeyLog(cfg.TLSKeyLog); err != nil {
+			return nil, err
+		}
+	}
+
+	// If a CA is provided, load it so the client trusts that root CA
+	ca, err := readPEM(cfg.CAPEM, cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	if ca != nil {
+		certs := x509.NewCertPool()
 		if !certs.AppendCertsFromPEM(ca) {
 			return nil, errors.New("failed to append CA certificate")
 		}
 		tlsConfig.RootCAs = certs
+
+		if err := checkCertExpiry("CA", parsePEMCertificates(ca), cfg); err != nil {
+			return nil, err
+		}
 	}
 
 	// If client certificate & key are provided, use mutual TLS
-	if certFile != "" && keyFile != "" {
-		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-		if err != nil {
+	certPEM, err := readPEM(cfg.CertPEM, cfg.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := readPEM(cfg.KeyPEM, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	var cert tls.Certificate
+	chainRoots := tlsConfig.RootCAs
+	switch {
+	case cfg.PKCS12File != "":
+		var roots []*x509.Certificate
+		if cert, roots, err = loadPKCS12(cfg); err != nil {
+			return nil, err
+		}
+		if len(roots) > 0 {
+			chainRoots = x509.NewCertPool()
+			for _, c := range roots {
+				chainRoots.AddCert(c)
+			}
+		}
+		// The bundle's CA certificates are trusted alongside the system roots
+		if tlsConfig.RootCAs == nil && len(roots) > 0 {
+			if tlsConfig.RootCAs, err = x509.SystemCertPool(); err != nil {
+				tlsConfig.RootCAs = x509.NewCertPool()
+			}
+			for _, c := range roots {
+				tlsConfig.RootCAs.AddCert(c)
+			}
+			if err := checkCertExpiry("CA", roots, cfg); err != nil {
+				return nil, err
+			}
+		}
+	case cfg.PKCS11Module != "":
+		if cert, err = loadPKCS11(cfg); err != nil {
+			return nil, err
+		}
+	case certPEM != nil && keyPEM != nil:
+		if keyPEM, err = decryptKeyPEM(keyPEM, cfg); err != nil {
 			return nil, err
 		}
+		if cert, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+			return nil, err
+		}
+	}
+	if cert.Certificate != nil {
+
+		// Append intermediates so brokers that reject leaf-only certs see the full chain
+		if cfg.ChainFile != "" {
+			chain, err := ioutil.ReadFile(cfg.ChainFile)
+			if err != nil {
+				return nil, err
+			}
+			intermediates := parsePEMCertificates(chain)
+			if len(intermediates) == 0 {
+				return nil, errors.New("no certificates found in chain file")
+			}
+			if err := checkCertExpiry("intermediate", intermediates, cfg); err != nil {
+				return nil, err
+			}
+			for _, c := range intermediates {
+				cert.Certificate = append(cert.Certificate, c.Raw)
+			}
+		}
 		tlsConfig.Certificates = []tls.Certificate{cert}
+
+		presented := make([]*x509.Certificate, 0, len(cert.Certificate))
+		for _, der := range cert.Certificate {
+			c, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, err
+			}
+			presented = append(presented, c)
+		}
+		if err := checkCertExpiry("client", presented[:1], cfg); err != nil {
+			return nil, err
+		}
+		if err := checkClientChain(presented, chainRoots); err != nil {
+			return nil, err
+		}
 	}
 
 	return tlsConfig, nil
 }
+
+// awsALPN is the protocol AWS IoT Core expects for MQTT with a client
+// certificate on port 443, which it otherwise serves HTTPS on.
+const awsALPN = "x-amzn-mqtt-ca"
+
+// alpnProtocols returns the ALPN protocols to offer: those in alpn, or
+// x-amzn-mqtt-ca for mutual TLS to an AWS IoT endpoint on port 443.
+func alpnProtocols(cfg *Config) []string {
+	var protos []string
+	for _, v := range cfg.ALPN {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				protos = append(protos, p)
+			}
+		}
+	}
+	if len(protos) > 0 {
+		return protos
+	}
+	u, err := url.Parse(cfg.BrokerURL)
+	if err != nil || u.Port() != "443" || u.Scheme == "wss" || u.Scheme == "https" {
+		return nil
+	}
+	clientCert := cfg.CertFile != "" || cfg.CertPEM != "" || cfg.PKCS12File != "" || cfg.PKCS11Module != ""
+	if clientCert && isAWSIoTEndpoint(cfg.BrokerURL) {
+		return []string{awsALPN}
+	}
+	return nil
+}
+
+// isAWSIoTEndpoint reports whether broker is an AWS IoT Core data endpoint,
+// such as ssl://abc123-ats.iot.eu-west-1.amazonaws.com:8883.
+func isAWSIoTEndpoint(broker string) bool {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return false
+	}
+	host := u.Hostname()
+	return strings.HasSuffix(host, ".amazonaws.com") && strings.Contains(host, ".iot.")
+}
+
+// readPEM returns inline PEM text if set, otherwise the contents of path.
+// It returns nil if neither is set. Inline values written on a single line
+// with literal "\n" escapes (common in env files) are unescaped.
+func readPEM(inline, path string) ([]byte, error) {
+	if inline != "" {
+		if !strings.Contains(inline, "\n") {
+			inline = strings.ReplaceAll(inline, `\n`, "\n")
+		}
+		return []byte(inline), nil
+	}
+	if path == "" {
+		return nil, nil
+	}
+	return ioutil.ReadFile(path)
+}
+
+// checkClientChain verifies that each certificate in the presented client chain
+// is signed by the next one. A broken link is an error, since brokers reject such
+// chains with handshake failures that rarely name the cause. When intermediates
+// are sent, it also warns if the chain stops short of a root that is self-signed
+// or trusted by roots.
+func checkClientChain(chain []*x509.Certificate, roots *x509.CertPool) error {
+	for i := 0; i+1 < len(chain); i++ {
+		child, parent := chain[i], chain[i+1]
+		if err := child.CheckSignatureFrom(parent); err != nil {
+			return fmt.Errorf("client certificate chain is broken: '%s' is not issued by '%s': %v",
+				child.Subject.CommonName, parent.Subject.CommonName, err)
+		}
+	}
+	if len(chain) == 1 {
+		return nil
+	}
+
+	top := chain[len(chain)-1]
+	if top.CheckSignatureFrom(top) == nil {
+		return nil
+	}
+	if roots != nil {
+		opts := x509.VerifyOptions{
+			Roots:     roots,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}
+		if _, err := top.Verify(opts); err == nil {
+			return nil
+		}
+	}
+	logWarn("cert_chain_incomplete", "client certificate chain ends at '%s' (issuer '%s'), which is not a root; "+
+		"the broker must already trust that issuer", top.Subject.CommonName, top.Issuer.CommonName)
+	return nil
+}
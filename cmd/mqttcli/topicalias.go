@@ -0,0 +1,103 @@
+// topicalias.go
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// minAliasedTopic is the shortest topic worth an alias; shorter ones save a
+// byte or two per publish and would use up aliases longer topics need.
+const minAliasedTopic = 16
+
+// topicAliases replaces repeated topics with MQTT v5 topic aliases on one
+// connection: outgoing publishes to a topic seen before carry only its
+// 2-byte alias, and aliases the broker uses for incoming ones are resolved.
+type topicAliases struct {
+	max uint16 // aliases we may assign, the smaller of topic_alias_max and the broker's limit
+
+	mu       sync.Mutex
+	out      map[string]uint16
+	sent     map[string]bool // the broker has seen the alias for this topic
+	in       map[uint16]string
+	inMax    uint16 // aliases the broker may assign, from topic_alias_max
+	reported bool
+}
+
+func newTopicAliases(max, inMax uint16) *topicAliases {
+	return &topicAliases{max: max, inMax: inMax, out: make(map[string]uint16),
+		sent: make(map[string]bool), in: make(map[uint16]string)}
+}
+
+// apply sets an alias on pb. A topic's first publishes carry both the topic
+// and its alias; once one of them has gone out, the topic is left off.
+// Aliases are handed out first come, first served and never rebound, since a
+// publish already queued with an alias must still reach the same topic.
+func (a *topicAliases) apply(pb *paho.Publish) {
+	if a.max == 0 || len(pb.Topic) < minAliasedTopic {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	alias, ok := a.out[pb.Topic]
+	if !ok {
+		if len(a.out) >= int(a.max) {
+			if !a.reported {
+				a.reported = true
+				logInfo("topic_aliases_exhausted", "All %d topic aliases are in use; publishing new topics in full", a.max)
+			}
+			return
+		}
+		alias = uint16(len(a.out) + 1)
+		a.out[pb.Topic] = alias
+	}
+	if pb.Properties == nil {
+		pb.Properties = &paho.PublishProperties{}
+	} else {
+		props := *pb.Properties // shared between publishes
+		pb.Properties = &props
+	}
+	pb.Properties.TopicAlias = &alias
+	if a.sent[pb.Topic] {
+		pb.Topic = ""
+	}
+}
+
+// published records that a publish to topic went out, so later ones can use
+// the alias alone.
+func (a *topicAliases) published(topic string) {
+	if topic == "" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.out[topic]; ok {
+		a.sent[topic] = true
+	}
+}
+
+// resolve fills in the topic of an incoming publish that uses an alias, and
+// records new aliases the broker sets.
+func (a *topicAliases) resolve(pb *paho.Publish) error {
+	if pb.Properties == nil || pb.Properties.TopicAlias == nil {
+		return nil
+	}
+	alias := *pb.Properties.TopicAlias
+	if alias == 0 || alias > a.inMax {
+		return fmt.Errorf("broker used topic alias %d, outside the %d allowed", alias, a.inMax)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if pb.Topic != "" {
+		a.in[alias] = pb.Topic
+		return nil
+	}
+	topic, ok := a.in[alias]
+	if !ok {
+		return fmt.Errorf("broker used topic alias %d before setting it", alias)
+	}
+	pb.Topic = topic
+	return nil
+}
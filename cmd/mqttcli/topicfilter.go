@@ -0,0 +1,24 @@
+// topicfilter.go
+package main
+
+import "strings"
+
+// topicMatches reports whether topic matches an MQTT subscription filter with
+// "+" (one level) and "#" (remaining levels) wildcards. As in the MQTT spec,
+// wildcards at the first level don't match topics starting with "$".
+func topicMatches(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, seg := range f {
+		if seg == "#" {
+			return true
+		}
+		if i >= len(t) || (seg != "+" && seg != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
@@ -0,0 +1,104 @@
+// topicpattern.go
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// topicPattern extracts named fields from topics, e.g. "iot/gnss/{device}/data".
+// A "{name}" segment captures one topic level, "+" matches one level without
+// capturing, and a trailing "#" or "{name#}" matches the remaining levels.
+type topicPattern struct {
+	segments []string
+	names    []string
+}
+
+// parseTopicPattern validates a pattern and records its field names in order.
+func parseTopicPattern(pattern string) (*topicPattern, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	p := &topicPattern{segments: strings.Split(pattern, "/")}
+	seen := map[string]bool{}
+	for i, seg := range p.segments {
+		multi := seg == "#" || (strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "#}"))
+		if multi && i != len(p.segments)-1 {
+			return nil, fmt.Errorf("invalid topic pattern '%s': multi-level segment must be last", pattern)
+		}
+		if name, ok := fieldName(seg); ok {
+			if name == "" || seen[name] {
+				return nil, fmt.Errorf("invalid topic pattern '%s': empty or duplicate field '%s'", pattern, seg)
+			}
+			seen[name] = true
+			p.names = append(p.names, name)
+		}
+	}
+	return p, nil
+}
+
+// fieldName returns the field captured by a "{name}" or "{name#}" segment.
+func fieldName(seg string) (string, bool) {
+	if !strings.HasPrefix(seg, "{") || !strings.HasSuffix(seg, "}") {
+		return "", false
+	}
+	return strings.TrimSuffix(seg[1:len(seg)-1], "#"), true
+}
+
+// Names returns the pattern's field names in the order they appear.
+func (p *topicPattern) Names() []string {
+	if p == nil {
+		return nil
+	}
+	return p.names
+}
+
+// Match returns the fields captured from topic, or false if it doesn't fit the pattern.
+func (p *topicPattern) Match(topic string) (map[string]string, bool) {
+	if p == nil {
+		return nil, false
+	}
+	levels := strings.Split(topic, "/")
+	fields := make(map[string]string, len(p.names))
+	for i, seg := range p.segments {
+		name, isField := fieldName(seg)
+		if seg == "#" || (isField && strings.HasSuffix(seg, "#}")) {
+			if i > len(levels) {
+				return nil, false
+			}
+			if isField {
+				fields[name] = strings.Join(levels[i:], "/")
+			}
+			return fields, true
+		}
+		if i >= len(levels) {
+			return nil, false
+		}
+		switch {
+		case isField:
+			fields[name] = levels[i]
+		case seg != "+" && seg != levels[i]:
+			return nil, false
+		}
+	}
+	if len(levels) != len(p.segments) {
+		return nil, false
+	}
+	return fields, true
+}
+
+// formatFields renders fields as "name=value" pairs in pattern order.
+func (p *topicPattern) formatFields(fields map[string]string) string {
+	var b strings.Builder
+	for _, name := range p.Names() {
+		v, ok := fields[name]
+		if !ok {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%s=%s", name, v)
+	}
+	return b.String()
+}
@@ -0,0 +1,105 @@
+// topics.go
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TopicSubscription is one topic filter to subscribe to, with an optional QoS
+// overriding the top-level qos.
+type TopicSubscription struct {
+	Topic string `json:"topic"`
+	QoS   *byte  `json:"qos,omitempty"`
+}
+
+// parseTopicSubscription parses "FILTER" or "FILTER@QOS", e.g. "alerts/#@1".
+func parseTopicSubscription(s string) (TopicSubscription, error) {
+	sub := TopicSubscription{Topic: s}
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		if q, err := strconv.Atoi(s[i+1:]); err == nil {
+			if q < 0 || q > 2 {
+				return sub, fmt.Errorf("invalid QoS %d for topic '%s'", q, s[:i])
+			}
+			qos := byte(q)
+			sub = TopicSubscription{Topic: s[:i], QoS: &qos}
+		}
+	}
+	if sub.Topic == "" {
+		return sub, fmt.Errorf("empty topic in '%s'", s)
+	}
+	return sub, nil
+}
+
+// topicFlag collects repeated --topic flags, each holding one filter or a
+// comma-separated list.
+type topicFlag []TopicSubscription
+
+func (t *topicFlag) String() string {
+	var filters []string
+	for _, s := range *t {
+		filters = append(filters, s.Topic)
+	}
+	return strings.Join(filters, ",")
+}
+
+func (t *topicFlag) Set(s string) error {
+	for _, part := range strings.Split(s, ",") {
+		sub, err := parseTopicSubscription(strings.TrimSpace(part))
+		if err != nil {
+			return err
+		}
+		*t = append(*t, sub)
+	}
+	return nil
+}
+
+// subscriptions returns every configured filter, from topic, topics, and
+// topics_file, with its effective QoS. With share_group, filters are members of that group.
+// With reconstruct, each also has a filter for the delta topics of what it matches.
+func (cfg *Config) subscriptions() map[string]byte {
+	subs := make(map[string]byte)
+	if cfg.Topic != "" {
+		subs[shareFilter(cfg.Topic, cfg.ShareGroup)] = cfg.QoS
+	}
+	topics := append(append([]TopicSubscription(nil), cfg.Topics...), cfg.fileTopics...)
+	for _, s := range topics {
+		qos := cfg.QoS
+		if s.QoS != nil {
+			qos = *s.QoS
+		}
+		subs[shareFilter(s.Topic, cfg.ShareGroup)] = qos
+	}
+	if cfg.Reconstruct {
+		for filter, qos := range deltaFilters(subs) {
+			subs[filter] = qos
+		}
+	}
+	return subs
+}
+
+// describeSubscriptions formats filters for log messages: "topic 'a/#' with QoS=1"
+// for one filter, "topics 'a/#' (QoS 1), 'b' (QoS 0)" for several.
+func describeSubscriptions(subs map[string]byte) string {
+	if len(subs) == 1 {
+		for topic, qos := range subs {
+			return fmt.Sprintf("topic '%s' with QoS=%d", topic, qos)
+		}
+	}
+	var parts []string
+	for _, topic := range sortedKeys(subs) {
+		parts = append(parts, fmt.Sprintf("'%s' (QoS %d)", topic, subs[topic]))
+	}
+	return "topics " + strings.Join(parts, ", ")
+}
+
+func sortedKeys(m map[string]byte) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,170 @@
+// topicsfile.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// parseTopicsFile reads a topics file: one filter per line, as FILTER,
+// FILTER@QOS, or FILTER QOS. Blank lines and comments ("# " at the start of
+// a line) are skipped; a bare "#" is the wildcard filter.
+func parseTopicsFile(data []byte) ([]TopicSubscription, error) {
+	var subs []TopicSubscription
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "# ") || strings.HasPrefix(line, "#\t") {
+			continue
+		}
+		if i := strings.LastIndexAny(line, " \t"); i >= 0 {
+			q, err := strconv.Atoi(line[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: expected FILTER or FILTER QOS, got '%s'", n, line)
+			}
+			line = strings.TrimSpace(line[:i]) + "@" + strconv.Itoa(q)
+		}
+		sub, err := parseTopicSubscription(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		if isSharedSubscription(sub.Topic) {
+			if err := validSharedFilter(sub.Topic); err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+		}
+		subs = append(subs, sub)
+	}
+	return subs, scanner.Err()
+}
+
+// loadTopicsFile reads and parses the topics file at path.
+func loadTopicsFile(path string) ([]TopicSubscription, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	subs, err := parseTopicsFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("topics file '%s', %v", path, err)
+	}
+	return subs, nil
+}
+
+// watchTopicsFile follows changes to cfg's topics_file while client is
+// subscribed with handler: new filters, and those whose QoS changed, are
+// subscribed to and removed ones unsubscribed from, without reconnecting.
+// Unreadable or invalid revisions are reported and ignored. The returned
+// function stops watching and waits for an update in progress to finish.
+func watchTopicsFile(ctx context.Context, client mqtt.Client, cfg *Config, handler mqtt.MessageHandler) func() {
+	if cfg.TopicsFile == "" {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// cfg isn't changed here: others read it while this runs
+		next := *cfg
+		current := cfg.subscriptions()
+		data, _ := ioutil.ReadFile(cfg.TopicsFile)
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			changed, err := ioutil.ReadFile(cfg.TopicsFile)
+			if err != nil || bytes.Equal(changed, data) {
+				continue
+			}
+			data = changed
+			subs, err := parseTopicsFile(data)
+			if err != nil {
+				logWarn("topics_file_invalid", "Ignoring changed topics file '%s': %v", cfg.TopicsFile, err)
+				continue
+			}
+			next.fileTopics = subs
+			updateSubscriptions(ctx, client, cfg, current, next.subscriptions(), handler)
+		}
+	}()
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// updateSubscriptions moves client from the filters in current to those in
+// want, updating current with what the broker accepted.
+func updateSubscriptions(ctx context.Context, client mqtt.Client, cfg *Config, current, want map[string]byte, handler mqtt.MessageHandler) {
+	var removed []string
+	for filter := range current {
+		if _, ok := want[filter]; !ok {
+			removed = append(removed, filter)
+		}
+	}
+	added := make(map[string]byte)
+	for filter, qos := range want {
+		if q, ok := current[filter]; !ok || q != qos {
+			added[filter] = qos
+		}
+	}
+	if len(removed) == 0 && len(added) == 0 {
+		return
+	}
+	timeout := time.Duration(cfg.SubscribeTimeout)
+	if len(removed) > 0 {
+		if err := waitToken(ctx, client.Unsubscribe(removed...), timeout, "unsubscribe"); err != nil {
+			logWarn("topics_file_update_failed", "Topics file '%s' changed, but unsubscribing from %d filter(s) failed: %v", cfg.TopicsFile, len(removed), err)
+		} else {
+			for _, filter := range removed {
+				delete(current, filter)
+			}
+			logInfo("topics_file_unsubscribed", "Topics file '%s' changed, unsubscribed from %s", cfg.TopicsFile, describeFilters(removed))
+		}
+	}
+	if len(added) > 0 {
+		token := client.SubscribeMultiple(added, handler)
+		if err := waitToken(ctx, token, timeout, "subscribe"); err != nil {
+			logWarn("topics_file_update_failed", "Topics file '%s' changed, but subscribing to %s failed: %v", cfg.TopicsFile, describeSubscriptions(added), err)
+			return
+		}
+		if st, ok := token.(*mqtt.SubscribeToken); ok {
+			for filter, code := range st.Result() {
+				if code == 0x80 {
+					logWarn("topics_file_update_failed", "Broker refused the subscription to '%s' from topics file '%s'", filter, cfg.TopicsFile)
+					delete(added, filter)
+				}
+			}
+		}
+		for filter, qos := range added {
+			current[filter] = qos
+		}
+		if len(added) > 0 {
+			logInfo("topics_file_subscribed", "Topics file '%s' changed, subscribed to %s", cfg.TopicsFile, describeSubscriptions(added))
+		}
+	}
+}
+
+// describeFilters formats filters without QoS for log messages.
+func describeFilters(filters []string) string {
+	if len(filters) == 1 {
+		return fmt.Sprintf("topic '%s'", filters[0])
+	}
+	sorted := append([]string(nil), filters...)
+	sort.Strings(sorted)
+	return "topics '" + strings.Join(sorted, "', '") + "'"
+}
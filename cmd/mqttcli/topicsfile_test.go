@@ -0,0 +1,152 @@
+// topicsfile_test.go
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestParseTopicsFile(t *testing.T) {
+	qos := func(q byte) *byte { return &q }
+	for _, tc := range []struct {
+		name string
+		file string
+		want []TopicSubscription
+		err  string
+	}{
+		{"each form", "a/b\nc/d@1\ne/f 2\n", []TopicSubscription{{Topic: "a/b"}, {Topic: "c/d", QoS: qos(1)}, {Topic: "e/f", QoS: qos(2)}}, ""},
+		{"tab and padding", "  a\t1  \n", []TopicSubscription{{Topic: "a", QoS: qos(1)}}, ""},
+		{"comments and blank lines", "# sensors\n\n#\tand more\nx\n", []TopicSubscription{{Topic: "x"}}, ""},
+		{"bare wildcard", "#\n#@1\n# 1 is a comment\n", []TopicSubscription{{Topic: "#"}, {Topic: "#", QoS: qos(1)}}, ""},
+		{"shared subscription", "$share/g/a/# 1", []TopicSubscription{{Topic: "$share/g/a/#", QoS: qos(1)}}, ""},
+		{"empty", "", nil, ""},
+		{"not a QoS", "a/b c", nil, "line 1: expected FILTER or FILTER QOS, got 'a/b c'"},
+		{"QoS out of range", "ok\na 3", nil, "line 2: invalid QoS 3 for topic 'a'"},
+		{"no filter", "@1", nil, "line 1: empty topic"},
+		{"shared without a filter", "x\n\n$share/g", nil, "line 3: invalid shared subscription"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseTopicsFile([]byte(tc.file))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got %v, want an error containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %s, want %s", describeTopics(got), describeTopics(tc.want))
+			}
+		})
+	}
+}
+
+// describeTopics formats subs as FILTER@QOS for test failures.
+func describeTopics(subs []TopicSubscription) string {
+	var s []string
+	for _, sub := range subs {
+		if sub.QoS == nil {
+			s = append(s, sub.Topic)
+		} else {
+			s = append(s, sub.Topic+"@"+string('0'+*sub.QoS))
+		}
+	}
+	return "[" + strings.Join(s, " ") + "]"
+}
+
+// subscribingClient records the subscription changes asked of it, failing
+// them with the given errors.
+type subscribingClient struct {
+	mqtt.Client
+	subErr, unsubErr error
+	subscribed       map[string]byte
+	unsubscribed     []string
+}
+
+func (c *subscribingClient) SubscribeMultiple(filters map[string]byte, _ mqtt.MessageHandler) mqtt.Token {
+	c.subscribed = filters
+	return newV5Token(func() error { return c.subErr })
+}
+
+func (c *subscribingClient) Unsubscribe(filters ...string) mqtt.Token {
+	c.unsubscribed = append([]string(nil), filters...)
+	sort.Strings(c.unsubscribed)
+	return newV5Token(func() error { return c.unsubErr })
+}
+
+func TestUpdateSubscriptions(t *testing.T) {
+	failed := errors.New("not authorized")
+	for _, tc := range []struct {
+		name             string
+		current, want    map[string]byte
+		subErr, unsubErr error
+		subscribed       map[string]byte
+		unsubscribed     []string
+		result           map[string]byte
+	}{
+		{
+			"added, removed, and QoS changed",
+			map[string]byte{"a": 0, "b": 1}, map[string]byte{"b": 2, "c": 0}, nil, nil,
+			map[string]byte{"b": 2, "c": 0}, []string{"a"},
+			map[string]byte{"b": 2, "c": 0},
+		},
+		{
+			"unchanged",
+			map[string]byte{"a": 1}, map[string]byte{"a": 1}, nil, nil,
+			nil, nil,
+			map[string]byte{"a": 1},
+		},
+		{
+			"unsubscribe failed",
+			map[string]byte{"a": 0, "b": 1}, map[string]byte{"b": 1, "c": 1}, nil, failed,
+			map[string]byte{"c": 1}, []string{"a"},
+			map[string]byte{"a": 0, "b": 1, "c": 1},
+		},
+		{
+			"subscribe failed",
+			map[string]byte{"a": 0, "b": 1}, map[string]byte{"b": 1, "c": 1}, failed, nil,
+			map[string]byte{"c": 1}, []string{"a"},
+			map[string]byte{"b": 1},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &subscribingClient{subErr: tc.subErr, unsubErr: tc.unsubErr}
+			current := make(map[string]byte)
+			for k, v := range tc.current {
+				current[k] = v
+			}
+			updateSubscriptions(context.Background(), client, &Config{TopicsFile: "topics.txt"}, current, tc.want, nil)
+			if !reflect.DeepEqual(client.subscribed, tc.subscribed) {
+				t.Errorf("subscribed to %v, want %v", client.subscribed, tc.subscribed)
+			}
+			if !reflect.DeepEqual(client.unsubscribed, tc.unsubscribed) {
+				t.Errorf("unsubscribed from %v, want %v", client.unsubscribed, tc.unsubscribed)
+			}
+			if !reflect.DeepEqual(current, tc.result) {
+				t.Errorf("got %v subscribed, want %v", current, tc.result)
+			}
+		})
+	}
+}
+
+func TestDescribeFilters(t *testing.T) {
+	for _, tc := range []struct {
+		filters []string
+		want    string
+	}{
+		{[]string{"a/#"}, "topic 'a/#'"},
+		{[]string{"b", "a"}, "topics 'a', 'b'"},
+	} {
+		if got := describeFilters(tc.filters); got != tc.want {
+			t.Errorf("describeFilters(%q) = %s, want %s", tc.filters, got, tc.want)
+		}
+	}
+}
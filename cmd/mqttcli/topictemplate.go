@@ -0,0 +1,53 @@
+// topictemplate.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// topicTemplate is a publish topic filled in from each JSON payload, e.g.
+// "devices/{{.device_id}}/data", using Go text/template syntax.
+type topicTemplate struct {
+	text string
+	t    *template.Template
+}
+
+// parseTopicTemplate returns nil for topics without "{{", which are published
+// to as they are.
+func parseTopicTemplate(topic string) (*topicTemplate, error) {
+	if !strings.Contains(topic, "{{") {
+		return nil, nil
+	}
+	t, err := template.New("topic").Option("missingkey=error").Parse(topic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid topic template '%s': %v", topic, err)
+	}
+	return &topicTemplate{text: topic, t: t}, nil
+}
+
+// topic resolves the template against a JSON payload. Numbers keep their
+// original digits, so large IDs aren't rounded.
+func (tt *topicTemplate) topic(payload []byte) (string, error) {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return "", fmt.Errorf("payload is not JSON: %v", err)
+	}
+	var b strings.Builder
+	if err := tt.t.Execute(&b, doc); err != nil {
+		return "", err
+	}
+	topic := b.String()
+	switch {
+	case topic == "" || strings.Contains(topic, "<no value>"):
+		return "", fmt.Errorf("topic template '%s' gave no topic", tt.text)
+	case strings.ContainsAny(topic, "+#\x00"):
+		return "", fmt.Errorf("topic '%s' contains a wildcard or NUL", topic)
+	}
+	return topic, nil
+}
@@ -0,0 +1,477 @@
+// tunnel.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// The HTTP tunnel carries an MQTT connection over plain HTTP requests, for
+// networks that only pass HTTP(S) on ports 80/443 and strip WebSocket upgrades.
+// The client opens a session with the relay, POSTs bytes upstream, and
+// long-polls for bytes downstream; the relay holds the TCP connection to the
+// broker. Every request is short and self-contained, so buffering proxies
+// can't stall the stream.
+const (
+	tunnelPollTimeout = 20 * time.Second      // how long the relay holds a poll open without data
+	tunnelIdleTimeout = 3 * tunnelPollTimeout // sessions without requests for this long are closed
+	tunnelMaxChunk    = 64 << 10              // most bytes returned by one poll
+	tunnelTokenHeader = "Authorization"       // carries "Bearer <token>" when a token is set
+)
+
+func isTunnelURL(broker string) bool {
+	return strings.HasPrefix(broker, "http://") || strings.HasPrefix(broker, "https://")
+}
+
+// tunnelAddr is the net.Addr of a tunnel session.
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "http-tunnel" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// tunnelConn is the client side of a tunnel session, used as the paho
+// connection.
+type tunnelConn struct {
+	session string // base URL of the session, e.g. https://relay/mqtt/<id>
+	token   string
+	http    *http.Client
+
+	rmu     sync.Mutex
+	pending []byte
+	closing atomic.Bool // set once the client has sent DISCONNECT
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// dialTunnel opens a tunnel session at broker, an http:// or https:// relay URL.
+func dialTunnel(ctx context.Context, broker string, tlsConfig *tls.Config, token string) (net.Conn, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if airGap != nil {
+		transport.Proxy = nil
+		transport.DialContext = egressDialer(30 * time.Second).DialContext
+	}
+	c := &tunnelConn{token: token, http: &http.Client{Transport: transport, Timeout: tunnelPollTimeout + 10*time.Second}}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	base := strings.TrimSuffix(broker, "/")
+	resp, err := c.do(ctx, http.MethodPost, base+"/open", nil)
+	if err != nil {
+		return nil, err
+	}
+	id, err := io.ReadAll(io.LimitReader(resp.Body, 128))
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	c.session = base + "/" + strings.TrimSpace(string(id))
+	return c, nil
+}
+
+func (c *tunnelConn) do(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set(tunnelTokenHeader, "Bearer "+c.token)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, io.EOF
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("HTTP tunnel %s %s: %s: %s", method, url, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func (c *tunnelConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.pending) == 0 {
+		resp, err := c.do(c.ctx, http.MethodGet, c.session+"/down", nil)
+		if err != nil {
+			if c.ctx.Err() != nil || c.closing.Load() {
+				return 0, net.ErrClosed
+			}
+			return 0, err
+		}
+		c.pending, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *tunnelConn) Write(p []byte) (int, error) {
+	// The broker drops the connection after a DISCONNECT, and the poll usually
+	// sees that before paho closes the conn; report it as a local close
+	if len(p) > 0 && p[0] == 0xE0 {
+		c.closing.Store(true)
+	}
+	resp, err := c.do(c.ctx, http.MethodPost, c.session+"/up", p)
+	if err != nil {
+		if c.ctx.Err() != nil {
+			return 0, net.ErrClosed
+		}
+		return 0, err
+	}
+	resp.Body.Close()
+	return len(p), nil
+}
+
+func (c *tunnelConn) Close() error {
+	if c.ctx.Err() != nil {
+		return nil
+	}
+	c.cancel()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if resp, err := c.do(ctx, http.MethodDelete, c.session, nil); err == nil {
+		resp.Body.Close()
+	}
+	return nil
+}
+
+func (c *tunnelConn) LocalAddr() net.Addr  { return tunnelAddr("local") }
+func (c *tunnelConn) RemoteAddr() net.Addr { return tunnelAddr(c.session) }
+
+// Deadlines are not supported; MQTT keepalives detect a dead tunnel instead.
+func (c *tunnelConn) SetDeadline(t time.Time) error      { return nil }
+func (c *tunnelConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *tunnelConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// openTunnel is a paho OpenConnectionFunc for http:// and https:// relay URLs.
+func openTunnel(cfg *Config) mqtt.OpenConnectionFunc {
+	return func(uri *url.URL, opts mqtt.ClientOptions) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ConnectTimeout))
+		defer cancel()
+		return dialTunnel(ctx, uri.String(), opts.TLSConfig, cfg.TunnelToken)
+	}
+}
+
+// tunnelSession is the relay side of one tunnel: a broker connection and the
+// bytes read from it that the client has not polled yet.
+type tunnelSession struct {
+	conn     net.Conn
+	down     chan []byte
+	done     chan struct{}
+	mu       sync.Mutex
+	lastSeen time.Time
+}
+
+func (s *tunnelSession) touch() {
+	s.mu.Lock()
+	s.lastSeen = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *tunnelSession) idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastSeen) > tunnelIdleTimeout
+}
+
+// readBroker forwards broker bytes to the down channel until the connection closes.
+func (s *tunnelSession) readBroker() {
+	defer close(s.down)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := s.conn.Read(buf)
+		if n > 0 {
+			chunk := append([]byte(nil), buf[:n]...)
+			select {
+			case s.down <- chunk:
+			case <-s.done:
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// tunnelRelay serves tunnel sessions, each connected to the same broker.
+type tunnelRelay struct {
+	broker    string // host:port
+	brokerTLS *tls.Config
+	token     string
+
+	mu       sync.Mutex
+	sessions map[string]*tunnelSession
+}
+
+// isLoopbackListen reports whether the listen address addr only accepts
+// connections from this host; ":8080" and other empty hosts listen on all.
+func isLoopbackListen(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// authorized reports whether req carries the relay's token; a relay without
+// one only runs on a loopback address or with --insecure-no-token.
+func (r *tunnelRelay) authorized(req *http.Request) bool {
+	if r.token == "" {
+		return true
+	}
+	got := strings.TrimPrefix(req.Header.Get(tunnelTokenHeader), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(r.token)) == 1
+}
+
+func (r *tunnelRelay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !r.authorized(req) {
+		http.Error(w, "invalid tunnel token", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	// Paths are .../open, .../<id>, .../<id>/up, and .../<id>/down
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	last := parts[len(parts)-1]
+	if req.Method == http.MethodPost && last == "open" {
+		r.open(w)
+		return
+	}
+	id, action := last, ""
+	if (last == "up" || last == "down") && len(parts) > 1 {
+		id, action = parts[len(parts)-2], last
+	}
+	r.mu.Lock()
+	s := r.sessions[id]
+	r.mu.Unlock()
+	if s == nil {
+		http.Error(w, "unknown or closed tunnel session", http.StatusGone)
+		return
+	}
+	s.touch()
+
+	switch {
+	case req.Method == http.MethodPost && action == "up":
+		if _, err := io.Copy(s.conn, io.LimitReader(req.Body, 1<<20)); err != nil {
+			r.close(id)
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case req.Method == http.MethodGet && action == "down":
+		r.poll(w, req, id, s)
+	case req.Method == http.MethodDelete && action == "":
+		r.close(id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (r *tunnelRelay) open(w http.ResponseWriter) {
+	var conn net.Conn
+	var err error
+	d := egressDialer(10 * time.Second)
+	if r.brokerTLS != nil {
+		conn, err = tls.DialWithDialer(d, "tcp", r.broker, r.brokerTLS)
+	} else {
+		conn, err = d.Dial("tcp", r.broker)
+	}
+	if err != nil {
+		logWarn("tunnel_dial_failed", "Could not connect to broker %s: %v", r.broker, err)
+		http.Error(w, "broker unreachable", http.StatusBadGateway)
+		return
+	}
+
+	idBytes := make([]byte, 16)
+	rand.Read(idBytes)
+	id := hex.EncodeToString(idBytes)
+	s := &tunnelSession{conn: conn, down: make(chan []byte, 64), done: make(chan struct{}), lastSeen: time.Now()}
+	r.mu.Lock()
+	r.sessions[id] = s
+	r.mu.Unlock()
+	go s.readBroker()
+
+	logInfo("tunnel_opened", "Opened tunnel session %s to %s", id[:8], r.broker)
+	fmt.Fprint(w, id)
+}
+
+// poll answers a long-poll with the buffered broker bytes, waiting up to
+// tunnelPollTimeout for the first ones.
+func (r *tunnelRelay) poll(w http.ResponseWriter, req *http.Request, id string, s *tunnelSession) {
+	var out []byte
+	select {
+	case chunk, ok := <-s.down:
+		if !ok {
+			r.close(id)
+			http.Error(w, "broker closed the connection", http.StatusGone)
+			return
+		}
+		out = chunk
+	case <-time.After(tunnelPollTimeout):
+	case <-req.Context().Done():
+		return
+	}
+	// Drain whatever else is already waiting
+drain:
+	for len(out) < tunnelMaxChunk {
+		select {
+		case chunk, ok := <-s.down:
+			if !ok {
+				break drain
+			}
+			out = append(out, chunk...)
+		default:
+			break drain
+		}
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(out)
+}
+
+func (r *tunnelRelay) close(id string) {
+	r.mu.Lock()
+	s := r.sessions[id]
+	delete(r.sessions, id)
+	r.mu.Unlock()
+	if s != nil {
+		close(s.done)
+		s.conn.Close()
+		logInfo("tunnel_closed", "Closed tunnel session %s", id[:8])
+	}
+}
+
+// reap closes sessions whose client stopped polling.
+func (r *tunnelRelay) reap(ctx context.Context) {
+	ticker := time.NewTicker(tunnelPollTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		r.mu.Lock()
+		var stale []string
+		for id, s := range r.sessions {
+			if s.idle() {
+				stale = append(stale, id)
+			}
+		}
+		r.mu.Unlock()
+		for _, id := range stale {
+			r.close(id)
+		}
+	}
+}
+
+// runRelay is the companion side of the HTTP tunnel: it accepts tunnel
+// sessions over HTTP(S) and connects each to the broker.
+func runRelay(args []string) {
+	fs := flag.NewFlagSet("relay", flag.ExitOnError)
+	listen := fs.String("listen", ":8080", "Address to serve tunnel requests on.")
+	path := fs.String("path", "/mqtt", "URL path of the tunnel endpoint.")
+	broker := fs.String("broker", "tcp://localhost:1883", "Broker to connect tunnel sessions to (tcp:// or ssl://).")
+	token := fs.String("token", os.Getenv("MQTTCLI_TUNNEL_TOKEN"), "Shared secret clients must send with --tunnel-token (default $MQTTCLI_TUNNEL_TOKEN).")
+	certFile := fs.String("tls-cert", "", "Serve HTTPS with this certificate (PEM).")
+	keyFile := fs.String("tls-key", "", "Private key for --tls-cert.")
+	noToken := fs.Bool("insecure-no-token", false, "Relay for anyone who can reach --listen, without a --token (NOT recommended); not needed on a loopback address.")
+	airGapped := fs.Bool("air-gapped", false, "Only ever connect to the broker's host and port; other connections are refused.")
+	output := fs.String("output", "", "Output format: 'text' (default) or 'json' for structured records on stderr.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s relay [options]\n\n"+
+			"Experimental: relays MQTT connections tunnelled over HTTP by clients using an\n"+
+			"http:// or https:// --broker URL (e.g. https://relay.example.com/mqtt).\n\nOptions:\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	jsonEvents = *output == outputJSON
+	// the relay forwards whatever its clients send, publishes included
+	if readOnlyEnv() {
+		fatal("read_only", false, "relay forwards client publishes and is refused while $%s is set.", envReadOnly)
+	}
+
+	if *token == "" && !*noToken && !isLoopbackListen(*listen) {
+		fatal("config_invalid", false, "relay needs --token (or $MQTTCLI_TUNNEL_TOKEN) to listen on %s, "+
+			"or it relays for anyone who can reach it; use a loopback --listen address, or --insecure-no-token.", *listen)
+	}
+	u, err := url.Parse(*broker)
+	if err != nil || u.Host == "" {
+		fatal("config_invalid", false, "Invalid --broker '%s'.", *broker)
+	}
+	r := &tunnelRelay{broker: u.Host, token: *token, sessions: make(map[string]*tunnelSession)}
+	switch u.Scheme {
+	case "tcp", "mqtt":
+	case "ssl", "tls", "mqtts":
+		r.brokerTLS = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	default:
+		fatal("config_invalid", false, "Unsupported --broker scheme '%s'; use tcp:// or ssl://.", u.Scheme)
+	}
+	if *airGapped {
+		if err := startAirGap(&Config{BrokerURL: *broker}); err != nil {
+			fatal("config_invalid", false, "%v", err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go r.reap(ctx)
+
+	mux := http.NewServeMux()
+	mux.Handle(strings.TrimSuffix(*path, "/")+"/", r)
+	srv := &http.Server{Addr: *listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	logInfo("relay_listening", "Relaying %s%s to %s", *listen, *path, *broker)
+	if *certFile != "" {
+		err = srv.ListenAndServeTLS(*certFile, *keyFile)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal("relay_failed", false, "%v", err)
+	}
+}
@@ -0,0 +1,45 @@
+// tunnel_test.go
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsLoopbackListen(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:8080": true,
+		"[::1]:8080":     true,
+		"localhost:8080": true,
+		":8080":          false,
+		"0.0.0.0:8080":   false,
+		"10.0.0.5:8080":  false,
+		"8080":           false,
+	} {
+		if got := isLoopbackListen(addr); got != want {
+			t.Errorf("%s: got %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestTunnelRelayAuthorized(t *testing.T) {
+	r := &tunnelRelay{token: "s3cret"}
+	for _, tc := range []struct {
+		header string
+		want   bool
+	}{
+		{"s3cret", true},
+		{"Bearer s3cret", true},
+		{"", false},
+		{"s3cre", false},
+		{"Bearer other", false},
+	} {
+		req := httptest.NewRequest("POST", "/mqtt/open", nil)
+		if tc.header != "" {
+			req.Header.Set(tunnelTokenHeader, tc.header)
+		}
+		if got := r.authorized(req); got != tc.want {
+			t.Errorf("%s %q: got %v, want %v", tunnelTokenHeader, tc.header, got, tc.want)
+		}
+	}
+}
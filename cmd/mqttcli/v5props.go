@@ -0,0 +1,151 @@
+// v5props.go
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// messageProperties is the MQTT v5 properties of a received message, as
+// printed in both text and JSON output.
+type messageProperties struct {
+	ContentType             string            `json:"content_type,omitempty"`
+	ResponseTopic           string            `json:"response_topic,omitempty"`
+	CorrelationData         string            `json:"correlation_data,omitempty"`
+	CorrelationDataEncoding string            `json:"correlation_data_encoding,omitempty"` // "base64" when not valid UTF-8
+	MessageExpiry           *uint32           `json:"message_expiry,omitempty"`            // seconds left, as forwarded by the broker
+	UserProperties          map[string]string `json:"user_properties,omitempty"`
+}
+
+// propertiesMessage is implemented by messages that can carry v5 properties.
+type propertiesMessage interface {
+	properties() *messageProperties
+}
+
+// messagePropertiesOf returns msg's v5 properties, or nil for messages
+// without any, such as everything received over MQTT 3.1.1.
+func messagePropertiesOf(msg mqtt.Message) *messageProperties {
+	if pm, ok := msg.(propertiesMessage); ok {
+		return pm.properties()
+	}
+	return nil
+}
+
+func (m *v5Message) properties() *messageProperties {
+	p := m.p.Properties
+	if p == nil {
+		return nil
+	}
+	mp := &messageProperties{ContentType: p.ContentType, ResponseTopic: p.ResponseTopic, MessageExpiry: p.MessageExpiry}
+	if len(p.CorrelationData) > 0 {
+		mp.CorrelationData = string(p.CorrelationData)
+		if !utf8.Valid(p.CorrelationData) {
+			mp.CorrelationData = base64.StdEncoding.EncodeToString(p.CorrelationData)
+			mp.CorrelationDataEncoding = "base64"
+		}
+	}
+	for _, u := range p.User {
+		if mp.UserProperties == nil {
+			mp.UserProperties = map[string]string{}
+		}
+		mp.UserProperties[u.Key] = u.Value
+	}
+	if mp.format() == "" {
+		return nil
+	}
+	return mp
+}
+
+func (m *decodedMessage) properties() *messageProperties  { return messagePropertiesOf(m.Message) }
+func (m *recordedMessage) properties() *messageProperties { return m.rec.Properties }
+
+// format renders the properties for text output, e.g.
+// "ContentType=application/json UserProperties={source=edge}".
+func (mp *messageProperties) format() string {
+	if mp == nil {
+		return ""
+	}
+	var parts []string
+	if mp.ContentType != "" {
+		parts = append(parts, "ContentType="+mp.ContentType)
+	}
+	if mp.ResponseTopic != "" {
+		parts = append(parts, "ResponseTopic="+mp.ResponseTopic)
+	}
+	if mp.CorrelationData != "" {
+		parts = append(parts, "CorrelationData="+mp.CorrelationData)
+	}
+	if mp.MessageExpiry != nil {
+		parts = append(parts, fmt.Sprintf("MessageExpiry=%ds", *mp.MessageExpiry))
+	}
+	if len(mp.UserProperties) > 0 {
+		keys := make([]string, 0, len(mp.UserProperties))
+		for k := range mp.UserProperties {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for i, k := range keys {
+			keys[i] = k + "=" + mp.UserProperties[k]
+		}
+		parts = append(parts, "UserProperties={"+strings.Join(keys, " ")+"}")
+	}
+	return strings.Join(parts, " ")
+}
+
+// publishProperties returns the v5 properties configured for published
+// messages, or nil if there are none.
+func publishProperties(cfg *Config) *paho.PublishProperties {
+	var p paho.PublishProperties
+	set := false
+	if cfg.MessageExpiry > 0 {
+		secs := uint32(time.Duration(cfg.MessageExpiry) / time.Second)
+		p.MessageExpiry, set = &secs, true
+	}
+	if cfg.ContentType != "" {
+		p.ContentType, set = cfg.ContentType, true
+	}
+	if cfg.CorrelationData != "" {
+		p.CorrelationData, set = []byte(cfg.CorrelationData), true
+	}
+	if cfg.ResponseTopic != "" {
+		p.ResponseTopic, set = cfg.ResponseTopic, true
+	}
+	keys := make([]string, 0, len(cfg.UserProperties))
+	for k := range cfg.UserProperties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		p.User, set = append(p.User, paho.UserProperty{Key: k, Value: cfg.UserProperties[k]}), true
+	}
+	if !set {
+		return nil
+	}
+	return &p
+}
+
+// propertyFlag collects repeated --property key=value flags.
+type propertyFlag map[string]string
+
+func (m *propertyFlag) String() string {
+	return fmt.Sprint(map[string]string(*m))
+}
+
+func (m *propertyFlag) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("invalid property '%s', expected 'key=value'", s)
+	}
+	if *m == nil {
+		*m = propertyFlag{}
+	}
+	(*m)[key] = value
+	return nil
+}
@@ -0,0 +1,142 @@
+// watch.go
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// watchRateSamples is how many recent arrival times are kept to estimate each topic's rate.
+const watchRateSamples = 20
+
+// watchRow is the latest state seen on one topic.
+type watchRow struct {
+	value    string
+	count    int
+	arrivals []time.Time
+}
+
+// rate estimates messages per second from the recent arrival times.
+func (r *watchRow) rate() float64 {
+	if len(r.arrivals) < 2 {
+		return 0
+	}
+	span := r.arrivals[len(r.arrivals)-1].Sub(r.arrivals[0]).Seconds()
+	if span <= 0 {
+		return 0
+	}
+	return float64(len(r.arrivals)-1) / span
+}
+
+// watcher keeps the latest value per topic and redraws them as a table.
+type watcher struct {
+	field string
+	stale time.Duration
+	out   io.Writer
+
+	mu   sync.Mutex
+	rows map[string]*watchRow
+}
+
+func newWatcher(field string, stale time.Duration, out io.Writer) *watcher {
+	return &watcher{field: field, stale: stale, out: out, rows: map[string]*watchRow{}}
+}
+
+// handler records the message as the topic's latest value.
+func (w *watcher) handler(client mqtt.Client, msg mqtt.Message) {
+	value := string(msg.Payload())
+	if w.field != "" {
+		v, ok := lookupJSONField(msg.Payload(), w.field)
+		if !ok {
+			return
+		}
+		value = fmt.Sprint(v)
+	}
+	value = sanitizeForTerminal(strings.Join(strings.Fields(value), " "))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	r, ok := w.rows[msg.Topic()]
+	if !ok {
+		r = &watchRow{}
+		w.rows[msg.Topic()] = r
+	}
+	r.value = value
+	r.count++
+	r.arrivals = append(r.arrivals, time.Now())
+	if len(r.arrivals) > watchRateSamples {
+		r.arrivals = r.arrivals[1:]
+	}
+}
+
+// run redraws the table once a second, so ages keep ticking without new messages.
+func (w *watcher) run(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			w.redraw()
+		}
+	}
+}
+
+func (w *watcher) redraw() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	topics := make([]string, 0, len(w.rows))
+	for t := range w.rows {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+
+	now := time.Now()
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+	fmt.Fprintf(&b, "%-40s %-30s %8s %8s %8s\n", "TOPIC", "VALUE", "AGE", "RATE/s", "COUNT")
+	for _, t := range topics {
+		r := w.rows[t]
+		age := now.Sub(r.arrivals[len(r.arrivals)-1])
+		line := fmt.Sprintf("%-40s %-30s %8s %8.2f %8d",
+			truncate(sanitizeForTerminal(t), 40), truncate(r.value, 30), age.Truncate(time.Second), r.rate(), r.count)
+		if w.stale > 0 && age > w.stale {
+			line = "\x1b[33m" + line + "\x1b[0m"
+		}
+		b.WriteString(line + "\n")
+	}
+	io.WriteString(w.out, b.String())
+}
+
+// runWatch implements "mqttcli watch": a continuously updated table with one
+// row per matched topic showing its latest value, age, and rate.
+func runWatch(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	flags := initCLIFlags(fs)
+	field := fs.String("field", "", "Show this dotted JSON field instead of the whole payload.")
+	stale := fs.Duration("stale", 30*time.Second, "Highlight rows with no message for this long (0 disables).")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s watch [options]\n\nOptions:\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cfg := buildConfig(flags)
+	w := newWatcher(*field, *stale, os.Stdout)
+	done := make(chan struct{})
+	go w.run(done)
+	runSubscription(context.Background(), &cfg, w.handler)
+	close(done)
+}
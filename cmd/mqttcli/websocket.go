@@ -0,0 +1,169 @@
+// websocket.go
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gorilla/websocket"
+)
+
+// defaultWSSubprotocol is what the paho client offers when no options are set.
+const defaultWSSubprotocol = "mqtt"
+
+// defaultWSHandshakeTimeout bounds the HTTP upgrade when --ws-handshake-timeout is unset.
+const defaultWSHandshakeTimeout = 10 * time.Second
+
+// hasWebSocketOptions reports whether any WebSocket dial option differs from the
+// paho defaults, in which case mqttcli dials the WebSocket itself.
+func hasWebSocketOptions(cfg *Config) bool {
+	return len(cfg.WSSubprotocols) > 0 || cfg.WSCompression || cfg.WSHandshakeTimeout > 0
+}
+
+// isWebSocketURL reports whether a broker URL uses ws:// or wss://.
+func isWebSocketURL(broker string) bool {
+	return strings.HasPrefix(broker, "ws://") || strings.HasPrefix(broker, "wss://")
+}
+
+// withWebSocketPath returns broker with its path replaced by path.
+func withWebSocketPath(broker, path string) string {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return broker
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	u.Path, u.RawPath = path, ""
+	return u.String()
+}
+
+// headerFlag collects repeated --ws-header flags.
+type headerFlag map[string]string
+
+func (m *headerFlag) String() string {
+	return fmt.Sprint(map[string]string(*m))
+}
+
+func (m *headerFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return fmt.Errorf("invalid header '%s', expected 'Name: value'", s)
+	}
+	if *m == nil {
+		*m = headerFlag{}
+	}
+	(*m)[name] = strings.TrimSpace(value)
+	return nil
+}
+
+// dialWebSocket opens an MQTT-over-WebSocket connection with the configured
+// subprotocols, compression, and handshake timeout. Handshake failures include
+// the HTTP status and the start of the response body, which is usually where
+// managed brokers explain what they didn't like.
+func dialWebSocket(cfg *Config, broker string, tlsConfig *tls.Config, header http.Header) (net.Conn, error) {
+	subprotocols := cfg.WSSubprotocols
+	if len(subprotocols) == 0 {
+		subprotocols = []string{defaultWSSubprotocol}
+	}
+	timeout := time.Duration(cfg.WSHandshakeTimeout)
+	if timeout <= 0 {
+		timeout = defaultWSHandshakeTimeout
+	}
+	dialer := &websocket.Dialer{
+		Proxy:             http.ProxyFromEnvironment,
+		NetDialContext:    egressDialer(timeout).DialContext,
+		HandshakeTimeout:  timeout,
+		EnableCompression: cfg.WSCompression,
+		TLSClientConfig:   tlsConfig,
+		Subprotocols:      subprotocols,
+	}
+	if airGap != nil {
+		dialer.Proxy = nil
+	}
+
+	ws, resp, err := dialer.Dial(broker, header)
+	if err != nil {
+		if resp != nil {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			resp.Body.Close()
+			msg := fmt.Sprintf("WebSocket handshake failed: %s (offered subprotocols %s)", resp.Status, strings.Join(subprotocols, ", "))
+			if b := strings.TrimSpace(string(body)); b != "" {
+				msg += ": " + b
+			}
+			return nil, fmt.Errorf("%s", msg)
+		}
+		return nil, fmt.Errorf("WebSocket handshake failed: %w", err)
+	}
+	if ws.Subprotocol() == "" {
+		logWarn("ws_no_subprotocol", "Broker accepted the WebSocket without selecting a subprotocol (offered %s)", strings.Join(subprotocols, ", "))
+	}
+	return &wsConn{Conn: ws}, nil
+}
+
+// openWebSocket is a paho OpenConnectionFunc that dials ws:// and wss:// brokers
+// with dialWebSocket and everything else as paho would.
+func openWebSocket(cfg *Config) mqtt.OpenConnectionFunc {
+	return func(uri *url.URL, opts mqtt.ClientOptions) (net.Conn, error) {
+		if uri.Scheme != "ws" && uri.Scheme != "wss" {
+			return nil, fmt.Errorf("unexpected broker scheme '%s'", uri.Scheme)
+		}
+		return dialWebSocket(cfg, uri.String(), opts.TLSConfig, opts.HTTPHeaders)
+	}
+}
+
+// wsConn adapts a WebSocket to net.Conn, carrying MQTT packets in binary messages.
+type wsConn struct {
+	*websocket.Conn
+	r   io.Reader
+	rmu sync.Mutex
+	wmu sync.Mutex
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for {
+		if c.r == nil {
+			var err error
+			if _, c.r, err = c.NextReader(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := c.r.Read(p)
+		if err == io.EOF {
+			// End of this message; MQTT packets may span several
+			c.r = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
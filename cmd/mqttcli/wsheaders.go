@@ -0,0 +1,153 @@
+// wsheaders.go
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wsHelperTimeout bounds a {exec:...} placeholder or ws_header_command run.
+const wsHelperTimeout = 30 * time.Second
+
+// wsPlaceholder matches the {env:NAME}, {file:PATH}, and {exec:COMMAND}
+// placeholders allowed in ws_headers values.
+var wsPlaceholder = regexp.MustCompile(`\{(env|file|exec):([^}]*)\}`)
+
+// hasDynamicWSHeaders reports whether the upgrade headers need evaluating on
+// each connection rather than being fixed.
+func hasDynamicWSHeaders(cfg *Config) bool {
+	if cfg.WSHeaderCommand != "" {
+		return true
+	}
+	for _, value := range cfg.WSHeaders {
+		if wsPlaceholder.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// wsHeaderCache keeps evaluated dynamic headers for ws_header_refresh, so
+// quick reconnects don't run helpers every time. Connections started after
+// it expires get freshly evaluated headers, e.g. a new JWT.
+var wsHeaderCache struct {
+	mu      sync.Mutex
+	cfg     *Config
+	header  http.Header
+	expires time.Time
+}
+
+// wsHeader returns the --ws-header values, with placeholders expanded, and the
+// headers printed by ws_header_command, or nil if there are none.
+func wsHeader(cfg *Config) (http.Header, error) {
+	if !hasDynamicWSHeaders(cfg) {
+		if len(cfg.WSHeaders) == 0 {
+			return nil, nil
+		}
+		h := http.Header{}
+		for name, value := range cfg.WSHeaders {
+			h.Set(name, value)
+		}
+		return h, nil
+	}
+
+	c := &wsHeaderCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cfg == cfg && time.Now().Before(c.expires) {
+		return c.header.Clone(), nil
+	}
+	h, err := evalWSHeaders(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.cfg, c.header = cfg, h
+	c.expires = time.Now().Add(time.Duration(cfg.WSHeaderRefresh))
+	logInfo("ws_headers_refreshed", "Evaluated %d WebSocket header(s) for the upgrade request", len(h))
+	return h.Clone(), nil
+}
+
+func evalWSHeaders(cfg *Config) (http.Header, error) {
+	h := http.Header{}
+	for name, value := range cfg.WSHeaders {
+		var err error
+		value = wsPlaceholder.ReplaceAllStringFunc(value, func(p string) string {
+			m := wsPlaceholder.FindStringSubmatch(p)
+			v, perr := expandWSPlaceholder(m[1], m[2])
+			if perr != nil && err == nil {
+				err = fmt.Errorf("ws_headers %s: %v", name, perr)
+			}
+			return v
+		})
+		if err != nil {
+			return nil, err
+		}
+		h.Set(name, value)
+	}
+	if cfg.WSHeaderCommand != "" {
+		out, err := runWSHelper(cfg.WSHeaderCommand)
+		if err != nil {
+			return nil, fmt.Errorf("ws_header_command: %v", err)
+		}
+		scanner := bufio.NewScanner(strings.NewReader(out))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			name, value, ok := strings.Cut(line, ":")
+			if !ok || strings.TrimSpace(name) == "" {
+				return nil, fmt.Errorf("ws_header_command printed '%s', expected 'Name: value' lines", line)
+			}
+			h.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+	}
+	return h, nil
+}
+
+func expandWSPlaceholder(kind, arg string) (string, error) {
+	switch kind {
+	case "env":
+		v, ok := os.LookupEnv(arg)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", arg)
+		}
+		return v, nil
+	case "file":
+		b, err := os.ReadFile(arg)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	out, err := runWSHelper(arg)
+	return strings.TrimSpace(out), err
+}
+
+// runWSHelper runs a helper command through the shell and returns its stdout.
+// Helper failures show the first line of its stderr.
+func runWSHelper(command string) (string, error) {
+	cmd := shellCommand(command)
+	var stdout, stderr strings.Builder
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	cmd.WaitDelay = time.Second
+	err := cmd.Start()
+	if err == nil {
+		timer := time.AfterFunc(wsHelperTimeout, func() { cmd.Process.Kill() })
+		err = cmd.Wait()
+		timer.Stop()
+	}
+	if err != nil {
+		if line, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n"); line != "" {
+			return "", fmt.Errorf("'%s' failed: %v: %s", command, err, line)
+		}
+		return "", fmt.Errorf("'%s' failed: %v", command, err)
+	}
+	return stdout.String(), nil
+}